@@ -0,0 +1,122 @@
+//go:build arrow
+
+// Arrow IPC output pulls in the Apache Arrow Go module, required by go.mod,
+// so it is only built with `-tags arrow`
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+)
+
+// SaveArrowMatrix saves a sparse matrix as an Arrow IPC file in CSR layout.
+// Each record row is one cell: a "cell" name column plus "indices" and
+// "values" list columns whose list offsets form the CSR row pointer. Gene
+// names are stored as a JSON array in the schema metadata. The values column
+// uses dtype, so a matrix compressed from uint16 counts is exported as uint16.
+func SaveArrowMatrix(matrix []SparseRow, geneNames, cellNames []string, dtype DType, filename string, opts SaveOptions) error {
+	genesJSON, err := json.Marshal(geneNames)
+	if err != nil {
+		return err
+	}
+
+	valueType := arrowValueType(dtype)
+	metadata := arrow.NewMetadata(
+		[]string{"genes", "num_genes", "dtype"},
+		[]string{string(genesJSON), strconv.Itoa(len(geneNames)), valueType.String()},
+	)
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "cell", Type: arrow.BinaryTypes.String},
+		{Name: "indices", Type: arrow.ListOf(arrow.PrimitiveTypes.Uint32)},
+		{Name: "values", Type: arrow.ListOf(valueType)},
+	}, &metadata)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+
+	cellBuilder := builder.Field(0).(*array.StringBuilder)
+	indicesBuilder := builder.Field(1).(*array.ListBuilder)
+	valuesBuilder := builder.Field(2).(*array.ListBuilder)
+	indexValues := indicesBuilder.ValueBuilder().(*array.Uint32Builder)
+	valueValues := valuesBuilder.ValueBuilder()
+
+	for i, row := range matrix {
+		if i < len(cellNames) {
+			cellBuilder.Append(cellNames[i])
+		} else {
+			cellBuilder.Append("Cell_" + strconv.Itoa(i+1))
+		}
+
+		indicesBuilder.Append(true)
+		indexValues.AppendValues(row.Indices, nil)
+		valuesBuilder.Append(true)
+		appendValues(valueValues, row.Values)
+	}
+
+	record := builder.NewRecord()
+	defer record.Release()
+
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer, err := ipc.NewFileWriter(file, ipc.WithSchema(schema))
+	if err != nil {
+		return err
+	}
+	if err := writer.Write(record); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// arrowValueType maps a recorded dtype to its Arrow type; unknown is uint32
+func arrowValueType(dtype DType) arrow.DataType {
+	switch dtype {
+	case DTypeUint8:
+		return arrow.PrimitiveTypes.Uint8
+	case DTypeUint16:
+		return arrow.PrimitiveTypes.Uint16
+	case DTypeFloat32:
+		return arrow.PrimitiveTypes.Float32
+	case DTypeFloat64:
+		return arrow.PrimitiveTypes.Float64
+	default:
+		return arrow.PrimitiveTypes.Uint32
+	}
+}
+
+// appendValues appends counts to a values builder of any arrowValueType type
+func appendValues(builder array.Builder, values []uint32) {
+	switch b := builder.(type) {
+	case *array.Uint8Builder:
+		for _, v := range values {
+			b.Append(uint8(v))
+		}
+	case *array.Uint16Builder:
+		for _, v := range values {
+			b.Append(uint16(v))
+		}
+	case *array.Float32Builder:
+		for _, v := range values {
+			b.Append(float32(v))
+		}
+	case *array.Float64Builder:
+		for _, v := range values {
+			b.Append(float64(v))
+		}
+	case *array.Uint32Builder:
+		b.AppendValues(values, nil)
+	}
+}
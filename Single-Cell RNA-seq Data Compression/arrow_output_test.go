@@ -0,0 +1,77 @@
+//go:build arrow
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+)
+
+func TestSaveArrowMatrix(t *testing.T) {
+	matrix := []SparseRow{
+		{Indices: []uint32{0, 2}, Values: []uint32{5, 1}},
+		{},
+		{Indices: []uint32{1}, Values: []uint32{200}},
+	}
+	geneNames := []string{"A", "B", "C"}
+	tests := []struct {
+		dtype     DType
+		valueType arrow.DataType
+	}{
+		{DTypeUnknown, arrow.PrimitiveTypes.Uint32},
+		{DTypeUint8, arrow.PrimitiveTypes.Uint8},
+		{DTypeUint16, arrow.PrimitiveTypes.Uint16},
+		{DTypeFloat64, arrow.PrimitiveTypes.Float64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dtype.String(), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "m.arrow")
+			if err := SaveArrowMatrix(matrix, geneNames, []string{"c1", "c2"}, tt.dtype, filename, SaveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			reader, err := ipc.NewFileReader(file, ipc.WithAllocator(memory.DefaultAllocator))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			if genes, _ := reader.Schema().Metadata().GetValue("genes"); genes != `["A","B","C"]` {
+				t.Errorf("genes metadata %q", genes)
+			}
+			record, err := reader.Record(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := record.Column(2).DataType().(*arrow.ListType).Elem(); !arrow.TypeEqual(got, tt.valueType) {
+				t.Errorf("values of type %v, want %v", got, tt.valueType)
+			}
+
+			cells := record.Column(0).(*array.String)
+			indices := record.Column(1).(*array.List)
+			offsets := indices.Offsets()
+			indexValues := indices.ListValues().(*array.Uint32).Uint32Values()
+			wantCells := []string{"c1", "c2", "Cell_3"}
+			for i, row := range matrix {
+				if cells.Value(i) != wantCells[i] {
+					t.Errorf("cell %d named %q, want %q", i, cells.Value(i), wantCells[i])
+				}
+				got := indexValues[offsets[i]:offsets[i+1]]
+				if len(got) != len(row.Indices) || (len(got) > 0 && !reflect.DeepEqual(got, row.Indices)) {
+					t.Errorf("cell %d has genes %v, want %v", i, got, row.Indices)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !arrow
+
+package main
+
+import "fmt"
+
+// SaveArrowMatrix is unavailable unless the binary is built with -tags arrow
+func SaveArrowMatrix(matrix []SparseRow, geneNames, cellNames []string, dtype DType, filename string, opts SaveOptions) error {
+	return fmt.Errorf("Arrow output not supported by this build; rebuild with -tags arrow")
+}
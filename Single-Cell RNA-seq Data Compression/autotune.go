@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultTuneSample is the number of cells -autotune compresses per trial
+	defaultTuneSample = 2000
+
+	// tuneSampleBlocks is the number of contiguous runs of cells the sample
+	// is taken from, spread evenly over the matrix. Runs keep neighbouring
+	// cells together, so a reference window sees the cells it would in the
+	// full matrix, while several runs avoid sampling a single cell type of a
+	// sorted file.
+	tuneSampleBlocks = 4
+)
+
+// tuneSimilarities are the similarity metrics tried, in table order
+var tuneSimilarities = []SimilarityMetric{SimilarityJaccard, SimilarityCosine, SimilarityWeightedJaccard, SimilarityRank}
+
+// tuneWindows are the reference windows tried in chain mode, -1 for all
+// earlier cells
+var tuneWindows = []int{-1, 1000, 100, 10}
+
+// tuneLossyLevels are the threshold and quantization levels tried for lossy
+// compression, from the most to the least faithful
+var tuneLossyLevels = []struct {
+	threshold   float64
+	quantLevels uint32
+}{
+	{0.05, 256},
+	{0.1, 256},
+	{0.2, 64},
+	{0.5, 16},
+}
+
+// TuneBudget limits what -autotune may pick: the projected time to compress
+// the full matrix and the projected archive size in bytes. Zero fields are
+// not limited.
+type TuneBudget struct {
+	Time time.Duration
+	Size int64
+}
+
+// TuneTrial is one configuration tried by autotune, with its estimated ratio
+// on the sample and its projections for the full matrix
+type TuneTrial struct {
+	Similarity  SimilarityMetric
+	RefWindow   int
+	Threshold   float64 // Lossy settings, zero unless lossy
+	QuantLevels uint32
+	lossyLevel  int // Index in tuneLossyLevels, lower is more faithful
+	Ratio       float64
+	Time        time.Duration
+	Size        int64
+	Fits        bool // Within every limit of the budget
+}
+
+// String describes the trial's settings as command-line flags
+func (t TuneTrial) String() string {
+	s := fmt.Sprintf("-similarity %s -ref-window %d", t.Similarity, t.RefWindow)
+	if t.QuantLevels > 0 {
+		s += fmt.Sprintf(" -threshold %g -quant %d", t.Threshold, t.QuantLevels)
+	}
+	return s
+}
+
+// autotune compresses a sample of the matrix under each combination of
+// similarity metric, reference window (chain mode only) and, for lossy
+// compression, threshold and quantization levels. Each trial's ratio is that
+// of the sample to its serialized archive, as SaveToFile would write it; its
+// time and size are projected to the full matrix.
+// Among the trials within budget it picks the most faithful lossy level,
+// then the smallest archive, then the fastest; if none fits, the one
+// exceeding the budget the least. It returns opts with the chosen settings
+// and every trial, chosen first.
+func autotune(matrix []SparseRow, geneNames, cellNames []string, opts compressOptions, budget TuneBudget, sampleCells int) (compressOptions, []TuneTrial, error) {
+	if len(matrix) == 0 {
+		return opts, nil, fmt.Errorf("no cells to tune on")
+	}
+	sample, sampleNames := tuneSample(matrix, cellNames, sampleCells)
+	fullSize := float64(EstimateOriginalSize(matrix, geneNames, cellNames))
+	sampleSize := float64(EstimateOriginalSize(sample, geneNames, sampleNames))
+
+	windows := tuneWindows
+	if opts.refMode != RefChain {
+		windows = []int{opts.refWindow}
+	}
+	levels := []int{-1}
+	if opts.lossy {
+		levels = make([]int, len(tuneLossyLevels))
+		for i := range levels {
+			levels[i] = i
+		}
+	}
+
+	trialOpts := opts
+	trialOpts.graphFile = ""
+	trialOpts.refMemory = 0
+	var trials []TuneTrial
+	for _, metric := range tuneSimilarities {
+		for _, window := range windows {
+			for _, level := range levels {
+				trial := TuneTrial{Similarity: metric, RefWindow: window, lossyLevel: level}
+				trialOpts.similarity, trialOpts.refWindow = metric, window
+				if level >= 0 {
+					trial.Threshold, trial.QuantLevels = tuneLossyLevels[level].threshold, tuneLossyLevels[level].quantLevels
+					trialOpts.threshold, trialOpts.quantLevels = trial.Threshold, trial.QuantLevels
+				}
+
+				start := time.Now()
+				compressed, err := trialOpts.newCompressor().Compress(sample, geneNames, sampleNames)
+				if err != nil {
+					return opts, nil, fmt.Errorf("trial %s: %w", trial, err)
+				}
+				size, err := compressed.SerializedSize()
+				if err != nil {
+					return opts, nil, fmt.Errorf("trial %s: %w", trial, err)
+				}
+				trial.Ratio = sampleSize / float64(size)
+				trial.Time = projectTime(time.Since(start), len(sample), len(matrix), window, opts.refIndex)
+				trial.Size = int64(math.Ceil(fullSize / trial.Ratio))
+				trial.Fits = (budget.Time == 0 || trial.Time <= budget.Time) && (budget.Size == 0 || trial.Size <= budget.Size)
+				trials = append(trials, trial)
+			}
+		}
+	}
+
+	sort.SliceStable(trials, func(a, b int) bool {
+		ta, tb := trials[a], trials[b]
+		if ta.Fits != tb.Fits {
+			return ta.Fits
+		}
+		if !ta.Fits {
+			return budget.overshoot(ta) < budget.overshoot(tb)
+		}
+		if ta.lossyLevel != tb.lossyLevel {
+			return ta.lossyLevel < tb.lossyLevel
+		}
+		if ta.Size != tb.Size {
+			return ta.Size < tb.Size
+		}
+		return ta.Time < tb.Time
+	})
+
+	best := trials[0]
+	opts.similarity, opts.refWindow, opts.refMemory = best.Similarity, best.RefWindow, 0
+	if best.lossyLevel >= 0 {
+		opts.threshold, opts.quantLevels = best.Threshold, best.QuantLevels
+	}
+	return opts, trials, nil
+}
+
+// overshoot returns by what factor a trial exceeds the budget's worst-hit
+// limit, at most 1 if it fits
+func (budget TuneBudget) overshoot(trial TuneTrial) float64 {
+	factor := 0.0
+	if budget.Time > 0 {
+		factor = math.Max(factor, float64(trial.Time)/float64(budget.Time))
+	}
+	if budget.Size > 0 {
+		factor = math.Max(factor, float64(trial.Size)/float64(budget.Size))
+	}
+	return factor
+}
+
+// tuneSample takes up to n cells from tuneSampleBlocks evenly spaced runs of
+// the matrix, in matrix order. The rows are shared with the matrix.
+func tuneSample(matrix []SparseRow, cellNames []string, n int) ([]SparseRow, []string) {
+	if n >= len(matrix) {
+		return matrix, cellNames
+	}
+	var sample []SparseRow
+	var names []string
+	for block := 0; block < tuneSampleBlocks; block++ {
+		size := (block+1)*n/tuneSampleBlocks - block*n/tuneSampleBlocks
+		start := block * len(matrix) / tuneSampleBlocks
+		sample = append(sample, matrix[start:start+size]...)
+		names = append(names, cellNames[start:start+size]...)
+	}
+	return sample, names
+}
+
+// projectTime scales the time a trial took on sampleCells cells to the full
+// matrix. Work outside the reference search grows with the cell count; the
+// search compares each cell with up to window earlier cells, so a window
+// wider than the sample grows faster. The larger of the two factors is
+// used, which overestimates when the search is not the bulk of the work.
+func projectTime(elapsed time.Duration, sampleCells, numCells, window int, index RefIndex) time.Duration {
+	factor := float64(numCells) / float64(sampleCells)
+	if index == RefIndexWindow {
+		factor = math.Max(factor, searchPairs(numCells, window)/searchPairs(sampleCells, window))
+	}
+	return time.Duration(float64(elapsed) * factor)
+}
+
+// searchPairs returns the number of cell pairs a window search over n cells
+// compares, a negative window searching all earlier cells
+func searchPairs(n, window int) float64 {
+	if window < 0 || window >= n {
+		return math.Max(float64(n)*float64(n-1)/2, 1)
+	}
+	w := float64(window)
+	return math.Max(w*(w-1)/2+float64(n-window)*w, 1)
+}
+
+// printTuneTrials writes the trials as a table, chosen first
+func printTuneTrials(w io.Writer, trials []TuneTrial) {
+	fmt.Fprintf(w, "%-60s %8s %14s %12s %s\n", "Settings", "Ratio", "Size (bytes)", "Time", "Budget")
+	for _, trial := range trials {
+		fits := "fits"
+		if !trial.Fits {
+			fits = "over"
+		}
+		fmt.Fprintf(w, "%-60s %8.2f %14d %12s %s\n", trial, trial.Ratio, trial.Size, trial.Time.Round(time.Millisecond), fits)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestAutotuneProjectsArchiveSize(t *testing.T) {
+	// Trials and the final archive must record the same creation time, which
+	// is compressed with the preamble and can change its size by a byte
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(150, 50, 0.8, 1)
+	tests := []struct {
+		name string
+		opts compressOptions
+	}{
+		{"lossless", compressOptions{}},
+		{"lossy", compressOptions{lossy: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// With the whole matrix as the sample nothing is extrapolated, so
+			// the projection must be the archive's size
+			tuned, trials, err := autotune(matrix, geneNames, cellNames, tt.opts, TuneBudget{}, len(matrix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := tuned.newCompressor().Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := compressed.SerializedSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := trials[0].Size - size; diff < 0 || diff > 1 {
+				t.Errorf("projected %d bytes for %s, the archive has %d", trials[0].Size, trials[0], size)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// BitWriter appends bits to a stream whose length need not be known up
+// front, packing them into 64-bit words least significant bit first: the
+// layout of BitArray, which BitArray returns. Sequential codecs use it
+// instead of computing a position for every BitArray.WriteBits.
+type BitWriter struct {
+	words []uint64 // Full words
+	acc   uint64   // Bits of the word being filled
+	size  uint32   // Number of bits written
+}
+
+// NewBitWriter creates a writer; sizeHint is the expected number of bits, 0
+// if unknown, and only sets the initial capacity
+func NewBitWriter(sizeHint uint32) *BitWriter {
+	return &BitWriter{words: make([]uint64, 0, (uint64(sizeHint)+63)/64)}
+}
+
+// WriteBits appends the low n bits of value (n at most 64)
+func (w *BitWriter) WriteBits(value uint64, n uint32) {
+	if n == 0 {
+		return
+	}
+	if n < 64 {
+		value &= 1<<n - 1
+	}
+	used := w.size % 64
+	w.acc |= value << used
+	w.size += n
+	if used+n >= 64 {
+		w.words = append(w.words, w.acc)
+		w.acc = value >> (64 - used) // The bits that did not fit, 0 if none
+	}
+}
+
+// WriteZeros appends n zero bits
+func (w *BitWriter) WriteZeros(n uint32) {
+	for n > 64 {
+		w.WriteBits(0, 64)
+		n -= 64
+	}
+	w.WriteBits(0, n)
+}
+
+// WriteUnary appends n zero bits followed by a one bit
+func (w *BitWriter) WriteUnary(n uint32) {
+	for n >= 64 {
+		w.WriteBits(0, 64)
+		n -= 64
+	}
+	w.WriteBits(1<<n, n+1)
+}
+
+// Len returns the number of bits written
+func (w *BitWriter) Len() uint32 {
+	return w.size
+}
+
+// BitArray returns the bits written so far as a bit array of exactly Len
+// bits. It shares the writer's words, so writing may continue only after
+// the array is no longer used.
+func (w *BitWriter) BitArray() *BitArray {
+	data := w.words
+	if w.size%64 != 0 {
+		data = append(data, w.acc)
+	}
+	return &BitArray{Data: data, Size: w.size}
+}
+
+// Bytes returns the bits written so far packed into bytes, least
+// significant bit first, with the final byte padded with zero bits: the
+// words' little-endian bytes, cut to whole bytes
+func (w *BitWriter) Bytes() []byte {
+	data := make([]byte, 0, len(w.words)*8+8)
+	for _, word := range w.words {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	data = binary.LittleEndian.AppendUint64(data, w.acc)
+	return data[:(w.size+7)/8]
+}
+
+// BitReader consumes the bits of a BitArray in order
+type BitReader struct {
+	array *BitArray
+	pos   uint32 // Next bit to read
+}
+
+// NewBitReader creates a reader at the first bit of array
+func NewBitReader(array *BitArray) *BitReader {
+	return &BitReader{array: array}
+}
+
+// ReadBits reads the next n bits (n at most 64); it reports false, reading
+// nothing, if fewer are left
+func (r *BitReader) ReadBits(n uint32) (uint64, bool) {
+	if uint64(r.pos)+uint64(n) > uint64(r.array.Size) {
+		return 0, false
+	}
+	value := r.array.ReadBits(r.pos, n)
+	r.pos += n
+	return value, true
+}
+
+// ReadUnary reads a value written by WriteUnary: it counts the zero bits up
+// to the next one bit, a word at a time, and consumes both. It reports false
+// if no one bit is left.
+func (r *BitReader) ReadUnary() (uint32, bool) {
+	start := r.pos
+	for r.pos < r.array.Size {
+		word := r.array.Data[r.pos/64] >> (r.pos % 64)
+		if word == 0 {
+			r.pos += 64 - r.pos%64
+			continue
+		}
+		one := r.pos + uint32(bits.TrailingZeros64(word))
+		if one >= r.array.Size {
+			break // Stray bits past Size do not count
+		}
+		r.pos = one + 1
+		return one - start, true
+	}
+	r.pos = r.array.Size
+	return 0, false
+}
+
+// NewByteBitReader creates a reader over bytes packed as BitWriter.Bytes
+// packs them, every bit of which is readable, padding included
+func NewByteBitReader(data []byte) *BitReader {
+	words := make([]uint64, (len(data)+7)/8)
+	for i, b := range data {
+		words[i/8] |= uint64(b) << (8 * (i % 8))
+	}
+	return NewBitReader(&BitArray{Data: words, Size: uint32(len(data)) * 8})
+}
+
+// Remaining returns the number of bits left to read
+func (r *BitReader) Remaining() uint32 {
+	return r.array.Size - r.pos
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestBitWriterBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *BitWriter)
+		want  []byte
+	}{
+		{"empty", func(w *BitWriter) {}, []byte{}},
+		{"one bit", func(w *BitWriter) { w.WriteBits(1, 1) }, []byte{0x1}},
+		{"lsb first", func(w *BitWriter) { w.WriteBits(0x5, 3); w.WriteBits(0x1f, 5) }, []byte{0xfd}},
+		{"padded", func(w *BitWriter) { w.WriteBits(0x3ff, 10) }, []byte{0xff, 0x3}},
+		{"unary", func(w *BitWriter) { w.WriteUnary(3); w.WriteUnary(0) }, []byte{0x18}},
+		{"across words", func(w *BitWriter) { w.WriteZeros(60); w.WriteBits(0xff, 8) }, []byte{0, 0, 0, 0, 0, 0, 0, 0xf0, 0xf}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewBitWriter(0)
+			tt.write(w)
+			if got := w.Bytes(); !bytes.Equal(got, tt.want) {
+				t.Errorf("Bytes() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestByteBitReader(t *testing.T) {
+	w := NewBitWriter(0)
+	unary := []uint32{0, 5, 63, 64, 130, 1}
+	for i, n := range unary {
+		w.WriteUnary(n)
+		w.WriteBits(uint64(i), 7)
+	}
+	data := w.Bytes()
+
+	r := NewByteBitReader(data)
+	if r.Remaining() != uint32(len(data))*8 {
+		t.Fatalf("Remaining() = %d, want %d", r.Remaining(), len(data)*8)
+	}
+	for i, want := range unary {
+		got, ok := r.ReadUnary()
+		if !ok || got != want {
+			t.Fatalf("value %d: ReadUnary() = %d, %v, want %d", i, got, ok, want)
+		}
+		if bits, ok := r.ReadBits(7); !ok || bits != uint64(i) {
+			t.Fatalf("value %d: ReadBits(7) = %d, %v", i, bits, ok)
+		}
+	}
+	if _, ok := r.ReadUnary(); ok {
+		t.Error("read a unary value from the padding")
+	}
+	if _, ok := NewByteBitReader([]byte{0xff}).ReadBits(9); ok {
+		t.Error("read 9 bits from one byte")
+	}
+}
+
+// BenchmarkBitWriter writes 100000 values of 1 to 20 bits, as a low-bits
+// array would hold, with a BitWriter growing from no size hint, one sized
+// up front, and positional BitArray.WriteBits into a preallocated array
+func BenchmarkBitWriter(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	widths := make([]uint32, 100000)
+	values := make([]uint64, len(widths))
+	var total uint32
+	for i := range widths {
+		widths[i] = 1 + uint32(rng.Intn(20))
+		values[i] = rng.Uint64()
+		total += widths[i]
+	}
+
+	b.Run("BitWriter", func(b *testing.B) {
+		b.SetBytes(int64(total / 8))
+		for i := 0; i < b.N; i++ {
+			w := NewBitWriter(0)
+			for j, value := range values {
+				w.WriteBits(value, widths[j])
+			}
+		}
+	})
+	b.Run("BitWriter sized", func(b *testing.B) {
+		b.SetBytes(int64(total / 8))
+		for i := 0; i < b.N; i++ {
+			w := NewBitWriter(total)
+			for j, value := range values {
+				w.WriteBits(value, widths[j])
+			}
+		}
+	})
+	b.Run("BitArray", func(b *testing.B) {
+		b.SetBytes(int64(total / 8))
+		for i := 0; i < b.N; i++ {
+			array := NewBitArray(total)
+			pos := uint32(0)
+			for j, value := range values {
+				array.WriteBits(pos, value, widths[j])
+				pos += widths[j]
+			}
+		}
+	})
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+// Block format layout:
+//
+//	magic "SCZB"
+//	preamble: uint32 length, uint32 CRC-32, zlib(header, names, ..., row count)
+//	blocks:   uint32 first cell, uint32 row count, uint32 length, uint32 CRC-32,
+//	          zlib(rows)
+//
+// Each block is compressed independently and its checksum covers the first
+// cell, row count and payload, so a damaged block can be detected and skipped
+// without losing the rest of the archive.
+//
+// Since version 15 a block's rows are stored column by column (see
+// writeRowColumns): first each metadata field of all rows as varints, then all
+// gene payloads, then all value payloads. Similar fields next to each other
+// deflate far better than the older layout, which wrote each row's fixed-size
+// metadata followed by its payloads (see readCompressedRow).
+
+var blockMagic = [4]byte{'S', 'C', 'Z', 'B'}
+
+const (
+	// rowsPerBlock is the number of compressed rows stored in each block
+	rowsPerBlock = 1024
+)
+
+// BlockDamage describes a block whose rows could not be recovered
+type BlockDamage struct {
+	FirstCell uint32
+	NumCells  uint32
+	Err       error
+}
+
+// byteCounter is an io.Writer that counts the bytes written to it and
+// discards them
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// SerializedSize returns the number of bytes SaveToFile writes for the
+// archive, serializing it without keeping the output. Unlike EstimateSize it
+// includes the zlib compression of the preamble and blocks.
+func (cd *CompressedData) SerializedSize() (int64, error) {
+	var counter byteCounter
+	if err := cd.writeBlocks(context.Background(), &counter); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// writeBlocks writes the archive in the block format, stopping between
+// blocks once ctx is done
+func (cd *CompressedData) writeBlocks(ctx context.Context, w io.Writer) error {
+	if _, err := w.Write(blockMagic[:]); err != nil {
+		return err
+	}
+
+	var preamble bytes.Buffer
+	zlibWriter := zlib.NewWriter(&preamble)
+	if err := cd.writePreamble(zlibWriter); err != nil {
+		return err
+	}
+	if err := zlibWriter.Close(); err != nil {
+		return err
+	}
+
+	payload := preamble.Bytes()
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(payload))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(payload)); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+
+	var block bytes.Buffer
+	for start := 0; start < len(cd.CompressedRows); start += rowsPerBlock {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + rowsPerBlock
+		if end > len(cd.CompressedRows) {
+			end = len(cd.CompressedRows)
+		}
+
+		block.Reset()
+		zlibWriter.Reset(&block)
+		if err := writeRowColumns(zlibWriter, uint32(start), cd.CompressedRows[start:end]); err != nil {
+			return err
+		}
+		if err := zlibWriter.Close(); err != nil {
+			return err
+		}
+
+		if err := writeBlock(w, uint32(start), uint32(end-start), block.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBlock writes one block header followed by its payload
+func writeBlock(w io.Writer, firstCell, numRows uint32, payload []byte) error {
+	header := [4]uint32{firstCell, numRows, uint32(len(payload)), blockChecksum(firstCell, numRows, payload)}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// blockChecksum computes the CRC-32 covering a block's position and payload
+func blockChecksum(firstCell, numRows uint32, payload []byte) uint32 {
+	var position [8]byte
+	binary.LittleEndian.PutUint32(position[0:], firstCell)
+	binary.LittleEndian.PutUint32(position[4:], numRows)
+	crc := crc32.ChecksumIEEE(position[:])
+	return crc32.Update(crc, crc32.IEEETable, payload)
+}
+
+// byteBudget counts down the bytes left unread in an archive, so that lengths
+// taken from unchecksummed headers are checked before anything is allocated
+// for them. A negative budget means the archive's size is unknown.
+type byteBudget int64
+
+// archiveBudget returns the budget for reading file from its start
+func archiveBudget(file *os.File) byteBudget {
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return -1
+	}
+	return byteBudget(info.Size())
+}
+
+// take consumes n bytes, reporting false if fewer than n remain
+func (b *byteBudget) take(n uint64) bool {
+	if *b < 0 {
+		return true
+	}
+	if n > uint64(*b) {
+		return false
+	}
+	*b -= byteBudget(n)
+	return true
+}
+
+// readBlocks reads an archive in the block format. With skipBadBlocks, rows of
+// damaged blocks are left empty and reported instead of failing the load.
+func readBlocks(r *bufio.Reader, budget byteBudget, skipBadBlocks bool) (*CompressedData, []BlockDamage, error) {
+	// The preamble holds the names and row count, so it cannot be skipped
+	cd, numRows, err := readBlockPreamble(r, &budget)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cd.CompressedRows = make([]CompressedRow, numRows)
+	loaded := make([]bool, numRows)
+	var damage []BlockDamage
+
+	for {
+		var header [4]uint32
+		err := binary.Read(r, binary.LittleEndian, &header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = eofAsTruncated(err, "failed to read block header")
+		}
+
+		firstCell, blockRows, length, checksum := header[0], header[1], header[2], header[3]
+		if err == nil && uint64(firstCell)+uint64(blockRows) > uint64(numRows) {
+			err = corruptf("block at cell %d with %d rows exceeds %d rows", firstCell, blockRows, numRows)
+		}
+		// Past a length that overruns the file, the next block can't be found
+		located := budget.take(uint64(len(header) * 4))
+		if err == nil && !budget.take(uint64(length)) {
+			err = corruptf("block at cell %d claims %d bytes, but only %d remain in the archive", firstCell, length, budget)
+			located = false
+		}
+
+		var rows []CompressedRow
+		if err == nil {
+			payload := make([]byte, length)
+			if _, err = io.ReadFull(r, payload); err != nil {
+				err = eofAsTruncated(err, "failed to read block at cell %d", firstCell)
+			} else {
+				rows, err = decodeBlock(cd.Header.Version, firstCell, blockRows, checksum, payload)
+			}
+		}
+
+		if err != nil {
+			if !skipBadBlocks {
+				return nil, nil, err
+			}
+			if !located || !plausibleBlock(firstCell, blockRows, numRows) {
+				// The block header itself is damaged, so the rest of the file
+				// can't be located; everything not yet loaded is lost
+				damage = append(damage, unloadedRanges(loaded, err)...)
+				break
+			}
+			damage = append(damage, BlockDamage{FirstCell: firstCell, NumCells: blockRows, Err: err})
+			continue
+		}
+
+		for i, row := range rows {
+			cd.CompressedRows[firstCell+uint32(i)] = row
+			loaded[firstCell+uint32(i)] = true
+		}
+	}
+
+	// Any rows never covered by a block are missing
+	for i, ok := range loaded {
+		if ok {
+			continue
+		}
+		if !skipBadBlocks {
+			return nil, nil, truncatedf("archive is truncated: row %d missing", i)
+		}
+		if !rangeCovered(damage, uint32(i)) {
+			damage = append(damage, unloadedRanges(loaded, truncatedf("archive is truncated"))...)
+			break
+		}
+	}
+
+	// Damaged rows decode as empty, self-encoded cells
+	for _, d := range damage {
+		for cell := d.FirstCell; cell < d.FirstCell+d.NumCells; cell++ {
+			cd.CompressedRows[cell] = CompressedRow{RefCell: -1}
+		}
+	}
+
+	return cd, damage, nil
+}
+
+// readBlockPreamble reads the magic and preamble of a block format archive,
+// leaving r at the first block
+func readBlockPreamble(r *bufio.Reader, budget *byteBudget) (*CompressedData, uint32, error) {
+	if _, err := r.Discard(len(blockMagic)); err != nil {
+		return nil, 0, err
+	}
+
+	var preambleHeader [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, &preambleHeader); err != nil {
+		return nil, 0, eofAsTruncated(err, "failed to read preamble")
+	}
+	if !budget.take(uint64(len(blockMagic)+len(preambleHeader)*4)) || !budget.take(uint64(preambleHeader[0])) {
+		return nil, 0, corruptf("preamble claims %d bytes, but only %d remain in the archive", preambleHeader[0], *budget)
+	}
+	payload := make([]byte, preambleHeader[0])
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, eofAsTruncated(err, "failed to read preamble")
+	}
+	if crc32.ChecksumIEEE(payload) != preambleHeader[1] {
+		return nil, 0, checksumf("preamble checksum mismatch")
+	}
+	preamble, err := inflate(payload)
+	if err != nil {
+		return nil, 0, corruptf("failed to decompress preamble: %w", err)
+	}
+	return readPreamble(bytes.NewReader(preamble))
+}
+
+// decodeBlock verifies and parses one block's rows, laid out as the archive
+// version dictates
+func decodeBlock(version, firstCell, numRows, checksum uint32, payload []byte) ([]CompressedRow, error) {
+	if blockChecksum(firstCell, numRows, payload) != checksum {
+		return nil, checksumf("checksum mismatch in block at cell %d", firstCell)
+	}
+
+	data, err := inflate(payload)
+	if err != nil {
+		return nil, corruptf("failed to decompress block at cell %d: %w", firstCell, err)
+	}
+
+	reader := bytes.NewReader(data)
+	if version >= 15 {
+		rows, err := readRowColumns(reader, version, firstCell, numRows)
+		if err != nil {
+			return nil, corruptf("failed to read block at cell %d: %w", firstCell, err)
+		}
+		return rows, nil
+	}
+	rows := make([]CompressedRow, numRows)
+	for i := range rows {
+		rows[i], err = readCompressedRow(reader)
+		if err != nil {
+			return nil, corruptf("failed to read row %d: %w", firstCell+uint32(i), err)
+		}
+	}
+	return rows, nil
+}
+
+// writeRowColumns writes the rows of a block starting at firstCell column by
+// column:
+//
+//	per row: varint reference code (see refCode)
+//	per row: uvarint NumGenes
+//	per row: uvarint MaxGeneIndex
+//	per row: uvarint length of EliasGenes
+//	per row: uvarint length of DeltaValues
+//	every row's EliasGenes, then every row's DeltaValues
+//
+// Chain references mostly point a few cells back, so the reference codes are
+// small and repetitive where absolute cell numbers never repeat.
+func writeRowColumns(w io.Writer, firstCell uint32, rows []CompressedRow) error {
+	var metadata []byte
+	for i, row := range rows {
+		metadata = binary.AppendVarint(metadata, refCode(firstCell+uint32(i), row.RefCell))
+	}
+	for _, row := range rows {
+		metadata = binary.AppendUvarint(metadata, uint64(row.NumGenes))
+	}
+	for _, row := range rows {
+		metadata = binary.AppendUvarint(metadata, uint64(row.MaxGeneIndex))
+	}
+	for _, row := range rows {
+		metadata = binary.AppendUvarint(metadata, uint64(len(row.EliasGenes)))
+	}
+	for _, row := range rows {
+		metadata = binary.AppendUvarint(metadata, uint64(len(row.DeltaValues)))
+	}
+	if _, err := w.Write(metadata); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err := w.Write(row.EliasGenes); err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		if _, err := w.Write(row.DeltaValues); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refCode encodes a row's reference relative to its cell: 0 for none, 1 for
+// the mean cell and otherwise the offset cell - RefCell, with positive
+// offsets shifted up by one to make room for the mean cell
+func refCode(cell uint32, refCell int32) int64 {
+	switch {
+	case refCell == -1:
+		return 0
+	case refCell == meanRefCell:
+		return 1
+	}
+	offset := int64(cell) - int64(refCell)
+	if offset > 0 {
+		offset++
+	}
+	return offset
+}
+
+// refFromCode decodes refCode. Version 15 archives have no mean cell and
+// store offsets unshifted.
+func refFromCode(version, cell uint32, code int64) (int32, error) {
+	if code == 0 {
+		return -1, nil
+	}
+	offset := code
+	if version >= 16 {
+		if code == 1 {
+			return meanRefCell, nil
+		}
+		if code > 1 {
+			offset--
+		}
+	}
+	ref := int64(cell) - offset
+	if ref < 0 || ref > math.MaxInt32 {
+		return 0, corruptf("reference code %d out of range", code)
+	}
+	return int32(ref), nil
+}
+
+// readRowColumns reads numRows rows written by writeRowColumns in an archive
+// of the given version
+func readRowColumns(reader *bytes.Reader, version, firstCell, numRows uint32) ([]CompressedRow, error) {
+	rows := make([]CompressedRow, numRows)
+	for i := range rows {
+		code, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read reference of row %d: %w", firstCell+uint32(i), err)
+		}
+		if rows[i].RefCell, err = refFromCode(version, firstCell+uint32(i), code); err != nil {
+			return nil, fmt.Errorf("row %d: %w", firstCell+uint32(i), err)
+		}
+	}
+
+	// The other metadata columns are uvarints that must fit a uint32
+	names := [4]string{"gene count", "max gene index", "gene payload length", "value payload length"}
+	var columns [4][]uint32
+	for c := range columns {
+		columns[c] = make([]uint32, numRows)
+		for i := range rows {
+			value, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s of row %d: %w", names[c], firstCell+uint32(i), err)
+			}
+			if value > math.MaxUint32 {
+				return nil, corruptf("row %d: %s %d out of range", firstCell+uint32(i), names[c], value)
+			}
+			columns[c][i] = uint32(value)
+		}
+	}
+
+	for i := range rows {
+		rows[i].NumGenes = columns[0][i]
+		rows[i].MaxGeneIndex = columns[1][i]
+	}
+	var err error
+	for i := range rows {
+		if rows[i].EliasGenes, err = readPayload(reader, columns[2][i]); err != nil {
+			return nil, fmt.Errorf("row %d: gene payload: %w", firstCell+uint32(i), err)
+		}
+	}
+	for i := range rows {
+		if rows[i].DeltaValues, err = readPayload(reader, columns[3][i]); err != nil {
+			return nil, fmt.Errorf("row %d: value payload: %w", firstCell+uint32(i), err)
+		}
+	}
+	return rows, nil
+}
+
+// readPayload reads the next length bytes, checking first that the data
+// holds that many
+func readPayload(reader *bytes.Reader, length uint32) ([]byte, error) {
+	if uint64(length) > uint64(reader.Len()) {
+		return nil, corruptf("%d bytes exceed the %d left to read", length, reader.Len())
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(reader, payload)
+	return payload, err
+}
+
+// plausibleBlock reports whether a block header's cell range can be trusted
+func plausibleBlock(firstCell, numRows, totalRows uint32) bool {
+	return numRows > 0 && numRows <= rowsPerBlock &&
+		firstCell%rowsPerBlock == 0 && uint64(firstCell)+uint64(numRows) <= uint64(totalRows)
+}
+
+// unloadedRanges returns the contiguous runs of rows not yet loaded
+func unloadedRanges(loaded []bool, err error) []BlockDamage {
+	var ranges []BlockDamage
+	for i := 0; i < len(loaded); i++ {
+		if loaded[i] {
+			continue
+		}
+		start := i
+		for i < len(loaded) && !loaded[i] {
+			i++
+		}
+		ranges = append(ranges, BlockDamage{FirstCell: uint32(start), NumCells: uint32(i - start), Err: err})
+	}
+	return ranges
+}
+
+// rangeCovered reports whether cell falls inside one of the damaged ranges
+func rangeCovered(damage []BlockDamage, cell uint32) bool {
+	for _, d := range damage {
+		if cell >= d.FirstCell && cell < d.FirstCell+d.NumCells {
+			return true
+		}
+	}
+	return false
+}
+
+// DependentCells returns the cells that reference a damaged cell, directly or
+// through a reference chain, and therefore decode incorrectly as well
+func DependentCells(cd *CompressedData, damage []BlockDamage) []uint32 {
+	numCells := len(cd.CompressedRows)
+	state := make([]int8, numCells) // 0 unknown, 1 clean, 2 affected
+	for _, d := range damage {
+		for cell := d.FirstCell; cell < d.FirstCell+d.NumCells && int(cell) < numCells; cell++ {
+			state[cell] = 2
+		}
+	}
+
+	var affected func(cell int, depth int) bool
+	affected = func(cell int, depth int) bool {
+		if state[cell] != 0 {
+			return state[cell] == 2
+		}
+		ref := int(cd.CompressedRows[cell].RefCell)
+		result := ref >= 0 && ref < numCells && depth < numCells && affected(ref, depth+1)
+		if result {
+			state[cell] = 2
+		} else {
+			state[cell] = 1
+		}
+		return result
+	}
+
+	var dependents []uint32
+	for cell := 0; cell < numCells; cell++ {
+		if !rangeCovered(damage, uint32(cell)) && affected(cell, 0) {
+			dependents = append(dependents, uint32(cell))
+		}
+	}
+	return dependents
+}
+
+// inflate decompresses a zlib payload
+func inflate(payload []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
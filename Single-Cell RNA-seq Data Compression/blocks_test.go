@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSerializedSizeMatchesSaveToFile(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(300, 80, 0.8, 1)
+	tests := []struct {
+		name       string
+		compressor *Compressor
+	}{
+		{"lossless", NewCompressor(false, 0.1, 256)},
+		{"lossy", NewCompressor(true, 0.1, 16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, err := tt.compressor.Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := compressed.SerializedSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(t.TempDir(), "m.scz")
+			if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != info.Size() {
+				t.Errorf("SerializedSize() = %d, SaveToFile wrote %d bytes", size, info.Size())
+			}
+		})
+	}
+}
+
+// blockOffsets returns the file offsets of the blocks of a block format
+// archive
+func blockOffsets(t *testing.T, data []byte) []int {
+	t.Helper()
+	offset := len(blockMagic)
+	offset += 8 + int(binary.LittleEndian.Uint32(data[offset:]))
+	var offsets []int
+	for offset < len(data) {
+		offsets = append(offsets, offset)
+		offset += 16 + int(binary.LittleEndian.Uint32(data[offset+8:]))
+	}
+	return offsets
+}
+
+// TestSaveToFileLargeRoundTrip streams a matrix spanning several blocks and
+// thousands of genes to a file and checks that every row loads back as
+// written and decodes to the original
+func TestSaveToFileLargeRoundTrip(t *testing.T) {
+	const cells, genes = 2*rowsPerBlock + 552, 3000
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(cells, genes, 0.95, 7)
+	c := NewCompressor(false, 0.1, 256)
+	c.SetRefWindow(50)
+	compressed, err := c.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "large.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := len(blockOffsets(t, data)); blocks != 3 {
+		t.Fatalf("archive has %d blocks, want 3", blocks)
+	}
+
+	loaded, err := LoadCompressedData(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.GeneNames) != genes || len(loaded.CellNames) != cells {
+		t.Fatalf("loaded %d genes and %d cells, want %d and %d", len(loaded.GeneNames), len(loaded.CellNames), genes, cells)
+	}
+	for cell, row := range loaded.CompressedRows {
+		want := compressed.CompressedRows[cell]
+		if row.RefCell != want.RefCell || row.NumGenes != want.NumGenes || row.MaxGeneIndex != want.MaxGeneIndex ||
+			!bytes.Equal(row.EliasGenes, want.EliasGenes) || !bytes.Equal(row.DeltaValues, want.DeltaValues) {
+			t.Fatalf("cell %d loaded as %+v, want %+v", cell, row, want)
+		}
+	}
+	decoded, _, _, err := NewDecompressor().Decompress(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cell := range matrix {
+		if !sameRow(decoded[cell], matrix[cell]) {
+			t.Fatalf("cell %d decoded as %v, want %v", cell, decoded[cell], matrix[cell])
+		}
+	}
+}
+
+// writeRowsInterleaved writes rows in the layout of blocks before version
+// 15, each row's fixed-size fields followed by its length-prefixed payloads;
+// with metadataOnly the payloads are left out, keeping their lengths
+func writeRowsInterleaved(w io.Writer, rows []CompressedRow, metadataOnly bool) {
+	for _, row := range rows {
+		binary.Write(w, binary.LittleEndian, row.RefCell)
+		binary.Write(w, binary.LittleEndian, row.NumGenes)
+		binary.Write(w, binary.LittleEndian, row.MaxGeneIndex)
+		binary.Write(w, binary.LittleEndian, uint32(len(row.EliasGenes)))
+		if !metadataOnly {
+			w.Write(row.EliasGenes)
+		}
+		binary.Write(w, binary.LittleEndian, uint32(len(row.DeltaValues)))
+		if !metadataOnly {
+			w.Write(row.DeltaValues)
+		}
+	}
+}
+
+// TestRowColumnsSize compares the deflated size of a chain-mode archive's
+// blocks, and of their row metadata alone, in the columnar layout against
+// the interleaved layout it replaced. Both must read back as the same rows.
+func TestRowColumnsSize(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(2200, 200, 0.9, 1)
+	c := NewCompressor(false, 0.1, 256)
+	c.SetRefWindow(30)
+	compressed, err := c.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deflatedSize := func(write func(w io.Writer)) int {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		write(w)
+		w.Close()
+		return buf.Len()
+	}
+	var columnar, interleaved, columnarMetadata, interleavedMetadata int
+	for start := 0; start < len(compressed.CompressedRows); start += rowsPerBlock {
+		end := start + rowsPerBlock
+		if end > len(compressed.CompressedRows) {
+			end = len(compressed.CompressedRows)
+		}
+		rows := compressed.CompressedRows[start:end]
+
+		var columns, rowByRow bytes.Buffer
+		if err := writeRowColumns(&columns, uint32(start), rows); err != nil {
+			t.Fatal(err)
+		}
+		writeRowsInterleaved(&rowByRow, rows, false)
+		for _, layout := range []struct {
+			version uint32
+			data    []byte
+		}{{FormatVersion, columns.Bytes()}, {14, rowByRow.Bytes()}} {
+			var block bytes.Buffer
+			w := zlib.NewWriter(&block)
+			w.Write(layout.data)
+			w.Close()
+			read, err := decodeBlock(layout.version, uint32(start), uint32(len(rows)),
+				blockChecksum(uint32(start), uint32(len(rows)), block.Bytes()), block.Bytes())
+			if err != nil {
+				t.Fatalf("version %d block at %d: %v", layout.version, start, err)
+			}
+			if !reflect.DeepEqual(read, rows) {
+				t.Fatalf("version %d block at %d read back differently", layout.version, start)
+			}
+		}
+
+		// The metadata columns are what precedes the payloads
+		metadataLen := columns.Len()
+		for _, row := range rows {
+			metadataLen -= len(row.EliasGenes) + len(row.DeltaValues)
+		}
+		columnar += deflatedSize(func(w io.Writer) { w.Write(columns.Bytes()) })
+		interleaved += deflatedSize(func(w io.Writer) { w.Write(rowByRow.Bytes()) })
+		columnarMetadata += deflatedSize(func(w io.Writer) { w.Write(columns.Bytes()[:metadataLen]) })
+		interleavedMetadata += deflatedSize(func(w io.Writer) { writeRowsInterleaved(w, rows, true) })
+	}
+
+	t.Logf("metadata: %d bytes columnar, %d interleaved; blocks: %d and %d",
+		columnarMetadata, interleavedMetadata, columnar, interleaved)
+	if columnarMetadata >= interleavedMetadata || columnar >= interleaved {
+		t.Errorf("columnar layout is not smaller: metadata %d >= %d or blocks %d >= %d",
+			columnarMetadata, interleavedMetadata, columnar, interleaved)
+	}
+}
+
+// TestCorruptBlock damages one byte of the second of three blocks, which
+// loading must report as a checksum mismatch and, skipping bad blocks,
+// replace with empty rows while keeping the other blocks intact
+func TestCorruptBlock(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(2*rowsPerBlock+100, 40, 0.8, 1)
+	compressed, err := NewCompressor(false, 0.1, 256).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "m.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := blockOffsets(t, data)
+	if len(offsets) != 3 {
+		t.Fatalf("archive has %d blocks, want 3", len(offsets))
+	}
+	data[offsets[1]+16+10] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadCompressedData(filename); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("LoadCompressedData: got %v, want ErrChecksumMismatch", err)
+	}
+
+	loaded, damage, err := LoadCompressedDataSkippingBadBlocks(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damage) != 1 || damage[0].FirstCell != rowsPerBlock || damage[0].NumCells != rowsPerBlock {
+		t.Fatalf("damage %+v, want cells %d to %d", damage, rowsPerBlock, 2*rowsPerBlock-1)
+	}
+	if !errors.Is(damage[0].Err, ErrChecksumMismatch) {
+		t.Errorf("damage error %v, want ErrChecksumMismatch", damage[0].Err)
+	}
+	for cell, row := range loaded.CompressedRows {
+		want := compressed.CompressedRows[cell]
+		if cell >= rowsPerBlock && cell < 2*rowsPerBlock {
+			want = CompressedRow{RefCell: -1}
+		}
+		if row.RefCell != want.RefCell || row.NumGenes != want.NumGenes || row.MaxGeneIndex != want.MaxGeneIndex ||
+			!bytes.Equal(row.EliasGenes, want.EliasGenes) || !bytes.Equal(row.DeltaValues, want.DeltaValues) {
+			t.Fatalf("cell %d loaded as %+v, want %+v", cell, row, want)
+		}
+	}
+
+	output := filepath.Join(t.TempDir(), "out.csv")
+	if err := run([]string{"-mode", "decompress", "-input", filename, "-output", output}); err == nil {
+		t.Error("decompress succeeded without -skip-bad-blocks")
+	}
+	if err := run([]string{"-mode", "decompress", "-input", filename, "-output", output, "-skip-bad-blocks"}); err != nil {
+		t.Errorf("decompress -skip-bad-blocks: %v", err)
+	}
+}
+
+// TestCorruptBlockLength overwrites the unchecksummed length of the second
+// block and of the preamble with values far past the end of the file, which
+// loading must reject as corruption before allocating them
+func TestCorruptBlockLength(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(2*rowsPerBlock+100, 40, 0.8, 1)
+	compressed, err := NewCompressor(false, 0.1, 256).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "m.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := blockOffsets(t, data)
+
+	badBlock := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(badBlock[offsets[1]+8:], 0xfffffff0)
+	badBlockFile := filepath.Join(dir, "block.scz")
+	if err := os.WriteFile(badBlockFile, badBlock, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadCompressedData(badBlockFile)
+	if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "remain in the archive") {
+		t.Fatalf("LoadCompressedData: got %v, want ErrCorrupt for the block length", err)
+	}
+
+	// The blocks after the bad length can't be located, so only the first
+	// survives
+	loaded, damage, err := LoadCompressedDataSkippingBadBlocks(badBlockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damage) != 1 || damage[0].FirstCell != rowsPerBlock || damage[0].NumCells != rowsPerBlock+100 {
+		t.Fatalf("damage %+v, want cells %d to %d", damage, rowsPerBlock, 2*rowsPerBlock+99)
+	}
+	if !errors.Is(damage[0].Err, ErrCorrupt) {
+		t.Errorf("damage error %v, want ErrCorrupt", damage[0].Err)
+	}
+	for cell := 0; cell < rowsPerBlock; cell++ {
+		if !bytes.Equal(loaded.CompressedRows[cell].DeltaValues, compressed.CompressedRows[cell].DeltaValues) {
+			t.Fatalf("cell %d of the intact block was not loaded", cell)
+		}
+	}
+
+	badPreamble := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(badPreamble[len(blockMagic):], 0xfffffff0)
+	badPreambleFile := filepath.Join(dir, "preamble.scz")
+	if err := os.WriteFile(badPreambleFile, badPreamble, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCompressedData(badPreambleFile); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("LoadCompressedData: got %v, want ErrCorrupt for the preamble length", err)
+	}
+	if _, err := LoadCompressedHeader(badPreambleFile); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("LoadCompressedHeader: got %v, want ErrCorrupt for the preamble length", err)
+	}
+}
+
+// TestSaveToFileContext checks that SaveToFile stops between blocks once its
+// context is done, leaving a partial file the OutputSet removes
+func TestSaveToFileContext(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(rowsPerBlock+10, 20, 0.8, 1)
+	compressed, err := NewCompressor(false, 0.1, 256).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	outputs := &OutputSet{}
+	filename := filepath.Join(t.TempDir(), "m.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{Outputs: outputs, Context: ctx}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if _, err := LoadCompressedData(filename); err == nil {
+		t.Error("the interrupted archive loads")
+	}
+	outputs.RemovePartial()
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("partial archive left behind: %v", err)
+	}
+}
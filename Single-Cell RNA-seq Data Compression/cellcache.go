@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// defaultCellCache is the number of decoded cells -head and
+// -benchmark-cell-cache let DecompressCell keep unless -cell-cache says
+// otherwise
+const defaultCellCache = 1024
+
+// CellCacheStats counts the work of the DecompressCell calls that used a
+// Decompressor's cell cache
+type CellCacheStats struct {
+	Hits    int64 // Cells found decoded in the cache, ending a chain walk
+	Decoded int64 // Cells decoded, requested ones and their ancestors
+	Evicted int64 // Cells dropped to stay within the capacity
+}
+
+// cellCacheKey identifies a cell of an archive, since one Decompressor may
+// serve several archives
+type cellCacheKey struct {
+	archive *CompressedData
+	cell    int
+}
+
+// cellCacheEntry is a decoded cell in its stored, pre-dequantization form:
+// the form its chain descendants are decoded against
+type cellCacheEntry struct {
+	key cellCacheKey
+	row SparseRow
+}
+
+// cellCache is an LRU cache of decoded cells shared by concurrent
+// DecompressCell calls. Its rows are never modified once cached. A nil
+// cellCache caches nothing.
+type cellCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[cellCacheKey]*list.Element
+	order    *list.List // Most recently used first
+	stats    CellCacheStats
+}
+
+// newCellCache creates a cache holding up to capacity cells
+func newCellCache(capacity int) *cellCache {
+	return &cellCache{
+		capacity: capacity,
+		entries:  make(map[cellCacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns a cached cell and marks it most recently used
+func (c *cellCache) get(archive *CompressedData, cell int) (SparseRow, bool) {
+	if c == nil {
+		return SparseRow{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[cellCacheKey{archive, cell}]
+	if !ok {
+		return SparseRow{}, false
+	}
+	c.order.MoveToFront(element)
+	c.stats.Hits++
+	return element.Value.(*cellCacheEntry).row, true
+}
+
+// put caches a cell just decoded, evicting the least recently used cells
+// beyond the capacity
+func (c *cellCache) put(archive *CompressedData, cell int, row SparseRow) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Decoded++
+	key := cellCacheKey{archive, cell}
+	if element, ok := c.entries[key]; ok {
+		// Another call decoded the same cell meanwhile
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cellCacheEntry{key: key, row: row})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cellCacheEntry).key)
+		c.stats.Evicted++
+	}
+}
+
+// SetCellCache makes DecompressCell keep up to capacity decoded cells in an
+// LRU cache and start each chain walk from the nearest cached ancestor, so
+// queries for many cells sharing deep reference chains decode each ancestor
+// about once. Decompress and DecompressTo do not use it. 0 disables the
+// cache. Call it before sharing the Decompressor between goroutines.
+func (d *Decompressor) SetCellCache(capacity int) {
+	d.cache = nil
+	if capacity > 0 {
+		d.cache = newCellCache(capacity)
+	}
+}
+
+// CellCacheStats returns the work counted by the cell cache so far, zero
+// without one
+func (d *Decompressor) CellCacheStats() CellCacheStats {
+	if d.cache == nil {
+		return CellCacheStats{}
+	}
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+	return d.cache.stats
+}
+
+// RunCellCacheBenchmark answers queries DecompressCell requests for random
+// cells of an archive, first without a cell cache and then with one of
+// capacity cells, and writes the cells each decoded, counting ancestors, and
+// the time each took to w. Both must return the same rows.
+func RunCellCacheBenchmark(w io.Writer, compressed *CompressedData, queries, capacity int, seed int64) error {
+	numCells := int(compressed.Header.NumCells)
+	if numCells == 0 {
+		return fmt.Errorf("the archive has no cells")
+	}
+	if queries <= 0 || capacity <= 0 {
+		return fmt.Errorf("the benchmark needs a positive number of queries and cache capacity")
+	}
+	rng := rand.New(rand.NewSource(seed))
+	cells := make([]int, queries)
+	for i := range cells {
+		cells[i] = rng.Intn(numCells)
+	}
+
+	// Without a cache every query decodes its whole chain
+	depths := referenceDepths(compressed.CompressedRows)
+	var uncachedWork int64
+	maxDepth := 0
+	for _, cell := range cells {
+		if depths[cell] > maxDepth {
+			maxDepth = depths[cell]
+		}
+		if depths[cell] > 0 {
+			uncachedWork += int64(depths[cell])
+		}
+		uncachedWork++
+	}
+	uncached := NewDecompressor()
+	want := make([]SparseRow, queries)
+	start := time.Now()
+	for i, cell := range cells {
+		row, err := uncached.DecompressCell(compressed, cell)
+		if err != nil {
+			return err
+		}
+		want[i] = row
+	}
+	uncachedTime := time.Since(start)
+
+	cached := NewDecompressor()
+	cached.SetCellCache(capacity)
+	start = time.Now()
+	for i, cell := range cells {
+		row, err := cached.DecompressCell(compressed, cell)
+		if err != nil {
+			return err
+		}
+		if !sameRow(row, want[i]) {
+			return fmt.Errorf("cell %d differs with the cache", cell)
+		}
+	}
+	cachedTime := time.Since(start)
+	stats := cached.CellCacheStats()
+
+	fmt.Fprintf(w, "Cell cache: %d queries for random cells of %d (deepest chain %d, seed %d)\n", queries, numCells, maxDepth, seed)
+	fmt.Fprintf(w, "%-12s %14s %10s %10s %12s\n", "Cache", "Cells decoded", "Hits", "Evicted", "Time")
+	fmt.Fprintf(w, "%-12s %14d %10s %10s %12v\n", "none", uncachedWork, "-", "-", uncachedTime.Round(time.Microsecond))
+	fmt.Fprintf(w, "%-12s %14d %10d %10d %12v\n", fmt.Sprintf("%d cells", capacity), stats.Decoded, stats.Hits, stats.Evicted, cachedTime.Round(time.Microsecond))
+	if stats.Decoded > 0 {
+		fmt.Fprintf(w, "The cache decoded %.1fx fewer cells\n", float64(uncachedWork)/float64(stats.Decoded))
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// indexCodec encodes one cell's sorted gene indices below a universe. The
+// codecs compared by -benchmark-codecs are the gene index encodings the
+// archive format supports, plus plain bit packing as a baseline.
+type indexCodec struct {
+	name   string
+	encode func(indices []uint32, universe uint32) ([]byte, error)
+	decode func(data []byte) ([]uint32, error)
+}
+
+// benchmarkChunkSize is the chunk size of the gene-chunked codec, as a user
+// would pass it to -gene-chunk
+const benchmarkChunkSize = 4096
+
+// indexCodecs lists the codecs run by RunCodecBenchmark, in table order
+var indexCodecs = []indexCodec{
+	{"elias-fano", eliasCodec(LowBitsHeuristic), decodeElias},
+	{"elias-fano floor", eliasCodec(LowBitsFloorLog), decodeElias},
+	{"elias-fano search", eliasCodec(LowBitsSearch), decodeElias},
+	{"elias-fano + flate", encodeEliasFlate, decodeEliasFlate},
+	{fmt.Sprintf("elias-fano chunk %d", benchmarkChunkSize), encodeChunked, decodeChunked},
+	{"bit-packed", encodeBitPacked, decodeBitPacked},
+}
+
+// eliasCodec returns the Elias-Fano encoder with a low-bit strategy
+func eliasCodec(strategy LowBitsStrategy) func([]uint32, uint32) ([]byte, error) {
+	return func(indices []uint32, universe uint32) ([]byte, error) {
+		if strategy == LowBitsSearch {
+			return NewEliasEncoderWithLowBits(universe, uint32(len(indices)), BestLowBits(indices, universe)).Encode(indices)
+		}
+		return NewEliasEncoderWithStrategy(universe, uint32(len(indices)), strategy).Encode(indices)
+	}
+}
+
+// decodeElias decodes a plain Elias-Fano sequence
+func decodeElias(data []byte) ([]uint32, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	decoder, err := NewEliasDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.Decode()
+}
+
+// encodeEliasFlate encodes like -ef-flate
+func encodeEliasFlate(indices []uint32, universe uint32) ([]byte, error) {
+	data, err := eliasCodec(LowBitsHeuristic)(indices, universe)
+	if err != nil || len(data) == 0 {
+		return data, err
+	}
+	return DeflateEliasFano(data)
+}
+
+// decodeEliasFlate decodes encodeEliasFlate's output
+func decodeEliasFlate(data []byte) ([]uint32, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	inflated, err := InflateEliasFano(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeElias(inflated)
+}
+
+// encodeChunked encodes like -gene-chunk benchmarkChunkSize
+func encodeChunked(indices []uint32, universe uint32) ([]byte, error) {
+	return encodeGeneChunks(indices, benchmarkChunkSize, universe, func(universe uint32, indices []uint32) *EliasEncoder {
+		return NewEliasEncoder(universe, uint32(len(indices)))
+	})
+}
+
+// decodeChunked decodes encodeChunked's output
+func decodeChunked(data []byte) ([]uint32, error) {
+	return decodeGeneChunks(data, benchmarkChunkSize)
+}
+
+// encodeBitPacked writes the count as a uvarint, the bit width as a byte and
+// then every index in that many bits
+func encodeBitPacked(indices []uint32, universe uint32) ([]byte, error) {
+	width := uint32(bits.Len32(universe - 1))
+	header := binary.AppendUvarint(nil, uint64(len(indices)))
+	w := NewBitWriter(uint32(len(indices)) * width)
+	for _, index := range indices {
+		if index >= universe {
+			return nil, fmt.Errorf("index %d exceeds universe %d", index, universe)
+		}
+		w.WriteBits(uint64(index), width)
+	}
+	return append(append(header, byte(width)), w.Bytes()...), nil
+}
+
+// decodeBitPacked decodes encodeBitPacked's output
+func decodeBitPacked(data []byte) ([]uint32, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || n >= len(data) || count > uint64(len(data))*8 {
+		return nil, fmt.Errorf("invalid bit-packed header")
+	}
+	width := uint32(data[n])
+	if width > 32 {
+		return nil, fmt.Errorf("invalid bit width %d", width)
+	}
+	r := NewByteBitReader(data[n+1:])
+	indices := make([]uint32, count)
+	for i := range indices {
+		value, ok := r.ReadBits(width)
+		if !ok {
+			return nil, fmt.Errorf("bit-packed data truncated after %d indices", i)
+		}
+		indices[i] = uint32(value)
+	}
+	return indices, nil
+}
+
+// codecResult is one row of the codec benchmark table
+type codecResult struct {
+	name       string
+	bytes      int
+	encodeTime time.Duration
+	decodeTime time.Duration
+	err        error
+}
+
+// RunCodecBenchmark encodes every cell's gene indices with each index codec,
+// decodes them again and writes a table of the encoded sizes and the encode
+// and decode throughput to w. A codec that fails or does not round-trip is
+// reported in the table, and makes the benchmark fail.
+func RunCodecBenchmark(w io.Writer, matrix []SparseRow, numGenes int) error {
+	universe := uint32(numGenes)
+	rows := make([][]uint32, len(matrix))
+	numIndices := 0
+	for i, row := range matrix {
+		indices := append([]uint32(nil), row.Indices...)
+		sort.Slice(indices, func(a, b int) bool { return indices[a] < indices[b] })
+		for _, index := range indices {
+			if index >= universe {
+				universe = index + 1
+			}
+		}
+		rows[i] = indices
+		numIndices += len(indices)
+	}
+	if numIndices == 0 {
+		return fmt.Errorf("the matrix has no expressed genes to encode")
+	}
+
+	results := make([]codecResult, len(indexCodecs))
+	for i, codec := range indexCodecs {
+		results[i] = benchmarkCodec(codec, rows, universe)
+	}
+
+	fmt.Fprintf(w, "Gene index codecs: %d cells, %d indices, universe %d\n", len(rows), numIndices, universe)
+	fmt.Fprintf(w, "%-22s %12s %10s %14s %14s\n", "Codec", "Bytes", "Bits/index", "Encode Midx/s", "Decode Midx/s")
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+			fmt.Fprintf(w, "%-22s FAILED: %v\n", result.name, result.err)
+			continue
+		}
+		fmt.Fprintf(w, "%-22s %12d %10.2f %14.1f %14.1f\n", result.name, result.bytes,
+			float64(result.bytes)*8/float64(numIndices),
+			throughput(numIndices, result.encodeTime), throughput(numIndices, result.decodeTime))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d codecs failed", failed, len(results))
+	}
+	return nil
+}
+
+// benchmarkCodec times one codec over every row and checks the round trip
+func benchmarkCodec(codec indexCodec, rows [][]uint32, universe uint32) codecResult {
+	result := codecResult{name: codec.name}
+	encoded := make([][]byte, len(rows))
+
+	start := time.Now()
+	for i, indices := range rows {
+		data, err := codec.encode(indices, universe)
+		if err != nil {
+			result.err = fmt.Errorf("cell %d: %w", i, err)
+			return result
+		}
+		encoded[i] = data
+		result.bytes += len(data)
+	}
+	result.encodeTime = time.Since(start)
+
+	decoded := make([][]uint32, len(rows))
+	start = time.Now()
+	for i, data := range encoded {
+		indices, err := codec.decode(data)
+		if err != nil {
+			result.err = fmt.Errorf("cell %d: %w", i, err)
+			return result
+		}
+		decoded[i] = indices
+	}
+	result.decodeTime = time.Since(start)
+
+	for i, indices := range rows {
+		if len(decoded[i]) != len(indices) {
+			result.err = fmt.Errorf("cell %d decoded to %d indices instead of %d", i, len(decoded[i]), len(indices))
+			return result
+		}
+		for j := range indices {
+			if decoded[i][j] != indices[j] {
+				result.err = fmt.Errorf("cell %d index %d decoded to %d instead of %d", i, j, decoded[i][j], indices[j])
+				return result
+			}
+		}
+	}
+	return result
+}
+
+// throughput returns millions of indices per second
+func throughput(numIndices int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(numIndices) / elapsed.Seconds() / 1e6
+}
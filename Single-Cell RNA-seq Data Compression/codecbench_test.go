@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBitPacked(t *testing.T) {
+	indices := []uint32{0, 3, 7, 1000, 1023}
+	data, err := encodeBitPacked(indices, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The layout written before the codec moved onto BitWriter
+	want := []byte{0x5, 0xa, 0x0, 0xc, 0x70, 0x0, 0xfa, 0xff, 0x3}
+	if !bytes.Equal(data, want) {
+		t.Errorf("encodeBitPacked = %#v, want %#v", data, want)
+	}
+	decoded, err := decodeBitPacked(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, indices) {
+		t.Errorf("decoded %v, want %v", decoded, indices)
+	}
+
+	if _, err := encodeBitPacked([]uint32{1024}, 1024); err == nil {
+		t.Error("encoded an index outside the universe")
+	}
+	if _, err := decodeBitPacked(data[:len(data)-2]); err == nil {
+		t.Error("decoded truncated data")
+	}
+}
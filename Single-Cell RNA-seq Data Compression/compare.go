@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// CellDivergence records how far a single cell differs between two matrices
+type CellDivergence struct {
+	Cell       int
+	NumDiffs   int
+	SumAbsDiff uint64
+	SumSqDiff  float64
+	MaxAbsDiff uint32
+}
+
+// MatrixDiff summarizes the differences between two sparse matrices
+type MatrixDiff struct {
+	NumCellsA   int
+	NumCellsB   int
+	NumEntries  int // Entries non-zero in either matrix
+	NumDiffs    int // Entries whose values differ beyond the tolerance
+	MaxAbsDiff  uint32
+	MeanAbsDiff float64
+	RMSE        float64          // Root mean squared difference over the compared entries
+	Cells       []CellDivergence // Diverging cells, most divergent first
+}
+
+// ValuesEqual reports whether two expression values are equal within tolerance
+func ValuesEqual(a, b, tolerance uint32) bool {
+	return absDiff(a, b) <= tolerance
+}
+
+// CompareMatrices compares two sparse matrices cell by cell. Cells present in
+// only one matrix are compared against an empty row.
+func CompareMatrices(matrixA, matrixB []SparseRow, tolerance uint32) MatrixDiff {
+	diff := MatrixDiff{
+		NumCellsA: len(matrixA),
+		NumCellsB: len(matrixB),
+	}
+
+	numCells := len(matrixA)
+	if len(matrixB) > numCells {
+		numCells = len(matrixB)
+	}
+
+	var sumAbsDiff uint64
+	var sumSqDiff float64
+	for cell := 0; cell < numCells; cell++ {
+		var rowA, rowB SparseRow
+		if cell < len(matrixA) {
+			rowA = matrixA[cell]
+		}
+		if cell < len(matrixB) {
+			rowB = matrixB[cell]
+		}
+
+		cellDiff := compareRows(rowA, rowB, tolerance, &diff.NumEntries)
+		cellDiff.Cell = cell
+		sumAbsDiff += cellDiff.SumAbsDiff
+		sumSqDiff += cellDiff.SumSqDiff
+		if cellDiff.MaxAbsDiff > diff.MaxAbsDiff {
+			diff.MaxAbsDiff = cellDiff.MaxAbsDiff
+		}
+		if cellDiff.NumDiffs > 0 {
+			diff.NumDiffs += cellDiff.NumDiffs
+			diff.Cells = append(diff.Cells, cellDiff)
+		}
+	}
+
+	if diff.NumEntries > 0 {
+		diff.MeanAbsDiff = float64(sumAbsDiff) / float64(diff.NumEntries)
+		diff.RMSE = math.Sqrt(sumSqDiff / float64(diff.NumEntries))
+	}
+
+	sort.SliceStable(diff.Cells, func(i, j int) bool {
+		return diff.Cells[i].SumAbsDiff > diff.Cells[j].SumAbsDiff
+	})
+
+	return diff
+}
+
+// compareRows merges two sorted sparse rows and accumulates their differences
+func compareRows(rowA, rowB SparseRow, tolerance uint32, numEntries *int) CellDivergence {
+	var cellDiff CellDivergence
+
+	record := func(a, b uint32) {
+		*numEntries++
+		d := absDiff(a, b)
+		cellDiff.SumAbsDiff += uint64(d)
+		cellDiff.SumSqDiff += float64(d) * float64(d)
+		if d > cellDiff.MaxAbsDiff {
+			cellDiff.MaxAbsDiff = d
+		}
+		if !ValuesEqual(a, b, tolerance) {
+			cellDiff.NumDiffs++
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(rowA.Indices) || j < len(rowB.Indices) {
+		switch {
+		case j >= len(rowB.Indices) || (i < len(rowA.Indices) && rowA.Indices[i] < rowB.Indices[j]):
+			record(rowA.Values[i], 0)
+			i++
+		case i >= len(rowA.Indices) || rowB.Indices[j] < rowA.Indices[i]:
+			record(0, rowB.Values[j])
+			j++
+		default:
+			record(rowA.Values[i], rowB.Values[j])
+			i++
+			j++
+		}
+	}
+
+	return cellDiff
+}
+
+// PrintSummary writes a human-readable report of the differences to w
+func (md MatrixDiff) PrintSummary(w io.Writer, cellNames []string, topN int) {
+	fmt.Fprintf(w, "Cells: %d vs %d\n", md.NumCellsA, md.NumCellsB)
+	fmt.Fprintf(w, "Compared entries: %d\n", md.NumEntries)
+	fmt.Fprintf(w, "Differing entries: %d\n", md.NumDiffs)
+	fmt.Fprintf(w, "Max absolute difference: %d\n", md.MaxAbsDiff)
+	fmt.Fprintf(w, "Mean absolute difference: %.4f\n", md.MeanAbsDiff)
+	fmt.Fprintf(w, "RMSE: %.4f\n", md.RMSE)
+
+	if len(md.Cells) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Most divergent cells:\n")
+	for i, cell := range md.Cells {
+		if i >= topN {
+			break
+		}
+		name := fmt.Sprintf("Cell_%d", cell.Cell+1)
+		if cell.Cell < len(cellNames) {
+			name = cellNames[cell.Cell]
+		}
+		fmt.Fprintf(w, "  %s: %d differing entries, sum |diff| %d, max |diff| %d\n",
+			name, cell.NumDiffs, cell.SumAbsDiff, cell.MaxAbsDiff)
+	}
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"math/rand"
 	"runtime"
 	"sort"
 	"sync"
@@ -10,17 +13,956 @@ import (
 
 // Compressor handles the compression of single-cell RNA-seq data
 type Compressor struct {
-	lossy       bool
-	threshold   float64
-	quantLevels uint32
-	deltaEncoder *DeltaEncoder
+	lossy           bool
+	threshold       float64
+	quantLevels     uint32
+	deltaEncoder    *DeltaEncoder
+	lowBitsStrategy LowBitsStrategy
+	fixedLowBits    uint32
+	refWindow       int
+	refWindowBudget int64 // Memory budget of an automatic reference window, 0 for a fixed window
+	refIndex        RefIndex
+	lshBands        int
+	lshRows         int
+	lsh             *lshIndex // Candidate index of the current Compress call with RefIndexLSH
+	refMode         RefMode
+	numMedoids      int
+	adaptiveQuant   bool
+	pickSmallest    bool
+	seed            int64
+	timestamp       int64
+	variableGenes   int
+	dtype           DType
+	binary          bool
+	detectedBinary  *bool // Binary decision made for all shards by CompressShards, nil to detect per call
+	eliasFlate      bool
+	forwardRefs     bool
+	noDelta         bool
+	deltaMinGenes   int // Cells expressing fewer genes are self-encoded
+	geneChunk       uint32
+	frontCodeNames  bool
+	valueCodec      ValueCodec
+	graphNeighbours int
+	graph           *similarityGraph
+	lossyMaxError   float64
+	duplicateOf     []int       // Earlier identical cell of every cell, or -1
+	lossless        []bool      // Cells stored unquantized to meet lossyMaxError, nil if off
+	exactGeneNames  []string    // Genes never quantized, see SetLosslessGenes
+	topGenes        int         // Genes kept per cell, 0 for all
+	meanCell        *SparseRow  // Synthetic reference in RefMean and RefGeneBaseline mode, nil otherwise
+	searchRows      []SparseRow // Rows compared by the reference search, see SimilarityMetric.PrepareRows
+	stats           CompressionStats
+	ctx             context.Context // Stops the worker pool once done, see SetContext
 }
 
+// RefMode selects how reference cells for delta encoding are chosen
+type RefMode int
+
+const (
+	// RefChain lets each cell reference the most similar earlier cell
+	RefChain RefMode = iota
+	// RefMedoid clusters the cells and has each cell reference its nearest
+	// medoid, capping reference chains at depth one
+	RefMedoid
+	// RefMean has each cell reference one synthetic cell holding the mean
+	// expression of every gene (see meanCell), stored in the archive
+	RefMean
+	// RefGeneBaseline is RefMean with the median instead of the mean (see
+	// medianCell), a baseline outliers do not pull away from the typical
+	// level of stably expressed genes
+	RefGeneBaseline
+)
+
 // NewCompressor creates a new compressor with the specified parameters
 func NewCompressor(lossy bool, threshold float64, quantLevels uint32) *Compressor {
 	return &Compressor{
-		lossy:       lossy,
-		threshold:   threshold,
-		quantLevels: quantLevels,
-		deltaEncoder: NewDeltaEncoder(lossy, threshold, quantLevels),
+		lossy:           lossy,
+		threshold:       threshold,
+		quantLevels:     quantLevels,
+		deltaEncoder:    NewDeltaEncoder(lossy, threshold, quantLevels),
+		lowBitsStrategy: LowBitsHeuristic,
+		refWindow:       -1,
+		pickSmallest:    true,
+		seed:            1,
+		ctx:             context.Background(),
+	}
+}
+
+// SetContext makes Compress and CompressShards stop encoding cells once ctx
+// is done and return its error, so a deadline or cancellation reaches the
+// worker pool rather than waiting for the whole matrix
+func (c *Compressor) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// SetLowBitsStrategy selects how the Elias-Fano low-bit width is chosen per
+// cell. fixedLowBits is only used with LowBitsFixed.
+func (c *Compressor) SetLowBitsStrategy(strategy LowBitsStrategy, fixedLowBits uint32) {
+	c.lowBitsStrategy = strategy
+	c.fixedLowBits = fixedLowBits
+}
+
+// SetRefWindow limits the reference search to the window cells immediately
+// preceding each cell. A smaller window trades compression ratio for speed:
+// the search is O(n*window) instead of O(n^2). 0 disables delta encoding and
+// a negative window searches all earlier cells.
+func (c *Compressor) SetRefWindow(window int) {
+	c.refWindow = window
+	c.refWindowBudget = 0
+}
+
+// SetAutoRefWindow sizes the reference window of each Compress call to a
+// memory budget in bytes instead, from the number of search workers and the
+// average cell's gene count (see autoRefWindow). RefWindow reports the
+// window chosen.
+func (c *Compressor) SetAutoRefWindow(budget int64) {
+	c.refWindowBudget = budget
+}
+
+// RefWindow returns the reference window of the most recent Compress call,
+// or the configured one before any
+func (c *Compressor) RefWindow() int {
+	return c.refWindow
+}
+
+// SetRefIndex selects which earlier cells chain mode compares each cell
+// against. RefIndexLSH compares only cells sharing one of bands MinHash bands
+// of rows values each (see lshIndex): more bands find more references, more
+// rows fewer but closer ones. The reference window still applies.
+func (c *Compressor) SetRefIndex(index RefIndex, bands, rows int) {
+	c.refIndex = index
+	c.lshBands = bands
+	c.lshRows = rows
+}
+
+// SetNoDelta self-encodes every cell: no reference search, no medoid
+// clustering and no duplicate detection, so every RefCell is -1. It is the
+// fastest setting, and loses nothing on matrices whose cells are too
+// dissimilar for deltas to pay off.
+func (c *Compressor) SetNoDelta(noDelta bool) {
+	c.noDelta = noDelta
+}
+
+// SetDeltaMinGenes self-encodes every cell expressing fewer than n genes.
+// Such cells gain little from a reference, whose index costs more than the
+// few values it saves. Duplicates of an earlier cell are still stored as
+// such; 0 lets every cell reference another.
+func (c *Compressor) SetDeltaMinGenes(n int) {
+	c.deltaMinGenes = n
+}
+
+// SetRefMode selects the reference strategy. numMedoids is the number of
+// medoid cells used by RefMedoid.
+func (c *Compressor) SetRefMode(mode RefMode, numMedoids int) {
+	c.refMode = mode
+	c.numMedoids = numMedoids
+}
+
+// SetSimilarity selects the metric used to choose reference cells and
+// medoids. It only affects which references are picked, so archives read the
+// same whatever metric wrote them.
+func (c *Compressor) SetSimilarity(metric SimilarityMetric) {
+	c.deltaEncoder.SetSimilarity(metric)
+}
+
+// SetForwardRefs makes medoid mode only reference medoids that precede the
+// cell, so every reference points backwards and the archive can be decoded in
+// a single forward pass. Chain mode always references earlier cells.
+func (c *Compressor) SetForwardRefs(forward bool) {
+	c.forwardRefs = forward
+}
+
+// SetGeneChunk splits the feature axis into ranges of size genes, each
+// encoded with its own small Elias-Fano universe (see encodeGeneChunks). It
+// helps very wide matrices whose density varies along the feature axis; each
+// non-empty chunk costs a few dozen bytes of headers, so chunks should be
+// tens of thousands of genes. 0 encodes each row over the whole axis.
+func (c *Compressor) SetGeneChunk(size uint32) {
+	c.geneChunk = size
+}
+
+// SetFrontCodedNames stores gene and cell names front-coded (shared prefix
+// length plus suffix), which shrinks long, similar barcodes
+func (c *Compressor) SetFrontCodedNames(frontCode bool) {
+	c.frontCodeNames = frontCode
+}
+
+// SetValueCodec selects the entropy coding of each row's deltas or values.
+// Golomb-Rice suits the short rows of sparse cells, where flate's block
+// overhead outweighs what it saves.
+func (c *Compressor) SetValueCodec(codec ValueCodec) {
+	c.valueCodec = codec
+	c.deltaEncoder.SetValueCodec(codec)
+}
+
+// SetSimilarityGraph makes Compress keep, for every cell, the k most similar
+// cells seen during the reference search (see SimilarityGraph); 0 disables it.
+// Only the chain reference search compares cells pairwise, so the graph stays
+// empty in medoid mode, with a reference window of 0 and for binary matrices.
+func (c *Compressor) SetSimilarityGraph(k int) {
+	c.graphNeighbours = k
+}
+
+// SimilarityGraph returns the top-k similarity edges of every cell collected
+// by the most recent Compress call, in cell order, or nil if disabled
+func (c *Compressor) SimilarityGraph() []CellSimilarity {
+	if c.graph == nil {
+		return nil
+	}
+	return c.graph.edges()
+}
+
+// SetAdaptiveQuantization replaces the fixed logarithmic quantizer with a
+// Lloyd-Max codebook fitted to the value distribution (lossy mode only)
+func (c *Compressor) SetAdaptiveQuantization(adaptive bool) {
+	c.adaptiveQuant = adaptive
+}
+
+// SetLossyMaxError bounds the per-cell reconstruction error of lossy
+// compression: after encoding, Compress decodes the archive and re-encodes
+// every cell whose largest absolute error exceeds maxError with its original
+// values, repeating until every cell is within the bound. Such cells are
+// listed in CompressedData.LosslessCells. 0 disables the check.
+func (c *Compressor) SetLossyMaxError(maxError float64) {
+	c.lossyMaxError = maxError
+}
+
+// SetLosslessGenes lists genes whose values lossy compression stores
+// exactly, such as a panel of marker genes, while the other genes are
+// quantized. Compress records the listed genes the matrix has (after -hvg
+// filtering) in CompressedData.LosslessGenes and ignores the rest.
+func (c *Compressor) SetLosslessGenes(names []string) {
+	c.exactGeneNames = names
+}
+
+// SetTopGenesPerCell keeps only the k highest values of every cell (after
+// -hvg filtering) and drops the rest, a lossy quick-look archive whose
+// decoded cells have at most k genes. The archive records k; 0 keeps every
+// gene.
+func (c *Compressor) SetTopGenesPerCell(k int) {
+	c.topGenes = k
+}
+
+// SetPickSmallest controls whether each cell that has a reference is also
+// self-encoded, keeping whichever payload is smaller. Disabling it skips the
+// second encoding and speeds up compression at some cost in ratio.
+func (c *Compressor) SetPickSmallest(pick bool) {
+	c.pickSmallest = pick
+}
+
+// SetSeed sets the seed of every randomized step (currently medoid
+// clustering), so the same seed always produces the same references
+func (c *Compressor) SetSeed(seed int64) {
+	c.seed = seed
+}
+
+// SetTimestamp fixes the creation time recorded in the header (Unix seconds)
+// instead of using the current time, for byte-identical reproducible archives
+func (c *Compressor) SetTimestamp(timestamp int64) {
+	c.timestamp = timestamp
+}
+
+// SetVariableGenes keeps only the n most variable genes (by dispersion) and
+// drops the rest before compressing. 0 keeps every gene.
+func (c *Compressor) SetVariableGenes(n int) {
+	c.variableGenes = n
+}
+
+// SetDType records dtype as the original value type instead of detecting the
+// smallest unsigned type that fits. DTypeUnknown restores detection.
+func (c *Compressor) SetDType(dtype DType) {
+	c.dtype = dtype
+}
+
+// SetBinary forces presence/absence encoding: only the gene indices are
+// stored and every expressed gene decompresses to 1. Matrices whose values
+// are all 1 are detected and encoded this way regardless; forcing it on other
+// data binarizes them.
+func (c *Compressor) SetBinary(binary bool) {
+	c.binary = binary
+}
+
+// SetEliasFlate adds a flate stage on top of each row's Elias-Fano encoding.
+// See DeflateEliasFano: on typical data this does not pay off.
+func (c *Compressor) SetEliasFlate(eliasFlate bool) {
+	c.eliasFlate = eliasFlate
+}
+
+// Compress compresses the sparse matrix using Elias-Fano encoding for the gene
+// indices and delta encoding against similar cells for the expression values
+func (c *Compressor) Compress(matrix []SparseRow, geneNames, cellNames []string) (*CompressedData, error) {
+	startTime := time.Now()
+	inputMatrix, inputGeneNames := matrix, geneNames
+
+	// Drop all but the most variable genes, remembering where the kept ones were
+	var keptGenes []uint32
+	var droppedGeneNames []string
+	if c.variableGenes > 0 && c.variableGenes < len(geneNames) {
+		keptGenes = SelectVariableGenes(matrix, len(geneNames), c.variableGenes)
+		matrix, geneNames, droppedGeneNames = filterGenes(matrix, geneNames, keptGenes)
+	}
+
+	// Drop all but the highest genes of every cell
+	var droppedCounts uint64
+	if c.topGenes > 0 {
+		matrix, droppedCounts = keepTopGenes(matrix, c.topGenes)
+	}
+
+	compressed := &CompressedData{
+		Header: Header{
+			Version:     FormatVersion,
+			NumCells:    uint32(len(matrix)),
+			NumGenes:    uint32(len(geneNames)),
+			IsLossy:     c.lossy,
+			Threshold:   c.threshold,
+			QuantLevels: c.quantLevels,
+			Timestamp:   startTime.Unix(),
+			EliasFlate:  c.eliasFlate,
+			GeneChunk:   c.geneChunk,
+
+			FrontCodedNames: c.frontCodeNames,
+			ValueCodec:      c.valueCodec,
+		},
+		GeneNames:        geneNames,
+		CellNames:        cellNames,
+		CompressedRows:   make([]CompressedRow, len(matrix)),
+		KeptGenes:        keptGenes,
+		DroppedGeneNames: droppedGeneNames,
+		DType:            c.dtype,
+		TopGenesPerCell:  uint32(c.topGenes),
+	}
+
+	// Record the original dtype before quantization shrinks the values
+	if compressed.DType == DTypeUnknown {
+		compressed.DType = DetectDType(matrix)
+	} else if err := checkDType(matrix, compressed.DType); err != nil {
+		return nil, err
+	}
+
+	if c.timestamp != 0 {
+		compressed.Header.Timestamp = c.timestamp
+	}
+
+	if c.refWindowBudget > 0 {
+		c.refWindow = autoRefWindow(matrix, c.refWindowBudget, runtime.NumCPU())
+	}
+
+	// Elias-Fano requires sorted gene indices
+	matrix = c.sortRows(matrix)
+	sortedMatrix := matrix
+
+	// Binary matrices need no values, so quantization and references are moot
+	if c.detectedBinary != nil {
+		compressed.Header.IsBinary = c.binary || *c.detectedBinary
+	} else {
+		compressed.Header.IsBinary = c.binary || isBinaryMatrix(matrix)
+	}
+	if compressed.Header.IsBinary {
+		compressed.Header.IsLossy = false
+	}
+
+	// Apply quantization if lossy compression is enabled, except to the
+	// lossless genes
+	lossy := c.lossy && !compressed.Header.IsBinary
+	var exactGenes []bool
+	if lossy && len(c.exactGeneNames) > 0 {
+		compressed.LosslessGenes, exactGenes = losslessGeneIndices(geneNames, c.exactGeneNames)
+	}
+	c.deltaEncoder.exactGenes = exactGenes
+	if lossy && c.adaptiveQuant {
+		compressed.Codebook = BuildCodebook(matrix, c.quantLevels)
+		matrix = c.applyCodebook(matrix, compressed.Codebook, exactGenes)
+	} else if lossy {
+		matrix = c.applyQuantization(matrix, exactGenes)
+	}
+
+	c.searchRows = c.deltaEncoder.metric.PrepareRows(matrix)
+
+	// In medoid mode the references are fixed up front by clustering
+	var references, medoids []int
+	if c.refMode == RefMedoid && !compressed.Header.IsBinary && !c.noDelta {
+		rng := rand.New(rand.NewSource(c.seed))
+		medoids, references = selectMedoids(c.searchRows, c.numMedoids, c.deltaEncoder, rng)
+		for _, cell := range medoids {
+			compressed.Medoids = append(compressed.Medoids, uint32(cell))
+		}
+		if c.forwardRefs {
+			c.referenceEarlierMedoids(c.searchRows, medoids, references)
+		}
+	}
+
+	// In mean and baseline mode every cell may reference the one synthetic
+	// cell
+	c.meanCell = nil
+	if (c.refMode == RefMean || c.refMode == RefGeneBaseline) && !compressed.Header.IsBinary && !c.noDelta {
+		synthetic := meanCell
+		if c.refMode == RefGeneBaseline {
+			synthetic = medianCell
+		}
+		if mean := synthetic(matrix); len(mean.Indices) > 0 {
+			c.meanCell = &mean
+			compressed.MeanCell = &mean
+		}
+	}
+
+	// Chain mode with an LSH index only compares colliding cells
+	c.lsh = nil
+	if c.refIndex == RefIndexLSH && c.refMode == RefChain && !compressed.Header.IsBinary && !c.noDelta {
+		c.lsh = newLSHIndex(matrix, c.lshBands, c.lshRows, c.seed)
+	}
+
+	// With a maximum error, cells that decode too far from the original are
+	// given back their original values and everything is encoded again,
+	// since cells referencing them must pick other references
+	c.lossless = nil
+	if lossy && c.lossyMaxError > 0 {
+		c.lossless = make([]bool, len(matrix))
+	}
+	for {
+		if err := c.compressRows(matrix, compressed, references, medoids); err != nil {
+			return nil, err
+		}
+		compressed.Header.RefsOrdered = refsOrdered(compressed.CompressedRows)
+		if c.lossless == nil {
+			break
+		}
+
+		offenders, err := c.cellsOverMaxError(compressed, sortedMatrix)
+		if err != nil {
+			return nil, err
+		}
+		if len(offenders) == 0 {
+			break
+		}
+		for _, cell := range offenders {
+			c.lossless[cell] = true
+			matrix[cell] = sortedMatrix[cell]
+			compressed.LosslessCells = append(compressed.LosslessCells, uint32(cell))
+		}
+		sort.Slice(compressed.LosslessCells, func(a, b int) bool {
+			return compressed.LosslessCells[a] < compressed.LosslessCells[b]
+		})
+	}
+
+	c.stats = newCompressionStats(inputMatrix, inputGeneNames, cellNames, compressed, time.Since(startTime))
+	for _, row := range compressed.CompressedRows {
+		if row.isDuplicate() {
+			c.stats.DuplicateCells++
+		}
+	}
+	c.stats.LosslessCells = len(compressed.LosslessCells)
+	c.stats.DroppedCounts = droppedCounts
+	return compressed, nil
+}
+
+// CompressShards compresses numShards contiguous ranges of cells into
+// separate, self-contained archives (see SaveShardedArchive). References stay
+// within a shard, but the dtype, binary detection and timestamp are decided
+// once for the whole matrix so the shards can be assembled again by
+// mergeShards. Settings fitted to the data they compress (adaptive
+// quantization, gene filtering, mean or baseline references) are not supported.
+func (c *Compressor) CompressShards(matrix []SparseRow, geneNames, cellNames []string, numShards int) ([]*CompressedData, error) {
+	if numShards < 1 || numShards > len(matrix) {
+		return nil, fmt.Errorf("cannot split %d cells into %d shards", len(matrix), numShards)
+	}
+	if c.adaptiveQuant || c.variableGenes > 0 || c.refMode == RefMean || c.refMode == RefGeneBaseline {
+		return nil, fmt.Errorf("adaptive quantization, gene filtering and mean or baseline references are fitted per shard, so sharded archives do not support them")
+	}
+	startTime := time.Now()
+
+	savedDType, savedTimestamp := c.dtype, c.timestamp
+	defer func() { c.dtype, c.timestamp, c.detectedBinary = savedDType, savedTimestamp, nil }()
+	if c.dtype == DTypeUnknown {
+		c.dtype = DetectDType(matrix)
 	}
+	if c.timestamp == 0 {
+		c.timestamp = startTime.Unix()
+	}
+	binary := isBinaryMatrix(matrix)
+	c.detectedBinary = &binary
+
+	bounds := shardRanges(len(matrix), numShards)
+	shards := make([]*CompressedData, numShards)
+	var duplicates, lossless int
+	var compressedSize int64
+	var droppedCounts uint64
+	for i := range shards {
+		start, end := bounds[i], bounds[i+1]
+		var shardCellNames []string
+		if len(cellNames) == len(matrix) {
+			shardCellNames = cellNames[start:end]
+		}
+		shard, err := c.Compress(matrix[start:end], geneNames, shardCellNames)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		shards[i] = shard
+		duplicates += c.stats.DuplicateCells
+		lossless += c.stats.LosslessCells
+		droppedCounts += c.stats.DroppedCounts
+		compressedSize += c.stats.CompressedSize
+	}
+
+	merged, err := mergeShards(shards)
+	if err != nil {
+		return nil, err
+	}
+	// Every shard repeats the gene names, so sum the shards' own sizes
+	c.stats = newCompressionStats(matrix, geneNames, cellNames, merged, time.Since(startTime))
+	c.stats.CompressedSize = compressedSize
+	if compressedSize > 0 {
+		c.stats.CompressionRatio = float64(c.stats.OriginalSize) / float64(compressedSize)
+	}
+	c.stats.DuplicateCells = duplicates
+	c.stats.LosslessCells = lossless
+	c.stats.DroppedCounts = droppedCounts
+	return shards, nil
+}
+
+// compressRows encodes every cell of the matrix into compressed.CompressedRows
+// with a worker pool
+func (c *Compressor) compressRows(matrix []SparseRow, compressed *CompressedData, references, medoids []int) error {
+	c.graph = nil
+	if c.graphNeighbours > 0 {
+		c.graph = newSimilarityGraph(len(matrix), c.graphNeighbours)
+	}
+
+	// Exact copies of an earlier cell are stored as bare references. Lossless
+	// cells hold values on another scale than the quantized cells, so they
+	// neither copy nor are copied.
+	c.duplicateOf = nil
+	if !c.noDelta {
+		candidates := matrix
+		if len(compressed.LosslessCells) > 0 {
+			candidates = make([]SparseRow, len(matrix))
+			for cell, row := range matrix {
+				if !c.lossless[cell] {
+					candidates[cell] = row
+				}
+			}
+		}
+		c.duplicateOf = findDuplicates(candidates, medoids)
+	}
+
+	numWorkers := runtime.NumCPU()
+	jobs := make(chan int, len(matrix))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var compressErr error
+
+	// Start workers
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cellIdx := range jobs {
+				if err := c.ctx.Err(); err != nil {
+					mu.Lock()
+					if compressErr == nil {
+						compressErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				row, err := c.compressCell(matrix, cellIdx, &compressed.Header, references)
+				if err != nil {
+					mu.Lock()
+					if compressErr == nil {
+						compressErr = fmt.Errorf("error compressing cell %d: %w", cellIdx, err)
+					}
+					mu.Unlock()
+					continue
+				}
+
+				mu.Lock()
+				compressed.CompressedRows[cellIdx] = row
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Send jobs
+	for i := range matrix {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return compressErr
+}
+
+// cellsOverMaxError decodes the archive and returns the quantized cells whose
+// largest absolute difference from the original row exceeds lossyMaxError
+func (c *Compressor) cellsOverMaxError(compressed *CompressedData, original []SparseRow) ([]int, error) {
+	decompressor := NewDecompressor()
+	decompressor.SetContext(c.ctx)
+	decoded, _, _, err := decompressor.Decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the lossy archive: %w", err)
+	}
+
+	var offenders []int
+	for cell, row := range original {
+		if c.lossless[cell] {
+			continue
+		}
+		if len(decoded[cell].Values) != len(row.Values) {
+			offenders = append(offenders, cell)
+			continue
+		}
+		for i, value := range row.Values {
+			if math.Abs(float64(decoded[cell].Values[i])-float64(value)) > c.lossyMaxError {
+				offenders = append(offenders, cell)
+				break
+			}
+		}
+	}
+	return offenders, nil
+}
+
+// Stats returns statistics about the most recent Compress call
+func (c *Compressor) Stats() CompressionStats {
+	return c.stats
+}
+
+// newCompressionStats summarizes a finished compression
+func newCompressionStats(matrix []SparseRow, geneNames, cellNames []string, compressed *CompressedData, elapsed time.Duration) CompressionStats {
+	stats := CompressionStats{
+		OriginalSize:    int64(EstimateOriginalSize(matrix, geneNames, cellNames)),
+		CompressedSize:  int64(compressed.EstimateSize()),
+		CompressionTime: elapsed.Nanoseconds(),
+		NumCells:        uint32(len(matrix)),
+		NumGenes:        uint32(len(geneNames)),
+	}
+	if stats.CompressedSize > 0 {
+		stats.CompressionRatio = float64(stats.OriginalSize) / float64(stats.CompressedSize)
+	}
+
+	nonZeros := 0
+	for _, row := range matrix {
+		nonZeros += len(row.Indices)
+	}
+	if len(matrix) > 0 {
+		stats.AvgGenesPerCell = float64(nonZeros) / float64(len(matrix))
+	}
+	if len(matrix) > 0 && len(geneNames) > 0 {
+		stats.Sparsity = 1 - float64(nonZeros)/(float64(len(matrix))*float64(len(geneNames)))
+	}
+	return stats
+}
+
+// EstimateRatio compresses the matrix in memory and returns the estimated
+// compression ratio (original size / compressed size, as EstimateSize and
+// EstimateOriginalSize see them) without writing anything
+func (c *Compressor) EstimateRatio(matrix []SparseRow, geneNames, cellNames []string) (float64, error) {
+	if _, err := c.Compress(matrix, geneNames, cellNames); err != nil {
+		return 0, err
+	}
+	if c.stats.CompressedSize == 0 {
+		return 0, fmt.Errorf("empty compressed output")
+	}
+	return c.stats.CompressionRatio, nil
+}
+
+// compressCell compresses a single cell's expression profile. references, when
+// not nil, gives the precomputed reference cell for every cell.
+func (c *Compressor) compressCell(matrix []SparseRow, cellIdx int, header *Header, references []int) (CompressedRow, error) {
+	row := matrix[cellIdx]
+	result := CompressedRow{
+		RefCell:  -1,
+		NumGenes: uint32(len(row.Indices)),
+	}
+
+	if len(row.Indices) == 0 {
+		return result, nil
+	}
+	result.MaxGeneIndex = row.Indices[len(row.Indices)-1]
+
+	if c.duplicateOf != nil && c.duplicateOf[cellIdx] >= 0 {
+		first := c.duplicateOf[cellIdx]
+		if c.graph != nil && references == nil {
+			c.findWindowReference(c.searchRows, cellIdx) // Records the cell's neighbours
+		}
+		result.RefCell = int32(first)
+		return result, nil
+	}
+
+	// Encode gene indices using Elias-Fano
+	universe := header.NumGenes
+	if result.MaxGeneIndex >= universe {
+		universe = result.MaxGeneIndex + 1
+	}
+	var eliasGenes []byte
+	var err error
+	if header.GeneChunk > 0 {
+		eliasGenes, err = encodeGeneChunks(row.Indices, header.GeneChunk, universe, c.newEliasEncoder)
+	} else {
+		eliasGenes, err = c.newEliasEncoder(universe, row.Indices).Encode(row.Indices)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to encode gene indices: %w", err)
+	}
+	if header.EliasFlate {
+		if eliasGenes, err = DeflateEliasFano(eliasGenes); err != nil {
+			return result, fmt.Errorf("failed to deflate gene indices: %w", err)
+		}
+	}
+	result.EliasGenes = eliasGenes
+
+	if header.IsBinary {
+		return result, nil
+	}
+
+	refIdx := -1
+	switch {
+	case c.noDelta:
+	case len(row.Indices) < c.deltaMinGenes:
+		if c.graph != nil && references == nil {
+			c.findWindowReference(c.searchRows, cellIdx) // Records the cell's neighbours
+		}
+	case c.meanCell != nil:
+		refIdx = meanRefCell
+	case references != nil:
+		refIdx = references[cellIdx]
+	default:
+		refIdx = c.findWindowReference(c.searchRows, cellIdx)
+	}
+	if c.lossless != nil && (c.lossless[cellIdx] || (refIdx >= 0 && c.lossless[refIdx])) {
+		// Lossless cells are self-encoded, since the delta threshold would
+		// perturb their values, and medoids that fell back cannot be
+		// referenced by quantized cells
+		refIdx = -1
+	}
+	var reference *SparseRow
+	switch {
+	case refIdx == meanRefCell:
+		reference = c.meanCell
+	case refIdx >= 0:
+		reference = &matrix[refIdx]
+	}
+
+	// Deltas too large for an int32 cannot be stored, so such cells are
+	// self-encoded instead
+	var deltas []int32
+	if reference != nil {
+		if deltas, err = c.deltaEncoder.ComputeDelta(row, *reference); err != nil {
+			reference = nil
+		}
+	}
+
+	// Delta-encode against the reference unless we are also going to try
+	// self-encoding and it turns out smaller
+	var deltaValues []byte
+	if reference != nil {
+		deltaValues, err = c.deltaEncoder.CompressDeltas(deltas)
+		if err != nil {
+			return result, fmt.Errorf("failed to compress deltas: %w", err)
+		}
+		result.RefCell = int32(refIdx)
+		result.DeltaValues = deltaValues
+		if !c.pickSmallest {
+			return result, nil
+		}
+	}
+
+	// Self-encode: no reference cell, store the values themselves
+	values := make([]int32, len(row.Values))
+	for i, value := range row.Values {
+		if value > math.MaxInt32 {
+			if reference != nil {
+				return result, nil // only the delta encoding can represent it
+			}
+			return result, fmt.Errorf("value %d of gene %d exceeds the int32 range", value, row.Indices[i])
+		}
+		values[i] = int32(value)
+	}
+	selfValues, err := c.deltaEncoder.CompressDeltas(values)
+	if err != nil {
+		return result, fmt.Errorf("failed to compress values: %w", err)
+	}
+	if reference == nil || len(selfValues) <= len(deltaValues) {
+		result.RefCell = -1
+		result.DeltaValues = selfValues
+	}
+
+	return result, nil
+}
+
+// referenceEarlierMedoids replaces every reference to a later medoid with the
+// best medoid preceding the cell, or none
+func (c *Compressor) referenceEarlierMedoids(matrix []SparseRow, medoids, references []int) {
+	for cell, ref := range references {
+		if ref < cell {
+			continue
+		}
+		var candidates []SparseRow
+		var candidateIndices []int
+		for _, medoid := range medoids {
+			if medoid < cell {
+				candidates = append(candidates, matrix[medoid])
+				candidateIndices = append(candidateIndices, medoid)
+			}
+		}
+		references[cell] = c.deltaEncoder.FindBestReference(matrix[cell], candidates, candidateIndices)
+	}
+}
+
+// refsOrdered reports whether every row references an earlier row (or none)
+func refsOrdered(rows []CompressedRow) bool {
+	for cell, row := range rows {
+		if int(row.RefCell) >= cell {
+			return false
+		}
+	}
+	return true
+}
+
+// findWindowReference finds the most similar earlier cell within the
+// reference window, among the cells colliding in the LSH index if there is one
+func (c *Compressor) findWindowReference(matrix []SparseRow, cellIdx int) int {
+	start := 0
+	if c.refWindow >= 0 && cellIdx > c.refWindow {
+		start = cellIdx - c.refWindow
+	}
+	var candidateIndices []int
+	var similarities []float64
+	if c.lsh != nil {
+		candidateIndices = c.lsh.candidates(cellIdx, start)
+		candidates := make([]SparseRow, len(candidateIndices))
+		for i, cell := range candidateIndices {
+			candidates[i] = matrix[cell]
+		}
+		similarities = c.deltaEncoder.Similarities(matrix[cellIdx], candidates)
+	} else {
+		candidateIndices = make([]int, cellIdx-start)
+		for i := range candidateIndices {
+			candidateIndices[i] = start + i
+		}
+		similarities = c.deltaEncoder.Similarities(matrix[cellIdx], matrix[start:cellIdx])
+	}
+	if c.graph != nil {
+		c.graph.addCell(cellIdx, candidateIndices, similarities)
+	}
+	if c.lossless != nil {
+		// Quantized cells cannot be delta-encoded against unquantized values
+		for i, cell := range candidateIndices {
+			if c.lossless[cell] {
+				similarities[i] = 0
+			}
+		}
+	}
+	return c.deltaEncoder.BestReference(similarities, candidateIndices)
+}
+
+// newEliasEncoder creates an Elias-Fano encoder using the configured low-bits strategy
+func (c *Compressor) newEliasEncoder(universe uint32, indices []uint32) *EliasEncoder {
+	count := uint32(len(indices))
+	switch c.lowBitsStrategy {
+	case LowBitsFixed:
+		return NewEliasEncoderWithLowBits(universe, count, c.fixedLowBits)
+	case LowBitsSearch:
+		return NewEliasEncoderWithLowBits(universe, count, BestLowBits(indices, universe))
+	default:
+		return NewEliasEncoderWithStrategy(universe, count, c.lowBitsStrategy)
+	}
+}
+
+// isBinaryMatrix reports whether every stored value is 1 (and there is at least one)
+func isBinaryMatrix(matrix []SparseRow) bool {
+	found := false
+	for _, row := range matrix {
+		for _, value := range row.Values {
+			if value != 1 {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
+
+// sortRows returns the matrix with each row's entries ordered by gene index
+func (c *Compressor) sortRows(matrix []SparseRow) []SparseRow {
+	sorted := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		if sort.SliceIsSorted(row.Indices, func(a, b int) bool { return row.Indices[a] < row.Indices[b] }) {
+			sorted[i] = row
+			continue
+		}
+
+		order := make([]int, len(row.Indices))
+		for j := range order {
+			order[j] = j
+		}
+		sort.Slice(order, func(a, b int) bool { return row.Indices[order[a]] < row.Indices[order[b]] })
+
+		sortedRow := SparseRow{
+			Indices: make([]uint32, len(order)),
+			Values:  make([]uint32, len(order)),
+		}
+		for j, k := range order {
+			sortedRow.Indices[j] = row.Indices[k]
+			sortedRow.Values[j] = row.Values[k]
+		}
+		sorted[i] = sortedRow
+	}
+	return sorted
+}
+
+// applyQuantization applies quantization to reduce the value range for lossy
+// compression, leaving the values of exact genes (nil for none) unchanged
+func (c *Compressor) applyQuantization(matrix []SparseRow, exactGenes []bool) []SparseRow {
+	quantized := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		quantizedValues := make([]uint32, len(row.Values))
+		for j, value := range row.Values {
+			quantizedValues[j] = value
+			if exactGenes == nil || !exactGenes[row.Indices[j]] {
+				quantizedValues[j] = c.deltaEncoder.QuantizeValue(value)
+			}
+		}
+		quantized[i] = SparseRow{
+			Indices: row.Indices,
+			Values:  quantizedValues,
+		}
+	}
+	return quantized
+}
+
+// applyCodebook replaces every value with its 1-based codebook bin index,
+// except the values of exact genes (nil for none)
+func (c *Compressor) applyCodebook(matrix []SparseRow, codebook *Codebook, exactGenes []bool) []SparseRow {
+	quantized := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		quantizedValues := make([]uint32, len(row.Values))
+		for j, value := range row.Values {
+			quantizedValues[j] = value
+			if exactGenes == nil || !exactGenes[row.Indices[j]] {
+				quantizedValues[j] = codebook.Quantize(value)
+			}
+		}
+		quantized[i] = SparseRow{
+			Indices: row.Indices,
+			Values:  quantizedValues,
+		}
+	}
+	return quantized
+}
+
+// losslessGeneIndices returns the ascending indices of the listed genes
+// among geneNames, and the same set as a mask over all genes
+func losslessGeneIndices(geneNames, listed []string) ([]uint32, []bool) {
+	wanted := make(map[string]bool, len(listed))
+	for _, name := range listed {
+		wanted[name] = true
+	}
+	var genes []uint32
+	mask := make([]bool, len(geneNames))
+	for gene, name := range geneNames {
+		if wanted[name] {
+			genes = append(genes, uint32(gene))
+			mask[gene] = true
+		}
+	}
+	return genes, mask
+}
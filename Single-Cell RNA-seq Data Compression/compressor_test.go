@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// onesMatrix returns the matrix with every value replaced by 1
+func onesMatrix(matrix []SparseRow) []SparseRow {
+	ones := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		ones[i].Indices = row.Indices
+		ones[i].Values = make([]uint32, len(row.Values))
+		for j := range ones[i].Values {
+			ones[i].Values[j] = 1
+		}
+	}
+	return ones
+}
+
+func TestBinaryMatrix(t *testing.T) {
+	counts, geneNames, cellNames := GenerateSyntheticMatrix(200, 80, 0.9, 1)
+	ones := onesMatrix(counts)
+	tests := []struct {
+		name   string
+		matrix []SparseRow
+		lossy  bool
+		force  bool
+		binary bool
+	}{
+		{"all ones", ones, false, false, true},
+		{"all ones lossy", ones, true, false, true},
+		{"counts", counts, false, false, false},
+		{"counts forced binary", counts, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressor := NewCompressor(tt.lossy, 0.1, 16)
+			compressor.SetBinary(tt.force)
+			compressed, err := compressor.Compress(tt.matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Header.IsBinary != tt.binary {
+				t.Fatalf("IsBinary = %v, want %v", compressed.Header.IsBinary, tt.binary)
+			}
+			if !tt.binary {
+				return
+			}
+			if compressed.Header.IsLossy {
+				t.Error("binary archive is marked lossy")
+			}
+			for cell, row := range compressed.CompressedRows {
+				if len(row.DeltaValues) > 0 {
+					t.Fatalf("cell %d stores %d value bytes", cell, len(row.DeltaValues))
+				}
+			}
+
+			decoded, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cell, row := range ones {
+				if !sameRow(decoded[cell], row) {
+					t.Fatalf("cell %d decoded as %v, want %v", cell, decoded[cell], row)
+				}
+			}
+		})
+	}
+}
+
+func TestIsBinaryMatrix(t *testing.T) {
+	tests := []struct {
+		matrix []SparseRow
+		want   bool
+	}{
+		{nil, false},
+		{[]SparseRow{{}, {}}, false},
+		{[]SparseRow{{Indices: []uint32{0, 3}, Values: []uint32{1, 1}}, {}}, true},
+		{[]SparseRow{{Indices: []uint32{0}, Values: []uint32{1}}, {Indices: []uint32{2}, Values: []uint32{2}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.matrix), func(t *testing.T) {
+			if got := isBinaryMatrix(tt.matrix); got != tt.want {
+				t.Errorf("isBinaryMatrix = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressEmptyCells(t *testing.T) {
+	synthetic, geneNames, _ := GenerateSyntheticMatrix(60, 30, 0.8, 1)
+	mixed := make([]SparseRow, len(synthetic))
+	for cell := range mixed {
+		if cell%3 != 1 {
+			mixed[cell] = synthetic[cell]
+		}
+	}
+	matrices := []struct {
+		name   string
+		matrix []SparseRow
+	}{
+		{"all empty", make([]SparseRow, 20)},
+		{"mixed", mixed},
+		{"one expressed", append(make([]SparseRow, 10), synthetic[0])},
+	}
+	modes := []struct {
+		name  string
+		mode  RefMode
+		lossy bool
+	}{
+		{"chain", RefChain, false},
+		{"chain lossy", RefChain, true},
+		{"medoid", RefMedoid, false},
+		{"mean", RefMean, false},
+		{"gene-baseline", RefGeneBaseline, false},
+	}
+	for _, m := range matrices {
+		cellNames := make([]string, len(m.matrix))
+		for cell := range cellNames {
+			cellNames[cell] = fmt.Sprintf("cell%d", cell)
+		}
+		for _, mode := range modes {
+			t.Run(m.name+"/"+mode.name, func(t *testing.T) {
+				compressor := NewCompressor(mode.lossy, 0.1, 256)
+				compressor.SetRefMode(mode.mode, 4)
+				compressed, err := compressor.Compress(m.matrix, geneNames, cellNames)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, medoid := range compressed.Medoids {
+					if len(m.matrix[medoid].Indices) == 0 {
+						t.Errorf("empty cell %d is a medoid", medoid)
+					}
+				}
+				for cell, row := range m.matrix {
+					stored := compressed.CompressedRows[cell]
+					if len(row.Indices) == 0 && (stored.NumGenes != 0 || len(stored.EliasGenes) > 0 || len(stored.DeltaValues) > 0) {
+						t.Errorf("empty cell %d stored as %+v", cell, stored)
+					}
+				}
+
+				decoded, _, _, err := NewDecompressor().Decompress(compressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for cell, row := range m.matrix {
+					if len(row.Indices) == 0 && len(decoded[cell].Indices) > 0 {
+						t.Fatalf("empty cell %d decoded as %v", cell, decoded[cell])
+					}
+					if !mode.lossy && !sameRow(decoded[cell], row) {
+						t.Fatalf("cell %d decoded as %v, want %v", cell, decoded[cell], row)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestLosslessGenes compresses lossily with a panel of genes to keep exact,
+// which must survive saving and loading and decode exactly while the other
+// genes are quantized
+func TestLosslessGenes(t *testing.T) {
+	const levels = 8
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(200, 40, 0.5, 1)
+	panel := map[uint32]bool{0: true, 5: true, 17: true}
+	names := []string{"not-a-gene"}
+	for gene := range panel {
+		names = append(names, geneNames[gene])
+	}
+	compressor := NewCompressor(true, 0, levels)
+	compressor.SetLosslessGenes(names)
+	compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "m.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCompressedData(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.LosslessGenes) != len(panel) {
+		t.Fatalf("archive records lossless genes %v, want %d", loaded.LosslessGenes, len(panel))
+	}
+	for _, gene := range loaded.LosslessGenes {
+		if !panel[gene] {
+			t.Errorf("gene %d recorded as lossless", gene)
+		}
+	}
+
+	decoded, _, _, err := NewDecompressor().Decompress(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quantized := 0
+	for cell, row := range matrix {
+		got := referenceValues(decoded[cell], row.Indices)
+		for i, gene := range row.Indices {
+			value := row.Values[i]
+			switch {
+			case panel[gene] && got[i] != value:
+				t.Fatalf("cell %d panel gene %d: %d decoded as %d", cell, gene, value, got[i])
+			case math.Abs(float64(got[i])-float64(value)) > quantizationBound(value, levels):
+				t.Fatalf("cell %d gene %d: %d decoded as %d", cell, gene, value, got[i])
+			case got[i] != value:
+				quantized++
+			}
+		}
+	}
+	if quantized == 0 {
+		t.Error("no value outside the panel was quantized")
+	}
+}
+
+// cellErrors returns the largest absolute decoding error of every cell
+func cellErrors(matrix, decoded []SparseRow) []float64 {
+	errs := make([]float64, len(matrix))
+	for cell, row := range matrix {
+		got := referenceValues(decoded[cell], row.Indices)
+		for i, value := range row.Values {
+			errs[cell] = math.Max(errs[cell], math.Abs(float64(got[i])-float64(value)))
+		}
+	}
+	return errs
+}
+
+// TestLossyMaxError checks that a per-cell error bound stores exactly the
+// cells plain lossy compression decodes too far off as lossless, that these
+// decode exactly, are self-encoded and referenced by no quantized cell, that
+// every other cell stays within the bound, and that the list survives saving
+func TestLossyMaxError(t *testing.T) {
+	const levels = 8
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(200, 40, 0.5, 1)
+	// A few cells with far larger counts than the rest quantize badly
+	for _, cell := range []int{3, 77, 140} {
+		for i := range matrix[cell].Values {
+			matrix[cell].Values[i] *= 500
+		}
+	}
+
+	plain, err := NewCompressor(true, 0, levels).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, _, err := NewDecompressor().Decompress(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainErrors := cellErrors(matrix, decoded)
+	bound := 0.0
+	for cell, e := range plainErrors {
+		if cell != 3 && cell != 77 && cell != 140 {
+			bound = math.Max(bound, e)
+		}
+	}
+	var want []uint32
+	for cell, e := range plainErrors {
+		if e > bound {
+			want = append(want, uint32(cell))
+		}
+	}
+	if len(want) == 0 {
+		t.Fatalf("no cell decodes more than %g off; the scaled cells were not quantized badly", bound)
+	}
+
+	compressor := NewCompressor(true, 0, levels)
+	compressor.SetLossyMaxError(bound)
+	compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(compressed.LosslessCells, want) {
+		t.Fatalf("lossless cells %v, want %v", compressed.LosslessCells, want)
+	}
+	if got := compressor.Stats().LosslessCells; got != len(want) {
+		t.Errorf("stats report %d lossless cells, want %d", got, len(want))
+	}
+	for cell, row := range compressed.CompressedRows {
+		switch {
+		case compressed.isLosslessCell(cell) && row.RefCell != -1:
+			t.Errorf("lossless cell %d references %d", cell, row.RefCell)
+		case row.RefCell >= 0 && compressed.isLosslessCell(int(row.RefCell)):
+			t.Errorf("cell %d references lossless cell %d", cell, row.RefCell)
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "m.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCompressedData(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.LosslessCells, want) {
+		t.Fatalf("loaded lossless cells %v, want %v", loaded.LosslessCells, want)
+	}
+	decoded, _, _, err = NewDecompressor().Decompress(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quantized := false
+	for cell, e := range cellErrors(matrix, decoded) {
+		switch {
+		case loaded.isLosslessCell(cell) && e != 0:
+			t.Errorf("lossless cell %d decodes %g off", cell, e)
+		case e > bound:
+			t.Errorf("cell %d decodes %g off, over the bound %g", cell, e, bound)
+		case e > 0:
+			quantized = true
+		}
+	}
+	if !quantized {
+		t.Error("no cell was left quantized")
+	}
+	for _, cell := range want {
+		row, err := NewDecompressor().DecompressCell(loaded, int(cell))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row, matrix[cell]) {
+			t.Errorf("DecompressCell(%d) = %v, want the original row", cell, row)
+		}
+	}
+}
+
+func TestCompressContext(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(200, 50, 0.8, 1)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"canceled", canceled, context.Canceled},
+		{"deadline passed", expired, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressor := NewCompressor(false, 0.1, 256)
+			compressor.SetContext(tt.ctx)
+			if _, err := compressor.Compress(matrix, geneNames, cellNames); !errors.Is(err, tt.want) {
+				t.Errorf("Compress: got %v, want %v", err, tt.want)
+			}
+			if _, err := compressor.CompressShards(matrix, geneNames, cellNames, 3); !errors.Is(err, tt.want) {
+				t.Errorf("CompressShards: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// graduatedMatrix returns two interleaved cell types whose values rise with
+// the cell index, so that under weighted Jaccard each type's medoid is one of
+// the middle cells and the cells before it reference forward
+func graduatedMatrix(cells, genes int) ([]SparseRow, []string, []string) {
+	matrix := make([]SparseRow, cells)
+	cellNames := make([]string, cells)
+	for cell := range matrix {
+		for gene := uint32(cell % 2); gene < uint32(genes); gene += 2 {
+			matrix[cell].Indices = append(matrix[cell].Indices, gene)
+			matrix[cell].Values = append(matrix[cell].Values, gene*37%200+20+uint32(cell/2))
+		}
+		cellNames[cell] = fmt.Sprintf("Cell_%d", cell)
+	}
+	geneNames := make([]string, genes)
+	for gene := range geneNames {
+		geneNames[gene] = fmt.Sprintf("Gene_%d", gene)
+	}
+	return matrix, geneNames, cellNames
+}
+
+// TestRefsOrdered checks that chain mode, and medoid mode with forward
+// references, mark their archives as ordered and only reference earlier
+// cells, that plain medoid mode does not, and that an archive falsely
+// claiming ordered references fails to decode as corrupt
+func TestRefsOrdered(t *testing.T) {
+	matrix, geneNames, cellNames := graduatedMatrix(60, 400)
+	tests := []struct {
+		name        string
+		mode        RefMode
+		forwardRefs bool
+		wantOrdered bool
+	}{
+		{"chain", RefChain, false, true},
+		{"medoid forward refs", RefMedoid, true, true},
+		{"medoid", RefMedoid, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCompressor(false, 0.1, 256)
+			c.SetRefMode(tt.mode, 2)
+			c.SetForwardRefs(tt.forwardRefs)
+			c.SetSimilarity(SimilarityWeightedJaccard)
+			compressed, err := c.Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Header.RefsOrdered != tt.wantOrdered {
+				t.Fatalf("RefsOrdered %v, want %v", compressed.Header.RefsOrdered, tt.wantOrdered)
+			}
+			forward, referencing := -1, 0
+			for cell, row := range compressed.CompressedRows {
+				if row.RefCell >= 0 {
+					referencing++
+				}
+				if forward < 0 && int(row.RefCell) >= cell {
+					forward = cell
+				}
+			}
+			if referencing == 0 {
+				t.Fatal("every cell is self-encoded")
+			}
+			if tt.wantOrdered && forward >= 0 {
+				t.Fatalf("cell %d references cell %d", forward, compressed.CompressedRows[forward].RefCell)
+			}
+			if !tt.wantOrdered && forward < 0 {
+				t.Fatal("no cell references a later one")
+			}
+
+			decoded, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cell := range matrix {
+				if !sameRow(decoded[cell], matrix[cell]) {
+					t.Fatalf("cell %d decoded as %v, want %v", cell, decoded[cell], matrix[cell])
+				}
+			}
+			if tt.wantOrdered {
+				return
+			}
+
+			// Forge the flag and check it survives a save, so only the
+			// decoder's own check stands between it and a wrong decode
+			compressed.Header.RefsOrdered = true
+			filename := filepath.Join(t.TempDir(), "forged.scz")
+			if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			forged, err := LoadCompressedData(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !forged.Header.RefsOrdered {
+				t.Fatal("RefsOrdered lost in the saved archive")
+			}
+			_, _, _, err = NewDecompressor().Decompress(forged)
+			if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "claims ordered references") {
+				t.Errorf("Decompress: got %v, want ErrCorrupt for the forward reference", err)
+			}
+		})
+	}
+}
+
+// TestMedoidMode checks that medoid mode stores its medoids self-encoded,
+// has every other cell reference a medoid or nothing, and round-trips
+// exactly; and that an archive listing a medoid past its last cell fails to
+// decode as corrupt
+func TestMedoidMode(t *testing.T) {
+	graduated, graduatedGenes, graduatedCells := graduatedMatrix(60, 400)
+	synthetic, syntheticGenes, syntheticCells := GenerateSyntheticMatrix(400, 200, 0.8, 1)
+	tests := []struct {
+		name       string
+		matrix     []SparseRow
+		geneNames  []string
+		cellNames  []string
+		numMedoids int
+	}{
+		{"graduated", graduated, graduatedGenes, graduatedCells, 2},
+		{"synthetic", synthetic, syntheticGenes, syntheticCells, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCompressor(false, 0.1, 256)
+			c.SetRefMode(RefMedoid, tt.numMedoids)
+			c.SetSimilarity(SimilarityWeightedJaccard)
+			compressed, err := c.Compress(tt.matrix, tt.geneNames, tt.cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed.Medoids) != tt.numMedoids {
+				t.Fatalf("%d medoids, want %d", len(compressed.Medoids), tt.numMedoids)
+			}
+			isMedoid := make(map[int32]bool)
+			for _, medoid := range compressed.Medoids {
+				isMedoid[int32(medoid)] = true
+				if ref := compressed.CompressedRows[medoid].RefCell; ref != -1 {
+					t.Errorf("medoid %d references %d, want self-encoded", medoid, ref)
+				}
+			}
+			for cell, row := range compressed.CompressedRows {
+				if row.RefCell >= 0 && !isMedoid[row.RefCell] {
+					t.Errorf("cell %d references %d, which is not a medoid", cell, row.RefCell)
+				}
+			}
+
+			decoded, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cell := range tt.matrix {
+				if !sameRow(decoded[cell], tt.matrix[cell]) {
+					t.Fatalf("cell %d decoded as %v, want %v", cell, decoded[cell], tt.matrix[cell])
+				}
+			}
+
+			// The medoid list is only consulted without ordered references
+			compressed.Header.RefsOrdered = false
+			compressed.Medoids[0] = compressed.Header.NumCells + 5
+			_, _, _, err = NewDecompressor().Decompress(compressed)
+			if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "out of range") {
+				t.Errorf("Decompress: got %v, want ErrCorrupt for the medoid index", err)
+			}
+		})
+	}
+}
+
+// TestPickSmallest compresses the same matrix with and without trying
+// self-encoding on cells that have a reference. Picking must never store a
+// cell larger than the delta encoding would, must fall back to self-encoding
+// somewhere, and both archives must decode exactly.
+func TestPickSmallest(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(300, 100, 0.8, 1)
+	archives := make(map[bool]*CompressedData)
+	for _, pick := range []bool{false, true} {
+		c := NewCompressor(false, 0.1, 256)
+		c.SetPickSmallest(pick)
+		compressed, err := c.Compress(matrix, geneNames, cellNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, _, _, err := NewDecompressor().Decompress(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cell := range matrix {
+			if !sameRow(decoded[cell], matrix[cell]) {
+				t.Fatalf("pick %v: cell %d decoded as %v, want %v", pick, cell, decoded[cell], matrix[cell])
+			}
+		}
+		archives[pick] = compressed
+	}
+
+	fellBack := 0
+	for cell, picked := range archives[true].CompressedRows {
+		delta := archives[false].CompressedRows[cell]
+		if len(picked.DeltaValues) > len(delta.DeltaValues) {
+			t.Errorf("cell %d stored in %d bytes, %d with its reference", cell, len(picked.DeltaValues), len(delta.DeltaValues))
+		}
+		if picked.RefCell != delta.RefCell {
+			if picked.RefCell != -1 {
+				t.Fatalf("cell %d references %d, %d without picking", cell, picked.RefCell, delta.RefCell)
+			}
+			fellBack++
+		}
+	}
+	if fellBack == 0 {
+		t.Error("no cell was smaller self-encoded")
+	}
+}
+
+// BenchmarkCompressRefWindow compresses one matrix with reference windows of
+// 0 (self-encoding only), 50 and every earlier cell, reporting the ratio each
+// buys with its time
+func BenchmarkCompressRefWindow(b *testing.B) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(1000, 1000, 0.9, 1)
+	windows := []struct {
+		name   string
+		window int
+	}{
+		{"0", 0},
+		{"50", 50},
+		{"full", -1},
+	}
+	for _, w := range windows {
+		b.Run(w.name, func(b *testing.B) {
+			var ratio float64
+			for i := 0; i < b.N; i++ {
+				c := NewCompressor(false, 0.1, 256)
+				c.SetRefWindow(w.window)
+				var err error
+				if ratio, err = c.EstimateRatio(matrix, geneNames, cellNames); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(ratio, "ratio")
+		})
+	}
+}
@@ -1,54 +1,444 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"runtime"
+	"sort"
 	"sync"
 	"time"
 )
 
-// Decompressor handles the decompression of single-cell RNA-seq data
-type Decompressor struct{}
+// Decompressor handles the decompression of single-cell RNA-seq data. Its
+// methods only read the archive, so one Decompressor may serve concurrent
+// Decompress, DecompressTo and DecompressCell calls on a shared archive.
+type Decompressor struct {
+	mu    sync.Mutex // Guards stats
+	stats DecompressionStats
+	cache *cellCache      // Decoded cells for DecompressCell, see SetCellCache
+	ctx   context.Context // Stops decoding once done, see SetContext
+}
 
 // NewDecompressor creates a new decompressor
 func NewDecompressor() *Decompressor {
-	return &Decompressor{}
+	return &Decompressor{ctx: context.Background()}
+}
+
+// SetContext makes Decompress, DecompressTo and DecompressGenes stop decoding
+// cells once ctx is done and return its error. Call it before sharing the
+// Decompressor between goroutines.
+func (d *Decompressor) SetContext(ctx context.Context) {
+	d.ctx = ctx
 }
 
-// Decompress decompresses the compressed data back to sparse matrix format
+// newHeaderDeltaEncoder creates the delta encoder that decodes an archive's
+// values as its header describes
+func newHeaderDeltaEncoder(header *Header) *DeltaEncoder {
+	// Before version 21 the fixed quantizer stored the count each bin stands
+	// for rather than the bin, so those values are read as they are
+	lossy := header.IsLossy && header.Version >= 21
+	deltaEncoder := NewDeltaEncoder(lossy, header.Threshold, header.QuantLevels)
+	deltaEncoder.SetValueCodec(header.ValueCodec)
+	return deltaEncoder
+}
+
+// Decompress decompresses the compressed data back to sparse matrix format.
+// The returned names are the archive's own slices; callers sharing the
+// archive must not modify them.
 func (d *Decompressor) Decompress(compressed *CompressedData) ([]SparseRow, []string, []string, error) {
 	startTime := time.Now()
 
 	matrix := make([]SparseRow, compressed.Header.NumCells)
+
+	// Create delta encoder for decompression
+	deltaEncoder := newHeaderDeltaEncoder(&compressed.Header)
+
+	// Archives whose references all point backwards decode in one forward pass
+	if compressed.Header.RefsOrdered {
+		if err := d.decompressForward(compressed, matrix, deltaEncoder); err != nil {
+			return nil, nil, nil, err
+		}
+		return d.finish(compressed, matrix, deltaEncoder, startTime)
+	}
+
+	// Medoids are the references of every other cell, so decode them first
+	isMedoid := make(map[int]bool, len(compressed.Medoids))
+	medoidCells := make([]int, 0, len(compressed.Medoids))
+	for _, cell := range compressed.Medoids {
+		if int(cell) >= len(matrix) {
+			return nil, nil, nil, corruptf("medoid cell %d out of range", cell)
+		}
+		isMedoid[int(cell)] = true
+		medoidCells = append(medoidCells, int(cell))
+	}
+	// Duplicates may copy any other cell, so they come last
+	otherCells := make([]int, 0, len(matrix)-len(medoidCells))
+	var duplicateCells []int
+	for i := range matrix {
+		switch {
+		case isMedoid[i]:
+		case i < len(compressed.CompressedRows) && compressed.CompressedRows[i].isDuplicate():
+			duplicateCells = append(duplicateCells, i)
+		default:
+			otherCells = append(otherCells, i)
+		}
+	}
+
+	for _, cells := range [][]int{medoidCells, otherCells, duplicateCells} {
+		if err := d.decompressCells(compressed, cells, matrix, deltaEncoder); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return d.finish(compressed, matrix, deltaEncoder, startTime)
+}
+
+// finish dequantizes the decoded matrix and records the statistics
+func (d *Decompressor) finish(compressed *CompressedData, matrix []SparseRow, deltaEncoder *DeltaEncoder, startTime time.Time) ([]SparseRow, []string, []string, error) {
+	// Apply dequantization if lossy compression was used
+	if len(compressed.LosslessCells) > 0 || len(compressed.LosslessGenes) > 0 {
+		for i := range matrix {
+			matrix[i] = d.dequantizeRow(i, matrix[i], compressed, deltaEncoder)
+		}
+	} else if compressed.Codebook != nil {
+		matrix = d.applyCodebook(matrix, compressed.Codebook)
+	} else if compressed.Header.IsLossy {
+		matrix = d.applyDequantization(matrix, deltaEncoder)
+	}
+
+	stats := newDecompressionStats(matrix, compressed.GeneNames, compressed.CellNames, time.Since(startTime))
+	d.mu.Lock()
+	d.stats = stats
+	d.mu.Unlock()
+	return matrix, compressed.GeneNames, compressed.CellNames, nil
+}
+
+// Stats returns statistics about the most recent Decompress or
+// DecompressGenes call to finish
+func (d *Decompressor) Stats() DecompressionStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// newDecompressionStats summarizes a finished decompression
+func newDecompressionStats(matrix []SparseRow, geneNames, cellNames []string, elapsed time.Duration) DecompressionStats {
+	stats := DecompressionStats{
+		DecompressedSize:  int64(EstimateOriginalSize(matrix, geneNames, cellNames)),
+		DecompressionTime: elapsed.Nanoseconds(),
+		NumCells:          uint32(len(matrix)),
+		NumGenes:          uint32(len(geneNames)),
+	}
+	if len(matrix) > 0 {
+		nonZeros := 0
+		for _, row := range matrix {
+			nonZeros += len(row.Indices)
+		}
+		stats.AvgGenesPerCell = float64(nonZeros) / float64(len(matrix))
+	}
+	return stats
+}
+
+// decompressForward decodes the cells in order, each from its already decoded
+// reference. It relies on Header.RefsOrdered and fails if a reference does not
+// precede its cell.
+func (d *Decompressor) decompressForward(compressed *CompressedData, matrix []SparseRow, deltaEncoder *DeltaEncoder) error {
+	if len(compressed.CompressedRows) < len(matrix) {
+		return corruptf("archive has %d rows for %d cells", len(compressed.CompressedRows), len(matrix))
+	}
+	for cellIdx := range matrix {
+		if err := d.ctx.Err(); err != nil {
+			return err
+		}
+		compressedRow := compressed.CompressedRows[cellIdx]
+		var reference *SparseRow
+		if ref := int(compressedRow.RefCell); ref >= 0 {
+			if ref >= cellIdx {
+				return corruptf("cell %d references cell %d, but the archive claims ordered references", cellIdx, ref)
+			}
+			reference = &matrix[ref]
+		} else if ref == meanRefCell {
+			reference = compressed.MeanCell
+		}
+
+		row, err := d.decompressCell(compressedRow, reference, deltaEncoder, &compressed.Header)
+		if err != nil {
+			return corruptf("error decompressing cell %d: %w", cellIdx, err)
+		}
+		matrix[cellIdx] = row
+	}
+	return nil
+}
+
+// DecompressTo decompresses the cells sequentially in output order and hands
+// each finished row to emit, so the full matrix is never held in memory. A
+// decoded row is only kept while later cells still reference it (medoids stay
+// for the whole run). This bounds memory by the live references rather than
+// the matrix size, but decodes on a single goroutine, so it is slower than
+// Decompress for archives that fit in memory.
+func (d *Decompressor) DecompressTo(compressed *CompressedData, emit func(cellIdx int, row SparseRow) error) error {
+	numCells := int(compressed.Header.NumCells)
+	if len(compressed.CompressedRows) < numCells {
+		return corruptf("archive has %d rows for %d cells", len(compressed.CompressedRows), numCells)
+	}
+
+	deltaEncoder := newHeaderDeltaEncoder(&compressed.Header)
+
+	// Count how many cells still need each row as a reference
+	pending := make([]int, numCells)
+	for i := 0; i < numCells; i++ {
+		ref := int(compressed.CompressedRows[i].RefCell)
+		if ref >= 0 && ref < numCells {
+			pending[ref]++
+		}
+	}
+
+	// cache holds decoded rows (in stored, pre-dequantization form) that are still referenced
+	cache := make(map[int]SparseRow)
+	var decode func(cellIdx int, depth int) (SparseRow, error)
+	decode = func(cellIdx int, depth int) (SparseRow, error) {
+		if row, ok := cache[cellIdx]; ok {
+			return row, nil
+		}
+		if depth > numCells {
+			return SparseRow{}, corruptf("reference cycle at cell %d", cellIdx)
+		}
+
+		compressedRow := compressed.CompressedRows[cellIdx]
+		var reference *SparseRow
+		if ref := int(compressedRow.RefCell); ref >= 0 && ref < numCells {
+			refRow, err := decode(ref, depth+1)
+			if err != nil {
+				return SparseRow{}, err
+			}
+			reference = &refRow
+		} else if ref == meanRefCell {
+			reference = compressed.MeanCell
+		}
+
+		row, err := d.decompressCell(compressedRow, reference, deltaEncoder, &compressed.Header)
+		if err != nil {
+			return SparseRow{}, corruptf("error decompressing cell %d: %w", cellIdx, err)
+		}
+		if pending[cellIdx] > 0 {
+			cache[cellIdx] = row
+		}
+		return row, nil
+	}
+
+	for i := 0; i < numCells; i++ {
+		if err := d.ctx.Err(); err != nil {
+			return err
+		}
+		row, err := decode(i, 0)
+		if err != nil {
+			return err
+		}
+
+		// Release the reference once its last referent has been decoded
+		if ref := int(compressed.CompressedRows[i].RefCell); ref >= 0 && ref < numCells {
+			pending[ref]--
+			if pending[ref] == 0 {
+				delete(cache, ref)
+			}
+		}
+
+		if err := emit(i, d.dequantizeRow(i, row, compressed, deltaEncoder)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DecompressGenes decompresses only the given stored genes of every cell into
+// a narrow matrix whose column i is geneIndices[i], e.g. a marker panel. Delta
+// rows need their reference's other genes, so every row is still decoded, but
+// through DecompressTo: only the narrow matrix and the live references are
+// held in memory.
+func (d *Decompressor) DecompressGenes(compressed *CompressedData, geneIndices []uint32) ([]SparseRow, error) {
+	startTime := time.Now()
+	column := make([]int32, compressed.Header.NumGenes)
+	for i := range column {
+		column[i] = -1
+	}
+	for i, gene := range geneIndices {
+		if gene >= compressed.Header.NumGenes {
+			return nil, fmt.Errorf("gene %d out of range [0, %d)", gene, compressed.Header.NumGenes)
+		}
+		if column[gene] >= 0 {
+			return nil, fmt.Errorf("gene %d requested twice", gene)
+		}
+		column[gene] = int32(i)
+	}
+	sorted := sort.SliceIsSorted(geneIndices, func(a, b int) bool { return geneIndices[a] < geneIndices[b] })
+
+	matrix := make([]SparseRow, compressed.Header.NumCells)
+	err := d.DecompressTo(compressed, func(cellIdx int, row SparseRow) error {
+		var narrow SparseRow
+		for i, gene := range row.Indices {
+			if int(gene) < len(column) && column[gene] >= 0 {
+				narrow.Indices = append(narrow.Indices, uint32(column[gene]))
+				narrow.Values = append(narrow.Values, row.Values[i])
+			}
+		}
+		if !sorted {
+			sort.Sort(byGeneIndex{&narrow})
+		}
+		matrix[cellIdx] = narrow
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	geneNames := make([]string, len(geneIndices))
+	for i, gene := range geneIndices {
+		if int(gene) < len(compressed.GeneNames) {
+			geneNames[i] = compressed.GeneNames[gene]
+		}
+	}
+	stats := newDecompressionStats(matrix, geneNames, compressed.CellNames, time.Since(startTime))
+	d.mu.Lock()
+	d.stats = stats
+	d.mu.Unlock()
+	return matrix, nil
+}
+
+// DecompressCell decompresses a single cell, decoding only the cells on its
+// reference chain, or with SetCellCache those below its nearest cached
+// ancestor. It is meant for peeking at or serving single cells; use
+// Decompress or DecompressTo for whole archives. Each call returns a fresh
+// row, so concurrent calls on one archive are safe.
+func (d *Decompressor) DecompressCell(compressed *CompressedData, cellIdx int) (SparseRow, error) {
+	numCells := int(compressed.Header.NumCells)
+	if cellIdx < 0 || cellIdx >= numCells || cellIdx >= len(compressed.CompressedRows) {
+		return SparseRow{}, fmt.Errorf("cell %d out of range [0, %d)", cellIdx, numCells)
+	}
+
+	deltaEncoder := newHeaderDeltaEncoder(&compressed.Header)
+
+	// Walk the chain up to a self-encoded cell, or to a cached one
+	var chain []int
+	var reference *SparseRow
+	for cell := cellIdx; ; {
+		if cached, ok := d.cache.get(compressed, cell); ok {
+			reference = &cached
+			break
+		}
+		chain = append(chain, cell)
+		ref := int(compressed.CompressedRows[cell].RefCell)
+		if ref < 0 || ref >= numCells {
+			if ref == meanRefCell {
+				reference = compressed.MeanCell
+			}
+			break
+		}
+		if len(chain) > numCells {
+			return SparseRow{}, corruptf("reference cycle at cell %d", cellIdx)
+		}
+		cell = ref
+	}
+
+	// Decode from the root back down to the requested cell
+	var row SparseRow
+	if len(chain) == 0 {
+		row = *reference
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		var err error
+		row, err = d.decompressCell(compressed.CompressedRows[chain[i]], reference, deltaEncoder, &compressed.Header)
+		if err != nil {
+			return SparseRow{}, corruptf("error decompressing cell %d: %w", chain[i], err)
+		}
+		d.cache.put(compressed, chain[i], row)
+		decoded := row
+		reference = &decoded
+	}
+
+	if d.cache != nil {
+		// The cache keeps row, so hand out a copy
+		row = SparseRow{
+			Indices: append([]uint32(nil), row.Indices...),
+			Values:  append([]uint32(nil), row.Values...),
+		}
+	}
+	return d.dequantizeRow(cellIdx, row, compressed, deltaEncoder), nil
+}
+
+// dequantizeRow maps a cell's stored row back to expression values
+func (d *Decompressor) dequantizeRow(cellIdx int, row SparseRow, compressed *CompressedData, deltaEncoder *DeltaEncoder) SparseRow {
+	var dequantized SparseRow
+	switch {
+	case compressed.isLosslessCell(cellIdx):
+		return row
+	case compressed.Codebook != nil:
+		dequantized = d.applyCodebook([]SparseRow{row}, compressed.Codebook)[0]
+	case compressed.Header.IsLossy:
+		dequantized = d.applyDequantization([]SparseRow{row}, deltaEncoder)[0]
+	default:
+		return row
+	}
+
+	// Lossless genes stored their original values
+	if len(compressed.LosslessGenes) > 0 {
+		for i, gene := range dequantized.Indices {
+			if compressed.isLosslessGene(gene) {
+				dequantized.Values[i] = row.Values[i]
+			}
+		}
+	}
+	return dequantized
+}
+
+// decompressCells decompresses the given cells into matrix using a worker pool
+func (d *Decompressor) decompressCells(
+	compressed *CompressedData,
+	cells []int,
+	matrix []SparseRow,
+	deltaEncoder *DeltaEncoder,
+) error {
 	numWorkers := runtime.NumCPU()
-	jobs := make(chan int, compressed.Header.NumCells)
+	jobs := make(chan int, len(cells))
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var decompressErr error
 
-	// Create delta encoder for decompression
-	deltaEncoder := NewDeltaEncoder(
-		compressed.Header.IsLossy,
-		compressed.Header.Threshold,
-		compressed.Header.QuantLevels,
-	)
-
 	// Start workers
 	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for cellIdx := range jobs {
+				if err := d.ctx.Err(); err != nil {
+					mu.Lock()
+					if decompressErr == nil {
+						decompressErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				compressedRow := compressed.CompressedRows[cellIdx]
+				var reference *SparseRow
+				if compressedRow.RefCell >= 0 && int(compressedRow.RefCell) < len(matrix) {
+					mu.Lock()
+					refRow := matrix[compressedRow.RefCell]
+					mu.Unlock()
+					reference = &refRow
+				} else if compressedRow.RefCell == meanRefCell {
+					reference = compressed.MeanCell
+				}
+
 				row, err := d.decompressCell(
-					compressed.CompressedRows[cellIdx],
-					matrix,
+					compressedRow,
+					reference,
 					deltaEncoder,
-					compressed.Header.NumGenes,
+					&compressed.Header,
 				)
 				if err != nil {
 					mu.Lock()
 					if decompressErr == nil {
-						decompressErr = fmt.Errorf("error decompressing cell %d: %w", cellIdx, err)
+						decompressErr = corruptf("error decompressing cell %d: %w", cellIdx, err)
 					}
 					mu.Unlock()
 					continue
@@ -62,47 +452,75 @@ func (d *Decompressor) Decompress(compressed *CompressedData) ([]SparseRow, []st
 	}
 
 	// Send jobs
-	for i := 0; i < int(compressed.Header.NumCells); i++ {
-		jobs <- i
+	for _, cellIdx := range cells {
+		jobs <- cellIdx
 	}
 	close(jobs)
 	wg.Wait()
 
-	if decompressErr != nil {
-		return nil, nil, nil, decompressErr
-	}
-
-	// Apply dequantization if lossy compression was used
-	if compressed.Header.IsLossy {
-		matrix = d.applyDequantization(matrix, deltaEncoder)
-	}
-
-	fmt.Printf("Decompression completed in %v\n", time.Since(startTime))
-	return matrix, compressed.GeneNames, compressed.CellNames, nil
+	return decompressErr
 }
 
-// decompressCell decompresses a single cell's expression profile
+// decompressCell decompresses a single cell's expression profile. reference is
+// the decoded reference cell or the mean cell, or nil when the row is
+// self-encoded.
 func (d *Decompressor) decompressCell(
 	compressedRow CompressedRow,
-	matrix []SparseRow,
+	reference *SparseRow,
 	deltaEncoder *DeltaEncoder,
-	numGenes uint32,
+	header *Header,
 ) (SparseRow, error) {
 	var result SparseRow
 
+	if compressedRow.RefCell == meanRefCell && reference == nil {
+		return result, corruptf("row references the mean cell, but the archive has none")
+	}
+
+	if compressedRow.isDuplicate() {
+		if reference == nil {
+			return result, corruptf("duplicate row without its reference cell")
+		}
+		result.Indices = append([]uint32(nil), reference.Indices...)
+		result.Values = append([]uint32(nil), reference.Values...)
+		return result, validateGeneIndices(compressedRow, result.Indices)
+	}
+
 	// Decompress gene indices using Elias-Fano decoding
 	if len(compressedRow.EliasGenes) > 0 {
-		decoder, err := NewEliasDecoder(compressedRow.EliasGenes)
+		data, err := eliasGenes(compressedRow, header)
 		if err != nil {
-			return result, fmt.Errorf("failed to create Elias-Fano decoder: %w", err)
+			return result, fmt.Errorf("failed to inflate gene indices: %w", err)
 		}
+		if header.GeneChunk > 0 {
+			if result.Indices, err = decodeGeneChunks(data, header.GeneChunk); err != nil {
+				return result, fmt.Errorf("failed to decode gene chunks: %w", err)
+			}
+		} else {
+			decoder, err := NewEliasDecoder(data)
+			if err != nil {
+				return result, fmt.Errorf("failed to create Elias-Fano decoder: %w", err)
+			}
 
-		geneIndices, err := decoder.Decode()
-		if err != nil {
-			return result, fmt.Errorf("failed to decode gene indices: %w", err)
+			geneIndices, err := decoder.Decode()
+			if err != nil {
+				return result, fmt.Errorf("failed to decode gene indices: %w", err)
+			}
+
+			result.Indices = geneIndices
 		}
+	}
 
-		result.Indices = geneIndices
+	if err := validateGeneIndices(compressedRow, result.Indices); err != nil {
+		return result, err
+	}
+
+	// Binary matrices store no values: every expressed gene has value 1
+	if header.IsBinary {
+		result.Values = make([]uint32, len(result.Indices))
+		for i := range result.Values {
+			result.Values[i] = 1
+		}
+		return result, nil
 	}
 
 	// Decompress expression values
@@ -112,14 +530,16 @@ func (d *Decompressor) decompressCell(
 			return result, fmt.Errorf("failed to decompress deltas: %w", err)
 		}
 
-		if compressedRow.RefCell >= 0 && int(compressedRow.RefCell) < len(matrix) {
+		if reference != nil {
 			// Reconstruct using reference cell and deltas
-			refCell := matrix[compressedRow.RefCell]
-			result = deltaEncoder.ReconstructFromDelta(refCell, deltas, result.Indices)
+			result, err = deltaEncoder.ReconstructFromDelta(*reference, deltas, result.Indices)
+			if err != nil {
+				return result, err
+			}
 		} else {
 			// No reference cell, deltas are the actual values
 			if len(deltas) != len(result.Indices) {
-				return result, fmt.Errorf("mismatch between number of genes (%d) and values (%d)", 
+				return result, corruptf("mismatch between number of genes (%d) and values (%d)", 
 					len(result.Indices), len(deltas))
 			}
 
@@ -147,6 +567,25 @@ func (d *Decompressor) decompressCell(
 	return result, nil
 }
 
+// validateGeneIndices checks the decoded gene indices against the row's stored
+// metadata and checks that they strictly increase, as every row must
+func validateGeneIndices(compressedRow CompressedRow, indices []uint32) error {
+	if uint32(len(indices)) != compressedRow.NumGenes {
+		return corruptf("corrupt row: decoded %d gene indices but row records %d",
+			len(indices), compressedRow.NumGenes)
+	}
+	if len(indices) > 0 && indices[len(indices)-1] != compressedRow.MaxGeneIndex {
+		return corruptf("corrupt row: decoded max gene index %d but row records %d",
+			indices[len(indices)-1], compressedRow.MaxGeneIndex)
+	}
+	for i := 1; i < len(indices); i++ {
+		if indices[i] <= indices[i-1] {
+			return corruptf("corrupt row: gene index %d follows %d", indices[i], indices[i-1])
+		}
+	}
+	return nil
+}
+
 // applyDequantization applies dequantization to restore approximate original values
 func (d *Decompressor) applyDequantization(matrix []SparseRow, deltaEncoder *DeltaEncoder) []SparseRow {
 	if !deltaEncoder.lossy {
@@ -166,3 +605,19 @@ func (d *Decompressor) applyDequantization(matrix []SparseRow, deltaEncoder *Del
 	}
 	return dequantized
 }
+
+// applyCodebook maps codebook bin indices back to their representative values
+func (d *Decompressor) applyCodebook(matrix []SparseRow, codebook *Codebook) []SparseRow {
+	dequantized := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		dequantizedValues := make([]uint32, len(row.Values))
+		for j, value := range row.Values {
+			dequantizedValues[j] = codebook.Dequantize(value)
+		}
+		dequantized[i] = SparseRow{
+			Indices: append([]uint32(nil), row.Indices...),
+			Values:  dequantizedValues,
+		}
+	}
+	return dequantized
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReads compresses a synthetic matrix with chain, medoid and
+// mean references, lossless and lossy, saves and reloads each archive, and
+// decodes random cells of it with DecompressCell from more goroutines than
+// most machines have cores, all sharing the archive and a Decompressor (with
+// a small cell cache for some archives, so that cells are evicted while
+// read), while some also run Decompress. Every cell must match a sequential
+// Decompress. Run it with go test -race to also detect data races.
+func TestConcurrentReads(t *testing.T) {
+	const (
+		workers = 16
+		queries = 4000
+		seed    = 42
+	)
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(500, 300, 0.9, seed)
+	tests := []struct {
+		name  string
+		lossy bool
+		mode  RefMode
+		cache int // Cell cache of the shared Decompressor, 0 for none
+	}{
+		{"chain", false, RefChain, 0},
+		{"chain lossy", true, RefChain, 0},
+		{"chain cached", false, RefChain, 64},
+		{"medoid", false, RefMedoid, 0},
+		{"mean lossy", true, RefMean, 0},
+		{"mean lossy cached", true, RefMean, 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressor := NewCompressor(tt.lossy, 0.1, 256)
+			compressor.SetRefMode(tt.mode, 16)
+			compressor.SetSeed(seed)
+			compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(t.TempDir(), "archive.scz")
+			if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := LoadCompressedData(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _, _, err := NewDecompressor().Decompress(loaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mismatches := concurrentReads(loaded, want, tt.cache, workers, queries, seed)
+			for i, mismatch := range mismatches {
+				if i == 20 {
+					t.Errorf("... %d more", len(mismatches)-i)
+					break
+				}
+				t.Error(mismatch)
+			}
+		})
+	}
+}
+
+// concurrentReads decodes n random cells of an archive with DecompressCell
+// from workers goroutines sharing one Decompressor, with a cell cache of
+// cacheSize cells; every eighth goroutine also decodes the whole archive. It
+// returns a description of each result that differs from want.
+func concurrentReads(compressed *CompressedData, want []SparseRow, cacheSize, workers, n int, seed int64) []string {
+	decompressor := NewDecompressor()
+	decompressor.SetCellCache(cacheSize)
+	var mu sync.Mutex
+	var mismatches []string
+	report := func(format string, args ...interface{}) {
+		mu.Lock()
+		mismatches = append(mismatches, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed + int64(worker)))
+			if worker%8 == 0 {
+				matrix, _, _, err := decompressor.Decompress(compressed)
+				if err != nil {
+					report("Decompress: %v", err)
+				}
+				for cell := range matrix {
+					if !sameRow(matrix[cell], want[cell]) {
+						report("Decompress: cell %d differs", cell)
+						break
+					}
+				}
+				decompressor.Stats()
+			}
+			for i := worker; i < n; i += workers {
+				cell := rng.Intn(len(want))
+				row, err := decompressor.DecompressCell(compressed, cell)
+				if err != nil {
+					report("DecompressCell %d: %v", cell, err)
+				} else if !sameRow(row, want[cell]) {
+					report("DecompressCell %d differs", cell)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	return mismatches
+}
+
+func TestValidateGeneIndices(t *testing.T) {
+	row := CompressedRow{NumGenes: 3, MaxGeneIndex: 9}
+	tests := []struct {
+		name    string
+		indices []uint32
+		wantErr bool
+	}{
+		{"valid", []uint32{1, 4, 9}, false},
+		{"too few", []uint32{4, 9}, true},
+		{"too many", []uint32{1, 2, 4, 9}, true},
+		{"wrong max", []uint32{1, 4, 8}, true},
+		{"repeated", []uint32{4, 4, 9}, true},
+		{"decreasing", []uint32{5, 4, 9}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateGeneIndices(row, tt.indices)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateGeneIndices(%v) = %v, want error %v", tt.indices, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrCorrupt) {
+				t.Errorf("error %v is not ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+// TestDecompressCorruptGeneMetadata alters the gene count or max gene index a
+// row records, which decoding must report as corruption rather than return a
+// wrong row
+func TestDecompressCorruptGeneMetadata(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(100, 60, 0.8, 1)
+	tests := []struct {
+		name    string
+		corrupt func(row *CompressedRow)
+	}{
+		{"gene count", func(row *CompressedRow) { row.NumGenes++ }},
+		{"max gene index", func(row *CompressedRow) { row.MaxGeneIndex++ }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, err := NewCompressor(false, 0.1, 256).Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cell := -1
+			for i, row := range compressed.CompressedRows {
+				if row.NumGenes > 0 && !row.isDuplicate() {
+					cell = i
+					break
+				}
+			}
+			if cell < 0 {
+				t.Fatal("no row stores its gene indices")
+			}
+			tt.corrupt(&compressed.CompressedRows[cell])
+
+			if _, _, _, err := NewDecompressor().Decompress(compressed); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Decompress: got %v, want ErrCorrupt", err)
+			}
+			if _, err := NewDecompressor().DecompressCell(compressed, cell); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("DecompressCell(%d): got %v, want ErrCorrupt", cell, err)
+			}
+		})
+	}
+}
+
+// TestDecompressContext checks that a done context stops every decoding path
+// with its own error rather than one reporting corruption
+func TestDecompressContext(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(100, 40, 0.8, 1)
+	compressed, err := NewCompressor(false, 0.1, 256).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unordered := *compressed
+	unordered.Header.RefsOrdered = false
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	decompressor := NewDecompressor()
+	decompressor.SetContext(ctx)
+
+	tests := []struct {
+		name   string
+		decode func() error
+	}{
+		{"forward", func() error {
+			_, _, _, err := decompressor.Decompress(compressed)
+			return err
+		}},
+		{"worker pool", func() error {
+			_, _, _, err := decompressor.Decompress(&unordered)
+			return err
+		}},
+		{"streaming", func() error {
+			return decompressor.DecompressTo(compressed, func(int, SparseRow) error { return nil })
+		}},
+		{"genes", func() error {
+			_, err := decompressor.DecompressGenes(compressed, []uint32{0, 1})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.decode()
+			if !errors.Is(err, context.Canceled) || errors.Is(err, ErrCorrupt) {
+				t.Errorf("got %v, want context.Canceled", err)
+			}
+		})
+	}
+}
+
+// TestDecompressGenes checks that a gene subset decodes to exactly the
+// requested columns, in the requested order, through chained and medoid
+// references, and that unknown or repeated genes are refused
+func TestDecompressGenes(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(200, 80, 0.8, 1)
+	panels := [][]uint32{{42, 7, 13, 0, 79}, {3, 4, 5}, {}}
+	for _, mode := range []RefMode{RefChain, RefMedoid} {
+		compressor := NewCompressor(false, 0, 0)
+		compressor.SetRefMode(mode, 3)
+		compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, panel := range panels {
+			narrow, err := NewDecompressor().DecompressGenes(compressed, panel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(narrow) != len(matrix) {
+				t.Fatalf("%v %v: %d cells, want %d", mode, panel, len(narrow), len(matrix))
+			}
+			for cell, row := range matrix {
+				var want SparseRow
+				for column, gene := range panel {
+					if value := rowValue(row, gene); value != 0 {
+						want.Indices = append(want.Indices, uint32(column))
+						want.Values = append(want.Values, value)
+					}
+				}
+				if fmt.Sprint(narrow[cell]) != fmt.Sprint(want) {
+					t.Fatalf("%v %v: cell %d = %v, want %v", mode, panel, cell, narrow[cell], want)
+				}
+			}
+		}
+
+		for _, panel := range [][]uint32{{1, 80}, {5, 2, 5}} {
+			if _, err := NewDecompressor().DecompressGenes(compressed, panel); err == nil {
+				t.Errorf("%v: DecompressGenes(%v) succeeded", mode, panel)
+			}
+		}
+	}
+}
+
+// TestDecompressTo checks that the streaming decoder emits every cell once,
+// in order, as Decompress decodes it, whether references point back, forward
+// to medoids or at quantized cells, and that an error from emit stops it
+func TestDecompressTo(t *testing.T) {
+	graduated, graduatedGenes, graduatedCells := graduatedMatrix(60, 400)
+	synthetic, syntheticGenes, syntheticCells := GenerateSyntheticMatrix(200, 80, 0.8, 1)
+	tests := []struct {
+		name      string
+		matrix    []SparseRow
+		geneNames []string
+		cellNames []string
+		lossy     bool
+		mode      RefMode
+	}{
+		{"chain", synthetic, syntheticGenes, syntheticCells, false, RefChain},
+		{"lossy chain", synthetic, syntheticGenes, syntheticCells, true, RefChain},
+		{"forward medoids", graduated, graduatedGenes, graduatedCells, false, RefMedoid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCompressor(tt.lossy, 2, 64)
+			c.SetRefMode(tt.mode, 2)
+			c.SetSimilarity(SimilarityWeightedJaccard)
+			compressed, err := c.Compress(tt.matrix, tt.geneNames, tt.cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			next := 0
+			err = NewDecompressor().DecompressTo(compressed, func(cell int, row SparseRow) error {
+				if cell != next {
+					return fmt.Errorf("emitted cell %d, want %d", cell, next)
+				}
+				if !sameRow(row, want[cell]) {
+					return fmt.Errorf("cell %d streamed as %v, want %v", cell, row, want[cell])
+				}
+				next++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next != len(tt.matrix) {
+				t.Fatalf("emitted %d cells, want %d", next, len(tt.matrix))
+			}
+
+			stop := errors.New("stop")
+			emitted := 0
+			err = NewDecompressor().DecompressTo(compressed, func(int, SparseRow) error {
+				emitted++
+				if emitted == 10 {
+					return stop
+				}
+				return nil
+			})
+			if err != stop || emitted != 10 {
+				t.Errorf("got %v after %d cells, want the emit error after 10", err, emitted)
+			}
+		})
+	}
+}
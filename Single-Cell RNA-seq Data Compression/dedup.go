@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// findDuplicates maps every cell whose genes and values exactly match an
+// earlier cell to the first such cell, and every other cell to -1. Such
+// cells are stored as duplicate rows (see CompressedRow.isDuplicate). Empty
+// cells cost nothing anyway and are left alone, as are the cells in
+// notDuplicates, which other cells must be able to reference before the
+// duplicates are decoded (medoids).
+func findDuplicates(matrix []SparseRow, notDuplicates []int) []int {
+	excluded := make(map[int]bool, len(notDuplicates))
+	for _, cell := range notDuplicates {
+		excluded[cell] = true
+	}
+
+	duplicateOf := make([]int, len(matrix))
+	firstByHash := make(map[uint64][]int) // Row hash -> first cells with that hash
+	for cell, row := range matrix {
+		duplicateOf[cell] = -1
+		if len(row.Indices) == 0 {
+			continue
+		}
+
+		hash := rowHash(row)
+		if !excluded[cell] {
+			for _, first := range firstByHash[hash] {
+				if sameRow(row, matrix[first]) {
+					duplicateOf[cell] = first
+					break
+				}
+			}
+		}
+		if duplicateOf[cell] < 0 {
+			firstByHash[hash] = append(firstByHash[hash], cell)
+		}
+	}
+	return duplicateOf
+}
+
+// rowHash hashes a row's genes and values
+func rowHash(row SparseRow) uint64 {
+	hasher := fnv.New64a()
+	var scratch [8]byte
+	for i, gene := range row.Indices {
+		binary.LittleEndian.PutUint32(scratch[:4], gene)
+		binary.LittleEndian.PutUint32(scratch[4:], row.Values[i])
+		hasher.Write(scratch[:])
+	}
+	return hasher.Sum64()
+}
+
+// sameRow reports whether two rows have identical genes and values
+func sameRow(a, b SparseRow) bool {
+	if len(a.Indices) != len(b.Indices) {
+		return false
+	}
+	for i := range a.Indices {
+		if a.Indices[i] != b.Indices[i] || a.Values[i] != b.Values[i] {
+			return false
+		}
+	}
+	return true
+}
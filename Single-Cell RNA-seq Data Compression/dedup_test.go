@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	a := SparseRow{Indices: []uint32{1, 4}, Values: []uint32{2, 3}}
+	b := SparseRow{Indices: []uint32{1, 4}, Values: []uint32{2, 5}}
+	c := SparseRow{Indices: []uint32{1, 5}, Values: []uint32{2, 3}}
+	tests := []struct {
+		name          string
+		matrix        []SparseRow
+		notDuplicates []int
+		want          []int
+	}{
+		{"none", []SparseRow{a, b, c}, nil, []int{-1, -1, -1}},
+		{"repeated", []SparseRow{a, b, a, a, b}, nil, []int{-1, -1, 0, 0, 1}},
+		{"same genes, other values", []SparseRow{a, b}, nil, []int{-1, -1}},
+		{"same values, other genes", []SparseRow{a, c}, nil, []int{-1, -1}},
+		{"empty cells", []SparseRow{{}, {}, a}, nil, []int{-1, -1, -1}},
+		{"excluded cell", []SparseRow{a, a, a}, []int{1}, []int{-1, -1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findDuplicates(tt.matrix, tt.notDuplicates); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findDuplicates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCompressDuplicateCells repeats cells of a matrix, which must be stored
+// as payload-free references to their first copy and decode exactly
+func TestCompressDuplicateCells(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(100, 50, 0.8, 1)
+	var copies []int // First copy of each appended duplicate
+	for _, first := range []int{3, 3, 40, 99} {
+		if len(matrix[first].Indices) == 0 {
+			t.Fatalf("cell %d is empty", first)
+		}
+		matrix = append(matrix, matrix[first])
+		cellNames = append(cellNames, cellNames[first]+"-copy")
+		copies = append(copies, first)
+	}
+
+	tests := []struct {
+		name string
+		mode RefMode
+	}{
+		{"chain", RefChain},
+		{"medoid", RefMedoid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressor := NewCompressor(false, 0.1, 256)
+			compressor.SetRefMode(tt.mode, 8)
+			compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := compressor.Stats().DuplicateCells; got < len(copies) {
+				t.Errorf("%d duplicate cells counted, want at least %d", got, len(copies))
+			}
+			for i, first := range copies {
+				row := compressed.CompressedRows[100+i]
+				if !row.isDuplicate() || row.RefCell != int32(first) || len(row.DeltaValues) > 0 {
+					t.Errorf("copy of cell %d stored as %+v", first, row)
+				}
+			}
+
+			decoded, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cell, row := range matrix {
+				if !sameRow(decoded[cell], row) {
+					t.Fatalf("cell %d decoded as %v, want %v", cell, decoded[cell], row)
+				}
+			}
+		})
+	}
+}
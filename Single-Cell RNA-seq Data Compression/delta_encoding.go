@@ -3,8 +3,8 @@ package main
 import (
 	"bytes"
 	"compress/flate"
+	"fmt"
 	"math"
-	"sort"
 )
 
 // DeltaEncoder handles delta encoding between similar cells
@@ -12,6 +12,9 @@ type DeltaEncoder struct {
 	threshold   float64
 	quantLevels uint32
 	lossy       bool
+	metric      SimilarityMetric
+	codec       ValueCodec
+	exactGenes  []bool // Genes whose deltas the lossy threshold keeps, nil for none
 }
 
 // NewDeltaEncoder creates a new delta encoder
@@ -23,7 +26,21 @@ func NewDeltaEncoder(lossy bool, threshold float64, quantLevels uint32) *DeltaEn
 	}
 }
 
-// JaccardSimilarity calculates the Jaccard similarity between two gene sets
+// SetSimilarity selects the metric used to pick reference cells
+func (de *DeltaEncoder) SetSimilarity(metric SimilarityMetric) {
+	de.metric = metric
+}
+
+// SetValueCodec selects how CompressDeltas codes the values and how
+// DecompressDeltas expects them
+func (de *DeltaEncoder) SetValueCodec(codec ValueCodec) {
+	de.codec = codec
+}
+
+// JaccardSimilarity calculates the Jaccard similarity between two gene sets.
+// Two empty sets count as identical (1.0), like the other metrics; empty
+// cells are never delta-encoded and are left out of medoid clustering, so
+// this only matters to callers comparing cells directly.
 func JaccardSimilarity(genesA, genesB []uint32) float64 {
 	if len(genesA) == 0 && len(genesB) == 0 {
 		return 1.0
@@ -55,18 +72,33 @@ func JaccardSimilarity(genesA, genesB []uint32) float64 {
 	return float64(intersection) / float64(union)
 }
 
-// FindBestReference finds the most similar cell to use as reference for delta encoding
+// FindBestReference finds the most similar cell to use as reference for delta encoding.
+// Ties in similarity go to the lowest candidate index so the choice does not
+// depend on the order candidates are passed in.
 func (de *DeltaEncoder) FindBestReference(targetCell SparseRow, candidates []SparseRow, candidateIndices []int) int {
-	if len(candidates) == 0 {
-		return -1
+	return de.BestReference(de.Similarities(targetCell, candidates), candidateIndices)
+}
+
+// Similarities returns the similarity of the target cell to each candidate
+func (de *DeltaEncoder) Similarities(targetCell SparseRow, candidates []SparseRow) []float64 {
+	similarities := make([]float64, len(candidates))
+	for i, candidate := range candidates {
+		similarities[i] = de.metric.Similarity(targetCell, candidate)
 	}
+	return similarities
+}
 
+// BestReference picks the reference from precomputed similarities, as
+// FindBestReference does
+func (de *DeltaEncoder) BestReference(similarities []float64, candidateIndices []int) int {
 	bestSimilarity := -1.0
 	bestIndex := -1
 
-	for i, candidate := range candidates {
-		similarity := JaccardSimilarity(targetCell.Indices, candidate.Indices)
-		if similarity > bestSimilarity && similarity > 0.1 { // Minimum similarity threshold
+	for i, similarity := range similarities {
+		if similarity <= 0.1 { // Minimum similarity threshold
+			continue
+		}
+		if similarity > bestSimilarity || (similarity == bestSimilarity && candidateIndices[i] < bestIndex) {
 			bestSimilarity = similarity
 			bestIndex = candidateIndices[i]
 		}
@@ -75,90 +107,92 @@ func (de *DeltaEncoder) FindBestReference(targetCell SparseRow, candidates []Spa
 	return bestIndex
 }
 
-// ComputeDelta computes the delta between two sparse rows
-func (de *DeltaEncoder) ComputeDelta(target, reference SparseRow) []int32 {
-	// Create maps for faster lookup
-	refMap := make(map[uint32]uint32)
-	for i, gene := range reference.Indices {
-		refMap[gene] = reference.Values[i]
-	}
+// ComputeDelta computes the delta between two sparse rows: one delta per
+// gene of the target, in the target's gene order, against the reference's
+// value for that gene (0 if the reference lacks it). Genes expressed only by
+// the reference need no delta, since the target's gene indices already show
+// them as zero. It fails if a delta does not fit in an int32, in which case
+// the cell must be self-encoded.
+func (de *DeltaEncoder) ComputeDelta(target, reference SparseRow) ([]int32, error) {
+	refValues := referenceValues(reference, target.Indices)
 
-	targetMap := make(map[uint32]uint32)
+	// Compute deltas
+	deltas := make([]int32, 0, len(target.Indices))
 	for i, gene := range target.Indices {
-		targetMap[gene] = target.Values[i]
-	}
+		targetVal := target.Values[i]
+		refVal := refValues[i]
 
-	// Find all genes that appear in either target or reference
-	allGenes := make(map[uint32]bool)
-	for _, gene := range target.Indices {
-		allGenes[gene] = true
-	}
-	for _, gene := range reference.Indices {
-		allGenes[gene] = true
-	}
-
-	// Convert to sorted slice
-	genes := make([]uint32, 0, len(allGenes))
-	for gene := range allGenes {
-		genes = append(genes, gene)
-	}
-	sort.Slice(genes, func(i, j int) bool { return genes[i] < genes[j] })
+		// Subtract in int64 so values above MaxInt32 cannot wrap around
+		delta := int64(targetVal) - int64(refVal)
+		if delta < math.MinInt32 || delta > math.MaxInt32 {
+			return nil, fmt.Errorf("delta %d for gene %d overflows int32", delta, gene)
+		}
 
-	// Compute deltas
-	deltas := make([]int32, 0, len(genes))
-	for _, gene := range genes {
-		targetVal := targetMap[gene]
-		refVal := refMap[gene]
-		
-		delta := int32(targetVal) - int32(refVal)
-		
 		// Apply lossy compression if enabled
-		if de.lossy && math.Abs(float64(delta)) < de.threshold {
+		if de.lossy && math.Abs(float64(delta)) < de.threshold && (de.exactGenes == nil || !de.exactGenes[gene]) {
 			delta = 0
 		}
-		
-		deltas = append(deltas, delta)
+
+		deltas = append(deltas, int32(delta))
 	}
 
-	return deltas
+	return deltas, nil
 }
 
-// QuantizeValue applies logarithmic quantization to a value
+// QuantizeValue maps a value to its bin on a logarithmic scale: bin q
+// stands for 2^(q*log2(levels)/(levels-1)) - 1, so levels bins cover counts
+// 0 to levels-1 and larger counts continue on the same scale. Decoding
+// thus changes value+1 by at most a factor 2^(log2(levels)/(levels-1)/2),
+// plus the rounding to a count. Fewer than two levels cannot represent
+// anything but zero, so values are then kept as is rather than fed through
+// a 0/0 scale.
 func (de *DeltaEncoder) QuantizeValue(value uint32) uint32 {
-	if !de.lossy || value == 0 {
+	if !de.lossy || value == 0 || de.quantLevels < 2 {
 		return value
 	}
 
 	// Logarithmic quantization
-	logVal := math.Log2(float64(value + 1))
+	logVal := math.Log2(float64(value) + 1)
 	maxLog := math.Log2(float64(de.quantLevels))
 	
-	quantized := uint32(math.Round(logVal / maxLog * float64(de.quantLevels-1)))
-	if quantized >= de.quantLevels {
-		quantized = de.quantLevels - 1
-	}
-
-	// Convert back to approximate original scale
-	return uint32(math.Pow(2, float64(quantized)*maxLog/float64(de.quantLevels-1))) - 1
+	return uint32(math.Round(logVal / maxLog * float64(de.quantLevels-1)))
 }
 
-// DequantizeValue reverses the quantization process
+// DequantizeValue maps a bin from QuantizeValue back to the count it
+// stands for
 func (de *DeltaEncoder) DequantizeValue(quantized uint32) uint32 {
-	if !de.lossy || quantized == 0 {
+	if !de.lossy || quantized == 0 || de.quantLevels < 2 {
 		return quantized
 	}
 
 	maxLog := math.Log2(float64(de.quantLevels))
 	logVal := float64(quantized) * maxLog / float64(de.quantLevels-1)
 	
-	return uint32(math.Pow(2, logVal)) - 1
+	return scaledCount(math.Round(math.Pow(2, logVal) - 1))
+}
+
+// scaledCount converts a rescaled value back to a count, saturating instead
+// of wrapping around: converting NaN, infinities or values beyond the uint32
+// range to uint32 gives arbitrary results in Go
+func scaledCount(value float64) uint32 {
+	switch {
+	case math.IsNaN(value) || value <= 0:
+		return 0
+	case value >= math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(value)
 }
 
-// CompressDeltas compresses a delta array using entropy coding
+// CompressDeltas compresses a delta array using entropy coding: zigzag
+// varints through flate, or Golomb-Rice codes (see SetValueCodec)
 func (de *DeltaEncoder) CompressDeltas(deltas []int32) ([]byte, error) {
 	if len(deltas) == 0 {
 		return []byte{}, nil
 	}
+	if de.codec == ValueCodecRice {
+		return EncodeRice(deltas), nil
+	}
 
 	var buf bytes.Buffer
 	
@@ -169,14 +203,21 @@ func (de *DeltaEncoder) CompressDeltas(deltas []int32) ([]byte, error) {
 	}
 
 	// Convert int32 deltas to bytes using variable-length encoding
+	var raw bytes.Buffer
 	for _, delta := range deltas {
-		if err := writeVarint(&buf, delta); err != nil {
+		if err := writeVarint(&raw, delta); err != nil {
 			writer.Close()
 			return nil, err
 		}
 	}
 
-	writer.Close()
+	if _, err := writer.Write(raw.Bytes()); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
@@ -185,6 +226,9 @@ func (de *DeltaEncoder) DecompressDeltas(compressed []byte) ([]int32, error) {
 	if len(compressed) == 0 {
 		return []int32{}, nil
 	}
+	if de.codec == ValueCodecRice {
+		return DecodeRice(compressed)
+	}
 
 	buf := bytes.NewReader(compressed)
 	reader := flate.NewReader(buf)
@@ -208,14 +252,24 @@ func (de *DeltaEncoder) DecompressDeltas(compressed []byte) ([]int32, error) {
 	return deltas, nil
 }
 
-// ReconstructFromDelta reconstructs the target cell from reference and delta
-func (de *DeltaEncoder) ReconstructFromDelta(reference SparseRow, deltas []int32, geneIndices []uint32) SparseRow {
-	// Create reference map
-	refMap := make(map[uint32]uint32)
-	for i, gene := range reference.Indices {
-		refMap[gene] = reference.Values[i]
+// ReconstructFromDelta reconstructs the target cell from reference and delta.
+// The deltas line up with the target's geneIndices, except in archives written
+// before that was fixed, which hold one delta per gene of the union of target
+// and reference genes; the two are told apart by the number of deltas. Genes
+// whose reconstructed value is not positive are dropped. The rest of the code
+// relies on rows having strictly increasing gene indices, so it fails if the
+// genes are not, rather than pairing them with the wrong reference values. It
+// also returns an error instead of a wrapped value if a reconstructed value
+// does not fit in a uint32. Both only happen with a corrupt archive.
+func (de *DeltaEncoder) ReconstructFromDelta(reference SparseRow, deltas []int32, geneIndices []uint32) (SparseRow, error) {
+	if len(deltas) != len(geneIndices) {
+		if union := unionGenes(geneIndices, reference.Indices); len(deltas) == len(union) {
+			geneIndices = union
+		}
 	}
 
+	refValues := referenceValues(reference, geneIndices)
+
 	// Apply deltas
 	var resultIndices []uint32
 	var resultValues []uint32
@@ -225,9 +279,17 @@ func (de *DeltaEncoder) ReconstructFromDelta(reference SparseRow, deltas []int32
 			break
 		}
 		
-		refVal := refMap[gene]
-		newVal := int32(refVal) + deltas[i]
-		
+		if i > 0 && gene <= geneIndices[i-1] {
+			return SparseRow{}, fmt.Errorf("gene indices not strictly increasing: %d after %d", gene, geneIndices[i-1])
+		}
+
+		// Add in int64: reference values above MaxInt32 are valid counts
+		refVal := refValues[i]
+		newVal := int64(refVal) + int64(deltas[i])
+		if newVal > math.MaxUint32 {
+			return SparseRow{}, fmt.Errorf("reconstructed value %d for gene %d overflows uint32", newVal, gene)
+		}
+
 		if newVal > 0 {
 			resultIndices = append(resultIndices, gene)
 			resultValues = append(resultValues, uint32(newVal))
@@ -237,7 +299,46 @@ func (de *DeltaEncoder) ReconstructFromDelta(reference SparseRow, deltas []int32
 	return SparseRow{
 		Indices: resultIndices,
 		Values:  resultValues,
+	}, nil
+}
+
+// referenceValues returns the reference's value for each of the sorted genes,
+// 0 where the reference lacks the gene. It walks both sorted index lists in
+// step, so encoder and decoder pair genes with reference values the same way
+// whatever the reference expresses besides.
+func referenceValues(reference SparseRow, genes []uint32) []uint32 {
+	values := make([]uint32, len(genes))
+	j := 0
+	for i, gene := range genes {
+		for j < len(reference.Indices) && reference.Indices[j] < gene {
+			j++
+		}
+		if j < len(reference.Indices) && reference.Indices[j] == gene {
+			values[i] = reference.Values[j]
+		}
+	}
+	return values
+}
+
+// unionGenes merges two sorted gene index lists into their sorted union
+func unionGenes(a, b []uint32) []uint32 {
+	union := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j >= len(b) || (i < len(a) && a[i] < b[j]):
+			union = append(union, a[i])
+			i++
+		case i >= len(a) || b[j] < a[i]:
+			union = append(union, b[j])
+			j++
+		default:
+			union = append(union, a[i])
+			i++
+			j++
+		}
 	}
+	return union
 }
 
 // writeVarint writes a signed integer using variable-length encoding
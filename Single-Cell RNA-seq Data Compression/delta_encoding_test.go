@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// quantizationBound is the largest error QuantizeValue allows when decoding
+// value with the given levels
+func quantizationBound(value, levels uint32) float64 {
+	step := math.Log2(float64(levels)) / float64(levels-1)
+	return (float64(value)+1)*(math.Pow(2, step/2)-1) + 1
+}
+
+func TestQuantizeValueRoundTrip(t *testing.T) {
+	values := []uint32{0, 1, 2, 3, 5, 10, 15, 16, 100, 255, 256, 544, 1000, 4095, 65535, 1 << 20, 1 << 31}
+	for _, levels := range []uint32{2, 3, 16, 64, 256, 4096} {
+		encoder := NewDeltaEncoder(true, 0.1, levels)
+		for _, value := range values {
+			bin := encoder.QuantizeValue(value)
+			if value > 0 && bin == 0 {
+				t.Errorf("levels %d: %d quantized to bin 0, which stands for an absent value", levels, value)
+			}
+			decoded := encoder.DequantizeValue(bin)
+			if diff := math.Abs(float64(decoded) - float64(value)); diff > quantizationBound(value, levels) {
+				t.Errorf("levels %d: %d decoded as %d (bin %d), off by %g, bound %g",
+					levels, value, decoded, bin, diff, quantizationBound(value, levels))
+			}
+		}
+	}
+}
+
+func TestQuantizeValueMonotonic(t *testing.T) {
+	encoder := NewDeltaEncoder(true, 0.1, 16)
+	previous := uint32(0)
+	for value := uint32(0); value < 5000; value++ {
+		bin := encoder.QuantizeValue(value)
+		if bin < previous {
+			t.Fatalf("%d quantized to bin %d, below bin %d of %d", value, bin, previous, value-1)
+		}
+		previous = bin
+	}
+}
+
+func TestQuantizeValueLossless(t *testing.T) {
+	tests := []struct {
+		name   string
+		lossy  bool
+		levels uint32
+	}{
+		{"lossless", false, 256},
+		{"one level", true, 1},
+		{"no levels", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder := NewDeltaEncoder(tt.lossy, 0.1, tt.levels)
+			for _, value := range []uint32{0, 1, 7, 1000, math.MaxUint32} {
+				if got := encoder.QuantizeValue(value); got != value {
+					t.Errorf("QuantizeValue(%d) = %d", value, got)
+				}
+				if got := encoder.DequantizeValue(value); got != value {
+					t.Errorf("DequantizeValue(%d) = %d", value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLossyCompressRoundTrip(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(300, 80, 0.8, 1)
+	for _, levels := range []uint32{16, 256, 4096} {
+		compressed, err := NewCompressor(true, 0.1, levels).Compress(matrix, geneNames, cellNames)
+		if err != nil {
+			t.Fatalf("levels %d: %v", levels, err)
+		}
+		decoded, _, _, err := NewDecompressor().Decompress(compressed)
+		if err != nil {
+			t.Fatalf("levels %d: %v", levels, err)
+		}
+		for cell, row := range matrix {
+			got := referenceValues(decoded[cell], row.Indices)
+			for i, value := range row.Values {
+				if diff := math.Abs(float64(got[i]) - float64(value)); diff > quantizationBound(value, levels) {
+					t.Fatalf("levels %d: cell %d gene %d: %d decoded as %d", levels, cell, row.Indices[i], value, got[i])
+				}
+			}
+		}
+	}
+}
+
+func TestLegacyLossyValuesReadAsStored(t *testing.T) {
+	header := Header{Version: 20, IsLossy: true, Threshold: 0.1, QuantLevels: 16}
+	encoder := newHeaderDeltaEncoder(&header)
+	for _, value := range []uint32{1, 3, 15} {
+		if got := encoder.DequantizeValue(value); got != value {
+			t.Errorf("version 20 value %d decoded as %d", value, got)
+		}
+	}
+}
+
+func TestReconstructFromDelta(t *testing.T) {
+	reference := SparseRow{Indices: []uint32{1, 3, 5}, Values: []uint32{4, 10, 6}}
+	tests := []struct {
+		name   string
+		genes  []uint32
+		deltas []int32
+		want   SparseRow
+	}{
+		{"only in target", []uint32{2}, []int32{7},
+			SparseRow{Indices: []uint32{2}, Values: []uint32{7}}},
+		{"only in reference", nil, nil,
+			SparseRow{}},
+		{"both increasing", []uint32{3}, []int32{5},
+			SparseRow{Indices: []uint32{3}, Values: []uint32{15}}},
+		{"both unchanged", []uint32{1, 3, 5}, []int32{0, 0, 0},
+			reference},
+		{"both decreasing", []uint32{3}, []int32{-9},
+			SparseRow{Indices: []uint32{3}, Values: []uint32{1}}},
+		{"both decreasing to zero", []uint32{1, 3}, []int32{-4, 2},
+			SparseRow{Indices: []uint32{3}, Values: []uint32{12}}},
+		{"both decreasing below zero", []uint32{1, 3}, []int32{-5, -11},
+			SparseRow{}},
+		{"mixed", []uint32{0, 1, 3, 4}, []int32{2, -4, 1, 9},
+			SparseRow{Indices: []uint32{0, 3, 4}, Values: []uint32{2, 11, 9}}},
+		{"legacy union deltas", []uint32{3}, []int32{1, -10, 2},
+			SparseRow{Indices: []uint32{1, 5}, Values: []uint32{5, 8}}},
+	}
+	encoder := NewDeltaEncoder(false, 0, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encoder.ReconstructFromDelta(reference, tt.deltas, tt.genes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameRow(got, tt.want) {
+				t.Errorf("reconstructed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestComputeDeltaRoundTrip checks that every target reconstructs exactly
+// from its deltas, whichever genes it shares with the reference
+func TestComputeDeltaRoundTrip(t *testing.T) {
+	reference := SparseRow{Indices: []uint32{1, 3, 5}, Values: []uint32{4, 10, math.MaxUint32}}
+	tests := []struct {
+		name   string
+		target SparseRow
+	}{
+		{"empty", SparseRow{}},
+		{"only in target", SparseRow{Indices: []uint32{0, 2, 6}, Values: []uint32{1, 2, 3}}},
+		{"only in reference", SparseRow{Indices: []uint32{3}, Values: []uint32{10}}},
+		{"both increasing", SparseRow{Indices: []uint32{1, 3}, Values: []uint32{9, 20}}},
+		{"both decreasing", SparseRow{Indices: []uint32{1, 3}, Values: []uint32{1, 2}}},
+		{"large counts", SparseRow{Indices: []uint32{3, 5}, Values: []uint32{1 << 30, math.MaxUint32 - 1}}},
+	}
+	encoder := NewDeltaEncoder(false, 0, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deltas, err := encoder.ComputeDelta(tt.target, reference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := encoder.ReconstructFromDelta(reference, deltas, tt.target.Indices)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameRow(got, tt.target) {
+				t.Errorf("reconstructed %v from deltas %v, want %v", got, deltas, tt.target)
+			}
+		})
+	}
+}
+
+func TestReconstructFromDeltaUnsortedGenes(t *testing.T) {
+	reference := SparseRow{Indices: []uint32{1, 3}, Values: []uint32{4, 10}}
+	tests := []struct {
+		name   string
+		genes  []uint32
+		deltas []int32
+	}{
+		{"decreasing", []uint32{3, 1}, []int32{1, 1}},
+		{"repeated", []uint32{2, 2}, []int32{1, 1}},
+		{"repeated after a dropped gene", []uint32{1, 1}, []int32{-4, 2}},
+	}
+	encoder := NewDeltaEncoder(false, 0, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := encoder.ReconstructFromDelta(reference, tt.deltas, tt.genes); err == nil {
+				t.Errorf("genes %v reconstructed as %v", tt.genes, got)
+			}
+		})
+	}
+}
+
+// TestDecompressedIndicesIncrease checks the invariant the rest of the code
+// relies on: every decoded row's gene indices strictly increase, whichever
+// references the cells were encoded against
+func TestDecompressedIndicesIncrease(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(300, 120, 0.9, 3)
+	tests := []struct {
+		name  string
+		lossy bool
+		mode  RefMode
+	}{
+		{"chain", false, RefChain},
+		{"chain lossy", true, RefChain},
+		{"medoid", false, RefMedoid},
+		{"mean lossy", true, RefMean},
+		{"gene-baseline", false, RefGeneBaseline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressor := NewCompressor(tt.lossy, 2, 64)
+			compressor.SetRefMode(tt.mode, 8)
+			compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cell, row := range decoded {
+				for i := 1; i < len(row.Indices); i++ {
+					if row.Indices[i] <= row.Indices[i-1] {
+						t.Fatalf("cell %d: gene %d follows %d", cell, row.Indices[i], row.Indices[i-1])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestJaccardSimilarity(t *testing.T) {
+	tests := []struct {
+		name           string
+		genesA, genesB []uint32
+		want           float64
+	}{
+		{"both empty", nil, nil, 1},
+		{"one empty", nil, []uint32{1}, 0},
+		{"disjoint", []uint32{1, 2}, []uint32{3}, 0},
+		{"half", []uint32{1, 2, 3}, []uint32{2, 3, 4}, 0.5},
+		{"identical", []uint32{1, 2}, []uint32{1, 2}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JaccardSimilarity(tt.genesA, tt.genesB); got != tt.want {
+				t.Errorf("JaccardSimilarity = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScaledCount(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  uint32
+	}{
+		{math.NaN(), 0},
+		{math.Inf(1), math.MaxUint32},
+		{math.Inf(-1), 0},
+		{-3, 0},
+		{0, 0},
+		{41, 41},
+		{math.MaxUint32, math.MaxUint32},
+		{1e20, math.MaxUint32},
+	}
+	for _, tt := range tests {
+		if got := scaledCount(tt.value); got != tt.want {
+			t.Errorf("scaledCount(%g) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestCompressDeltaOverflowFallsBack builds a reference chain whose values
+// climb past the int32 range: cell 1 can only be stored as deltas from cell 0,
+// and cell 2, whose genes match cell 1's best, is so far below it that the
+// deltas overflow. Cell 2 must fall back to self-encoding, and every cell must
+// decode exactly.
+func TestCompressDeltaOverflowFallsBack(t *testing.T) {
+	cells := []struct {
+		genes uint32
+		level uint32
+	}{
+		{60, 2_000_000_000},
+		{50, 4_000_000_000},
+		{50, 10},
+	}
+	matrix := make([]SparseRow, len(cells))
+	cellNames := make([]string, len(cells))
+	for cell, c := range cells {
+		for gene := uint32(0); gene < c.genes; gene++ {
+			matrix[cell].Indices = append(matrix[cell].Indices, gene)
+			matrix[cell].Values = append(matrix[cell].Values, c.level+gene)
+		}
+		cellNames[cell] = fmt.Sprintf("Cell_%d", cell)
+	}
+	geneNames := make([]string, cells[0].genes)
+	for gene := range geneNames {
+		geneNames[gene] = fmt.Sprintf("Gene_%d", gene)
+	}
+
+	encoder := NewDeltaEncoder(false, 0, 0)
+	if best := encoder.FindBestReference(matrix[2], matrix[:2], []int{0, 1}); best != 1 {
+		t.Fatalf("cell 2's best reference is %d, want 1", best)
+	}
+	if _, err := encoder.ComputeDelta(matrix[2], matrix[1]); err == nil {
+		t.Fatal("deltas from cell 1 to cell 2 fit in an int32")
+	}
+
+	compressed, err := NewCompressor(false, 0, 256).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := compressed.CompressedRows[1].RefCell; ref != 0 {
+		t.Errorf("cell 1 references %d, want cell 0", ref)
+	}
+	if ref := compressed.CompressedRows[2].RefCell; ref != -1 {
+		t.Errorf("cell 2 references %d, want self-encoded", ref)
+	}
+
+	decoded, _, _, err := NewDecompressor().Decompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cell := range matrix {
+		if !sameRow(decoded[cell], matrix[cell]) {
+			t.Errorf("cell %d decoded as %v, want %v", cell, decoded[cell], matrix[cell])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// DType is the value type of the original matrix, recorded so typed exports
+// can restore it. Values are always stored as uint32 counts internally.
+type DType uint8
+
+const (
+	// DTypeUnknown marks archives written before the dtype was recorded;
+	// they export as uint32
+	DTypeUnknown DType = iota
+	DTypeUint8
+	DTypeUint16
+	DTypeUint32
+	DTypeFloat32
+	DTypeFloat64
+)
+
+var dtypeNames = map[DType]string{
+	DTypeUnknown: "unknown",
+	DTypeUint8:   "uint8",
+	DTypeUint16:  "uint16",
+	DTypeUint32:  "uint32",
+	DTypeFloat32: "float32",
+	DTypeFloat64: "float64",
+}
+
+// String returns the dtype's name as accepted by ParseDType
+func (d DType) String() string {
+	if name, ok := dtypeNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("dtype(%d)", uint8(d))
+}
+
+// ParseDType parses a dtype name such as "uint16" or "float32"
+func ParseDType(name string) (DType, error) {
+	for dtype, dtypeName := range dtypeNames {
+		if dtype != DTypeUnknown && dtypeName == name {
+			return dtype, nil
+		}
+	}
+	return DTypeUnknown, fmt.Errorf("unknown dtype %q; use uint8, uint16, uint32, float32 or float64", name)
+}
+
+// maxValue returns the largest count the dtype can hold exactly
+func (d DType) maxValue() uint64 {
+	switch d {
+	case DTypeUint8:
+		return math.MaxUint8
+	case DTypeUint16:
+		return math.MaxUint16
+	case DTypeFloat32:
+		return 1 << 24 // Largest run of exactly representable integers
+	default:
+		return math.MaxUint32
+	}
+}
+
+// DetectDType returns the smallest unsigned integer dtype that holds every
+// value in the matrix. Inputs hold whole counts (fractions are rejected on
+// load, or truncated with LoadOptions.LenientValues), so a float dtype can
+// only be recorded through an explicit override.
+func DetectDType(matrix []SparseRow) DType {
+	var maxValue uint32
+	for _, row := range matrix {
+		for _, value := range row.Values {
+			if value > maxValue {
+				maxValue = value
+			}
+		}
+	}
+
+	switch {
+	case maxValue <= math.MaxUint8:
+		return DTypeUint8
+	case maxValue <= math.MaxUint16:
+		return DTypeUint16
+	default:
+		return DTypeUint32
+	}
+}
+
+// checkDType verifies that every value of the matrix fits the dtype
+func checkDType(matrix []SparseRow, dtype DType) error {
+	limit := dtype.maxValue()
+	for i, row := range matrix {
+		for j, value := range row.Values {
+			if uint64(value) > limit {
+				return fmt.Errorf("cell %d gene %d: value %d does not fit dtype %s",
+					i, row.Indices[j], value, dtype)
+			}
+		}
+	}
+	return nil
+}
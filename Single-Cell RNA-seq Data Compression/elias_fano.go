@@ -2,10 +2,20 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"fmt"
+	"math"
+	"math/bits"
+	"runtime"
+	"sync"
 )
 
+// parallelDecodeThreshold is the sequence length from which Decode splits the
+// high-bits walk across goroutines. Below it the goroutine overhead outweighs
+// the gain; only very dense cells reach it.
+const parallelDecodeThreshold = 1 << 14
+
 // EliasEncoder handles Elias-Fano encoding of sorted integer sequences
 type EliasEncoder struct {
 	universe uint32
@@ -13,20 +23,51 @@ type EliasEncoder struct {
 	lowBits  uint32
 }
 
+// LowBitsStrategy selects how an EliasEncoder chooses its low-bit width
+type LowBitsStrategy int
+
+const (
+	// LowBitsHeuristic uses ceil(log2(u/k)) - 1
+	LowBitsHeuristic LowBitsStrategy = iota
+	// LowBitsFloorLog uses the textbook floor(log2(u/k))
+	LowBitsFloorLog
+	// LowBitsSearch tries nearby widths and keeps the smallest encoding
+	LowBitsSearch
+	// LowBitsFixed uses a caller-provided width
+	LowBitsFixed
+)
+
 // NewEliasEncoder creates a new Elias-Fano encoder
 func NewEliasEncoder(universe, count uint32) *EliasEncoder {
+	return NewEliasEncoderWithStrategy(universe, count, LowBitsHeuristic)
+}
+
+// NewEliasEncoderWithStrategy creates a new Elias-Fano encoder whose low-bit
+// width is derived from the universe/count ratio using the given strategy.
+// LowBitsSearch and LowBitsFixed need the sequence or a width, so they fall
+// back to the heuristic here; use BestLowBits or NewEliasEncoderWithLowBits.
+func NewEliasEncoderWithStrategy(universe, count uint32, strategy LowBitsStrategy) *EliasEncoder {
+	if strategy == LowBitsFloorLog {
+		return NewEliasEncoderWithLowBits(universe, count, floorLog2Ratio(universe, count))
+	}
+
 	lowBits := uint32(0)
 	if count > 0 && universe > count {
-		// Calculate l = floor(log2(u/k))
+		// Calculate l = ceil(log2(u/k)) - 1
 		ratio := universe / count
-		for (1 << lowBits) < ratio {
-			lowBits++
-		}
+		lowBits = uint32(bits.Len32(ratio - 1))
 		if lowBits > 0 {
 			lowBits--
 		}
 	}
+	return NewEliasEncoderWithLowBits(universe, count, lowBits)
+}
 
+// NewEliasEncoderWithLowBits creates a new Elias-Fano encoder with an explicit low-bit width
+func NewEliasEncoderWithLowBits(universe, count, lowBits uint32) *EliasEncoder {
+	if lowBits > 31 {
+		lowBits = 31
+	}
 	return &EliasEncoder{
 		universe: universe,
 		count:    count,
@@ -34,6 +75,74 @@ func NewEliasEncoder(universe, count uint32) *EliasEncoder {
 	}
 }
 
+// floorLog2Ratio calculates l = floor(log2(u/k)), or 0 when u <= k
+func floorLog2Ratio(universe, count uint32) uint32 {
+	lowBits := uint32(0)
+	if count > 0 && universe > count {
+		lowBits = uint32(bits.Len32(universe/count)) - 1
+	}
+	return lowBits
+}
+
+// EncodedSize returns the number of bytes Encode produces for this encoder's parameters
+func (e *EliasEncoder) EncodedSize() int {
+	if e.count == 0 {
+		return 0
+	}
+	lowBitsSize, highBitsSize := e.bitSizes()
+	lowWords := (lowBitsSize + 63) / 64
+	highWords := (highBitsSize + 63) / 64
+	return eliasHeaderSize + 4 + int(lowWords)*8 + 4 + int(highWords)*8
+}
+
+// bitSizes returns the lengths of the low and high bit arrays. They are
+// computed in 64 bits: a wide universe with few low bits, or many elements
+// with many low bits, needs more bits than a BitArray can hold.
+func (e *EliasEncoder) bitSizes() (uint64, uint64) {
+	lowBitsSize := uint64(e.count) * uint64(e.lowBits)
+	highBitsSize := uint64(e.count) + uint64(e.universe>>e.lowBits) + 1
+	return lowBitsSize, highBitsSize
+}
+
+// checkBitSizes returns an error if either bit array needs more than the
+// math.MaxUint32 bits a BitArray can hold
+func (e *EliasEncoder) checkBitSizes() error {
+	lowBitsSize, highBitsSize := e.bitSizes()
+	if lowBitsSize > math.MaxUint32 || highBitsSize > math.MaxUint32 {
+		return fmt.Errorf("universe %d with %d values and %d low bits needs %d low and %d high bits, more than %d",
+			e.universe, e.count, e.lowBits, lowBitsSize, highBitsSize, uint32(math.MaxUint32))
+	}
+	return nil
+}
+
+// LowBits returns the low-bit width used by the encoder
+func (e *EliasEncoder) LowBits() uint32 {
+	return e.lowBits
+}
+
+// BestLowBits picks the low-bit width that minimizes the encoded size of the
+// sequence, trying widths around floor(log2(u/k))
+func BestLowBits(sequence []uint32, universe uint32) uint32 {
+	count := uint32(len(sequence))
+	center := floorLog2Ratio(universe, count)
+
+	start := uint32(0)
+	if center > 2 {
+		start = center - 2
+	}
+
+	best := center
+	bestSize := -1
+	for lowBits := start; lowBits <= center+2 && lowBits <= 31; lowBits++ {
+		size := NewEliasEncoderWithLowBits(universe, count, lowBits).EncodedSize()
+		if bestSize < 0 || size < bestSize {
+			best = lowBits
+			bestSize = size
+		}
+	}
+	return best
+}
+
 // Encode compresses a sorted sequence of integers using Elias-Fano encoding
 func (e *EliasEncoder) Encode(sequence []uint32) ([]byte, error) {
 	if len(sequence) == 0 {
@@ -54,53 +163,75 @@ func (e *EliasEncoder) Encode(sequence []uint32) ([]byte, error) {
 		}
 	}
 
+	// Both bit arrays must fit a BitArray; otherwise the sizes below would
+	// wrap and the high bits would be cut short without a decode error
+	if err := e.checkBitSizes(); err != nil {
+		return nil, err
+	}
+	lowBitsSize, highBitsSize := e.bitSizes()
+
 	var buf bytes.Buffer
 
 	// Write header information
-	binary.Write(&buf, binary.LittleEndian, e.universe)
-	binary.Write(&buf, binary.LittleEndian, e.count)
-	binary.Write(&buf, binary.LittleEndian, e.lowBits)
+	header := EliasRange{Universe: e.universe, Count: e.count, LowBits: e.lowBits}
+	buf.Write(header.bytes())
 
 	if e.count == 0 {
 		return buf.Bytes(), nil
 	}
 
 	// Encode low bits
-	lowBitsSize := e.count * e.lowBits
-	lowArray := NewBitArray(lowBitsSize)
-	
-	for i, val := range sequence {
-		lowValue := val & ((1 << e.lowBits) - 1)
-		lowArray.WriteBits(uint32(i)*e.lowBits, uint64(lowValue), e.lowBits)
+	lowArray := NewBitWriter(uint32(lowBitsSize))
+	for _, val := range sequence {
+		lowArray.WriteBits(uint64(val), e.lowBits)
 	}
 
-	// Encode high bits using unary encoding
-	highBitsSize := e.count + (e.universe >> e.lowBits) + 1
-	highArray := NewBitArray(highBitsSize)
-	
-	pos := uint32(0)
+	// Encode high bits in unary: each element's gap from the previous
+	// element's high value in zeros, then a one
+	highArray := NewBitWriter(uint32(highBitsSize))
+	previousHigh := uint32(0)
 	for _, val := range sequence {
-		highValue := val >> e.lowBits
-		pos += highValue
-		if pos < highBitsSize {
-			highArray.SetBit(pos)
-		}
-		pos++
+		high := val >> e.lowBits
+		highArray.WriteUnary(high - previousHigh)
+		previousHigh = high
+	}
+	if uint64(highArray.Len()) > highBitsSize {
+		return nil, fmt.Errorf("high bits overflow: %d written for %d", highArray.Len(), highBitsSize)
 	}
+	highArray.WriteZeros(uint32(highBitsSize) - highArray.Len())
 
 	// Write low bits array
-	if err := lowArray.WriteTo(&buf); err != nil {
+	if _, err := lowArray.BitArray().WriteTo(&buf); err != nil {
 		return nil, err
 	}
 
 	// Write high bits array
-	if err := highArray.WriteTo(&buf); err != nil {
+	if _, err := highArray.BitArray().WriteTo(&buf); err != nil {
 		return nil, err
 	}
 
 	return buf.Bytes(), nil
 }
 
+// bytes serializes the range as an encoded sequence's header
+func (r EliasRange) bytes() []byte {
+	header := make([]byte, eliasHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], r.Universe)
+	binary.LittleEndian.PutUint32(header[4:], r.Count)
+	binary.LittleEndian.PutUint32(header[8:], r.LowBits)
+	return header
+}
+
+// parseEliasRange reads the header written by EliasRange.bytes; data must
+// hold at least eliasHeaderSize bytes
+func parseEliasRange(data []byte) EliasRange {
+	return EliasRange{
+		Universe: binary.LittleEndian.Uint32(data[0:]),
+		Count:    binary.LittleEndian.Uint32(data[4:]),
+		LowBits:  binary.LittleEndian.Uint32(data[8:]),
+	}
+}
+
 // EliasDecoder handles Elias-Fano decoding
 type EliasDecoder struct {
 	universe uint32
@@ -112,23 +243,14 @@ type EliasDecoder struct {
 
 // NewEliasDecoder creates a new Elias-Fano decoder from encoded data
 func NewEliasDecoder(data []byte) (*EliasDecoder, error) {
-	if len(data) < 12 { // 3 uint32s
-		return nil, fmt.Errorf("encoded data too short")
+	if len(data) < eliasHeaderSize {
+		return nil, corruptf("encoded data too short")
 	}
 
-	buf := bytes.NewReader(data)
-	decoder := &EliasDecoder{}
-
 	// Read header
-	if err := binary.Read(buf, binary.LittleEndian, &decoder.universe); err != nil {
-		return nil, err
-	}
-	if err := binary.Read(buf, binary.LittleEndian, &decoder.count); err != nil {
-		return nil, err
-	}
-	if err := binary.Read(buf, binary.LittleEndian, &decoder.lowBits); err != nil {
-		return nil, err
-	}
+	header := parseEliasRange(data)
+	buf := bytes.NewReader(data[eliasHeaderSize:])
+	decoder := &EliasDecoder{universe: header.Universe, count: header.Count, lowBits: header.LowBits}
 
 	if decoder.count == 0 {
 		return decoder, nil
@@ -136,13 +258,13 @@ func NewEliasDecoder(data []byte) (*EliasDecoder, error) {
 
 	// Read low bits array
 	decoder.lowArray = &BitArray{}
-	if err := decoder.lowArray.ReadFrom(buf); err != nil {
+	if _, err := decoder.lowArray.ReadFrom(buf); err != nil {
 		return nil, err
 	}
 
 	// Read high bits array
 	decoder.highArray = &BitArray{}
-	if err := decoder.highArray.ReadFrom(buf); err != nil {
+	if _, err := decoder.highArray.ReadFrom(buf); err != nil {
 		return nil, err
 	}
 
@@ -155,35 +277,97 @@ func (d *EliasDecoder) Decode() ([]uint32, error) {
 		return []uint32{}, nil
 	}
 
+	if d.count >= parallelDecodeThreshold && runtime.NumCPU() > 1 {
+		return d.decodeParallel()
+	}
+	return d.decodeSerial()
+}
+
+// decodeSerial decodes the sequence in one walk over the high-bits array
+func (d *EliasDecoder) decodeSerial() ([]uint32, error) {
 	result := make([]uint32, d.count)
 	
-	// Decode high bits to find positions
-	highPos := uint32(0)
+	// Each element's high part is the previous one's plus its unary gap
+	high := NewBitReader(d.highArray)
+	low := NewBitReader(d.lowArray)
 	currentHigh := uint32(0)
 	
 	for i := uint32(0); i < d.count; i++ {
-		// Find next set bit in high array
-		for highPos < d.highArray.Size && !d.highArray.GetBit(highPos) {
-			highPos++
-			currentHigh++
-		}
-		
-		if highPos >= d.highArray.Size {
-			return nil, fmt.Errorf("unexpected end of high bits array")
+		gap, ok := high.ReadUnary()
+		if !ok {
+			return nil, corruptf("unexpected end of high bits array")
 		}
+		currentHigh += gap
 		
-		// Get low bits for this element
-		lowValue := d.lowArray.ReadBits(i*d.lowBits, d.lowBits)
+		// A truncated low array decodes as zeros rather than out of bounds
+		lowValue, _ := low.ReadBits(d.lowBits)
 		
 		// Combine high and low parts
 		result[i] = (currentHigh << d.lowBits) | uint32(lowValue)
-		
-		highPos++
 	}
 
 	return result, nil
 }
 
+// decodeParallel decodes the sequence with the high-bits array split into
+// contiguous word ranges, one per goroutine. A popcount prefix over the words
+// gives the rank of each range's first set bit, which is the index of the
+// first element the range decodes, so the ranges are independent.
+func (d *EliasDecoder) decodeParallel() ([]uint32, error) {
+	words := d.highArray.Data
+	if d.highArray.Size%64 != 0 && len(words) > 0 {
+		// Bits past Size are never set by the encoder, but don't trust the input
+		words = append([]uint64(nil), words...)
+		words[len(words)-1] &= (1 << (d.highArray.Size % 64)) - 1
+	}
+
+	// ranks[w] is the number of set bits before word w
+	ranks := make([]uint32, len(words)+1)
+	for w, word := range words {
+		ranks[w+1] = ranks[w] + uint32(bits.OnesCount64(word))
+	}
+	if ranks[len(words)] < d.count {
+		return nil, corruptf("unexpected end of high bits array")
+	}
+
+	result := make([]uint32, d.count)
+	numWorkers := runtime.NumCPU()
+	chunk := (len(words) + numWorkers - 1) / numWorkers
+	var wg sync.WaitGroup
+
+	for start := 0; start < len(words); start += chunk {
+		end := start + chunk
+		if end > len(words) {
+			end = len(words)
+		}
+		if ranks[start] >= d.count {
+			break
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			i := ranks[start]
+			for w := start; w < end && i < d.count; w++ {
+				word := words[w]
+				for word != 0 && i < d.count {
+					pos := uint32(w*64 + bits.TrailingZeros64(word))
+					word &= word - 1
+
+					// The element's high part is the number of zeros before its bit
+					high := pos - i
+					lowValue := d.lowArray.ReadBits(i*d.lowBits, d.lowBits)
+					result[i] = (high << d.lowBits) | uint32(lowValue)
+					i++
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	return result, nil
+}
+
 // Access provides random access to the i-th element without full decoding
 func (d *EliasDecoder) Access(index uint32) (uint32, error) {
 	if index >= d.count {
@@ -228,7 +412,58 @@ func (d *EliasDecoder) Size() uint32 {
 	return d.count
 }
 
+// LowBits returns the low-bit width of the encoded sequence
+func (d *EliasDecoder) LowBits() uint32 {
+	return d.lowBits
+}
+
 // Universe returns the universe size of the encoded sequence
 func (d *EliasDecoder) Universe() uint32 {
 	return d.universe
 }
+
+// DeflateEliasFano runs encoded Elias-Fano bytes through flate as a second
+// entropy-coding stage.
+//
+// This is a negative result. On a 1000x2000 synthetic matrix (~195 genes per
+// cell) the gene index payload grows 3.6% and the archive 4.4%; on a binary
+// 500x3000 matrix the archive grows 5.6%. EF is within a fraction of a bit
+// per element of the information-theoretic bound, so flate finds little to
+// remove, and its per-stream overhead outweighs that. The archive blocks are
+// zlib-compressed as a whole anyway. Kept as an option for data with
+// strongly non-uniform low bits.
+func DeflateEliasFano(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// InflateEliasFano reverses DeflateEliasFano
+func InflateEliasFano(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// eliasGenes returns a row's raw Elias-Fano bytes, undoing the optional flate stage
+func eliasGenes(row CompressedRow, header *Header) ([]byte, error) {
+	if !header.EliasFlate || len(row.EliasGenes) == 0 {
+		return row.EliasGenes, nil
+	}
+	return InflateEliasFano(row.EliasGenes)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestEliasRangeBytes(t *testing.T) {
+	tests := []EliasRange{
+		{},
+		{Universe: 1000, Count: 10, LowBits: 6},
+		{Universe: math.MaxUint32, Count: math.MaxUint32, LowBits: 31},
+	}
+	for _, r := range tests {
+		t.Run(fmt.Sprintf("%+v", r), func(t *testing.T) {
+			data := r.bytes()
+			if len(data) != eliasHeaderSize {
+				t.Fatalf("%d header bytes, want %d", len(data), eliasHeaderSize)
+			}
+			if got := parseEliasRange(data); got != r {
+				t.Errorf("parsed %+v", got)
+			}
+		})
+	}
+}
+
+// TestEliasRangeHeader checks that encoded sequences start with the
+// EliasRange of their encoder, which the decoder reads back
+func TestEliasRangeHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		universe uint32
+		sequence []uint32
+		lowBits  int // Fixed low bits, -1 for the default
+	}{
+		{"single", 100, []uint32{42}, -1},
+		{"dense", 16, []uint32{0, 1, 2, 3, 5, 8, 13, 15}, -1},
+		{"sparse", 1 << 20, []uint32{7, 1000, 65536, 1<<20 - 1}, -1},
+		{"fixed low bits", 1000, []uint32{3, 300, 999}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count := uint32(len(tt.sequence))
+			encoder := NewEliasEncoder(tt.universe, count)
+			if tt.lowBits >= 0 {
+				encoder = NewEliasEncoderWithLowBits(tt.universe, count, uint32(tt.lowBits))
+			}
+			data, err := encoder.Encode(tt.sequence)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := EliasRange{Universe: tt.universe, Count: count, LowBits: encoder.LowBits()}
+			if got := parseEliasRange(data); got != want {
+				t.Errorf("header %+v, want %+v", got, want)
+			}
+
+			decoder, err := NewEliasDecoder(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := (EliasRange{decoder.Universe(), decoder.Size(), decoder.LowBits()}); got != want {
+				t.Errorf("decoder read %+v, want %+v", got, want)
+			}
+			decoded, err := decoder.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.sequence) {
+				t.Errorf("decoded %v, want %v", decoded, tt.sequence)
+			}
+		})
+	}
+
+	if _, err := NewEliasDecoder(make([]byte, eliasHeaderSize-1)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("short header: got %v, want ErrCorrupt", err)
+	}
+}
+
+// TestEliasEncodeOverflow checks that a low-bit width too narrow for the
+// universe fails to encode instead of cutting the high bits short
+func TestEliasEncodeOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		universe uint32
+		sequence []uint32
+		lowBits  uint32
+		wantErr  bool
+	}{
+		{"two values without low bits", math.MaxUint32, []uint32{0, math.MaxUint32 - 1}, 0, true},
+		{"one value without low bits", math.MaxUint32, []uint32{math.MaxUint32 - 1}, 0, true},
+		{"three values without low bits", math.MaxUint32, []uint32{1, 1 << 31, math.MaxUint32 - 1}, 0, true},
+		{"wide enough low bits", math.MaxUint32, []uint32{0, 1 << 31, math.MaxUint32 - 1}, 8, false},
+		{"small universe without low bits", 1000, []uint32{0, 500, 999}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder := NewEliasEncoderWithLowBits(tt.universe, uint32(len(tt.sequence)), tt.lowBits)
+			data, err := encoder.Encode(tt.sequence)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("encoded %d bytes although the high bits overflow", len(data))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder, err := NewEliasDecoder(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := decoder.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.sequence) {
+				t.Errorf("decoded %v, want %v", decoded, tt.sequence)
+			}
+		})
+	}
+}
+
+// TestEliasBitSizeBoundary pins the exact limits of the size check: the high
+// bits, count + (universe >> lowBits) + 1, and the low bits, count * lowBits,
+// may each reach math.MaxUint32 but not one bit more. Shapes that just fit
+// are only checked, since encoding them would allocate half a gigabyte; the
+// first shape that overflows must also be refused by Encode itself.
+func TestEliasBitSizeBoundary(t *testing.T) {
+	tests := []struct {
+		name                     string
+		universe, count, lowBits uint32
+		wantHigh, wantLow        uint64
+		fits                     bool
+	}{
+		{"high bits just fit", math.MaxUint32 - 3, 2, 0, math.MaxUint32, 0, true},
+		{"high bits one over", math.MaxUint32 - 2, 2, 0, math.MaxUint32 + 1, 0, false},
+		{"shifted high bits just fit", math.MaxUint32, 1<<31 - 1, 1, math.MaxUint32, 1<<31 - 1, true},
+		{"shifted high bits one over", math.MaxUint32, 1 << 31, 1, math.MaxUint32 + 1, 1 << 31, false},
+		{"low bits just fit", math.MaxUint32, 1431655765, 3, 1431655765 + 536870911 + 1, math.MaxUint32, true},
+		{"low bits one element over", math.MaxUint32, 1431655766, 3, 1431655766 + 536870911 + 1, math.MaxUint32 + 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder := NewEliasEncoderWithLowBits(tt.universe, tt.count, tt.lowBits)
+			low, high := encoder.bitSizes()
+			if high != tt.wantHigh || low != tt.wantLow {
+				t.Fatalf("bit sizes low %d, high %d; want %d and %d", low, high, tt.wantLow, tt.wantHigh)
+			}
+			if err := encoder.checkBitSizes(); (err == nil) != tt.fits {
+				t.Errorf("checkBitSizes: %v, want fits %v", err, tt.fits)
+			}
+		})
+	}
+
+	// The smallest rejected high-bit shape, with a real sequence
+	encoder := NewEliasEncoderWithLowBits(math.MaxUint32-2, 2, 0)
+	if data, err := encoder.Encode([]uint32{0, math.MaxUint32 - 3}); err == nil {
+		t.Errorf("encoded %d bytes with %d high bits", len(data), uint64(math.MaxUint32)+1)
+	}
+}
+
+// denseSequence returns count sorted values with random gaps of 1 to maxGap,
+// and a universe just past the last of them
+func denseSequence(count, maxGap int, seed int64) ([]uint32, uint32) {
+	rng := rand.New(rand.NewSource(seed))
+	sequence := make([]uint32, count)
+	value := uint32(rng.Intn(maxGap))
+	for i := range sequence {
+		sequence[i] = value
+		value += uint32(1 + rng.Intn(maxGap))
+	}
+	return sequence, value
+}
+
+// TestEliasDecodeParallel checks that the parallel decode of sequences at and
+// above parallelDecodeThreshold matches the serial walk, including sequences
+// whose high-bits array ends partway through its last word
+func TestEliasDecodeParallel(t *testing.T) {
+	tests := []struct {
+		name   string
+		count  int
+		maxGap int
+	}{
+		{"threshold", parallelDecodeThreshold, 2},
+		{"threshold plus odd", parallelDecodeThreshold + 37, 40},
+		{"dense row", 55000, 1},
+		{"near full", 60000, 3},
+	}
+	partialWords := 0
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sequence, universe := denseSequence(tt.count, tt.maxGap, int64(i))
+			data, err := NewEliasEncoder(universe, uint32(len(sequence))).Encode(sequence)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder, err := NewEliasDecoder(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoder.highArray.Size%64 != 0 {
+				partialWords++
+			}
+
+			serial, err := decoder.decodeSerial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parallel, err := decoder.decodeParallel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(serial, sequence) {
+				t.Fatal("serial decode differs from the encoded sequence")
+			}
+			if !reflect.DeepEqual(parallel, serial) {
+				for j := range serial {
+					if parallel[j] != serial[j] {
+						t.Fatalf("element %d decoded as %d in parallel, %d serially", j, parallel[j], serial[j])
+					}
+				}
+			}
+
+			// With too few set bits, both walks report corruption
+			words := decoder.highArray.Data
+			for w := len(words) / 2; w < len(words); w++ {
+				words[w] = 0
+			}
+			if _, err := decoder.decodeSerial(); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("serial decode of damaged high bits: got %v, want ErrCorrupt", err)
+			}
+			if _, err := decoder.decodeParallel(); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("parallel decode of damaged high bits: got %v, want ErrCorrupt", err)
+			}
+		})
+	}
+	if partialWords == 0 {
+		t.Error("no sequence ended its high bits partway through a word")
+	}
+}
+
+// BenchmarkDecode decodes a 55000-of-60000 gene row, far above
+// parallelDecodeThreshold, with each walk
+func BenchmarkDecode(b *testing.B) {
+	// Every gene but one in twelve is expressed
+	var sequence []uint32
+	for gene := uint32(0); gene < 60000; gene++ {
+		if gene%12 != 5 {
+			sequence = append(sequence, gene)
+		}
+	}
+	data, err := NewEliasEncoder(60000, uint32(len(sequence))).Encode(sequence)
+	if err != nil {
+		b.Fatal(err)
+	}
+	decoder, err := NewEliasDecoder(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	walks := []struct {
+		name   string
+		decode func() ([]uint32, error)
+	}{
+		{"serial", decoder.decodeSerial},
+		{"parallel", decoder.decodeParallel},
+	}
+	for _, walk := range walks {
+		b.Run(walk.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := walk.decode(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEncode encodes a 10000-element sequence, and packs its low bits
+// both with word-at-a-time WriteBits and with the per-bit SetBit loop
+// WriteBits replaced
+func BenchmarkEncode(b *testing.B) {
+	sequence, universe := denseSequence(10000, 40, 1)
+	encoder := NewEliasEncoder(universe, uint32(len(sequence)))
+	lowBits := encoder.LowBits()
+	lowMask := uint32(1)<<lowBits - 1
+
+	b.Run("Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := encoder.Encode(sequence); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("WriteBits", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			low := NewBitArray(uint32(len(sequence)) * lowBits)
+			for j, value := range sequence {
+				low.WriteBits(uint32(j)*lowBits, uint64(value&lowMask), lowBits)
+			}
+		}
+	})
+	b.Run("SetBit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			low := NewBitArray(uint32(len(sequence)) * lowBits)
+			for j, value := range sequence {
+				for bit := uint32(0); bit < lowBits; bit++ {
+					if value>>bit&1 == 1 {
+						low.SetBit(uint32(j)*lowBits + bit)
+					}
+				}
+			}
+		}
+	})
+}
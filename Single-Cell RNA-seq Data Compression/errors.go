@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Kinds of errors loading and decoding return, for callers that handle them
+// differently (errors.Is(err, ErrCorrupt) and so on). The messages still
+// describe the specific problem. Failures of the file system itself are
+// returned as the *fs.PathError and friends of package os.
+var (
+	// ErrCorrupt marks archives whose contents are inconsistent: references
+	// or sizes out of range, malformed payloads. Checksum mismatches and
+	// truncation are corruption too.
+	ErrCorrupt = errors.New("corrupt archive")
+	// ErrChecksumMismatch marks an archive section failing its CRC
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrTruncated marks archives that end before their last row
+	ErrTruncated = errors.New("truncated archive")
+	// ErrUnsupportedFormat marks inputs this build cannot read: unknown file
+	// types, newer archive versions, unknown codecs
+	ErrUnsupportedFormat = errors.New("unsupported format")
+)
+
+// kindError is an error of one of the kinds above. It keeps the message and
+// the wrapped errors of the specific problem.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether the error is of the target kind
+func (e *kindError) Is(target error) bool {
+	if target == ErrCorrupt {
+		return e.kind == ErrCorrupt || e.kind == ErrChecksumMismatch || e.kind == ErrTruncated
+	}
+	return target == e.kind
+}
+
+// corruptf formats an ErrCorrupt error
+func corruptf(format string, args ...interface{}) error {
+	return &kindError{ErrCorrupt, fmt.Errorf(format, args...)}
+}
+
+// checksumf formats an ErrChecksumMismatch error
+func checksumf(format string, args ...interface{}) error {
+	return &kindError{ErrChecksumMismatch, fmt.Errorf(format, args...)}
+}
+
+// truncatedf formats an ErrTruncated error
+func truncatedf(format string, args ...interface{}) error {
+	return &kindError{ErrTruncated, fmt.Errorf(format, args...)}
+}
+
+// unsupportedf formats an ErrUnsupportedFormat error
+func unsupportedf(format string, args ...interface{}) error {
+	return &kindError{ErrUnsupportedFormat, fmt.Errorf(format, args...)}
+}
+
+// eofAsTruncated wraps an error reading data the archive says is there,
+// reporting running out of data as ErrTruncated
+func eofAsTruncated(err error, format string, args ...interface{}) error {
+	args = append(args, err)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return truncatedf(format+": %w", args...)
+	}
+	return fmt.Errorf(format+": %w", args...)
+}
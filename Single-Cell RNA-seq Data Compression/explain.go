@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// findCell returns the index of the cell called name, or, if no cell has
+// that name, of the cell numbered name (counting from 1)
+func findCell(cd *CompressedData, name string) (int, error) {
+	for i, cellName := range cd.CellNames {
+		if cellName == name {
+			return i, nil
+		}
+	}
+	numCells := int(cd.Header.NumCells)
+	if number, err := strconv.Atoi(name); err == nil && number >= 1 && number <= numCells {
+		return number - 1, nil
+	}
+	return 0, fmt.Errorf("no cell named %q, nor a cell number from 1 to %d", name, numCells)
+}
+
+// ExplainCell writes how one cell of an archive was encoded: the encoding
+// path and reference, the similarity of the decoded cell to its reference,
+// the Elias-Fano parameters of its gene indices, the sizes of its stored
+// payloads and the values it decodes to
+func ExplainCell(w io.Writer, cd *CompressedData, cell int) error {
+	info, err := cd.Inspect()
+	if err != nil {
+		return err
+	}
+	if cell < 0 || cell >= len(info.Cells) {
+		return fmt.Errorf("cell %d out of range [0, %d)", cell, len(info.Cells))
+	}
+	encoding := info.Cells[cell]
+	row := cd.CompressedRows[cell]
+
+	decompressor := NewDecompressor()
+	decoded, err := decompressor.DecompressCell(cd, cell)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Cell %d of %d: %s\n", cell+1, cd.Header.NumCells, explainName(cd.CellNames, cell))
+	var reference *SparseRow
+	switch encoding.Method {
+	case "self":
+		fmt.Fprintf(w, "Encoding: self (gene indices and values stored as they are)\n")
+	case "delta", "duplicate":
+		ref := int(encoding.RefCell)
+		if encoding.Method == "delta" {
+			fmt.Fprintf(w, "Encoding: delta against cell %d (%s), reference chain depth %d\n",
+				ref+1, explainName(cd.CellNames, ref), encoding.Depth)
+		} else {
+			fmt.Fprintf(w, "Encoding: duplicate of cell %d (%s), nothing stored\n", ref+1, explainName(cd.CellNames, ref))
+		}
+		refRow, err := decompressor.DecompressCell(cd, ref)
+		if err != nil {
+			return fmt.Errorf("reference cell %d: %w", ref+1, err)
+		}
+		reference = &refRow
+	case "mean":
+		fmt.Fprintf(w, "Encoding: delta against the archive's mean cell\n")
+		reference = cd.MeanCell
+	case "empty":
+		fmt.Fprintf(w, "Encoding: empty (no expressed genes)\n")
+	}
+	if reference != nil {
+		// The archive does not record which metric picked the reference
+		fmt.Fprintf(w, "Similarity to reference: jaccard %.4f, weighted-jaccard %.4f, cosine %.4f\n",
+			SimilarityJaccard.Similarity(decoded, *reference),
+			SimilarityWeightedJaccard.Similarity(decoded, *reference),
+			SimilarityCosine.Similarity(decoded, *reference))
+	}
+
+	switch {
+	case cd.Header.IsBinary:
+		fmt.Fprintf(w, "Values: binary archive, every expressed gene is 1\n")
+	case !cd.Header.IsLossy:
+		fmt.Fprintf(w, "Values: lossless\n")
+	case cd.isLosslessCell(cell):
+		fmt.Fprintf(w, "Values: stored losslessly in a lossy archive (-lossy-maxerr)\n")
+	case cd.Codebook != nil:
+		fmt.Fprintf(w, "Values: quantized with a %d-level adaptive codebook\n", len(cd.Codebook.Representatives))
+	default:
+		fmt.Fprintf(w, "Values: quantized (threshold %g, %d levels)\n", cd.Header.Threshold, cd.Header.QuantLevels)
+	}
+
+	fmt.Fprintf(w, "Genes: %d\n", row.NumGenes)
+	if len(row.EliasGenes) > 0 {
+		ranges, err := cd.rowRanges(row)
+		if err != nil {
+			return err
+		}
+		for i, r := range ranges {
+			prefix := "Elias-Fano"
+			if len(ranges) > 1 {
+				prefix = fmt.Sprintf("Elias-Fano chunk %d", i+1)
+			}
+			fmt.Fprintf(w, "%s: universe %d, count %d, low bits %d\n", prefix, r.Universe, r.Count, r.LowBits)
+		}
+	}
+	fmt.Fprintf(w, "Stored: %d index bytes, %d value bytes\n", encoding.IndexBytes, encoding.ValueBytes)
+
+	fmt.Fprintf(w, "Decoded values:\n")
+	for i, gene := range decoded.Indices {
+		fmt.Fprintf(w, "  %s\t%d\n", explainGeneName(cd.GeneNames, gene), decoded.Values[i])
+	}
+	return nil
+}
+
+// explainName returns a cell's name, or Cell_N if the archive has none
+func explainName(cellNames []string, cell int) string {
+	if cell < len(cellNames) {
+		return cellNames[cell]
+	}
+	return fmt.Sprintf("Cell_%d", cell+1)
+}
+
+// explainGeneName returns a gene's name, or Gene_N if the archive has none
+func explainGeneName(geneNames []string, gene uint32) string {
+	if int(gene) < len(geneNames) {
+		return geneNames[gene]
+	}
+	return fmt.Sprintf("Gene_%d", gene+1)
+}
+
+// explainFile prints ExplainCell for the cell of an archive given by name
+// or number
+func explainFile(inputFile, cellName string, w io.Writer) error {
+	compressed, err := LoadCompressedData(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to load compressed file: %w", err)
+	}
+	cell, err := findCell(compressed, cellName)
+	if err != nil {
+		return err
+	}
+	return ExplainCell(w, compressed, cell)
+}
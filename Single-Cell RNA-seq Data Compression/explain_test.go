@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// explainMatrix returns cells that encode in every way -explain reports: a
+// self-encoded first cell, a near copy delta-encoded against it, an exact
+// copy stored as a duplicate and an empty cell
+func explainMatrix() ([]SparseRow, []string, []string) {
+	var first, second SparseRow
+	for gene := uint32(0); gene < 200; gene += 4 {
+		first.Indices = append(first.Indices, gene)
+		first.Values = append(first.Values, 50+gene)
+		second.Indices = append(second.Indices, gene)
+		second.Values = append(second.Values, 50+gene)
+	}
+	second.Values[3]++
+	third := SparseRow{Indices: append([]uint32(nil), first.Indices...), Values: append([]uint32(nil), first.Values...)}
+	geneNames := make([]string, 200)
+	for gene := range geneNames {
+		geneNames[gene] = fmt.Sprintf("G%d", gene)
+	}
+	return []SparseRow{first, second, third, {}}, geneNames, []string{"AAAC-1", "AAAG-1", "AAAT-1", "AACA-1"}
+}
+
+func TestFindCell(t *testing.T) {
+	matrix, geneNames, cellNames := explainMatrix()
+	compressed, err := NewCompressor(false, 0, 0).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"AAAG-1": 1, "AACA-1": 3, "1": 0, "3": 2} {
+		got, err := findCell(compressed, name)
+		if err != nil || got != want {
+			t.Errorf("findCell(%q) = %d, %v; want %d", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"TTTT-1", "0", "5"} {
+		if _, err := findCell(compressed, name); err == nil || !strings.Contains(err.Error(), "nor a cell number from 1 to 4") {
+			t.Errorf("findCell(%q): got %v, want a no-such-cell error", name, err)
+		}
+	}
+}
+
+// TestExplainCell checks every line ExplainCell prints against the archive
+// for a cell of each encoding
+func TestExplainCell(t *testing.T) {
+	matrix, geneNames, cellNames := explainMatrix()
+	compressed, err := NewCompressor(false, 0, 0).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := compressed.CompressedRows
+	if rows[0].RefCell != -1 || rows[1].RefCell != 0 || !rows[2].isDuplicate() || rows[2].RefCell != 0 {
+		t.Fatalf("cells not stored as self, delta, duplicate: refs %d %d %d", rows[0].RefCell, rows[1].RefCell, rows[2].RefCell)
+	}
+
+	wantEncoding := []string{
+		"Encoding: self (gene indices and values stored as they are)",
+		"Encoding: delta against cell 1 (AAAC-1), reference chain depth 1",
+		"Encoding: duplicate of cell 1 (AAAC-1), nothing stored",
+		"Encoding: empty (no expressed genes)",
+	}
+	for cell, row := range matrix {
+		var out bytes.Buffer
+		if err := ExplainCell(&out, compressed, cell); err != nil {
+			t.Fatalf("cell %d: %v", cell, err)
+		}
+		text := out.String()
+		want := []string{
+			fmt.Sprintf("Cell %d of 4: %s\n", cell+1, cellNames[cell]),
+			wantEncoding[cell] + "\n",
+			"Values: lossless\n",
+			fmt.Sprintf("Genes: %d\n", len(row.Indices)),
+			fmt.Sprintf("Stored: %d index bytes, %d value bytes\n", len(rows[cell].EliasGenes), len(rows[cell].DeltaValues)),
+		}
+		if cell == 1 || cell == 2 {
+			want = append(want, fmt.Sprintf("Similarity to reference: jaccard 1.0000, weighted-jaccard %.4f, cosine %.4f\n",
+				SimilarityWeightedJaccard.Similarity(row, matrix[0]), SimilarityCosine.Similarity(row, matrix[0])))
+		}
+		decoded := "Decoded values:\n"
+		for i, gene := range row.Indices {
+			decoded += fmt.Sprintf("  G%d\t%d\n", gene, row.Values[i])
+		}
+		want = append(want, decoded)
+		for _, line := range want {
+			if !strings.Contains(text, line) {
+				t.Errorf("cell %d: output lacks %q:\n%s", cell, line, text)
+			}
+		}
+
+		hasElias := strings.Contains(text, "Elias-Fano:")
+		if hasElias != (len(rows[cell].EliasGenes) > 0) {
+			t.Errorf("cell %d: Elias-Fano line shown %v with %d stored index bytes", cell, hasElias, len(rows[cell].EliasGenes))
+		}
+		if hasElias {
+			var universe, count, lowBits uint32
+			line := text[strings.Index(text, "Elias-Fano:"):]
+			if _, err := fmt.Sscanf(line, "Elias-Fano: universe %d, count %d, low bits %d", &universe, &count, &lowBits); err != nil {
+				t.Fatalf("cell %d: %v", cell, err)
+			}
+			if count != 50 || universe <= 196 || lowBits > 5 {
+				t.Errorf("cell %d: universe %d, count %d, low bits %d for 50 genes up to 196", cell, universe, count, lowBits)
+			}
+		}
+	}
+
+	if err := ExplainCell(&bytes.Buffer{}, compressed, 4); err == nil {
+		t.Error("explained a cell past the end of the archive")
+	}
+}
+
+func TestRunExplain(t *testing.T) {
+	matrix, geneNames, cellNames := explainMatrix()
+	compressed, err := NewCompressor(false, 0, 0).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "m.scz")
+	if err := compressed.SaveToFile(archive, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var want bytes.Buffer
+	if err := ExplainCell(&want, compressed, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, cell := range []string{"AAAG-1", "2"} {
+		printed, err := captureStdout(t, func() error {
+			return run([]string{"-explain", "-input", archive, "-cell", cell})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if printed != want.String() {
+			t.Errorf("-cell %s printed\n%s\nwant\n%s", cell, printed, want.String())
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-explain", "-input", archive}, "-explain requires -input and -cell"},
+		{[]string{"-mode", "decompress", "-input", archive, "-cell", "1"}, "-cell requires -explain"},
+		{[]string{"-explain", "-input", archive, "-cell", "TTTT-1"}, `no cell named "TTTT-1"`},
+	}
+	for _, tt := range tests {
+		if err := run(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
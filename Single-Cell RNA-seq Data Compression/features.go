@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GeneFeatureTypes returns the feature type of every stored gene (after any
+// gene filtering), or nil if the archive has no feature types
+func (cd *CompressedData) GeneFeatureTypes() []string {
+	if len(cd.FeatureTypes) == 0 || len(cd.KeptGenes) == 0 {
+		return cd.FeatureTypes
+	}
+
+	types := make([]string, len(cd.KeptGenes))
+	for i, gene := range cd.KeptGenes {
+		types[i] = cd.FeatureTypes[gene]
+	}
+	return types
+}
+
+// modalityAliases maps the short modality names of -modality-opts to the
+// CellRanger feature types they stand for
+var modalityAliases = map[string]string{
+	"rna":    "Gene Expression",
+	"adt":    "Antibody Capture",
+	"crispr": "CRISPR Guide Capture",
+	"hto":    "Multiplexing Capture",
+	"atac":   "Peaks",
+}
+
+// ParseModalityOptions parses a -modality-opts spec such as
+// rna:lossy=true,adt:lossy=false into whether each feature type is stored
+// lossily. A modality is a short name from modalityAliases or a feature type
+// as written in features.tsv. lossy is the only per-modality setting: the
+// threshold, quantization levels and codecs apply to the whole archive.
+func ParseModalityOptions(spec string) (map[string]bool, error) {
+	lossy := make(map[string]bool)
+	for _, field := range strings.Split(spec, ",") {
+		modality, setting, ok := strings.Cut(strings.TrimSpace(field), ":")
+		key, value, hasValue := strings.Cut(setting, "=")
+		if !ok || modality == "" || !hasValue {
+			return nil, fmt.Errorf("%q is not modality:setting=value", field)
+		}
+		if key != "lossy" {
+			return nil, fmt.Errorf("unknown setting %q for %s; only lossy can differ between modalities", key, modality)
+		}
+		isLossy, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("lossy=%s for %s is not true or false", value, modality)
+		}
+		featureType := modality
+		if alias, ok := modalityAliases[strings.ToLower(modality)]; ok {
+			featureType = alias
+		}
+		if _, seen := lossy[featureType]; seen {
+			return nil, fmt.Errorf("%s is given more than once", modality)
+		}
+		lossy[featureType] = isLossy
+	}
+	return lossy, nil
+}
+
+// modalityLosslessGenes applies per-modality lossy settings to a matrix's
+// genes: it returns the names of the genes to store losslessly and whether
+// any modality is lossy, with feature types missing from lossy following
+// defaultLossy. Every modality given must occur in featureTypes.
+func modalityLosslessGenes(geneNames, featureTypes []string, lossy map[string]bool, defaultLossy bool) ([]string, bool, error) {
+	if len(featureTypes) == 0 {
+		return nil, false, fmt.Errorf("the input has no feature types (an .mtx input with a type column in features.tsv)")
+	}
+	present := make(map[string]bool)
+	for _, featureType := range featureTypes {
+		present[featureType] = true
+	}
+	for featureType := range lossy {
+		if !present[featureType] {
+			types := make([]string, 0, len(present))
+			for featureType := range present {
+				types = append(types, featureType)
+			}
+			sort.Strings(types)
+			return nil, false, fmt.Errorf("no %s features in the input; it has %s", featureType, strings.Join(types, ", "))
+		}
+	}
+
+	var lossless []string
+	anyLossy := false
+	for gene, featureType := range featureTypes {
+		isLossy, ok := lossy[featureType]
+		if !ok {
+			isLossy = defaultLossy
+		}
+		if isLossy {
+			anyLossy = true
+		} else {
+			lossless = append(lossless, geneNames[gene])
+		}
+	}
+	return lossless, anyLossy, nil
+}
+
+// FeatureSubset is the part of a matrix belonging to one feature type
+type FeatureSubset struct {
+	FeatureType string
+	Matrix      []SparseRow
+	GeneNames   []string
+}
+
+// SplitByFeatureType splits the matrix column-wise into one subset per
+// feature type, in order of first appearance, renumbering each subset's genes
+func SplitByFeatureType(matrix []SparseRow, geneNames, featureTypes []string) []FeatureSubset {
+	var subsets []FeatureSubset
+	subsetOf := make(map[string]int)
+	subsetOfGene := make([]int, len(featureTypes))
+	indexInSubset := make([]uint32, len(featureTypes))
+
+	for gene, featureType := range featureTypes {
+		idx, ok := subsetOf[featureType]
+		if !ok {
+			idx = len(subsets)
+			subsetOf[featureType] = idx
+			subsets = append(subsets, FeatureSubset{
+				FeatureType: featureType,
+				Matrix:      make([]SparseRow, len(matrix)),
+			})
+		}
+		subsetOfGene[gene] = idx
+		indexInSubset[gene] = uint32(len(subsets[idx].GeneNames))
+		subsets[idx].GeneNames = append(subsets[idx].GeneNames, geneNames[gene])
+	}
+
+	for cell, row := range matrix {
+		for i, gene := range row.Indices {
+			if int(gene) >= len(featureTypes) {
+				continue
+			}
+			subset := &subsets[subsetOfGene[gene]].Matrix[cell]
+			subset.Indices = append(subset.Indices, indexInSubset[gene])
+			subset.Values = append(subset.Values, row.Values[i])
+		}
+	}
+
+	return subsets
+}
+
+// featureTypeFilename derives the output file of one feature type subset,
+// e.g. out.csv and "Antibody Capture" give out_Antibody_Capture.csv
+func featureTypeFilename(filename, featureType string) string {
+	ext := filepath.Ext(filename)
+	clean := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' || r == '\t' {
+			return '_'
+		}
+		return r
+	}, featureType)
+	return strings.TrimSuffix(filename, ext) + "_" + clean + ext
+}
+
+// SaveFeaturesSidecar writes a CellRanger-style features file (id, name and
+// type columns) next to a decompressed matrix, e.g. out.csv -> out_features.tsv
+func SaveFeaturesSidecar(geneNames, featureTypes []string, matrixFilename string, opts SaveOptions) (string, error) {
+	if len(featureTypes) != len(geneNames) {
+		return "", fmt.Errorf("%d feature types for %d genes", len(featureTypes), len(geneNames))
+	}
+	geneNames, err := opts.outputNames(geneNames, "gene")
+	if err != nil {
+		return "", err
+	}
+
+	filename := strings.TrimSuffix(matrixFilename, filepath.Ext(matrixFilename)) + "_features.tsv"
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for i, name := range geneNames {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", name, name, featureTypes[i])
+	}
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	return filename, file.Close()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestModalityOptions checks -modality-opts on a synthetic RNA + ADT matrix,
+// the last 30 genes antibody features. For each spec it compresses the
+// matrix with the per-modality settings, saves and reloads the archive and
+// decompresses it: genes of lossless modalities must come back exactly, and
+// genes of lossy ones must match an archive quantized as a whole. The
+// threshold is 0, so lossy values do not depend on the references chosen,
+// and there are 4 quantization levels, so lossy values visibly change.
+func TestModalityOptions(t *testing.T) {
+	const adtGenes = 30
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(400, 300, 0.9, 42)
+	featureTypes := make([]string, len(geneNames))
+	for gene := range featureTypes {
+		featureTypes[gene] = modalityAliases["rna"]
+		if gene >= len(geneNames)-adtGenes {
+			featureTypes[gene] = modalityAliases["adt"]
+		}
+	}
+
+	// Every gene quantized, for the values of lossy modalities
+	quantized := modalityArchive(t, matrix, geneNames, cellNames, true, nil)
+
+	tests := []struct {
+		spec         string
+		defaultLossy bool
+		wantLossless int
+	}{
+		{"rna:lossy=true,adt:lossy=false", false, adtGenes},
+		{"adt:lossy=false", true, adtGenes},
+		{"Gene Expression:lossy=false,ADT:lossy=true", false, len(geneNames) - adtGenes},
+		{"rna:lossy=false,adt:lossy=false", true, len(geneNames)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			modalities, err := ParseModalityOptions(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lossless, anyLossy, err := modalityLosslessGenes(geneNames, featureTypes, modalities, tt.defaultLossy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lossless) != tt.wantLossless {
+				t.Errorf("%d lossless genes, want %d", len(lossless), tt.wantLossless)
+			}
+			decoded := modalityArchive(t, matrix, geneNames, cellNames, anyLossy, lossless)
+
+			exact := make(map[string]bool, len(lossless))
+			for _, name := range lossless {
+				exact[name] = true
+			}
+			changed := make(map[string]bool) // Lossy modalities whose values changed
+			for cell, row := range matrix {
+				want := SparseRow{Indices: row.Indices, Values: make([]uint32, len(row.Values))}
+				for j, gene := range row.Indices {
+					want.Values[j] = row.Values[j]
+					// With threshold 0, quantizing keeps every expressed gene
+					q := quantized[cell]
+					if anyLossy && !exact[geneNames[gene]] && j < len(q.Indices) && q.Indices[j] == gene {
+						want.Values[j] = q.Values[j]
+						if want.Values[j] != row.Values[j] {
+							changed[featureTypes[gene]] = true
+						}
+					}
+				}
+				if !sameRow(decoded[cell], want) {
+					t.Fatalf("cell %d is %v, want %v", cell, decoded[cell], want)
+				}
+			}
+			for featureType, isLossy := range modalities {
+				if isLossy && !changed[featureType] {
+					t.Errorf("no %s value was quantized", featureType)
+				}
+			}
+		})
+	}
+}
+
+func TestParseModalityOptionsInvalid(t *testing.T) {
+	for _, spec := range []string{"rna", "rna:lossy", "rna:lossy=maybe", "rna:levels=4", ":lossy=true", "rna:lossy=true,RNA:lossy=false"} {
+		if _, err := ParseModalityOptions(spec); err == nil {
+			t.Errorf("ParseModalityOptions(%q) succeeded", spec)
+		}
+	}
+}
+
+// modalityArchive compresses the matrix, storing the exact genes losslessly
+// in a lossy archive, saves and reloads it, and decompresses it
+func modalityArchive(t *testing.T, matrix []SparseRow, geneNames, cellNames []string, lossy bool, exact []string) []SparseRow {
+	t.Helper()
+	compressor := NewCompressor(lossy, 0, 4)
+	compressor.SetRefWindow(100)
+	compressor.SetLosslessGenes(exact)
+	compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Header.IsLossy != lossy {
+		t.Fatalf("archive is lossy %v, want %v", compressed.Header.IsLossy, lossy)
+	}
+	filename := filepath.Join(t.TempDir(), "archive.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCompressedData(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, _, err := NewDecompressor().Decompress(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Gene chunking splits the feature axis into ranges of Header.GeneChunk genes
+// and encodes each cell's genes per range with a local Elias-Fano universe.
+// A chunked row's EliasGenes holds
+//
+//	uvarint number of non-empty chunks
+//	per chunk: uvarint chunk number, uvarint payload length, Elias-Fano payload
+//
+// with gene indices relative to the start of their chunk. Chunking pays off
+// when the density differs between feature ranges (e.g. genes followed by
+// many sparse peaks); for uniformly spread genes the per-chunk headers make it
+// slightly larger.
+
+// encodeGeneChunks encodes sorted gene indices chunk by chunk. universe is
+// the size of the whole feature axis; newEncoder creates the encoder for one
+// chunk's local universe and indices.
+func encodeGeneChunks(indices []uint32, chunkSize, universe uint32, newEncoder func(universe uint32, indices []uint32) *EliasEncoder) ([]byte, error) {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	writeUvarint := func(value uint64) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], value)])
+	}
+
+	// Group the indices by chunk
+	type chunk struct {
+		number uint32
+		local  []uint32
+	}
+	var chunks []chunk
+	for _, gene := range indices {
+		number := gene / chunkSize
+		if len(chunks) == 0 || chunks[len(chunks)-1].number != number {
+			chunks = append(chunks, chunk{number: number})
+		}
+		last := &chunks[len(chunks)-1]
+		last.local = append(last.local, gene-number*chunkSize)
+	}
+
+	writeUvarint(uint64(len(chunks)))
+	for _, c := range chunks {
+		localUniverse := chunkSize
+		if start := c.number * chunkSize; universe-start < chunkSize {
+			localUniverse = universe - start
+		}
+		payload, err := newEncoder(localUniverse, c.local).Encode(c.local)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", c.number, err)
+		}
+		writeUvarint(uint64(c.number))
+		writeUvarint(uint64(len(payload)))
+		buf.Write(payload)
+	}
+	return buf.Bytes(), nil
+}
+
+// geneChunkPayloads splits a chunked row into its chunk numbers and
+// Elias-Fano payloads
+func geneChunkPayloads(data []byte) ([]uint32, [][]byte, error) {
+	reader := bytes.NewReader(data)
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, nil, corruptf("failed to read chunk count: %w", err)
+	}
+	if count > uint64(len(data)) {
+		return nil, nil, corruptf("chunk count %d exceeds the row size", count)
+	}
+
+	numbers := make([]uint32, 0, count)
+	payloads := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		number, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, nil, corruptf("failed to read chunk number: %w", err)
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, nil, corruptf("failed to read chunk length: %w", err)
+		}
+		if length > uint64(reader.Len()) {
+			return nil, nil, corruptf("chunk %d: payload of %d bytes exceeds the row", number, length)
+		}
+		if len(numbers) > 0 && uint32(number) <= numbers[len(numbers)-1] {
+			return nil, nil, corruptf("chunk %d out of order", number)
+		}
+		offset := len(data) - reader.Len()
+		numbers = append(numbers, uint32(number))
+		payloads = append(payloads, data[offset:offset+int(length)])
+		reader.Seek(int64(length), io.SeekCurrent)
+	}
+	return numbers, payloads, nil
+}
+
+// decodeGeneChunks decodes a chunked row back to global sorted gene indices
+func decodeGeneChunks(data []byte, chunkSize uint32) ([]uint32, error) {
+	numbers, payloads, err := geneChunkPayloads(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var indices []uint32
+	for i, payload := range payloads {
+		decoder, err := NewEliasDecoder(payload)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", numbers[i], err)
+		}
+		local, err := decoder.Decode()
+		if err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", numbers[i], err)
+		}
+		base := numbers[i] * chunkSize
+		for _, gene := range local {
+			if gene >= chunkSize {
+				return nil, corruptf("chunk %d: gene %d beyond the chunk size %d", numbers[i], gene, chunkSize)
+			}
+			indices = append(indices, base+gene)
+		}
+	}
+	return indices, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// widePeakMatrix returns cells over 30000 genes at 10% density followed by
+// numPeaks peaks at 0.2%, the shape gene chunking is for
+func widePeakMatrix(cells, numPeaks int, seed int64) ([]SparseRow, []string, []string) {
+	genes, geneNames, cellNames := GenerateSyntheticMatrix(cells, 30000, 0.9, seed)
+	peaks, peakNames, _ := GenerateSyntheticMatrix(cells, numPeaks, 0.998, seed+1)
+	matrix := make([]SparseRow, cells)
+	for cell := range matrix {
+		row := genes[cell]
+		for i, peak := range peaks[cell].Indices {
+			row.Indices = append(row.Indices, 30000+peak)
+			row.Values = append(row.Values, peaks[cell].Values[i])
+		}
+		matrix[cell] = row
+	}
+	for i, name := range peakNames {
+		peakNames[i] = "Peak" + name
+	}
+	return matrix, append(geneNames, peakNames...), cellNames
+}
+
+// TestGeneChunkRoundTrip compresses a wide matrix with and without gene
+// chunks, which must decode to the same matrix
+func TestGeneChunkRoundTrip(t *testing.T) {
+	matrix, featureNames, cellNames := widePeakMatrix(20, 20000, 1)
+	for _, chunk := range []uint32{0, 1000, 65536, 300000} {
+		t.Run(fmt.Sprint(chunk), func(t *testing.T) {
+			c := NewCompressor(false, 0.1, 256)
+			c.SetGeneChunk(chunk)
+			compressed, err := c.Compress(matrix, featureNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Header.GeneChunk != chunk {
+				t.Fatalf("header records chunks of %d, want %d", compressed.Header.GeneChunk, chunk)
+			}
+			decoded, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cell := range matrix {
+				if !sameRow(decoded[cell], matrix[cell]) {
+					t.Fatalf("cell %d decoded with %d genes, want %d", cell, len(decoded[cell].Indices), len(matrix[cell].Indices))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkGeneChunk compresses a 200000-feature matrix with several chunk
+// sizes, reporting the archive size next to the time
+func BenchmarkGeneChunk(b *testing.B) {
+	matrix, featureNames, cellNames := widePeakMatrix(200, 170000, 1)
+	for _, chunk := range []uint32{0, 16384, 65536} {
+		b.Run(fmt.Sprint(chunk), func(b *testing.B) {
+			var size int64
+			for i := 0; i < b.N; i++ {
+				c := NewCompressor(false, 0.1, 256)
+				c.SetGeneChunk(chunk)
+				compressed, err := c.Compress(matrix, featureNames, cellNames)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if size, err = compressed.SerializedSize(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "bytes")
+		})
+	}
+}
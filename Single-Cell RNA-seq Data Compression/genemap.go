@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GeneMap renames genes, e.g. from Ensembl IDs to gene symbols. Genes it does
+// not list keep their name.
+type GeneMap map[string]string
+
+// LoadGeneMap reads a two-column mapping file, old name then new name on
+// every line, separated by tabs (commas for .csv files). Blank lines and
+// lines starting with # are skipped.
+func LoadGeneMap(filename string) (GeneMap, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	delimiter := "\t"
+	if strings.EqualFold(filepath.Ext(filename), ".csv") {
+		delimiter = ","
+	}
+	mapping := make(GeneMap)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, delimiter)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected 2 columns (old and new name), got %d", filename, line, len(fields))
+		}
+		from, to := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("%s line %d: empty gene name", filename, line)
+		}
+		if previous, ok := mapping[from]; ok && previous != to {
+			return nil, fmt.Errorf("%s line %d: %s is mapped to both %s and %s", filename, line, from, previous, to)
+		}
+		mapping[from] = to
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// Apply renames the genes of a matrix. Genes that end up with the same name
+// are collapsed into one, at the position of the first, by summing their
+// counts. It also returns the new index of every original gene.
+func (m GeneMap) Apply(matrix []SparseRow, geneNames []string) ([]SparseRow, []string, []int, error) {
+	newIndex := make([]int, len(geneNames))
+	positions := make(map[string]int, len(geneNames))
+	var newNames []string
+	for gene, name := range geneNames {
+		if renamed, ok := m[name]; ok {
+			name = renamed
+		}
+		position, ok := positions[name]
+		if !ok {
+			position = len(newNames)
+			positions[name] = position
+			newNames = append(newNames, name)
+		}
+		newIndex[gene] = position
+	}
+
+	mapped := make([]SparseRow, len(matrix))
+	sums := make([]uint64, len(newNames))
+	present := make([]bool, len(newNames))
+	for cell, row := range matrix {
+		var genes []uint32
+		for i, gene := range row.Indices {
+			target := newIndex[gene]
+			if !present[target] {
+				present[target] = true
+				genes = append(genes, uint32(target))
+			}
+			sums[target] += uint64(row.Values[i])
+		}
+		sort.Slice(genes, func(a, b int) bool { return genes[a] < genes[b] })
+
+		mapped[cell].Indices = genes
+		mapped[cell].Values = make([]uint32, len(genes))
+		for i, gene := range genes {
+			if sums[gene] > math.MaxUint32 {
+				return nil, nil, nil, fmt.Errorf("cell %d: the counts collapsed into %s exceed %d", cell, newNames[gene], uint32(math.MaxUint32))
+			}
+			mapped[cell].Values[i] = uint32(sums[gene])
+			sums[gene] = 0
+			present[gene] = false
+		}
+	}
+	return mapped, newNames, newIndex, nil
+}
+
+// applyGeneMap renames the genes of an input matrix with the options'
+// GeneMap, collapsing feature types along with the genes. Genes collapsed
+// together must have the same feature type.
+func (opts LoadOptions) applyGeneMap(matrix []SparseRow, geneNames, featureTypes []string) ([]SparseRow, []string, []string, error) {
+	if opts.GeneMap == nil {
+		return matrix, geneNames, featureTypes, nil
+	}
+	matrix, newNames, newIndex, err := opts.GeneMap.Apply(matrix, geneNames)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(featureTypes) == 0 {
+		return matrix, newNames, nil, nil
+	}
+	if len(featureTypes) != len(geneNames) {
+		return nil, nil, nil, fmt.Errorf("%d feature types for %d genes", len(featureTypes), len(geneNames))
+	}
+
+	newTypes := make([]string, len(newNames))
+	for gene, featureType := range featureTypes {
+		target := newIndex[gene]
+		if newTypes[target] == "" {
+			newTypes[target] = featureType
+		} else if newTypes[target] != featureType {
+			return nil, nil, nil, fmt.Errorf("gene %s collapses features of types %s and %s", newNames[target], newTypes[target], featureType)
+		}
+	}
+	return matrix, newNames, newTypes, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGeneMapApply(t *testing.T) {
+	geneNames := []string{"ENSG1", "ENSG2", "ENSG3", "KEEP"}
+	matrix := []SparseRow{
+		{Indices: []uint32{0, 1, 3}, Values: []uint32{2, 5, 1}},
+		{Indices: []uint32{1, 2}, Values: []uint32{3, 4}},
+		{},
+	}
+	tests := []struct {
+		name      string
+		mapping   GeneMap
+		wantNames []string
+		want      []SparseRow
+	}{
+		{"rename", GeneMap{"ENSG1": "A", "ENSG2": "B", "ENSG3": "C"},
+			[]string{"A", "B", "C", "KEEP"}, matrix},
+		{"collapse two genes", GeneMap{"ENSG1": "A", "ENSG2": "A", "ENSG3": "C"},
+			[]string{"A", "C", "KEEP"}, []SparseRow{
+				{Indices: []uint32{0, 2}, Values: []uint32{7, 1}},
+				{Indices: []uint32{0, 1}, Values: []uint32{3, 4}},
+				{},
+			}},
+		{"collapse onto an unmapped gene", GeneMap{"ENSG3": "ENSG1"},
+			[]string{"ENSG1", "ENSG2", "KEEP"}, []SparseRow{
+				{Indices: []uint32{0, 1, 2}, Values: []uint32{2, 5, 1}},
+				{Indices: []uint32{0, 1}, Values: []uint32{4, 3}},
+				{},
+			}},
+		{"unlisted genes", GeneMap{"OTHER": "X"},
+			geneNames, matrix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapped, names, _, err := tt.mapping.Apply(matrix, geneNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("names %q, want %q", names, tt.wantNames)
+			}
+			for cell := range tt.want {
+				if !sameRow(mapped[cell], tt.want[cell]) {
+					t.Errorf("cell %d: %v, want %v", cell, mapped[cell], tt.want[cell])
+				}
+			}
+		})
+	}
+
+	overflow := []SparseRow{{Indices: []uint32{0, 1}, Values: []uint32{math.MaxUint32, 1}}}
+	if _, _, _, err := (GeneMap{"ENSG2": "ENSG1"}).Apply(overflow, geneNames[:2]); err == nil {
+		t.Error("collapsing counts beyond uint32 succeeded")
+	}
+}
+
+func TestLoadGeneMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    GeneMap
+		wantErr string
+	}{
+		{"tsv", "map.tsv", "# old\tnew\nENSG1\tA\n\nENSG2\tB\r\n", GeneMap{"ENSG1": "A", "ENSG2": "B"}, ""},
+		{"csv", "map.csv", "ENSG1,A\nENSG2, B\n", GeneMap{"ENSG1": "A", "ENSG2": "B"}, ""},
+		{"repeated line", "map.tsv", "ENSG1\tA\nENSG1\tA\n", GeneMap{"ENSG1": "A"}, ""},
+		{"three columns", "map.tsv", "ENSG1\tA\tB\n", nil, "line 1: expected 2 columns"},
+		{"empty name", "map.tsv", "ENSG1\t\n", nil, "line 1: empty gene name"},
+		{"conflict", "map.tsv", "ENSG1\tA\nENSG1\tB\n", nil, "line 2: ENSG1 is mapped to both A and B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(filename, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadGeneMap(filename)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadGeneMap = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRunGeneMap compresses with a mapping that collapses two genes and
+// checks the decompressed counts are summed
+func TestRunGeneMap(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "m.csv")
+	if err := os.WriteFile(input, []byte("Cell,ENSG1,ENSG2,ENSG3\nc1,1,2,0\nc2,0,3,4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapping := filepath.Join(dir, "map.tsv")
+	if err := os.WriteFile(mapping, []byte("ENSG1\tGAPDH\nENSG2\tGAPDH\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := compressDecompress(t, input, "-gene-map", mapping)
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Cell,GAPDH,ENSG3\nc1,3,0\nc2,3,4\n"
+	if string(got) != want {
+		t.Errorf("decompressed\n%s\nwant\n%s", got, want)
+	}
+}
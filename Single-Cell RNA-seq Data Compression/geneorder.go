@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GeneOrder returns the output column order for a -gene-order spec as a list
+// of original gene indices: "original" (or "") keeps the stored order,
+// "alpha" sorts by name, and "file=path" puts the genes listed in path (one
+// per line) first, followed by the rest in stored order.
+func GeneOrder(geneNames []string, spec string) ([]int, error) {
+	order := make([]int, len(geneNames))
+	for i := range order {
+		order[i] = i
+	}
+
+	switch {
+	case spec == "" || spec == "original":
+		return order, nil
+	case spec == "alpha":
+		sort.SliceStable(order, func(a, b int) bool { return geneNames[order[a]] < geneNames[order[b]] })
+		return order, nil
+	case strings.HasPrefix(spec, "file="):
+		path := strings.TrimPrefix(spec, "file=")
+		listed, err := readNameColumn(path, strings.HasSuffix(path, ".gz"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gene order file: %w", err)
+		}
+		return listedGeneOrder(geneNames, listed, path)
+	default:
+		return nil, fmt.Errorf("unknown gene order %q; use alpha, original or file=path", spec)
+	}
+}
+
+// listedGeneOrder puts the listed genes first, then the remaining genes
+func listedGeneOrder(geneNames, listed []string, path string) ([]int, error) {
+	index := make(map[string]int, len(geneNames))
+	for i, name := range geneNames {
+		if _, ok := index[name]; !ok {
+			index[name] = i
+		}
+	}
+
+	order := make([]int, 0, len(geneNames))
+	placed := make([]bool, len(geneNames))
+	for _, name := range listed {
+		gene, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("gene %q from %s is not in the matrix", name, path)
+		}
+		if placed[gene] {
+			return nil, fmt.Errorf("gene %q is listed more than once in %s", name, path)
+		}
+		placed[gene] = true
+		order = append(order, gene)
+	}
+	for gene := range geneNames {
+		if !placed[gene] {
+			order = append(order, gene)
+		}
+	}
+	return order, nil
+}
+
+// GenePanelIndices returns the index of every listed gene in geneNames, in
+// list order; path names the list in errors
+func GenePanelIndices(geneNames, listed []string, path string) ([]uint32, error) {
+	index := make(map[string]int, len(geneNames))
+	for i, name := range geneNames {
+		if _, ok := index[name]; !ok {
+			index[name] = i
+		}
+	}
+
+	indices := make([]uint32, 0, len(listed))
+	placed := make(map[int]bool, len(listed))
+	for _, name := range listed {
+		gene, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("gene %q from %s is not in the archive", name, path)
+		}
+		if placed[gene] {
+			return nil, fmt.Errorf("gene %q is listed more than once in %s", name, path)
+		}
+		placed[gene] = true
+		indices = append(indices, uint32(gene))
+	}
+	return indices, nil
+}
+
+// geneReorder maps rows and names to a new column order
+type geneReorder struct {
+	newIndex []uint32 // Original gene index -> output column
+	names    []string // Gene names in output order
+}
+
+// newGeneReorder prepares the permutation given by order (see GeneOrder)
+func newGeneReorder(geneNames []string, order []int) *geneReorder {
+	r := &geneReorder{
+		newIndex: make([]uint32, len(geneNames)),
+		names:    make([]string, len(order)),
+	}
+	for pos, gene := range order {
+		r.newIndex[gene] = uint32(pos)
+		r.names[pos] = geneNames[gene]
+	}
+	return r
+}
+
+// row renumbers a row's genes to their output columns, keeping indices sorted
+func (r *geneReorder) row(row SparseRow) SparseRow {
+	reordered := SparseRow{
+		Indices: make([]uint32, 0, len(row.Indices)),
+		Values:  make([]uint32, 0, len(row.Values)),
+	}
+	for i, gene := range row.Indices {
+		if int(gene) < len(r.newIndex) {
+			reordered.Indices = append(reordered.Indices, r.newIndex[gene])
+			reordered.Values = append(reordered.Values, row.Values[i])
+		}
+	}
+	sort.Sort(byGeneIndex{&reordered})
+	return reordered
+}
+
+// ReorderGenes permutes the columns of the matrix into the given order (see
+// GeneOrder), returning the reindexed rows and the reordered gene names
+func ReorderGenes(matrix []SparseRow, geneNames []string, order []int) ([]SparseRow, []string) {
+	r := newGeneReorder(geneNames, order)
+	reordered := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		reordered[i] = r.row(row)
+	}
+	return reordered, r.names
+}
+
+// reorderStrings permutes per-gene values (such as feature types) into order
+func reorderStrings(values []string, order []int) []string {
+	if len(values) == 0 {
+		return values
+	}
+	reordered := make([]string, len(order))
+	for pos, gene := range order {
+		reordered[pos] = values[gene]
+	}
+	return reordered
+}
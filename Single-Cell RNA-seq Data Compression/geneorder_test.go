@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// rowValue returns a row's count for gene, or 0 when it is not expressed
+func rowValue(row SparseRow, gene uint32) uint32 {
+	for i, g := range row.Indices {
+		if g == gene {
+			return row.Values[i]
+		}
+	}
+	return 0
+}
+
+func TestGeneOrder(t *testing.T) {
+	geneNames := []string{"CD3E", "ACTB", "MS4A1", "GAPDH"}
+	order := filepath.Join(t.TempDir(), "order.txt")
+	if err := os.WriteFile(order, []byte("MS4A1\nCD3E\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec string
+		want []int
+	}{
+		{"", []int{0, 1, 2, 3}},
+		{"original", []int{0, 1, 2, 3}},
+		{"alpha", []int{1, 0, 3, 2}},
+		{"file=" + order, []int{2, 0, 1, 3}},
+	}
+	for _, tt := range tests {
+		got, err := GeneOrder(geneNames, tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestGeneOrderErrors(t *testing.T) {
+	geneNames := []string{"CD3E", "ACTB", "MS4A1"}
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.txt")
+	if err := os.WriteFile(missing, []byte("ACTB\nNOPE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repeated := filepath.Join(dir, "repeated.txt")
+	if err := os.WriteFile(repeated, []byte("ACTB\nACTB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"file=" + missing, `gene "NOPE" from ` + missing + " is not in the matrix"},
+		{"file=" + repeated, `gene "ACTB" is listed more than once`},
+		{"file=" + filepath.Join(dir, "absent.txt"), "failed to read gene order file"},
+		{"reverse", `unknown gene order "reverse"`},
+	}
+	for _, tt := range tests {
+		_, err := GeneOrder(geneNames, tt.spec)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want an error containing %q", tt.spec, err, tt.want)
+		}
+	}
+}
+
+func TestReorderGenes(t *testing.T) {
+	matrix := []SparseRow{
+		{Indices: []uint32{0, 2, 3}, Values: []uint32{5, 7, 9}},
+		{Indices: []uint32{1}, Values: []uint32{4}},
+	}
+	rows, names := ReorderGenes(matrix, []string{"a", "b", "c", "d"}, []int{3, 0, 2, 1})
+	if want := []string{"d", "a", "c", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+	want := []SparseRow{
+		{Indices: []uint32{0, 1, 2}, Values: []uint32{9, 5, 7}},
+		{Indices: []uint32{3}, Values: []uint32{4}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+}
+
+func TestRunGeneOrder(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 150, 60)
+	_, geneNames, _ := GenerateSyntheticMatrix(150, 60, 0.8, 1)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+	order := filepath.Join(dir, "order.txt")
+	if err := os.WriteFile(order, []byte("Gene_42\nGene_7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	alpha := append([]string(nil), geneNames...)
+	sort.Strings(alpha)
+	listed := []string{"Gene_42", "Gene_7"}
+	for _, name := range geneNames {
+		if name != "Gene_42" && name != "Gene_7" {
+			listed = append(listed, name)
+		}
+	}
+	tests := []struct {
+		spec      string
+		wantNames []string
+	}{
+		{"original", geneNames},
+		{"alpha", alpha},
+		{"file=" + order, listed},
+	}
+	for _, tt := range tests {
+		output := filepath.Join(dir, "out.csv")
+		if err := run([]string{"-mode", "decompress", "-input", archive, "-output", output, "-force", "-gene-order", tt.spec}); err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		rows, names, _, err := LoadSparseMatrix(output, DefaultLoadOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, tt.wantNames) {
+			t.Fatalf("%s: columns %v, want %v", tt.spec, names, tt.wantNames)
+		}
+		original := make(map[string]uint32, len(geneNames))
+		for i, name := range geneNames {
+			original[name] = uint32(i)
+		}
+		for cell, row := range rows {
+			for col, name := range names {
+				if got, want := rowValue(row, uint32(col)), rowValue(matrix[cell], original[name]); got != want {
+					t.Fatalf("%s: cell %d gene %s = %d, want %d", tt.spec, cell, name, got, want)
+				}
+			}
+		}
+	}
+
+	missing := filepath.Join(dir, "missing.txt")
+	if err := os.WriteFile(missing, []byte("Gene_1\nNOT_A_GENE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := run([]string{"-mode", "decompress", "-input", archive, "-output", filepath.Join(dir, "bad.csv"), "-gene-order", "file=" + missing})
+	if err == nil || !strings.Contains(err.Error(), `gene "NOT_A_GENE"`) {
+		t.Errorf("order file with an unknown gene: got %v, want an error naming it", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.csv")); !os.IsNotExist(err) {
+		t.Errorf("a failed -gene-order still wrote the output")
+	}
+}
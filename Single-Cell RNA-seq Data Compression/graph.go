@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// similarityGraph collects the top-k most similar cells of every cell from the
+// similarities computed during the reference search. Each comparison counts
+// for both cells, so a cell also gets neighbours among the cells after it.
+type similarityGraph struct {
+	k          int
+	mu         sync.Mutex
+	neighbours [][]CellSimilarity // Per cell, sorted by descending similarity
+}
+
+// newSimilarityGraph creates an empty graph over numCells cells
+func newSimilarityGraph(numCells, k int) *similarityGraph {
+	return &similarityGraph{
+		k:          k,
+		neighbours: make([][]CellSimilarity, numCells),
+	}
+}
+
+// addCell records the similarities of cell to each of the candidate cells
+func (g *similarityGraph) addCell(cell int, candidateIndices []int, similarities []float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, other := range candidateIndices {
+		if similarities[i] <= 0 {
+			continue
+		}
+		g.insert(cell, other, similarities[i])
+		g.insert(other, cell, similarities[i])
+	}
+}
+
+// insert adds the edge cell -> other if it is among cell's k best; ties go to
+// the lower neighbour index
+func (g *similarityGraph) insert(cell, other int, similarity float64) {
+	list := g.neighbours[cell]
+	pos := sort.Search(len(list), func(i int) bool {
+		return list[i].Similarity < similarity ||
+			(list[i].Similarity == similarity && int(list[i].CellB) > other)
+	})
+	if pos >= g.k {
+		return
+	}
+	if len(list) < g.k {
+		list = append(list, CellSimilarity{})
+	}
+	copy(list[pos+1:], list[pos:])
+	list[pos] = CellSimilarity{CellA: uint32(cell), CellB: uint32(other), Similarity: similarity}
+	g.neighbours[cell] = list
+}
+
+// edges returns every cell's neighbours in cell order
+func (g *similarityGraph) edges() []CellSimilarity {
+	var edges []CellSimilarity
+	for _, list := range g.neighbours {
+		edges = append(edges, list...)
+	}
+	return edges
+}
+
+// SaveSimilarityGraph writes a cell-cell similarity graph as an edge list with
+// one "cell,neighbor,similarity" line per edge, ready for graph clustering
+// tools such as Leiden or Louvain. A .tsv filename gives tab-separated output.
+func SaveSimilarityGraph(edges []CellSimilarity, cellNames []string, filename string, opts SaveOptions) error {
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sep := string(OutputDelimiter(filename))
+	writer := bufio.NewWriterSize(file, defaultIOBufferSize)
+	fmt.Fprintf(writer, "cell%sneighbor%ssimilarity\n", sep, sep)
+	for _, edge := range edges {
+		if int(edge.CellA) >= len(cellNames) || int(edge.CellB) >= len(cellNames) {
+			return fmt.Errorf("edge %d-%d refers to a cell beyond %d cells", edge.CellA, edge.CellB, len(cellNames))
+		}
+		fmt.Fprintf(writer, "%s%s%s%s%s\n", cellNames[edge.CellA], sep, cellNames[edge.CellB], sep,
+			strconv.FormatFloat(edge.Similarity, 'g', 6, 64))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
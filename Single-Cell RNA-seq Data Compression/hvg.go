@@ -0,0 +1,140 @@
+package main
+
+import "sort"
+
+// SelectVariableGenes returns the indices, in ascending order, of the n genes
+// with the highest dispersion (variance / mean of the counts across all
+// cells, zeros included). Genes never expressed have dispersion 0; ties go to
+// the lower gene index.
+func SelectVariableGenes(matrix []SparseRow, numGenes, n int) []uint32 {
+	if n >= numGenes {
+		n = numGenes
+	}
+
+	// First pass: per-gene sums over the non-zero entries
+	sums := make([]float64, numGenes)
+	sumSquares := make([]float64, numGenes)
+	for _, row := range matrix {
+		for i, gene := range row.Indices {
+			if int(gene) >= numGenes {
+				continue
+			}
+			value := float64(row.Values[i])
+			sums[gene] += value
+			sumSquares[gene] += value * value
+		}
+	}
+
+	numCells := float64(len(matrix))
+	dispersion := make([]float64, numGenes)
+	for gene := range dispersion {
+		if sums[gene] == 0 || numCells == 0 {
+			continue
+		}
+		mean := sums[gene] / numCells
+		variance := sumSquares[gene]/numCells - mean*mean
+		dispersion[gene] = variance / mean
+	}
+
+	order := make([]int, numGenes)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return dispersion[order[a]] > dispersion[order[b]] })
+
+	kept := make([]uint32, n)
+	for i := range kept {
+		kept[i] = uint32(order[i])
+	}
+	sort.Slice(kept, func(a, b int) bool { return kept[a] < kept[b] })
+	return kept
+}
+
+// filterGenes keeps only the given genes (sorted original indices), renumbering
+// them 0..len(kept)-1. It returns the filtered matrix, the kept gene names and
+// the names of the dropped genes in their original order.
+func filterGenes(matrix []SparseRow, geneNames []string, kept []uint32) ([]SparseRow, []string, []string) {
+	newIndex := make(map[uint32]uint32, len(kept))
+	keptNames := make([]string, len(kept))
+	for i, gene := range kept {
+		newIndex[gene] = uint32(i)
+		keptNames[i] = geneNames[gene]
+	}
+
+	var droppedNames []string
+	for gene, name := range geneNames {
+		if _, ok := newIndex[uint32(gene)]; !ok {
+			droppedNames = append(droppedNames, name)
+		}
+	}
+
+	filtered := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		var newRow SparseRow
+		for j, gene := range row.Indices {
+			if idx, ok := newIndex[gene]; ok {
+				newRow.Indices = append(newRow.Indices, idx)
+				newRow.Values = append(newRow.Values, row.Values[j])
+			}
+		}
+		filtered[i] = newRow
+	}
+
+	return filtered, keptNames, droppedNames
+}
+
+// OriginalGeneNames returns the gene names of the matrix before gene
+// filtering, or GeneNames if no genes were dropped
+func (cd *CompressedData) OriginalGeneNames() []string {
+	if len(cd.KeptGenes) == 0 {
+		return cd.GeneNames
+	}
+
+	names := make([]string, 0, len(cd.KeptGenes)+len(cd.DroppedGeneNames))
+	kept, dropped := 0, 0
+	for gene := 0; kept < len(cd.KeptGenes) || dropped < len(cd.DroppedGeneNames); gene++ {
+		if kept < len(cd.KeptGenes) && int(cd.KeptGenes[kept]) == gene {
+			names = append(names, cd.GeneNames[kept])
+			kept++
+		} else if dropped < len(cd.DroppedGeneNames) {
+			names = append(names, cd.DroppedGeneNames[dropped])
+			dropped++
+		} else {
+			break // Corrupt mapping; kept indices exceed the original gene count
+		}
+	}
+	return names
+}
+
+// ExpandRow maps a decompressed row from filtered gene indices back to the
+// original gene indices, so dropped genes read as zeros
+func (cd *CompressedData) ExpandRow(row SparseRow) SparseRow {
+	if len(cd.KeptGenes) == 0 {
+		return row
+	}
+
+	expanded := SparseRow{
+		Indices: make([]uint32, 0, len(row.Indices)),
+		Values:  make([]uint32, 0, len(row.Values)),
+	}
+	for i, gene := range row.Indices {
+		if int(gene) < len(cd.KeptGenes) {
+			expanded.Indices = append(expanded.Indices, cd.KeptGenes[gene])
+			expanded.Values = append(expanded.Values, row.Values[i])
+		}
+	}
+	return expanded
+}
+
+// ExpandMatrix applies ExpandRow to every row of a decompressed matrix
+func (cd *CompressedData) ExpandMatrix(matrix []SparseRow) []SparseRow {
+	if len(cd.KeptGenes) == 0 {
+		return matrix
+	}
+
+	expanded := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		expanded[i] = cd.ExpandRow(row)
+	}
+	return expanded
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// ArchiveInfo summarizes how the rows of a compressed archive were encoded
+type ArchiveInfo struct {
+	Header           Header
+	DType            DType
+	NumRows          int
+	EmptyCells       int
+	SelfEncoded      int
+	DeltaEncoded     int
+	Duplicates       int // Delta-encoded cells stored as exact copies of their reference
+	MeanEncoded      int // Delta-encoded cells referencing the mean cell
+	LosslessCells    int // Cells of a lossy archive stored unquantized
+	LosslessGenes    int // Genes of a lossy archive stored unquantized
+	TopGenesPerCell  int // Genes kept per cell, 0 if every gene was kept
+	IndexBytes       int
+	ValueBytes       int
+	SourceHash       []byte         // SHA-256 of the input file, empty if not recorded
+	LowBitsHistogram map[uint32]int // Elias-Fano low-bit width -> number of cells (gene chunks if chunked)
+	DepthHistogram   map[int]int    // Reference chain depth (0 = self-encoded) -> number of cells
+	Cells            []CellEncoding // How each row was encoded, in cell order
+}
+
+// Summary describes an archive's matrix and settings without its rows, as
+// needed to list archives (see LoadCompressedHeader)
+type Summary struct {
+	Version     uint32
+	NumCells    uint32
+	NumGenes    uint32
+	GeneNames   []string
+	CellNames   []string
+	IsLossy     bool
+	Threshold   float64   // Delta threshold, if lossy
+	QuantLevels uint32    // Quantization levels, if lossy
+	Created     time.Time // Zero if the archive records no creation time
+}
+
+// Summary returns the archive's shape, names, lossy settings and creation
+// time. It only uses the preamble, so it works on archives loaded with
+// LoadCompressedHeader.
+func (cd *CompressedData) Summary() Summary {
+	summary := Summary{
+		Version:     cd.Header.Version,
+		NumCells:    cd.Header.NumCells,
+		NumGenes:    cd.Header.NumGenes,
+		GeneNames:   cd.GeneNames,
+		CellNames:   cd.CellNames,
+		IsLossy:     cd.Header.IsLossy,
+		Threshold:   cd.Header.Threshold,
+		QuantLevels: cd.Header.QuantLevels,
+	}
+	if cd.Header.Timestamp != 0 {
+		summary.Created = time.Unix(cd.Header.Timestamp, 0).UTC()
+	}
+	return summary
+}
+
+// CellEncoding records the encoding path taken for one cell
+type CellEncoding struct {
+	Method     string // "self", "delta", "mean", "duplicate" or "empty"
+	RefCell    int32  // Reference cell, -1 unless delta-encoded
+	Depth      int    // Length of the reference chain down to a self-encoded cell
+	LowBits    uint32 // Elias-Fano low-bit width (the widest chunk's if chunked)
+	IndexBytes int
+	ValueBytes int
+}
+
+// Inspect gathers encoding statistics for the archive without decompressing values
+func (cd *CompressedData) Inspect() (*ArchiveInfo, error) {
+	info := &ArchiveInfo{
+		Header:           cd.Header,
+		DType:            cd.DType,
+		NumRows:          len(cd.CompressedRows),
+		LosslessCells:    len(cd.LosslessCells),
+		LosslessGenes:    len(cd.LosslessGenes),
+		TopGenesPerCell:  int(cd.TopGenesPerCell),
+		SourceHash:       cd.SourceHash,
+		LowBitsHistogram: make(map[uint32]int),
+		DepthHistogram:   make(map[int]int),
+		Cells:            make([]CellEncoding, len(cd.CompressedRows)),
+	}
+
+	depths := referenceDepths(cd.CompressedRows)
+	for i, row := range cd.CompressedRows {
+		info.IndexBytes += len(row.EliasGenes)
+		info.ValueBytes += len(row.DeltaValues)
+		cell := &info.Cells[i]
+		*cell = CellEncoding{
+			Method:     "self",
+			RefCell:    -1,
+			Depth:      depths[i],
+			IndexBytes: len(row.EliasGenes),
+			ValueBytes: len(row.DeltaValues),
+		}
+
+		if row.isDuplicate() {
+			info.DeltaEncoded++
+			info.Duplicates++
+			cell.Method = "duplicate"
+			cell.RefCell = row.RefCell
+			info.DepthHistogram[depths[i]]++
+			continue
+		}
+		if len(row.EliasGenes) == 0 {
+			info.EmptyCells++
+			cell.Method = "empty"
+			continue
+		}
+
+		if row.RefCell >= 0 {
+			info.DeltaEncoded++
+			cell.Method = "delta"
+			cell.RefCell = row.RefCell
+		} else if row.RefCell == meanRefCell {
+			info.DeltaEncoded++
+			info.MeanEncoded++
+			cell.Method = "mean"
+		} else {
+			info.SelfEncoded++
+		}
+		info.DepthHistogram[depths[i]]++
+
+		ranges, err := cd.rowRanges(row)
+		if err != nil {
+			return nil, fmt.Errorf("cell %d: %w", i, err)
+		}
+		for _, r := range ranges {
+			info.LowBitsHistogram[r.LowBits]++
+			if r.LowBits > cell.LowBits {
+				cell.LowBits = r.LowBits
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// rowRanges returns the Elias-Fano parameters of a row's gene indices, one
+// per chunk if the archive is gene-chunked
+func (cd *CompressedData) rowRanges(row CompressedRow) ([]EliasRange, error) {
+	data, err := eliasGenes(row, &cd.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inflate gene indices: %w", err)
+	}
+	payloads := [][]byte{data}
+	if cd.Header.GeneChunk > 0 {
+		if _, payloads, err = geneChunkPayloads(data); err != nil {
+			return nil, err
+		}
+	}
+	ranges := make([]EliasRange, len(payloads))
+	for i, payload := range payloads {
+		decoder, err := NewEliasDecoder(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Elias-Fano header: %w", err)
+		}
+		ranges[i] = EliasRange{Universe: decoder.Universe(), Count: decoder.Size(), LowBits: decoder.LowBits()}
+	}
+	return ranges, nil
+}
+
+// referenceDepths returns the length of every row's reference chain; rows on
+// a reference cycle or pointing out of range count up to where the walk stops
+func referenceDepths(rows []CompressedRow) []int {
+	const unknown = -1
+	depths := make([]int, len(rows))
+	for i := range depths {
+		depths[i] = unknown
+	}
+
+	var chain []int
+	for i := range rows {
+		// Walk up to a row whose depth is known or that has no reference
+		chain = chain[:0]
+		cell := i
+		for depths[cell] == unknown {
+			chain = append(chain, cell)
+			depths[cell] = 0 // Provisional, so a cycle ends the walk
+			ref := int(rows[cell].RefCell)
+			if ref < 0 || ref >= len(rows) {
+				break
+			}
+			cell = ref
+		}
+
+		// Assign depths back down the chain
+		depth := depths[cell]
+		if len(chain) > 0 && chain[len(chain)-1] == cell {
+			depth = -1 // The walk stopped at a row without a usable reference
+			if rows[cell].RefCell == meanRefCell {
+				depth = 0 // The mean cell is decoded already
+			}
+		}
+		for j := len(chain) - 1; j >= 0; j-- {
+			depth++
+			depths[chain[j]] = depth
+		}
+	}
+	return depths
+}
+
+// Print writes a human-readable report of the archive to w
+func (info *ArchiveInfo) Print(w io.Writer) {
+	fmt.Fprintf(w, "Format version: %d\n", info.Header.Version)
+	if info.Header.Timestamp != 0 {
+		fmt.Fprintf(w, "Created: %s\n", time.Unix(info.Header.Timestamp, 0).UTC().Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "Created: unknown\n")
+	}
+	if len(info.SourceHash) > 0 {
+		fmt.Fprintf(w, "Source SHA-256: %x\n", info.SourceHash)
+	}
+	fmt.Fprintf(w, "Matrix: %d cells x %d genes (%s values)\n", info.Header.NumCells, info.Header.NumGenes, info.DType)
+	if info.Header.IsBinary {
+		fmt.Fprintf(w, "Binary: presence/absence only, no values stored\n")
+	} else if info.Header.IsLossy {
+		fmt.Fprintf(w, "Lossy: threshold %.4g, %d quantization levels\n", info.Header.Threshold, info.Header.QuantLevels)
+		if info.LosslessCells > 0 {
+			fmt.Fprintf(w, "Lossless fallback: %d cells stored unquantized to bound the error\n", info.LosslessCells)
+		}
+		if info.LosslessGenes > 0 {
+			fmt.Fprintf(w, "Lossless genes: %d genes stored unquantized\n", info.LosslessGenes)
+		}
+	} else if info.TopGenesPerCell == 0 {
+		fmt.Fprintf(w, "Lossless\n")
+	}
+	if info.TopGenesPerCell > 0 {
+		fmt.Fprintf(w, "Top genes: only the %d highest genes of each cell are stored\n", info.TopGenesPerCell)
+	}
+
+	fmt.Fprintf(w, "Rows: %d (%d self-encoded, %d delta-encoded, %d empty)\n",
+		info.NumRows, info.SelfEncoded, info.DeltaEncoded, info.EmptyCells)
+	if info.Duplicates > 0 {
+		fmt.Fprintf(w, "Duplicates: %d delta-encoded cells are exact copies of their reference\n", info.Duplicates)
+	}
+	if info.MeanEncoded > 0 {
+		fmt.Fprintf(w, "Synthetic reference: %d delta-encoded cells reference the mean or baseline cell\n", info.MeanEncoded)
+	}
+	if info.Header.RefsOrdered {
+		fmt.Fprintf(w, "References: ordered (single-pass decode)\n")
+	}
+	if encoded := info.SelfEncoded + info.DeltaEncoded; encoded > 0 && !info.Header.IsBinary {
+		selfShare := 100 * float64(info.SelfEncoded) / float64(encoded)
+		fmt.Fprintf(w, "Self-encoded: %.1f%% of non-empty cells", selfShare)
+		if selfShare >= 90 {
+			fmt.Fprintf(w, " (references rarely help; consider -ref-mode medoid or a wider -ref-window)")
+		}
+		fmt.Fprintln(w)
+	}
+
+	indexCodec := "Elias-Fano"
+	if info.Header.EliasFlate {
+		indexCodec += " + flate"
+	}
+	valueCodec := "zigzag varint + flate"
+	if info.Header.ValueCodec == ValueCodecRice {
+		valueCodec = "zigzag Golomb-Rice"
+	}
+	if info.Header.IsBinary {
+		valueCodec = "none (binary)"
+	}
+	if info.Header.GeneChunk > 0 {
+		indexCodec = fmt.Sprintf("%s in %d-gene chunks", indexCodec, info.Header.GeneChunk)
+	}
+	fmt.Fprintf(w, "Codecs: gene indices %s, values %s\n", indexCodec, valueCodec)
+	fmt.Fprintf(w, "Gene index payload: %d bytes\n", info.IndexBytes)
+	fmt.Fprintf(w, "Value payload: %d bytes\n", info.ValueBytes)
+
+	depths := make([]int, 0, len(info.DepthHistogram))
+	for depth := range info.DepthHistogram {
+		depths = append(depths, depth)
+	}
+	sort.Ints(depths)
+	fmt.Fprintf(w, "Reference depth:\n")
+	for _, depth := range depths {
+		fmt.Fprintf(w, "  %2d: %d cells\n", depth, info.DepthHistogram[depth])
+	}
+
+	widths := make([]uint32, 0, len(info.LowBitsHistogram))
+	for lowBits := range info.LowBitsHistogram {
+		widths = append(widths, lowBits)
+	}
+	sort.Slice(widths, func(i, j int) bool { return widths[i] < widths[j] })
+
+	unit := "cells"
+	if info.Header.GeneChunk > 0 {
+		unit = "chunks"
+	}
+	fmt.Fprintf(w, "Elias-Fano low bits:\n")
+	for _, lowBits := range widths {
+		fmt.Fprintf(w, "  %2d bits: %d %s\n", lowBits, info.LowBitsHistogram[lowBits], unit)
+	}
+}
+
+// PrintCells writes one line per cell with the encoding path it took
+func (info *ArchiveInfo) PrintCells(w io.Writer, cellNames []string) {
+	fmt.Fprintf(w, "cell\tmethod\tref\tdepth\tlow_bits\tindex_bytes\tvalue_bytes\n")
+	for i, cell := range info.Cells {
+		name := fmt.Sprintf("Cell_%d", i+1)
+		if i < len(cellNames) {
+			name = cellNames[i]
+		}
+		ref := "-"
+		if cell.RefCell >= 0 {
+			ref = fmt.Sprint(cell.RefCell)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+			name, cell.Method, ref, cell.Depth, cell.LowBits, cell.IndexBytes, cell.ValueBytes)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestLoadCompressedHeader loads only the preamble of archives, intact and
+// with every block cut off or garbled, so any attempt to read or decode a row
+// would fail
+func TestLoadCompressedHeader(t *testing.T) {
+	const timestamp = 1700000000
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(300, 40, 0.8, 1)
+	tests := []struct {
+		name   string
+		lossy  bool
+		damage func(data []byte, blocks int) []byte
+	}{
+		{"intact", false, func(data []byte, blocks int) []byte { return data }},
+		{"lossy", true, func(data []byte, blocks int) []byte { return data }},
+		{"blocks cut off", false, func(data []byte, blocks int) []byte { return data[:blocks] }},
+		{"blocks garbled", false, func(data []byte, blocks int) []byte {
+			for i := blocks; i < len(data); i++ {
+				data[i] ^= 0x5a
+			}
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressor := NewCompressor(tt.lossy, 0.1, 16)
+			compressor.SetTimestamp(timestamp)
+			compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(t.TempDir(), "m.scz")
+			if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks := len(blockMagic) + 8 + int(binary.LittleEndian.Uint32(data[len(blockMagic):]))
+			if err := os.WriteFile(filename, tt.damage(data, blocks), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := LoadCompressedHeader(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.CompressedRows != nil {
+				t.Errorf("loaded %d rows", len(loaded.CompressedRows))
+			}
+			want := Summary{
+				Version:     FormatVersion,
+				NumCells:    uint32(len(cellNames)),
+				NumGenes:    uint32(len(geneNames)),
+				GeneNames:   geneNames,
+				CellNames:   cellNames,
+				IsLossy:     tt.lossy,
+				Threshold:   0.1,
+				QuantLevels: 16,
+				Created:     time.Unix(timestamp, 0).UTC(),
+			}
+			if got := loaded.Summary(); !reflect.DeepEqual(got, want) {
+				t.Errorf("Summary() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
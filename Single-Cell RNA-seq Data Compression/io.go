@@ -3,87 +3,430 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
-// LoadSparseMatrix loads a sparse matrix from various file formats
-func LoadSparseMatrix(filename string) ([]SparseRow, []string, []string, error) {
-	ext := strings.ToLower(filename[strings.LastIndex(filename, "."):])
+// defaultIOBufferSize is the buffer size of archive and report file IO, and
+// of matrix file IO unless the load or save options set another
+const defaultIOBufferSize = 1 << 20
+
+// LoadOptions controls how LoadSparseMatrix and the helpers loading input
+// matrices read a matrix file. Start from DefaultLoadOptions, which matches
+// the command-line defaults.
+type LoadOptions struct {
+	// HasHeader and HasIndex declare whether CSV/TSV input has a header row
+	// of gene names and an index column of cell names. Missing names are
+	// synthesized as Gene_1..Gene_N and Cell_1..Cell_M.
+	HasHeader, HasIndex bool
+
+	// Comment is the character that marks comment lines in CSV/TSV input,
+	// such as the metadata some exports write above the gene header. Lines
+	// starting with it are skipped wherever they occur, so a cell whose name
+	// starts with it would be dropped; 0 turns comment handling off.
+	Comment rune
+
+	// LenientValues skips unparseable CSV/TSV values (treated as zero)
+	// rather than reporting them as errors. Values that parse but are not
+	// counts, in CSV/TSV or MTX input, are then also accepted: negative
+	// values and values above the uint32 range are skipped and fractions
+	// truncated. Lenient parsing silently drops data on malformed input, so
+	// it is only meant for files known to contain harmless junk such as NA
+	// markers.
+	LenientValues bool
+
+	// Zeros selects which zero values of CSV/TSV input are stored. Explicit
+	// zeros survive compression, but the dense CSV/TSV output writes every
+	// missing value as 0 anyway.
+	Zeros ZeroPolicy
+
+	// NonFinite is what happens to NaN and infinite values of CSV/TSV and
+	// MTX input
+	NonFinite NonFinitePolicy
+
+	// CellOffset and CellCount select cells [CellOffset,
+	// CellOffset+CellCount) of the input, CellCount 0 meaning up to the last
+	// cell, so separate jobs can each compress a slice of a large file.
+	// Every gene is kept, so the slices' archives can be listed in a shard
+	// manifest. CSV/TSV rows before the range are split into fields but not
+	// parsed, and reading stops after it; other formats are loaded whole and
+	// cut.
+	CellOffset, CellCount int
+
+	// CellLimit keeps only the first CellLimit cells of the input (within
+	// the range), for quick runs on a sample of a large file; 0 keeps every
+	// cell. CSV/TSV parsing stops reading after them, other formats are
+	// loaded whole and cut. See also applyCellLimit.
+	CellLimit int
+
+	// StripBarcodeSuffix removes the gem-group suffix of 10x barcodes, so
+	// AAACCTGAGAAACCAT-1 becomes AAACCTGAGAAACCAT. Otherwise the suffixed
+	// barcode is the cell name, which keeps the same barcode from different
+	// runs apart.
+	StripBarcodeSuffix bool
+
+	// GeneMap renames the genes of the loaded matrix, nil for none. It is
+	// applied by applyGeneMap, after the feature types are loaded.
+	GeneMap GeneMap
+
+	// BufferSize is the read buffer size in bytes, 0 for
+	// defaultIOBufferSize. Large buffers cut the number of syscalls, which
+	// matters most for big dense CSVs on spinning disks and network
+	// filesystems.
+	BufferSize int
+}
+
+// DefaultLoadOptions returns the options of the command-line defaults:
+// CSV/TSV input with a header and index, # comments, strict values, zeros
+// dropped and every cell read
+func DefaultLoadOptions() LoadOptions {
+	return LoadOptions{HasHeader: true, HasIndex: true, Comment: '#'}
+}
+
+// bufferSize returns the read buffer size to use
+func (opts LoadOptions) bufferSize() int {
+	if opts.BufferSize > 0 {
+		return opts.BufferSize
+	}
+	return defaultIOBufferSize
+}
+
+// cellRangeEnd returns how many input cells to read, counting those skipped
+// before the range: the end of the range, capped by the cell limit, or 0 for
+// every cell
+func (opts LoadOptions) cellRangeEnd() int {
+	n := opts.CellCount
+	if opts.CellLimit > 0 && (n == 0 || opts.CellLimit < n) {
+		n = opts.CellLimit
+	}
+	if n == 0 {
+		return 0
+	}
+	return opts.CellOffset + n
+}
+
+// selectCellRange cuts a matrix loaded whole to the cell range
+func (opts LoadOptions) selectCellRange(matrix []SparseRow, geneNames, cellNames []string, err error) ([]SparseRow, []string, []string, error) {
+	if err != nil || (opts.CellOffset == 0 && opts.CellCount == 0) {
+		return matrix, geneNames, cellNames, err
+	}
+	if opts.CellOffset >= len(matrix) {
+		return nil, nil, nil, fmt.Errorf("row offset %d is past the %d cells of the input", opts.CellOffset, len(matrix))
+	}
+	end := len(matrix)
+	if opts.CellCount > 0 && opts.CellOffset+opts.CellCount < end {
+		end = opts.CellOffset + opts.CellCount
+	}
+	return matrix[opts.CellOffset:end], geneNames, cellNames[opts.CellOffset:end], nil
+}
+
+// ZeroPolicy selects which zero values of CSV/TSV input are stored. Values
+// that parse to zero count as zeros however they are written ("0", "0.0",
+// "-0", "0e5"); negative values are rejected, or skipped with
+// LoadOptions.LenientValues.
+type ZeroPolicy int
+
+const (
+	// ZerosDrop stores only positive values, the sparse default
+	ZerosDrop ZeroPolicy = iota
+	// ZerosKeepExplicit also stores the zeros written in the file as explicit
+	// entries; empty fields are still left out
+	ZerosKeepExplicit
+	// ZerosKeepAll stores every field, reading empty ones as explicit zeros
+	ZerosKeepAll
+)
+
+// ParseZeroPolicy parses a -zeros value: drop, explicit or all
+func ParseZeroPolicy(name string) (ZeroPolicy, error) {
+	switch name {
+	case "drop":
+		return ZerosDrop, nil
+	case "explicit":
+		return ZerosKeepExplicit, nil
+	case "all":
+		return ZerosKeepAll, nil
+	default:
+		return ZerosDrop, fmt.Errorf("unknown zero policy %q; use drop, explicit or all", name)
+	}
+}
+
+// NonFinitePolicy selects what happens to NaN and infinite values of the
+// input, which upstream tools write for divisions by zero. Converted to a
+// count they would become arbitrary numbers.
+type NonFinitePolicy int
+
+const (
+	// NonFiniteError fails with the location of the first such value
+	NonFiniteError NonFinitePolicy = iota
+	// NonFiniteDrop leaves such values out, like empty fields
+	NonFiniteDrop
+	// NonFiniteZero reads such values as 0, which the zero policy then
+	// stores or drops like any other zero
+	NonFiniteZero
+)
+
+// ParseNonFinitePolicy parses a -nonfinite value: error, drop or zero
+func ParseNonFinitePolicy(name string) (NonFinitePolicy, error) {
+	switch name {
+	case "error":
+		return NonFiniteError, nil
+	case "drop":
+		return NonFiniteDrop, nil
+	case "zero":
+		return NonFiniteZero, nil
+	default:
+		return NonFiniteError, fmt.Errorf("unknown policy %q; use error, drop or zero", name)
+	}
+}
+
+// isNonFinite reports whether a parsed value is NaN or infinite
+func isNonFinite(value float64) bool {
+	return math.IsNaN(value) || math.IsInf(value, 0)
+}
+
+// countProblem describes why a finite parsed value is not a count the matrix
+// can store, or returns "" if it is one. Converting such values to uint32
+// would wrap around or truncate them silently.
+func countProblem(value float64) string {
+	switch {
+	case value < 0:
+		return "negative value"
+	case value > math.MaxUint32:
+		return "value above the uint32 range"
+	case value != math.Trunc(value):
+		return "fractional value"
+	}
+	return ""
+}
+
+// keepsValue reports whether the policy stores a parsed value. empty marks
+// fields left blank in the file, which parse as 0.
+func (p ZeroPolicy) keepsValue(value float64, empty bool) bool {
+	switch {
+	case value > 0:
+		return true
+	case value < 0 || math.IsNaN(value):
+		return false
+	case empty:
+		return p == ZerosKeepAll
+	default:
+		return p != ZerosDrop
+	}
+}
+
+// LoadSparseMatrix loads a sparse matrix from various file formats, or from
+// CSV/TSV shards when filename is a glob pattern. Only the cells in the
+// options' range and limit are kept, and barcode suffixes are removed if the
+// options ask for it.
+func LoadSparseMatrix(filename string, opts LoadOptions) ([]SparseRow, []string, []string, error) {
+	if isShardPattern(filename) && (opts.CellOffset > 0 || opts.CellCount > 0) {
+		return nil, nil, nil, fmt.Errorf("a cell range cannot be read from shards (%s); each file already holds a slice of the cells", filename)
+	}
+	matrix, geneNames, cellNames, err := loadSparseMatrix(filename, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if opts.CellLimit > 0 && len(matrix) > opts.CellLimit {
+		matrix, cellNames = matrix[:opts.CellLimit], cellNames[:opts.CellLimit]
+	}
+	if opts.StripBarcodeSuffix {
+		if err := stripGemGroups(cellNames); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return matrix, geneNames, cellNames, nil
+}
+
+// LoadNameHeader returns the header of the cell name column of CSV/TSV
+// input, such as barcode, or the empty one pandas writes, so decompressed
+// output can repeat it. It is nil for other formats and for input without a
+// header or name column. Shards are taken to share the first one's header.
+func LoadNameHeader(filename string, opts LoadOptions) (*string, error) {
+	if !opts.HasHeader || !opts.HasIndex {
+		return nil, nil
+	}
+	if isShardPattern(filename) {
+		shards, err := shardFiles(filename)
+		if err != nil {
+			return nil, err
+		}
+		filename = shards[0]
+	}
+	lower := strings.ToLower(filename)
+	isTab := strings.HasSuffix(strings.TrimSuffix(lower, ".gz"), ".tsv")
+	if !isTab && !strings.HasSuffix(strings.TrimSuffix(lower, ".gz"), ".csv") {
+		return nil, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(lower, ".gz") {
+		gzReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	csvReader := csv.NewReader(reader)
+	if isTab {
+		csvReader.Comma = '\t'
+	}
+	if opts.Comment != csvReader.Comma {
+		csvReader.Comment = opts.Comment
+	}
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	return &header[0], nil
+}
+
+// loadSparseMatrix loads a matrix by the format its name implies
+func loadSparseMatrix(filename string, opts LoadOptions) ([]SparseRow, []string, []string, error) {
+	if isShardPattern(filename) {
+		return loadShards(filename, opts)
+	}
+	if isArchive(filename) {
+		return nil, nil, nil, fmt.Errorf("input %s appears to be an already-compressed .scz file", filename)
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
 	
 	switch ext {
 	case ".csv", ".tsv":
-		return loadFromCSV(filename, ext == ".tsv")
+		return loadFromCSV(filename, ext == ".tsv", opts)
 	case ".gz":
 		// Handle compressed files
 		if strings.HasSuffix(strings.ToLower(filename), ".csv.gz") {
-			return loadFromCompressedCSV(filename, false)
+			return loadFromCompressedCSV(filename, false, opts)
 		} else if strings.HasSuffix(strings.ToLower(filename), ".tsv.gz") {
-			return loadFromCompressedCSV(filename, true)
+			return loadFromCompressedCSV(filename, true, opts)
+		} else if strings.HasSuffix(strings.ToLower(filename), ".mtx.gz") {
+			return opts.selectCellRange(loadFromMTX(filename, true, opts))
 		}
-		return nil, nil, nil, fmt.Errorf("unsupported compressed file format: %s", filename)
+		return nil, nil, nil, unsupportedf("unsupported compressed file format: %s", filename)
+	case ".mtx":
+		return opts.selectCellRange(loadFromMTX(filename, false, opts))
 	case ".rds":
 		return loadFromRDS(filename)
+	case "":
+		return nil, nil, nil, unsupportedf("unsupported input format: %s has no extension", filename)
 	default:
-		return nil, nil, nil, fmt.Errorf("unsupported file format: %s", ext)
+		return nil, nil, nil, unsupportedf("unsupported input format: %s", ext)
+	}
+}
+
+// isArchive reports whether the file is a .scz archive or shard manifest, by
+// its block format magic or, for legacy archives without one, by its extension
+func isArchive(filename string) bool {
+	if strings.EqualFold(filepath.Ext(filename), ".scz") || isShardIndex(filename) {
+		return true
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	var magic [len(blockMagic)]byte
+	if _, err := io.ReadFull(file, magic[:]); err != nil {
+		return false
 	}
+	return magic == blockMagic
 }
 
 // loadFromCSV loads matrix data from CSV/TSV files
-func loadFromCSV(filename string, isTab bool) ([]SparseRow, []string, []string, error) {
+func loadFromCSV(filename string, isTab bool, opts LoadOptions) ([]SparseRow, []string, []string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 	defer file.Close()
 
-	return parseCSVReader(file, isTab)
+	return parseCSVReader(bufio.NewReaderSize(file, opts.bufferSize()), isTab, opts)
 }
 
 // loadFromCompressedCSV loads matrix data from compressed CSV/TSV files
-func loadFromCompressedCSV(filename string, isTab bool) ([]SparseRow, []string, []string, error) {
+func loadFromCompressedCSV(filename string, isTab bool, opts LoadOptions) ([]SparseRow, []string, []string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 	defer file.Close()
 
-	gzReader, err := gzip.NewReader(file)
+	gzReader, err := gzip.NewReader(bufio.NewReaderSize(file, opts.bufferSize()))
 	if err != nil {
 		return nil, nil, nil, err
 	}
 	defer gzReader.Close()
 
-	return parseCSVReader(gzReader, isTab)
+	// csv.Reader only buffers 4 KiB, so give it a larger buffer of its own
+	return parseCSVReader(bufio.NewReaderSize(gzReader, opts.bufferSize()), isTab, opts)
 }
 
 // parseCSVReader parses CSV data from an io.Reader
-func parseCSVReader(reader io.Reader, isTab bool) ([]SparseRow, []string, []string, error) {
+func parseCSVReader(reader io.Reader, isTab bool, opts LoadOptions) ([]SparseRow, []string, []string, error) {
 	csvReader := csv.NewReader(reader)
 	if isTab {
 		csvReader.Comma = '\t'
 	}
+	if opts.Comment != 0 && opts.Comment == csvReader.Comma {
+		return nil, nil, nil, fmt.Errorf("comment character %q is also the field delimiter", opts.Comment)
+	}
+	csvReader.Comment = opts.Comment
 
-	// Read header (gene names)
-	header, err := csvReader.Read()
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to read header: %w", err)
+	// Data values start after the cell name column, if there is one
+	firstValue := 0
+	if opts.HasIndex {
+		firstValue = 1
 	}
 
-	// First column is usually cell names, rest are gene names
-	geneNames := header[1:]
+	// Read header (gene names)
+	var geneNames []string
+	if opts.HasHeader {
+		header, err := csvReader.Read()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		if len(header) < firstValue {
+			return nil, nil, nil, fmt.Errorf("empty header")
+		}
+		geneNames = header[firstValue:]
+	}
 	var cellNames []string
 	var matrix []SparseRow
 
-	// Read data rows
-	for {
+	// Rows before the cell range are only split into fields, reusing one
+	// record, so the header must not share its storage
+	if opts.CellOffset > 0 {
+		geneNames = append([]string(nil), geneNames...)
+		csvReader.ReuseRecord = true
+	}
+
+	// Read data rows, counting the cells before the range in numRead
+	end := opts.cellRangeEnd()
+	numRead := 0
+	for end == 0 || numRead < end {
 		record, err := csvReader.Read()
 		if err == io.EOF {
 			break
@@ -92,28 +435,70 @@ func parseCSVReader(reader io.Reader, isTab bool) ([]SparseRow, []string, []stri
 			return nil, nil, nil, fmt.Errorf("failed to read CSV record: %w", err)
 		}
 
-		if len(record) < 2 {
+		if len(record) < firstValue+1 {
 			continue // Skip invalid rows
 		}
+		numRead++
+		if numRead <= opts.CellOffset {
+			if numRead == opts.CellOffset {
+				csvReader.ReuseRecord = false
+			}
+			continue
+		}
+
+		// Without a header the first row fixes the number of genes
+		if geneNames == nil {
+			geneNames = make([]string, len(record)-firstValue)
+			for i := range geneNames {
+				geneNames[i] = fmt.Sprintf("Gene_%d", i+1)
+			}
+		}
 
-		cellName := record[0]
+		cellName := fmt.Sprintf("Cell_%d", numRead)
+		if opts.HasIndex {
+			cellName = record[0]
+		}
 		cellNames = append(cellNames, cellName)
 
 		// Parse expression values
 		var indices []uint32
 		var values []uint32
 
-		for i, valueStr := range record[1:] {
-			if valueStr == "" || valueStr == "0" {
-				continue // Skip zero values
+		for i, valueStr := range record[firstValue:] {
+			value, err := 0.0, error(nil)
+			if valueStr != "" && valueStr != "0" {
+				value, err = parseCSVValue(valueStr)
 			}
-
-			value, err := strconv.ParseFloat(valueStr, 64)
 			if err != nil {
-				continue // Skip invalid values
+				if opts.LenientValues {
+					continue // Skip invalid values
+				}
+				return nil, nil, nil, fmt.Errorf("%s: invalid value %q; use -lenient-values to skip such values",
+					csvFieldLocation(csvReader, firstValue, i, geneNames), valueStr)
+			}
+			if isNonFinite(value) {
+				switch opts.NonFinite {
+				case NonFiniteDrop:
+					continue
+				case NonFiniteZero:
+					value = 0
+				default:
+					return nil, nil, nil, fmt.Errorf("%s: non-finite value %q; use -nonfinite drop or zero to accept such values",
+						csvFieldLocation(csvReader, firstValue, i, geneNames), valueStr)
+				}
+			}
+
+			if problem := countProblem(value); problem != "" {
+				if !opts.LenientValues {
+					return nil, nil, nil, fmt.Errorf("%s: %s %q; use -lenient-values to skip negative and out-of-range values and truncate fractions",
+						csvFieldLocation(csvReader, firstValue, i, geneNames), problem, valueStr)
+				}
+				if value < 0 || value > math.MaxUint32 {
+					continue
+				}
 			}
 
-			if value > 0 {
+			if opts.Zeros.keepsValue(value, valueStr == "") {
 				indices = append(indices, uint32(i))
 				values = append(values, uint32(value))
 			}
@@ -124,209 +509,1033 @@ func parseCSVReader(reader io.Reader, isTab bool) ([]SparseRow, []string, []stri
 			Values:  values,
 		})
 	}
+	if opts.CellOffset > 0 && numRead <= opts.CellOffset {
+		return nil, nil, nil, fmt.Errorf("row offset %d is past the %d cells of the input", opts.CellOffset, numRead)
+	}
 
 	return matrix, geneNames, cellNames, nil
 }
 
+// csvFieldLocation describes where value i of the record just read is, for
+// error messages
+func csvFieldLocation(csvReader *csv.Reader, firstValue, i int, geneNames []string) string {
+	line, _ := csvReader.FieldPos(firstValue + i)
+	gene := ""
+	if i < len(geneNames) {
+		gene = fmt.Sprintf(" (gene %s)", geneNames[i])
+	}
+	return fmt.Sprintf("line %d, column %d%s", line, firstValue+i+1, gene)
+}
+
+// parseCSVValue parses one expression value. Besides anything ParseFloat
+// accepts (including scientific notation such as 1e3), it reads numbers with
+// comma thousands separators like 1,234 or 12,345.5, which spreadsheets write
+// into quoted CSV fields.
+func parseCSVValue(valueStr string) (float64, error) {
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err == nil || !strings.Contains(valueStr, ",") {
+		return value, err
+	}
+
+	integer, fraction := valueStr, ""
+	if dot := strings.IndexByte(valueStr, '.'); dot >= 0 {
+		integer, fraction = valueStr[:dot], valueStr[dot:]
+	}
+	groups := strings.Split(integer, ",")
+	if len(groups[0]) == 0 || len(groups[0]) > 3 {
+		return value, err
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 {
+			return value, err
+		}
+	}
+	return strconv.ParseFloat(strings.Join(groups, "")+fraction, 64)
+}
+
 // loadFromRDS loads matrix data from RDS files (simplified implementation)
 // Note: This is a basic implementation and may not handle all RDS formats
 func loadFromRDS(filename string) ([]SparseRow, []string, []string, error) {
 	// For now, return an error suggesting conversion to CSV
-	return nil, nil, nil, fmt.Errorf("RDS format not fully supported yet. Please convert to CSV/TSV format using R:\n" +
+	return nil, nil, nil, unsupportedf("RDS format not fully supported yet. Please convert to CSV/TSV format using R:\n" +
 		"library(Matrix)\n" +
 		"data <- readRDS('%s')\n" +
 		"write.csv(as.matrix(data$all_data[[1]]$hg19$mat), 'output.csv')", filename)
 }
 
-// SaveSparseMatrix saves a sparse matrix to a CSV file
-func SaveSparseMatrix(matrix []SparseRow, geneNames, cellNames []string, filename string) error {
-	file, err := os.Create(filename)
+// defaultNameHeader heads the cell name column of CSV output when the input
+// gave it no header of its own
+const defaultNameHeader = "Cell"
+
+// SaveSparseMatrix saves a sparse matrix to a CSV file, with nameHeader above
+// the cell names and values formatted for dtype
+func SaveSparseMatrix(matrix []SparseRow, geneNames, cellNames []string, nameHeader string, dtype DType, filename string, opts SaveOptions) error {
+	writer, err := NewCSVMatrixWriter(filename, geneNames, cellNames, nameHeader, opts)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	writer.SetDType(dtype)
+
+	// Write data rows
+	for _, row := range matrix {
+		if err := writer.WriteRow(row); err != nil {
+			writer.Close()
+			return err
+		}
+	}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	return writer.Close()
+}
 
-	// Write header
-	header := append([]string{"Cell"}, geneNames...)
-	if err := writer.Write(header); err != nil {
+// SaveTransposedMatrix saves a matrix to a CSV/TSV file with genes as rows
+// and cells as columns, the layout R and Bioconductor expect, with values
+// formatted for dtype
+func SaveTransposedMatrix(matrix []SparseRow, geneNames, cellNames []string, dtype DType, filename string, opts SaveOptions) error {
+	writer, err := newCSVMatrixWriter(filename, cellNames, geneNames, "cell", "gene", "Gene", opts)
+	if err != nil {
 		return err
 	}
+	writer.SetDType(dtype)
 
-	// Write data rows
-	for i, row := range matrix {
-		cellName := ""
-		if i < len(cellNames) {
-			cellName = cellNames[i]
-		} else {
-			cellName = fmt.Sprintf("Cell_%d", i+1)
+	for _, row := range TransposeMatrix(matrix, len(geneNames)) {
+		if err := writer.WriteRow(row); err != nil {
+			writer.Close()
+			return err
 		}
+	}
 
-		// Create dense row with zeros
-		denseRow := make([]string, len(geneNames)+1)
-		denseRow[0] = cellName
-		for j := 1; j < len(denseRow); j++ {
-			denseRow[j] = "0"
-		}
+	return writer.Close()
+}
 
-		// Fill in non-zero values
-		for j, geneIdx := range row.Indices {
-			if int(geneIdx) < len(geneNames) {
-				denseRow[geneIdx+1] = strconv.Itoa(int(row.Values[j]))
+// TransposeMatrix turns a cells x genes matrix into a genes x cells one:
+// row g lists the cells expressing gene g, in ascending order. Gene indices
+// at or beyond numGenes are dropped.
+func TransposeMatrix(matrix []SparseRow, numGenes int) []SparseRow {
+	counts := make([]int, numGenes)
+	for _, row := range matrix {
+		for _, gene := range row.Indices {
+			if int(gene) < numGenes {
+				counts[gene]++
 			}
 		}
+	}
 
-		if err := writer.Write(denseRow); err != nil {
-			return err
+	transposed := make([]SparseRow, numGenes)
+	for gene, count := range counts {
+		transposed[gene] = SparseRow{
+			Indices: make([]uint32, 0, count),
+			Values:  make([]uint32, 0, count),
 		}
 	}
-
-	return nil
+	for cell, row := range matrix {
+		for i, gene := range row.Indices {
+			if int(gene) < numGenes {
+				transposed[gene].Indices = append(transposed[gene].Indices, uint32(cell))
+				transposed[gene].Values = append(transposed[gene].Values, row.Values[i])
+			}
+		}
+	}
+	return transposed
 }
 
-// SaveToFile saves compressed data to a binary file
-func (cd *CompressedData) SaveToFile(filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+// OutputDelimiter returns the field delimiter for a matrix output file: a tab
+// for .tsv files and a comma otherwise
+func OutputDelimiter(filename string) rune {
+	if strings.ToLower(filepath.Ext(filename)) == ".tsv" {
+		return '\t'
 	}
-	defer file.Close()
+	return ','
+}
 
-	// Use zlib compression for the entire file
-	zlibWriter := zlib.NewWriter(file)
-	defer zlibWriter.Close()
+// NameQuoting selects how gene and cell names that R's read.csv may misparse
+// are written to CSV/TSV output. Commas and the delimiter are always safe:
+// such names are quoted, which R, pandas and this tool all read back.
+type NameQuoting int
 
-	var buf bytes.Buffer
+const (
+	// QuoteRFC4180 writes names as they are, quoted per RFC 4180 (embedded
+	// quotes doubled, fields with line breaks quoted). pandas reads this
+	// back, but R's read.csv can split rows at embedded line breaks.
+	QuoteRFC4180 NameQuoting = iota
+	// QuoteSanitize replaces line breaks and tabs in names with spaces and
+	// double quotes with single quotes, so the output reads back everywhere
+	// at the cost of altering those names
+	QuoteSanitize
+	// QuoteStrict refuses to write output containing such names, listing them
+	QuoteStrict
+)
 
-	// Write header
-	if err := binary.Write(&buf, binary.LittleEndian, cd.Header); err != nil {
-		return err
+// ParseNameQuoting parses a -name-quoting value: rfc4180, sanitize or strict
+func ParseNameQuoting(name string) (NameQuoting, error) {
+	switch name {
+	case "rfc4180":
+		return QuoteRFC4180, nil
+	case "sanitize":
+		return QuoteSanitize, nil
+	case "strict":
+		return QuoteStrict, nil
+	default:
+		return QuoteRFC4180, fmt.Errorf("unknown name quoting %q; use rfc4180, sanitize or strict", name)
 	}
+}
 
-	// Write gene names
-	if err := writeStringSlice(&buf, cd.GeneNames); err != nil {
-		return err
-	}
+// nameSanitizer replaces the characters QuoteSanitize removes from names
+var nameSanitizer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ", "\t", " ", `"`, "'")
 
-	// Write cell names
-	if err := writeStringSlice(&buf, cd.CellNames); err != nil {
-		return err
+// outputNames applies the quoting mode to names of the given kind ("gene" or
+// "cell") before they are written
+func (opts SaveOptions) outputNames(names []string, kind string) ([]string, error) {
+	if opts.Quoting == QuoteRFC4180 {
+		return names, nil
 	}
 
-	// Write number of compressed rows
-	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(cd.CompressedRows))); err != nil {
-		return err
+	var bad []string
+	converted := names
+	copied := false
+	for i, name := range names {
+		if !strings.ContainsAny(name, "\"\r\n\t") {
+			continue
+		}
+		if opts.Quoting == QuoteStrict {
+			bad = append(bad, strconv.Quote(name))
+			continue
+		}
+		if !copied {
+			converted = append([]string(nil), names...)
+			copied = true
+		}
+		converted[i] = nameSanitizer.Replace(name)
 	}
 
-	// Write compressed rows
-	for _, row := range cd.CompressedRows {
-		if err := writeCompressedRow(&buf, row); err != nil {
-			return err
+	if len(bad) > 0 {
+		const maxListed = 10
+		more := ""
+		if len(bad) > maxListed {
+			more = fmt.Sprintf(" and %d more", len(bad)-maxListed)
+			bad = bad[:maxListed]
 		}
+		return nil, fmt.Errorf("%s names with quotes, tabs or line breaks would not read back in R: %s%s (use -name-quoting sanitize)",
+			kind, strings.Join(bad, ", "), more)
 	}
+	return converted, nil
+}
 
-	// Write buffer to zlib writer
-	_, err = zlibWriter.Write(buf.Bytes())
-	return err
+// ValueFormat selects how CSV/TSV output writes values. Values are counts,
+// so the formats differ only in how they spell them.
+type ValueFormat int
+
+const (
+	// FormatByDType writes plain integers (3) for integer dtypes and floats
+	// (3.0) for float32 and float64
+	FormatByDType ValueFormat = iota
+	// FormatInt always writes plain integers (-force-int)
+	FormatInt
+	// FormatFloat always writes floats (-force-float)
+	FormatFloat
+)
+
+// SaveOptions controls how matrices and the name tables written with them
+// are saved. The zero value matches the command-line defaults.
+type SaveOptions struct {
+	// Quoting is how gene and cell names R's read.csv may misparse are
+	// written
+	Quoting NameQuoting
+
+	// Format selects integer or float values of CSV/TSV output, and
+	// Precision the significant digits of floats, 0 for the fewest that
+	// read back as the stored value
+	Format    ValueFormat
+	Precision int
+
+	// BufferSize is the write buffer size in bytes of matrix files, 0 for
+	// defaultIOBufferSize
+	BufferSize int
+
+	// Overwrite lets writers replace an existing file; by default they
+	// refuse
+	Overwrite bool
+
+	// Outputs, if set, records every file the writers create
+	Outputs *OutputSet
+
+	// Context, if set, stops SaveToFile between blocks once it is done
+	Context context.Context
 }
 
-// LoadCompressedData loads compressed data from a binary file
-func LoadCompressedData(filename string) (*CompressedData, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// ctx returns the context writers stop on
+func (opts SaveOptions) ctx() context.Context {
+	if opts.Context != nil {
+		return opts.Context
 	}
-	defer file.Close()
+	return context.Background()
+}
 
-	// Use zlib decompression
-	zlibReader, err := zlib.NewReader(file)
-	if err != nil {
-		return nil, err
+// bufferSize returns the write buffer size to use
+func (opts SaveOptions) bufferSize() int {
+	if opts.BufferSize > 0 {
+		return opts.BufferSize
 	}
-	defer zlibReader.Close()
+	return defaultIOBufferSize
+}
 
-	var buf bytes.Buffer
-	if _, err := buf.ReadFrom(zlibReader); err != nil {
-		return nil, err
+// floatOutput reports whether values of a matrix of the given dtype are
+// written as floats
+func (opts SaveOptions) floatOutput(dtype DType) bool {
+	switch opts.Format {
+	case FormatInt:
+		return false
+	case FormatFloat:
+		return true
+	default:
+		return dtype == DTypeFloat32 || dtype == DTypeFloat64
 	}
+}
 
-	reader := bytes.NewReader(buf.Bytes())
-	cd := &CompressedData{}
+// formatValue spells a value as a plain integer, or as a float with
+// Precision significant digits. A float always has a decimal point or an
+// exponent (3.0, not 3) so readers expecting floats take it as one.
+func (opts SaveOptions) formatValue(value uint32, asFloat bool) string {
+	if !asFloat {
+		return strconv.FormatUint(uint64(value), 10)
+	}
+	precision := opts.Precision
+	if precision == 0 {
+		precision = -1
+	}
+	text := strconv.FormatFloat(float64(value), 'g', precision, 64)
+	if !strings.ContainsAny(text, ".e") {
+		text += ".0"
+	}
+	return text
+}
 
-	// Read header
-	if err := binary.Read(reader, binary.LittleEndian, &cd.Header); err != nil {
+// CSVMatrixWriter writes a sparse matrix to a dense CSV file one row at a time
+type CSVMatrixWriter struct {
+	file      io.WriteCloser
+	writer    *csv.Writer
+	geneNames []string
+	cellNames []string
+	numRows   int
+	denseRow  []string // Cell name and a zero per gene, reused across rows
+	opts      SaveOptions
+	asFloat   bool   // Write values as floats, see SetDType
+	zero      string // Absent values as written
+}
+
+// NewCSVMatrixWriter creates the output file and writes the gene header,
+// headed by nameHeader above the cell names
+func NewCSVMatrixWriter(filename string, geneNames, cellNames []string, nameHeader string, opts SaveOptions) (*CSVMatrixWriter, error) {
+	return newCSVMatrixWriter(filename, geneNames, cellNames, "gene", "cell", nameHeader, opts)
+}
+
+// newCSVMatrixWriter creates a writer with a column per name in geneNames and
+// rows named by cellNames, under nameHeader. The kinds ("gene" and "cell",
+// swapped for a transposed matrix) label the names in errors.
+func newCSVMatrixWriter(filename string, geneNames, cellNames []string, columnKind, rowKind, nameHeader string, opts SaveOptions) (*CSVMatrixWriter, error) {
+	geneNames, err := opts.outputNames(geneNames, columnKind)
+	if err != nil {
+		return nil, err
+	}
+	if cellNames, err = opts.outputNames(cellNames, rowKind); err != nil {
 		return nil, err
 	}
 
-	// Read gene names
-	cd.GeneNames, err = readStringSlice(reader)
+	file, err := createOutputFile(filename, opts)
 	if err != nil {
 		return nil, err
 	}
+	return newCSVMatrixStream(file, OutputDelimiter(filename), geneNames, cellNames, nameHeader, opts)
+}
 
-	// Read cell names
-	cd.CellNames, err = readStringSlice(reader)
+// NewCSVMatrixStreamWriter writes a CSV matrix to an already open stream,
+// such as a pipe, which Close closes
+func NewCSVMatrixStreamWriter(stream io.WriteCloser, geneNames, cellNames []string, nameHeader string, opts SaveOptions) (*CSVMatrixWriter, error) {
+	geneNames, err := opts.outputNames(geneNames, "gene")
 	if err != nil {
 		return nil, err
 	}
-
-	// Read number of compressed rows
-	var numRows uint32
-	if err := binary.Read(reader, binary.LittleEndian, &numRows); err != nil {
+	if cellNames, err = opts.outputNames(cellNames, "cell"); err != nil {
 		return nil, err
 	}
+	return newCSVMatrixStream(stream, ',', geneNames, cellNames, nameHeader, opts)
+}
 
-	// Read compressed rows
-	cd.CompressedRows = make([]CompressedRow, numRows)
-	for i := uint32(0); i < numRows; i++ {
-		row, err := readCompressedRow(reader)
-		if err != nil {
-			return nil, err
-		}
-		cd.CompressedRows[i] = row
+// newCSVMatrixStream writes the header of a matrix with checked names
+func newCSVMatrixStream(stream io.WriteCloser, delimiter rune, geneNames, cellNames []string, nameHeader string, opts SaveOptions) (*CSVMatrixWriter, error) {
+	w := &CSVMatrixWriter{
+		file:      stream,
+		writer:    csv.NewWriter(bufio.NewWriterSize(stream, opts.bufferSize())), // csv.Writer reuses this buffer
+		geneNames: geneNames,
+		cellNames: cellNames,
+		denseRow:  make([]string, len(geneNames)+1),
+		opts:      opts,
 	}
+	w.SetDType(DTypeUnknown)
+	w.writer.Comma = delimiter
 
-	return cd, nil
+	// Write header
+	header := append([]string{nameHeader}, geneNames...)
+	if err := w.writer.Write(header); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return w, nil
 }
 
-// EstimateSize estimates the size of compressed data in bytes
-func (cd *CompressedData) EstimateSize() int {
-	size := 0
-	
-	// Header size
-	size += 32 // approximate header size
-	
-	// Gene names
-	for _, name := range cd.GeneNames {
-		size += len(name) + 4 // string length + length prefix
+// SetDType formats values for a matrix of the given dtype (see floatOutput);
+// writers start out formatting for an unknown dtype. Call it before WriteRow.
+func (w *CSVMatrixWriter) SetDType(dtype DType) {
+	w.asFloat = w.opts.floatOutput(dtype)
+	w.zero = w.opts.formatValue(0, w.asFloat)
+	for j := 1; j < len(w.denseRow); j++ {
+		w.denseRow[j] = w.zero
 	}
-	
-	// Cell names
-	for _, name := range cd.CellNames {
-		size += len(name) + 4 // string length + length prefix
-	}
-	
-	// Compressed rows
-	for _, row := range cd.CompressedRows {
-		size += len(row.EliasGenes) + len(row.DeltaValues) + 16 // data + metadata
-	}
-	
-	return size
 }
 
-// Helper functions for reading/writing binary data
+// WriteRow writes the next cell's row. The dense row buffer is shared by all
+// rows: only the row's expressed genes are filled in, and reset to zero once
+// the row is written, so a row costs O(expressed genes) beyond the write.
+func (w *CSVMatrixWriter) WriteRow(row SparseRow) error {
+	i := w.numRows
+	w.numRows++
 
-func writeStringSlice(buf *bytes.Buffer, strings []string) error {
-	// Write number of strings
-	if err := binary.Write(buf, binary.LittleEndian, uint32(len(strings))); err != nil {
-		return err
+	cellName := ""
+	if i < len(w.cellNames) {
+		cellName = w.cellNames[i]
+	} else {
+		cellName = fmt.Sprintf("Cell_%d", i+1)
 	}
-	
+
+	// Fill in non-zero values
+	w.denseRow[0] = cellName
+	for j, geneIdx := range row.Indices {
+		if int(geneIdx) < len(w.geneNames) {
+			w.denseRow[geneIdx+1] = w.opts.formatValue(row.Values[j], w.asFloat)
+		}
+	}
+
+	err := w.writer.Write(w.denseRow)
+	for _, geneIdx := range row.Indices {
+		if int(geneIdx) < len(w.geneNames) {
+			w.denseRow[geneIdx+1] = w.zero
+		}
+	}
+	return err
+}
+
+// Close flushes buffered rows and closes the file or stream
+func (w *CSVMatrixWriter) Close() error {
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// SaveToFile saves compressed data to a binary file in the block format.
+// Rows are serialized one block at a time so the full payload is never held
+// in memory as a whole. Only opts.Overwrite, opts.Outputs and opts.Context
+// apply.
+func (cd *CompressedData) SaveToFile(filename string, opts SaveOptions) error {
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriterSize(file, defaultIOBufferSize)
+	if err := cd.writeBlocks(opts.ctx(), writer); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writePreamble serializes the header, name slices and row count. Every
+// section is always written, so the header is stamped with FormatVersion even
+// when cd was loaded from an older archive.
+func (cd *CompressedData) writePreamble(w io.Writer) error {
+	// Write header
+	header := cd.Header
+	header.Version = FormatVersion
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	// Write gene and cell names
+	writeNames := writeStringSlice
+	if cd.Header.FrontCodedNames {
+		writeNames = writeFrontCoded
+	}
+	if err := writeNames(w, cd.GeneNames); err != nil {
+		return err
+	}
+	if err := writeNames(w, cd.CellNames); err != nil {
+		return err
+	}
+
+	// Write medoid cell indices
+	if err := writeUint32Slice(w, cd.Medoids); err != nil {
+		return err
+	}
+
+	// Write adaptive quantization codebook (empty when unused)
+	if err := writeCodebook(w, cd.Codebook); err != nil {
+		return err
+	}
+
+	// Write the gene filter mapping (empty when all genes are kept)
+	if err := writeUint32Slice(w, cd.KeptGenes); err != nil {
+		return err
+	}
+	if err := writeStringSlice(w, cd.DroppedGeneNames); err != nil {
+		return err
+	}
+
+	// Write the original value dtype
+	if err := binary.Write(w, binary.LittleEndian, cd.DType); err != nil {
+		return err
+	}
+
+	// Write per-gene feature types (empty when unknown)
+	if err := writeStringSlice(w, cd.FeatureTypes); err != nil {
+		return err
+	}
+
+	// Write the cells stored unquantized (empty unless lossy with a max error)
+	if err := writeUint32Slice(w, cd.LosslessCells); err != nil {
+		return err
+	}
+
+	// Write the mean cell (empty when unused)
+	var mean SparseRow
+	if cd.MeanCell != nil {
+		mean = *cd.MeanCell
+	}
+	if err := writeUint32Slice(w, mean.Indices); err != nil {
+		return err
+	}
+	if err := writeUint32Slice(w, mean.Values); err != nil {
+		return err
+	}
+
+	// Write the genes stored unquantized (empty unless lossy with a gene panel)
+	if err := writeUint32Slice(w, cd.LosslessGenes); err != nil {
+		return err
+	}
+
+	// Write the number of genes kept per cell (0 unless the rest were dropped)
+	if err := binary.Write(w, binary.LittleEndian, cd.TopGenesPerCell); err != nil {
+		return err
+	}
+
+	// Write the cell name column header, as a list of zero or one names
+	var nameHeader []string
+	if cd.NameHeader != nil {
+		nameHeader = []string{*cd.NameHeader}
+	}
+	if err := writeStringSlice(w, nameHeader); err != nil {
+		return err
+	}
+
+	// Write the source file hash, length-prefixed (empty if not recorded)
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(cd.SourceHash))); err != nil {
+		return err
+	}
+	if _, err := w.Write(cd.SourceHash); err != nil {
+		return err
+	}
+
+	// Write number of compressed rows
+	return binary.Write(w, binary.LittleEndian, uint32(len(cd.CompressedRows)))
+}
+
+// LoadCompressedData loads compressed data from a binary file, or from the
+// shards listed in a .index manifest (see SaveShardedArchive)
+func LoadCompressedData(filename string) (*CompressedData, error) {
+	cd, _, err := loadCompressedData(filename, false)
+	return cd, err
+}
+
+// LoadCompressedDataSkippingBadBlocks loads compressed data, replacing the rows
+// of blocks that fail their checksum with empty rows instead of failing. The
+// returned damage list describes the replaced cell ranges.
+func LoadCompressedDataSkippingBadBlocks(filename string) (*CompressedData, []BlockDamage, error) {
+	return loadCompressedData(filename, true)
+}
+
+func loadCompressedData(filename string, skipBadBlocks bool) (*CompressedData, []BlockDamage, error) {
+	if isShardIndex(filename) {
+		return loadShardedArchive(filename, func(shard string) (*CompressedData, []BlockDamage, error) {
+			return loadCompressedData(shard, skipBadBlocks)
+		})
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, defaultIOBufferSize)
+	magic, err := reader.Peek(len(blockMagic))
+	if err == nil && bytes.Equal(magic, blockMagic[:]) {
+		return readBlocks(reader, archiveBudget(file), skipBadBlocks)
+	}
+
+	// Files written before the block format are a single zlib stream
+	cd, err := loadLegacyCompressedData(reader)
+	return cd, nil, err
+}
+
+// LoadCompressedHeader loads only an archive's header, names and other
+// preamble sections, leaving CompressedRows nil. Block format archives are
+// read up to the first block, so no row is read or decoded whatever the
+// archive's size. Legacy archives are a single zlib stream, which is
+// inflated whole, but their rows are not parsed either.
+func LoadCompressedHeader(filename string) (*CompressedData, error) {
+	if isShardIndex(filename) {
+		cd, _, err := loadShardedArchive(filename, func(shard string) (*CompressedData, []BlockDamage, error) {
+			cd, err := LoadCompressedHeader(shard)
+			return cd, nil, err
+		})
+		return cd, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, defaultIOBufferSize)
+	magic, err := reader.Peek(len(blockMagic))
+	if err == nil && bytes.Equal(magic, blockMagic[:]) {
+		budget := archiveBudget(file)
+		cd, _, err := readBlockPreamble(reader, &budget)
+		return cd, err
+	}
+
+	data, err := inflateLegacy(reader)
+	if err != nil {
+		return nil, err
+	}
+	cd, _, err := readPreamble(data)
+	return cd, err
+}
+
+// inflateLegacy decompresses a legacy archive's zlib stream
+func inflateLegacy(r io.Reader) (*bytes.Reader, error) {
+	zlibReader, err := zlib.NewReader(r)
+	if err == zlib.ErrHeader {
+		return nil, unsupportedf("not a compressed archive: %w", err)
+	} else if err != nil {
+		return nil, eofAsTruncated(err, "failed to read archive")
+	}
+	defer zlibReader.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(zlibReader); err != nil {
+		var corrupt flate.CorruptInputError
+		switch {
+		case err == zlib.ErrChecksum:
+			return nil, checksumf("archive checksum mismatch")
+		case errors.As(err, &corrupt):
+			return nil, corruptf("failed to inflate archive: %w", err)
+		}
+		return nil, eofAsTruncated(err, "failed to inflate archive")
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// loadLegacyCompressedData reads the original single-zlib-stream format
+func loadLegacyCompressedData(r io.Reader) (*CompressedData, error) {
+	reader, err := inflateLegacy(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cd, numRows, err := readPreamble(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read compressed rows
+	cd.CompressedRows = make([]CompressedRow, numRows)
+	for i := uint32(0); i < numRows; i++ {
+		row, err := readCompressedRow(reader)
+		if err != nil {
+			return nil, corruptf("failed to read row %d: %w", i, err)
+		}
+		cd.CompressedRows[i] = row
+	}
+
+	return cd, nil
+}
+
+// readPreamble reads the header, name slices and row count. The preamble is
+// read from memory, so running out of data means the archive is corrupt.
+func readPreamble(reader *bytes.Reader) (*CompressedData, uint32, error) {
+	cd, numRows, err := parsePreamble(reader)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, corruptf("preamble ends early: %w", err)
+	}
+	return cd, numRows, err
+}
+
+// parsePreamble does the work of readPreamble
+func parsePreamble(reader *bytes.Reader) (*CompressedData, uint32, error) {
+	cd := &CompressedData{}
+	var err error
+
+	// Read header
+	var header headerV1
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, 0, err
+	}
+	cd.Header = Header{
+		Version:     header.Version,
+		NumCells:    header.NumCells,
+		NumGenes:    header.NumGenes,
+		IsLossy:     header.IsLossy,
+		Threshold:   header.Threshold,
+		QuantLevels: header.QuantLevels,
+		Timestamp:   header.Timestamp,
+	}
+	if cd.Header.Version > FormatVersion {
+		return nil, 0, unsupportedf("archive format version %d is newer than the newest version this build reads (%d); upgrade the tool",
+			cd.Header.Version, FormatVersion)
+	}
+	if cd.Header.Version >= 7 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.Header.IsBinary); err != nil {
+			return nil, 0, err
+		}
+	}
+	if cd.Header.Version >= 8 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.Header.EliasFlate); err != nil {
+			return nil, 0, err
+		}
+	}
+	if cd.Header.Version >= 9 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.Header.RefsOrdered); err != nil {
+			return nil, 0, err
+		}
+	}
+	if cd.Header.Version >= 10 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.Header.GeneChunk); err != nil {
+			return nil, 0, err
+		}
+	}
+	if cd.Header.Version >= 11 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.Header.FrontCodedNames); err != nil {
+			return nil, 0, err
+		}
+	}
+	if cd.Header.Version >= 12 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.Header.ValueCodec); err != nil {
+			return nil, 0, err
+		}
+		if _, ok := valueCodecNames[cd.Header.ValueCodec]; !ok {
+			return nil, 0, unsupportedf("unknown value codec %d", cd.Header.ValueCodec)
+		}
+	}
+
+	// Read gene and cell names
+	readNames := readStringSlice
+	if cd.Header.FrontCodedNames {
+		readNames = readFrontCoded
+	}
+	cd.GeneNames, err = readNames(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	cd.CellNames, err = readNames(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Read medoid cell indices, introduced in version 2
+	if cd.Header.Version >= 2 {
+		cd.Medoids, err = readUint32Slice(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Read adaptive quantization codebook, introduced in version 3
+	if cd.Header.Version >= 3 {
+		cd.Codebook, err = readCodebook(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Read the gene filter mapping, introduced in version 4
+	if cd.Header.Version >= 4 {
+		cd.KeptGenes, err = readUint32Slice(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		cd.DroppedGeneNames, err = readStringSlice(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(cd.KeptGenes) > 0 && len(cd.KeptGenes) != len(cd.GeneNames) {
+			return nil, 0, corruptf("gene filter maps %d genes but archive has %d gene names",
+				len(cd.KeptGenes), len(cd.GeneNames))
+		}
+	}
+
+	// Read the original value dtype, introduced in version 5
+	if cd.Header.Version >= 5 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.DType); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Read per-gene feature types, introduced in version 6
+	if cd.Header.Version >= 6 {
+		cd.FeatureTypes, err = readStringSlice(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		numOriginal := len(cd.GeneNames)
+		if len(cd.KeptGenes) > 0 {
+			numOriginal = len(cd.KeptGenes) + len(cd.DroppedGeneNames)
+		}
+		if len(cd.FeatureTypes) > 0 && len(cd.FeatureTypes) != numOriginal {
+			return nil, 0, corruptf("archive has %d feature types for %d genes", len(cd.FeatureTypes), numOriginal)
+		}
+	}
+
+	// Read the lossless cells of a lossy archive, introduced in version 14
+	if cd.Header.Version >= 14 {
+		cd.LosslessCells, err = readUint32Slice(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, cell := range cd.LosslessCells {
+			if cell >= cd.Header.NumCells || (i > 0 && cell <= cd.LosslessCells[i-1]) {
+				return nil, 0, corruptf("invalid lossless cell list at cell %d", cell)
+			}
+		}
+	}
+
+	// Read the mean cell, introduced in version 16
+	if cd.Header.Version >= 16 {
+		var mean SparseRow
+		if mean.Indices, err = readUint32Slice(reader); err != nil {
+			return nil, 0, err
+		}
+		if mean.Values, err = readUint32Slice(reader); err != nil {
+			return nil, 0, err
+		}
+		if len(mean.Values) != len(mean.Indices) {
+			return nil, 0, corruptf("mean cell has %d genes but %d values", len(mean.Indices), len(mean.Values))
+		}
+		for i := 1; i < len(mean.Indices); i++ {
+			if mean.Indices[i] <= mean.Indices[i-1] {
+				return nil, 0, corruptf("mean cell genes out of order at gene %d", mean.Indices[i])
+			}
+		}
+		if len(mean.Indices) > 0 {
+			cd.MeanCell = &mean
+		}
+	}
+
+	// Read the lossless genes of a lossy archive, introduced in version 17
+	if cd.Header.Version >= 17 {
+		cd.LosslessGenes, err = readUint32Slice(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, gene := range cd.LosslessGenes {
+			if int(gene) >= len(cd.GeneNames) || (i > 0 && gene <= cd.LosslessGenes[i-1]) {
+				return nil, 0, corruptf("invalid lossless gene list at gene %d", gene)
+			}
+		}
+	}
+
+	// Read the number of genes kept per cell, introduced in version 18
+	if cd.Header.Version >= 18 {
+		if err := binary.Read(reader, binary.LittleEndian, &cd.TopGenesPerCell); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Read the cell name column header, introduced in version 19
+	if cd.Header.Version >= 19 {
+		nameHeader, err := readStringSlice(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch len(nameHeader) {
+		case 0:
+		case 1:
+			cd.NameHeader = &nameHeader[0]
+		default:
+			return nil, 0, corruptf("archive has %d cell name column headers", len(nameHeader))
+		}
+	}
+
+	// Read the source file hash, introduced in version 20
+	if cd.Header.Version >= 20 {
+		var length uint32
+		if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+			return nil, 0, err
+		}
+		if cd.SourceHash, err = readPayload(reader, length); err != nil {
+			return nil, 0, corruptf("source hash: %w", err)
+		}
+		if length == 0 {
+			cd.SourceHash = nil
+		}
+	}
+
+	// Read number of compressed rows
+	var numRows uint32
+	if err := binary.Read(reader, binary.LittleEndian, &numRows); err != nil {
+		return nil, 0, err
+	}
+
+	return cd, numRows, nil
+}
+
+// EstimateSize estimates the size of compressed data in bytes
+func (cd *CompressedData) EstimateSize() int {
+	size := 0
+	
+	// Header size
+	size += 32 // approximate header size
+	
+	// Gene names
+	for _, name := range cd.GeneNames {
+		size += len(name) + 4 // string length + length prefix
+	}
+	
+	// Cell names
+	for _, name := range cd.CellNames {
+		size += len(name) + 4 // string length + length prefix
+	}
+	
+	// Compressed rows
+	for _, row := range cd.CompressedRows {
+		size += len(row.EliasGenes) + len(row.DeltaValues) + 16 // data + metadata
+	}
+	
+	return size
+}
+
+// EstimateOriginalSize estimates the size in bytes of the uncompressed sparse
+// matrix: the names plus 4 bytes per stored gene index and value
+func EstimateOriginalSize(matrix []SparseRow, geneNames, cellNames []string) int {
+	size := 0
+	// Gene names
+	for _, name := range geneNames {
+		size += len(name)
+	}
+	// Cell names
+	for _, name := range cellNames {
+		size += len(name)
+	}
+	// Matrix data (assuming 4 bytes per int32)
+	for _, row := range matrix {
+		size += len(row.Indices) * 4 // gene indices
+		size += len(row.Values) * 4  // expression values
+	}
+	return size
+}
+
+// EnsureOutputDir creates the parent directory of filename if it doesn't exist
+func EnsureOutputDir(filename string) error {
+	return os.MkdirAll(filepath.Dir(filename), 0755)
+}
+
+// OutputSet records the output files a run creates, so a run that fails or
+// is interrupted can remove them rather than leave truncated files behind
+// that could be mistaken for valid ones. A nil OutputSet records nothing.
+type OutputSet struct {
+	mu    sync.Mutex
+	paths []string // Created since the last Commit, possibly incomplete
+}
+
+// add records a newly created output file
+func (s *OutputSet) add(path string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, path)
+}
+
+// Commit marks every output file recorded so far as complete
+func (s *OutputSet) Commit() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = nil
+}
+
+// RemovePartial deletes the output files recorded since the last Commit and
+// returns the removed paths
+func (s *OutputSet) RemovePartial() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []string
+	for _, path := range s.paths {
+		if err := os.Remove(path); err == nil {
+			removed = append(removed, path)
+		}
+	}
+	s.paths = nil
+	return removed
+}
+
+// createOutputFile creates filename, replacing an existing file only with
+// opts.Overwrite and recording it in opts.Outputs. It reports a missing parent
+// directory and an existing file clearly.
+func createOutputFile(filename string, opts SaveOptions) (*os.File, error) {
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if !opts.Overwrite {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(filename, flags, 0666)
+	if err == nil {
+		opts.Outputs.add(filename)
+		return file, nil
+	}
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("output %s exists, use -force to overwrite", filename)
+	}
+
+	dir := filepath.Dir(filename)
+	if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+		return nil, fmt.Errorf("output directory %s does not exist (use -mkdir to create it)", dir)
+	}
+	return nil, err
+}
+
+// Helper functions for reading/writing binary data
+
+func writeStringSlice(w io.Writer, strings []string) error {
+	// Write number of strings
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(strings))); err != nil {
+		return err
+	}
+	
 	// Write each string
 	for _, s := range strings {
-		if err := writeString(buf, s); err != nil {
+		if err := writeString(w, s); err != nil {
 			return err
 		}
 	}
@@ -350,57 +1559,169 @@ func readStringSlice(reader *bytes.Reader) ([]string, error) {
 	return strings, nil
 }
 
-func writeString(buf *bytes.Buffer, s string) error {
-	// Write string length
-	if err := binary.Write(buf, binary.LittleEndian, uint32(len(s))); err != nil {
+// writeFrontCoded writes strings front-coded: each string stores the length
+// of the prefix it shares with the previous string, then the rest of it. Cell
+// barcodes and numbered gene names share long prefixes, especially sorted.
+func writeFrontCoded(w io.Writer, strings []string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(strings))); err != nil {
 		return err
 	}
-	// Write string data
-	_, err := buf.WriteString(s)
-	return err
+
+	var scratch [2 * binary.MaxVarintLen32]byte
+	previous := ""
+	for _, s := range strings {
+		shared := 0
+		for shared < len(s) && shared < len(previous) && s[shared] == previous[shared] {
+			shared++
+		}
+		n := binary.PutUvarint(scratch[:], uint64(shared))
+		n += binary.PutUvarint(scratch[n:], uint64(len(s)-shared))
+		if _, err := w.Write(scratch[:n]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, s[shared:]); err != nil {
+			return err
+		}
+		previous = s
+	}
+	return nil
 }
 
-func readString(reader *bytes.Reader) (string, error) {
-	var length uint32
-	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
-		return "", err
+// readFrontCoded reads strings written by writeFrontCoded
+func readFrontCoded(reader *bytes.Reader) ([]string, error) {
+	var count uint32
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return nil, err
 	}
-	
-	data := make([]byte, length)
-	if _, err := reader.Read(data); err != nil {
-		return "", err
+	if int64(count)*2 > int64(reader.Len()) {
+		return nil, corruptf("corrupt names: %d names exceed remaining %d bytes", count, reader.Len())
 	}
-	return string(data), nil
+
+	strings := make([]string, count)
+	var previous []byte
+	for i := range strings {
+		shared, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		suffix, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if shared > uint64(len(previous)) || suffix > uint64(reader.Len()) {
+			return nil, corruptf("corrupt name %d: prefix %d or suffix %d out of range", i, shared, suffix)
+		}
+
+		data := make([]byte, shared+suffix)
+		copy(data, previous[:shared])
+		if _, err := io.ReadFull(reader, data[shared:]); err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(data) {
+			return nil, corruptf("corrupt name: %q is not valid UTF-8", data)
+		}
+		strings[i] = string(data)
+		previous = data
+	}
+	return strings, nil
 }
 
-func writeCompressedRow(buf *bytes.Buffer, row CompressedRow) error {
-	// Write metadata
-	if err := binary.Write(buf, binary.LittleEndian, row.RefCell); err != nil {
+func writeUint32Slice(w io.Writer, values []uint32) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(values))); err != nil {
 		return err
 	}
-	if err := binary.Write(buf, binary.LittleEndian, row.NumGenes); err != nil {
-		return err
+	return binary.Write(w, binary.LittleEndian, values)
+}
+
+func readUint32Slice(reader *bytes.Reader) ([]uint32, error) {
+	var count uint32
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return nil, err
 	}
-	if err := binary.Write(buf, binary.LittleEndian, row.MaxGeneIndex); err != nil {
-		return err
+	if int64(count)*4 > int64(reader.Len()) {
+		return nil, corruptf("corrupt slice: %d values exceed remaining %d bytes", count, reader.Len())
 	}
-	
-	// Write Elias-Fano data
-	if err := binary.Write(buf, binary.LittleEndian, uint32(len(row.EliasGenes))); err != nil {
-		return err
+
+	values := make([]uint32, count)
+	if err := binary.Read(reader, binary.LittleEndian, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func writeCodebook(w io.Writer, codebook *Codebook) error {
+	var reps []uint32
+	var boundaries []float64
+	if codebook != nil {
+		reps = codebook.Representatives
+		boundaries = codebook.Boundaries
 	}
-	if _, err := buf.Write(row.EliasGenes); err != nil {
+
+	if err := writeUint32Slice(w, reps); err != nil {
 		return err
 	}
-	
-	// Write delta values
-	if err := binary.Write(buf, binary.LittleEndian, uint32(len(row.DeltaValues))); err != nil {
+	return binary.Write(w, binary.LittleEndian, boundaries)
+}
+
+func readCodebook(reader *bytes.Reader) (*Codebook, error) {
+	reps, err := readUint32Slice(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(reps) == 0 {
+		return nil, nil
+	}
+
+	codebook := &Codebook{
+		Representatives: reps,
+		Boundaries:      make([]float64, len(reps)-1),
+	}
+	if err := binary.Read(reader, binary.LittleEndian, codebook.Boundaries); err != nil {
+		return nil, err
+	}
+	if err := codebook.Validate(); err != nil {
+		return nil, corruptf("invalid codebook: %w", err)
+	}
+	return codebook, nil
+}
+
+func writeString(w io.Writer, s string) error {
+	// Names are read back as UTF-8, so refuse to write anything that won't be
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("name %q is not valid UTF-8", s)
+	}
+
+	// Write string length
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(s))); err != nil {
 		return err
 	}
-	_, err := buf.Write(row.DeltaValues)
+	// Write string data
+	_, err := io.WriteString(w, s)
 	return err
 }
 
+func readString(reader *bytes.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	
+	if int64(length) > int64(reader.Len()) {
+		return "", corruptf("corrupt name: length %d exceeds remaining %d bytes", length, reader.Len())
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+	if !utf8.Valid(data) {
+		return "", corruptf("corrupt name: %q is not valid UTF-8", data)
+	}
+	return string(data), nil
+}
+
+// readCompressedRow reads one row of the row-by-row layout used before
+// version 15: fixed-size metadata, then the length-prefixed payloads
 func readCompressedRow(reader *bytes.Reader) (CompressedRow, error) {
 	var row CompressedRow
 	
@@ -420,8 +1741,8 @@ func readCompressedRow(reader *bytes.Reader) (CompressedRow, error) {
 	if err := binary.Read(reader, binary.LittleEndian, &eliasLen); err != nil {
 		return row, err
 	}
-	row.EliasGenes = make([]byte, eliasLen)
-	if _, err := reader.Read(row.EliasGenes); err != nil {
+	var err error
+	if row.EliasGenes, err = readPayload(reader, eliasLen); err != nil {
 		return row, err
 	}
 	
@@ -430,8 +1751,7 @@ func readCompressedRow(reader *bytes.Reader) (CompressedRow, error) {
 	if err := binary.Read(reader, binary.LittleEndian, &deltaLen); err != nil {
 		return row, err
 	}
-	row.DeltaValues = make([]byte, deltaLen)
-	if _, err := reader.Read(row.DeltaValues); err != nil {
+	if row.DeltaValues, err = readPayload(reader, deltaLen); err != nil {
 		return row, err
 	}
 	
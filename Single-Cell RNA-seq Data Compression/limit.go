@@ -0,0 +1,44 @@
+package main
+
+// applyCellLimit removes the genes that no cell of a matrix loaded with a
+// CellLimit expresses, with their feature types, so a limited archive only
+// covers the genes its cells touch. Without a limit the matrix is unchanged.
+func (opts LoadOptions) applyCellLimit(matrix []SparseRow, geneNames, featureTypes []string) ([]SparseRow, []string, []string) {
+	if opts.CellLimit == 0 {
+		return matrix, geneNames, featureTypes
+	}
+
+	newIndex := make([]int32, len(geneNames))
+	for gene := range newIndex {
+		newIndex[gene] = -1
+	}
+	for _, row := range matrix {
+		for _, gene := range row.Indices {
+			newIndex[gene] = 0
+		}
+	}
+	var keptNames, keptTypes []string
+	for gene, index := range newIndex {
+		if index < 0 {
+			continue
+		}
+		newIndex[gene] = int32(len(keptNames))
+		keptNames = append(keptNames, geneNames[gene])
+		if len(featureTypes) == len(geneNames) {
+			keptTypes = append(keptTypes, featureTypes[gene])
+		}
+	}
+	if len(keptNames) == len(geneNames) {
+		return matrix, geneNames, featureTypes
+	}
+
+	limited := make([]SparseRow, len(matrix))
+	for cell, row := range matrix {
+		limited[cell].Indices = make([]uint32, len(row.Indices))
+		for i, gene := range row.Indices {
+			limited[cell].Indices[i] = uint32(newIndex[gene])
+		}
+		limited[cell].Values = row.Values
+	}
+	return limited, keptNames, keptTypes
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestApplyCellLimit(t *testing.T) {
+	matrix := []SparseRow{
+		{Indices: []uint32{1, 3}, Values: []uint32{2, 5}},
+		{Indices: []uint32{3}, Values: []uint32{7}},
+	}
+	geneNames := []string{"A", "B", "C", "D", "E"}
+	featureTypes := []string{"GEX", "GEX", "ADT", "ADT", "GEX"}
+	tests := []struct {
+		name      string
+		limit     int
+		wantNames []string
+		wantTypes []string
+		want      []SparseRow
+	}{
+		{"no limit", 0, geneNames, featureTypes, matrix},
+		{"limit", 2, []string{"B", "D"}, []string{"GEX", "ADT"}, []SparseRow{
+			{Indices: []uint32{0, 1}, Values: []uint32{2, 5}},
+			{Indices: []uint32{1}, Values: []uint32{7}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultLoadOptions()
+			opts.CellLimit = tt.limit
+			limited, names, types := opts.applyCellLimit(matrix, geneNames, featureTypes)
+			if !reflect.DeepEqual(names, tt.wantNames) || !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("genes %q of types %q, want %q of types %q", names, types, tt.wantNames, tt.wantTypes)
+			}
+			for cell := range tt.want {
+				if !sameRow(limited[cell], tt.want[cell]) {
+					t.Errorf("cell %d: %v, want %v", cell, limited[cell], tt.want[cell])
+				}
+			}
+		})
+	}
+}
+
+// TestRunLimit compresses the first N cells and checks the archive decodes to
+// exactly those cells, over the genes they express
+func TestRunLimit(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 100, 40)
+	_, geneNames, cellNames, err := LoadSparseMatrix(input, DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []int{1, 10, 100, 500} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			output := compressDecompress(t, input, "-limit", fmt.Sprint(limit))
+			decoded, genes, cells, err := LoadSparseMatrix(output, DefaultLoadOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := limit
+			if want > len(matrix) {
+				want = len(matrix)
+			}
+			if !reflect.DeepEqual(cells, cellNames[:want]) {
+				t.Fatalf("cells %q, want the first %d", cells, want)
+			}
+
+			position := make(map[string]uint32, len(geneNames))
+			for gene, name := range geneNames {
+				position[name] = uint32(gene)
+			}
+			expressed := make(map[uint32]bool)
+			for cell, row := range decoded {
+				original := SparseRow{}
+				for i, gene := range row.Indices {
+					original.Indices = append(original.Indices, position[genes[gene]])
+					original.Values = append(original.Values, row.Values[i])
+					expressed[position[genes[gene]]] = true
+				}
+				if !sameRow(original, matrix[cell]) {
+					t.Fatalf("cell %d decoded as %v, want %v", cell, original, matrix[cell])
+				}
+			}
+			if len(expressed) != len(genes) {
+				t.Errorf("%d genes kept, but the cells express %d", len(genes), len(expressed))
+			}
+		})
+	}
+}
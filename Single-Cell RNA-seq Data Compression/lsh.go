@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// RefIndex selects which earlier cells the chain reference search compares a
+// cell against
+type RefIndex int
+
+const (
+	// RefIndexWindow compares every earlier cell within the reference window
+	RefIndexWindow RefIndex = iota
+	// RefIndexLSH only compares earlier cells that share a MinHash band with
+	// the cell (see lshIndex), so the search is sublinear in the cell count
+	RefIndexLSH
+)
+
+const (
+	// defaultLSHBands and defaultLSHRows give 64 MinHash values per cell.
+	// Cells with Jaccard similarity s collide in some band with probability
+	// 1-(1-s^rows)^bands: about 0.99 at s=0.7 and 0.34 at s=0.4.
+	defaultLSHBands = 16
+	defaultLSHRows  = 4
+
+	// maxLSHBucketCandidates caps the cells taken from each bucket to the
+	// most recent ones, so a bucket shared by many similar cells (a large
+	// cell type) costs the same as a small one
+	maxLSHBucketCandidates = 32
+)
+
+// ParseRefIndex parses the -ref-index flag: window or lsh
+func ParseRefIndex(name string) (RefIndex, error) {
+	switch name {
+	case "window":
+		return RefIndexWindow, nil
+	case "lsh":
+		return RefIndexLSH, nil
+	}
+	return RefIndexWindow, fmt.Errorf("unknown reference index %q; use window or lsh", name)
+}
+
+// lshIndex buckets cells by banded MinHash signatures of their expressed
+// genes. Each band hashes rows consecutive MinHash values; cells whose band
+// hashes agree are likely to have a high Jaccard similarity, and only those
+// are compared when searching for a reference.
+type lshIndex struct {
+	keys    [][]uint64           // Band hashes of every cell, nil for empty cells
+	buckets []map[uint64][]int32 // Cells of each band hash, in increasing order
+}
+
+// newLSHIndex computes the signature of every cell of the matrix and buckets
+// the cells. The MinHash functions are drawn from seed, so the same seed
+// finds the same references.
+func newLSHIndex(matrix []SparseRow, bands, rows int, seed int64) *lshIndex {
+	rng := rand.New(rand.NewSource(seed))
+	hashSeeds := make([]uint64, bands*rows)
+	for i := range hashSeeds {
+		hashSeeds[i] = rng.Uint64()
+	}
+
+	index := &lshIndex{
+		keys:    make([][]uint64, len(matrix)),
+		buckets: make([]map[uint64][]int32, bands),
+	}
+	numWorkers := runtime.NumCPU()
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			signature := make([]uint64, len(hashSeeds))
+			for cell := w; cell < len(matrix); cell += numWorkers {
+				if len(matrix[cell].Indices) > 0 {
+					index.keys[cell] = bandKeys(matrix[cell].Indices, hashSeeds, signature, rows)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for band := range index.buckets {
+		index.buckets[band] = make(map[uint64][]int32)
+	}
+	for cell, keys := range index.keys {
+		for band, key := range keys {
+			index.buckets[band][key] = append(index.buckets[band][key], int32(cell))
+		}
+	}
+	return index
+}
+
+// bandKeys computes a cell's MinHash signature into signature, one value per
+// hash seed, and returns the FNV-1a hash of each band of rows values
+func bandKeys(genes []uint32, hashSeeds, signature []uint64, rows int) []uint64 {
+	for i := range signature {
+		signature[i] = ^uint64(0)
+	}
+	for _, gene := range genes {
+		for i, hashSeed := range hashSeeds {
+			if hash := mixHash(uint64(gene) ^ hashSeed); hash < signature[i] {
+				signature[i] = hash
+			}
+		}
+	}
+
+	keys := make([]uint64, len(signature)/rows)
+	for band := range keys {
+		key := uint64(14695981039346656037)
+		for _, value := range signature[band*rows : (band+1)*rows] {
+			key = (key ^ value) * 1099511628211
+		}
+		keys[band] = key
+	}
+	return keys
+}
+
+// mixHash is the SplitMix64 finalizer, a cheap hash of 64-bit keys
+func mixHash(x uint64) uint64 {
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// candidates returns the cells from start up to (excluding) cell that share
+// a band with it, in increasing order. Only the maxLSHBucketCandidates most
+// recent cells of each bucket are considered.
+func (index *lshIndex) candidates(cell, start int) []int {
+	var candidates []int
+	for band, key := range index.keys[cell] {
+		bucket := index.buckets[band][key]
+		end := sort.Search(len(bucket), func(i int) bool { return int(bucket[i]) >= cell })
+		first := end - maxLSHBucketCandidates
+		if first < 0 {
+			first = 0
+		}
+		for _, other := range bucket[first:end] {
+			if int(other) >= start {
+				candidates = append(candidates, int(other))
+			}
+		}
+	}
+
+	sort.Ints(candidates)
+	unique := candidates[:0]
+	for i, other := range candidates {
+		if i == 0 || other != candidates[i-1] {
+			unique = append(unique, other)
+		}
+	}
+	return unique
+}
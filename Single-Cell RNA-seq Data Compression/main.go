@@ -1,151 +1,1748 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
 func main() {
+	outputs := &OutputSet{}
+
+	// On Ctrl-C or SIGTERM, remove half-written outputs before exiting
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		os.Exit(handleSignal(<-interrupts, outputs))
+	}()
+
+	err := execute(context.Background(), os.Args[1:], outputs)
+	if err == nil {
+		outputs.Commit()
+		return
+	}
+	removePartialOutputs(outputs)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	log.Print(err)
+	os.Exit(exitStatus(err))
+}
+
+// exitStatus returns the status a failed run exits with: 124 for a run
+// stopped by -timeout, as timeout(1) reports it, and 1 otherwise
+func exitStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 124
+	}
+	return 1
+}
+
+// handleSignal removes the half-written outputs of a run interrupted by sig
+// and returns the status to exit with at once, without waiting for running
+// workers: 130 for SIGINT and 143 for SIGTERM, as shells report them
+func handleSignal(sig os.Signal, outputs *OutputSet) int {
+	code := 130
+	if sig == syscall.SIGTERM {
+		code = 143
+	}
+	removePartialOutputs(outputs)
+	log.Printf("Interrupted by %v", sig)
+	return code
+}
+
+// removePartialOutputs deletes the outputs of a run that did not finish,
+// logging each
+func removePartialOutputs(outputs *OutputSet) {
+	for _, path := range outputs.RemovePartial() {
+		log.Printf("Removed incomplete output %s", path)
+	}
+}
+
+// run runs the CLI in-process without recording its outputs, which a caller
+// such as a test cleans up itself
+func run(args []string) error {
+	return execute(context.Background(), args, nil)
+}
+
+// execute parses the command-line arguments and runs the selected mode until
+// ctx is done, recording the files it creates in outputs. It is separate from
+// main so the whole CLI can be driven in-process.
+func execute(ctx context.Context, args []string, outputs *OutputSet) (err error) {
+	flags := flag.NewFlagSet("scz", flag.ContinueOnError)
 	var (
-		inputFile    = flag.String("input", "", "Input file path (CSV, TSV, or RDS)")
-		outputFile   = flag.String("output", "", "Output compressed file path")
-		mode         = flag.String("mode", "compress", "Mode: compress or decompress")
-		lossy        = flag.Bool("lossy", false, "Enable lossy compression")
-		threshold    = flag.Float64("threshold", 0.1, "Delta threshold for lossy compression")
-		quantLevels  = flag.Int("quant", 256, "Quantization levels for lossy compression")
-		verbose      = flag.Bool("verbose", false, "Verbose output")
+		inputFile    = flags.String("input", "", "Input file path (CSV, TSV, MTX, or RDS; .gz accepted for CSV/TSV/MTX), or a quoted glob such as 'counts.part*.csv' to concatenate CSV/TSV shards with the same genes")
+		outputFile   = flags.String("output", "", "Output compressed file path")
+		mode         = flags.String("mode", "compress", "Mode: compress, decompress, inspect, qc or generate")
+		lossy        = flags.Bool("lossy", false, "Enable lossy compression")
+		threshold    = flags.Float64("threshold", 0.1, "Delta threshold for lossy compression")
+		quantLevels  = flags.Int("quant", 256, "Quantization levels for lossy compression (at least 2)")
+		verbose      = flags.Bool("verbose", false, "Verbose output")
+		compare      = flags.Bool("compare", false, "Compare two files (.scz, CSV or TSV) given as arguments")
+		sweep        = flags.Bool("sweep", false, "Compress the -input matrix lossily with every combination of -sweep-threshold and -sweep-quant, decompress each archive and write a table of size, ratio, RMSE and max/mean error against the input, and compression and decompression time to -output (CSV or TSV) or stdout; nothing else is written")
+		sweepThresh  = flags.String("sweep-threshold", "", "Comma-separated -threshold values for -sweep, e.g. 0.1,0.2,0.5 (default: -threshold)")
+		sweepQuant   = flags.String("sweep-quant", "", "Comma-separated -quant levels for -sweep, e.g. 64,128,256 (default: -quant)")
+		explain      = flags.Bool("explain", false, "Print how the -cell of the -input archive was encoded: self, delta or duplicate and its reference with their similarity, genes, Elias-Fano universe/count/low bits, stored index and value bytes, and decoded values")
+		explainCell  = flags.String("cell", "", "Cell for -explain, by name or by number counting from 1")
+		benchCodecs  = flags.Bool("benchmark-codecs", false, "Compare the gene index codecs (Elias-Fano variants, bit packing) on the matrix file given as argument: encoded bytes and encode/decode throughput")
+		benchCache   = flags.Bool("benchmark-cell-cache", false, "Query -n random cells of the archive given as argument one at a time, without and with a -cell-cache, and compare the cells decoded (counting reference chain ancestors) and the time")
+		cellCache    = flags.Int("cell-cache", defaultCellCache, "Decoded cells kept in an LRU cache by single-cell reads (-head, -benchmark-cell-cache), so cells sharing reference chain ancestors decode them once; 0 disables")
+		tolerance    = flags.Int("tolerance", 0, "Absolute difference tolerated per entry in compare mode")
+		efLowBits    = flags.String("ef-lowbits", "heuristic", "Elias-Fano low-bit width: heuristic, floor, search, or a fixed number of bits")
+		refWindow    = flags.String("ref-window", "-1", "Number of preceding cells searched for a delta reference (0 = none, -1 = all), or auto to size it to -max-memory; smaller is faster but compresses less")
+		maxMemory    = flags.Int64("max-memory", 0, "Memory budget in MiB for -ref-window auto; 0 uses a quarter of the available memory")
+		refIndex     = flags.String("ref-index", "window", "Cells compared in the chain reference search: window (every earlier cell in -ref-window) or lsh (only earlier cells sharing a MinHash band; much faster on large matrices, may miss some references)")
+		lshBands     = flags.Int("lsh-bands", defaultLSHBands, "MinHash bands of -ref-index lsh; more bands find more references but compare more cells")
+		lshRows      = flags.Int("lsh-rows", defaultLSHRows, "MinHash values per band of -ref-index lsh; more rows only collide more similar cells")
+		refMode      = flags.String("ref-mode", "chain", "Reference selection: chain (most similar earlier cell), medoid (nearest of -medoids cluster medoids) mean (a synthetic cell of per-gene mean expression, stored once) or gene-baseline (likewise with the per-gene median, so values are stored as offsets from each gene's typical level)")
+		valueMode    = flags.String("value-mode", "", "How values are stored: cell-delta (as offsets from the reference cell -ref-mode selects) or gene-baseline (as offsets from each gene's median, the same as -ref-mode gene-baseline); by default as -ref-mode selects")
+		numMedoids   = flags.Int("medoids", 16, "Number of medoid reference cells for -ref-mode medoid")
+		noDelta      = flags.Bool("no-delta", false, "Self-encode every cell, skipping the reference search, medoid clustering and duplicate detection (fastest; for dissimilar cells or debugging)")
+		deltaMin     = flags.Int("delta-min-genes", 0, "Self-encode cells expressing fewer than N genes instead of searching for a reference, whose index costs more than it saves on tiny cells; exact duplicates still reference their copy. 0 lets every cell use a reference")
+		forwardRefs  = flags.Bool("forward-refs", false, "With -ref-mode medoid, only reference medoids earlier in the file so the archive decodes in a single forward pass (chain mode always does)")
+		similarity   = flags.String("similarity", "jaccard", "Cell similarity for choosing references: jaccard (expressed genes), cosine, weighted-jaccard (Ruzicka, uses counts) or rank (weighted-jaccard of within-cell expression ranks, robust to depth)")
+		graphFile    = flags.String("similarity-graph", "", "On compress, also write each cell's most similar cells (found by the reference search) to this CSV/TSV edge list for clustering")
+		graphK       = flags.Int("graph-k", 10, "Neighbours per cell kept for -similarity-graph")
+		numShards    = flags.Int("shards", 0, "On compress, split the archive into N self-contained files out.000.scz, out.001.scz, ... of consecutive cells plus an out.index manifest, which decompress, inspect and compare accept as input; 0 writes one file")
+		autotuneFlag = flags.Bool("autotune", false, "On compress, try every -similarity, -ref-window (chain mode) and, with -lossy, a range of -threshold/-quant settings on a sample of the cells, and compress with the best that fits -tune-time and -tune-size, overriding those flags")
+		tuneTime     = flags.Duration("tune-time", 0, "Budget for -autotune: projected time to compress the whole matrix (e.g. 5m); 0 for none")
+		tuneSize     = flags.Float64("tune-size", 0, "Budget for -autotune: projected archive size in MiB; 0 for none. Within budget, the most faithful lossy setting wins, then the smallest archive")
+		tuneSample   = flags.Int("tune-sample", defaultTuneSample, "Cells -autotune compresses in each trial, taken in runs from across the matrix")
+		sourceHash   = flags.Bool("source-hash", true, "On compress, record the SHA-256 of the input file (of the shards one after another for a glob) in the archive, shown by inspect, so outputs can be traced to their source; false skips the extra read of the input")
+		checkSource  = flags.String("check-source", "", "On inspect, check that this file is the archive's source: its SHA-256 must match the one recorded by -source-hash")
+		qcOut        = flags.String("qc-out", "", "On compress, also write QC statistics of the input to genes.csv,cells.csv: per gene total counts, expressing cells, mean and variance; per cell library size and genes. -mode qc writes only these")
+		quantAdapt   = flags.Bool("quant-adaptive", false, "Fit a Lloyd-Max quantization codebook to the value distribution (with -lossy)")
+		quantGenes   = flags.String("quant-genes", "", "With -lossy, a file listing genes (one per line, e.g. a marker panel) whose values are stored exactly while the other genes are quantized")
+		modalityOpts = flags.String("modality-opts", "", "On compress of a multimodal .mtx (feature types from features.tsv), store each modality lossily or not, e.g. rna:lossy=true,adt:lossy=false quantizes RNA but keeps ADT counts exact; modalities are rna, adt, crispr, hto, atac or a feature type, and unlisted ones follow -lossy (-threshold, -quant and the codecs are shared)")
+		lossyMaxErr  = flags.Float64("lossy-maxerr", 0, "With -lossy, store every cell whose decoded values would differ from the original by more than this losslessly instead; 0 disables")
+		pickSmallest = flags.Bool("pick-smallest", true, "Try both self and delta encoding per cell and keep the smaller (disable for speed)")
+		streamOut    = flags.Bool("stream-out", false, "Write decompressed rows as they are decoded instead of holding the whole matrix (single-threaded, CSV only)")
+		skipBad      = flags.Bool("skip-bad-blocks", false, "Decompress damaged archives, emitting zeros for cells in blocks that fail their checksum")
+		hvg          = flags.Int("hvg", 0, "Keep only the N most variable genes (by dispersion) when compressing; 0 keeps all")
+		topGenes     = flags.Int("top-genes-per-cell", 0, "Keep only the K highest-valued genes of each cell when compressing and drop the rest (lossy quick-look archives; reports the fraction of counts retained); 0 keeps all")
+		origShape    = flags.Bool("original-shape", false, "On decompress, reinsert zero columns for genes dropped by -hvg")
+		dtypeFlag    = flags.String("dtype", "", "Value dtype to record on compress or export on decompress: uint8, uint16, uint32, float32 or float64 (default: detected / as recorded)")
+		geneChunk    = flags.Int("gene-chunk", 0, "Encode each cell's genes in ranges of N features with a local Elias-Fano universe (for very wide matrices, e.g. genes + peaks; use large N such as 65536); 0 disables")
+		frontCode    = flags.Bool("front-code-names", false, "Store gene and cell names front-coded (shared prefix with the previous name plus suffix); shrinks long barcode lists")
+		valueCodec   = flags.String("value-codec", "flate", "Entropy coding of each cell's values: flate (zigzag varints deflated) or rice (Golomb-Rice, parameter per cell; smaller on sparse cells)")
+		efFlate      = flags.Bool("ef-flate", false, "Deflate each cell's Elias-Fano gene indices as a second stage (rarely smaller)")
+		binaryFlag   = flags.Bool("binary", false, "Store presence/absence only (every non-zero becomes 1); all-ones matrices are detected automatically")
+		head         = flags.Int("head", 0, "On decompress, print only the first N cells to stdout (as a table of their expressed genes) instead of writing -output")
+		geneOrder    = flags.String("gene-order", "original", "On decompress, output column order: original, alpha, or file=order.txt (listed genes first, then the rest)")
+		genePanel    = flags.String("gene-panel", "", "On decompress, write only the genes listed in this file (one per line, e.g. a marker panel), as columns in list order (named -gene-panel because -genes sets the gene count of -mode generate)")
+		transposeOut = flags.Bool("transpose-out", false, "On decompress, write genes as rows and cells as columns (genes x cells, as R/Bioconductor expect); CSV/TSV output only")
+		pipeCmd      = flags.String("pipe", "", "On decompress, stream the CSV into the standard input of this shell command instead of writing -output, e.g. 'python analyze.py' (run with sh -c: quote and escape as in the shell)")
+		splitTypes   = flags.Bool("split-by-feature-type", false, "On decompress, write one matrix per feature type (e.g. Gene Expression, Antibody Capture) from features.tsv")
+		recompress   = flags.String("recompress", "", "Recompress an existing .scz with the given compression flags (requires -output)")
+		compact      = flags.String("compact", "", "Rebuild the references of an existing lossless .scz with a fresh search over all cells (the -ref-* flags), keeping its encoding settings; reports the size before and after (requires -output)")
+		repair       = flags.String("repair", "", "Salvage a damaged .scz: keep every block that passes its checksum and write a consistent archive to -output, logging the lost cells")
+		repairLost   = flags.String("repair-lost", "zero", "With -repair, what becomes of cells in damaged blocks and cells referencing them: zero (kept as empty cells) or drop (removed with their names)")
+		noHeader     = flags.Bool("no-header", false, "CSV/TSV input has no header row; genes are named Gene_1..Gene_N")
+		noIndex      = flags.Bool("no-index", false, "CSV/TSV input has no cell name column; cells are named Cell_1..Cell_M")
+		stripSuffix  = flags.Bool("strip-suffix", false, "Remove the gem-group suffix of 10x barcodes in input cell names (AAACCTGAGAAACCAT-1 becomes AAACCTGAGAAACCAT); fails if two cells, e.g. the same barcode from two merged runs, would share a name")
+		lenient      = flags.Bool("lenient-values", false, "Skip CSV/TSV values that do not parse as numbers (e.g. NA), and skip negative values and values above the uint32 range and truncate fractional values in CSV/TSV and MTX input, instead of failing with their location")
+		nonFinite    = flags.String("nonfinite", "error", "NaN and infinite values of CSV/TSV and MTX input: error (fail with their location), drop (leave them out) or zero (read them as 0, subject to -zeros)")
+		zeros        = flags.String("zeros", "drop", "Zero values of CSV/TSV input: drop (store only non-zeros), explicit (also store zeros written in the file, e.g. 0 or 0.0) or all (also read empty fields as explicit zeros)")
+		limit        = flags.Int("limit", 0, "Load only the first N cells of input matrices, and on compress keep only the genes they express, for quick parameter sweeps on large files; 0 loads all")
+		rowOffset    = flags.Int("row-offset", 0, "Skip the first N cells of input matrices, so parallel jobs can each compress a slice of a large file; the slices' archives keep every gene and can be combined by listing them with their first cells in an .index manifest (see -shards)")
+		rowCount     = flags.Int("row-count", 0, "Load at most N cells of input matrices, starting at -row-offset; 0 reads to the last cell")
+		geneMapFile  = flags.String("gene-map", "", "Rename the genes of input matrices by a two-column old<TAB>new mapping file (e.g. Ensembl IDs to symbols); genes mapped to the same name are merged by summing their counts, unmapped genes keep their name")
+		commentChar  = flags.String("comment-char", "#", "CSV/TSV input lines starting with this character (e.g. metadata above the header) are skipped; empty disables")
+		nameQuoting  = flags.String("name-quoting", "rfc4180", "How CSV/TSV output writes gene and cell names with quotes, tabs or line breaks: rfc4180 (quoted; pandas-safe, R's read.csv may misparse), sanitize (replaced by spaces and single quotes) or strict (fail, listing them)")
+		forceInt     = flags.Bool("force-int", false, "Write CSV/TSV values as plain integers (3) whatever the dtype; by default float32/float64 archives are written as floats")
+		forceFloat   = flags.Bool("force-float", false, "Write CSV/TSV values as floats (3.0) whatever the dtype, for tools that expect them")
+		precision    = flags.Int("precision", 0, "Significant digits of CSV/TSV values written as floats (float dtypes or -force-float); 0 writes the fewest digits that read back as the stored value")
+		ioBuf        = flags.Int("iobuf", defaultIOBufferSize, "Buffer size in bytes for reading and writing matrix files (CSV, TSV, MTX)")
+		force        = flags.Bool("force", false, "Overwrite the output file if it already exists")
+		mkdir        = flags.Bool("mkdir", false, "Create the output file's parent directory if it doesn't exist")
+		appendLog    = flags.String("append-log", "", "Append a JSON line describing each compress, decompress or recompress run (parameters, sizes, duration) to this file")
+		numCells     = flags.Int("cells", 1000, "Number of cells for generate mode")
+		numGenes     = flags.Int("genes", 2000, "Number of genes for generate mode")
+		sparsity     = flags.Float64("sparsity", 0.9, "Fraction of zero entries for generate mode")
+		selfTest     = flags.String("selftest", "", "Run a built-in self-test instead of a mode: elias (Elias-Fano encode/decode/access on random sequences)")
+		selfTestN    = flags.Int("n", 10000, "Number of random cases (sequences or cells) for -selftest, or of queries for -benchmark-cell-cache")
+		timeout      = flags.Duration("timeout", 0, "Abort the run if it takes longer than this (e.g. 10m or 2h), removing partial outputs and exiting with status 124; 0 never aborts")
+		seed         = flags.Int64("seed", 1, "Random seed for all randomized steps (clustering, generate mode); with SOURCE_DATE_EPOCH set, output is byte-identical across runs")
 	)
-	flag.Parse()
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *timeout < 0 {
+		return fmt.Errorf("Invalid -timeout %v: must be positive, or 0 for none", *timeout)
+	}
+	if *timeout > 0 {
+		// The worker pools and block writers stop once the deadline
+		// passes, and the run fails with context.DeadlineExceeded
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		defer func() {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("Aborted: the run took longer than -timeout %v: %w", *timeout, err)
+			}
+		}()
+	}
+
+	loadOpts := DefaultLoadOptions()
+	loadOpts.HasHeader, loadOpts.HasIndex = !*noHeader, !*noIndex
+	loadOpts.LenientValues = *lenient
+	loadOpts.StripBarcodeSuffix = *stripSuffix
+	loadOpts.BufferSize = *ioBuf
+	saveOpts := SaveOptions{BufferSize: *ioBuf, Overwrite: *force, Outputs: outputs, Context: ctx}
+	if *limit < 0 {
+		return fmt.Errorf("Invalid -limit %d: must be positive, or 0 for all cells", *limit)
+	}
+	loadOpts.CellLimit = *limit
+	if *rowOffset < 0 {
+		return fmt.Errorf("Invalid -row-offset %d: must not be negative", *rowOffset)
+	}
+	if *rowCount < 0 {
+		return fmt.Errorf("Invalid -row-count %d: must be positive, or 0 for all remaining cells", *rowCount)
+	}
+	loadOpts.CellOffset, loadOpts.CellCount = *rowOffset, *rowCount
+	nanPolicy, err := ParseNonFinitePolicy(*nonFinite)
+	if err != nil {
+		return fmt.Errorf("Invalid -nonfinite: %w", err)
+	}
+	loadOpts.NonFinite = nanPolicy
+	zeroPolicy, err := ParseZeroPolicy(*zeros)
+	if err != nil {
+		return fmt.Errorf("Invalid -zeros: %w", err)
+	}
+	loadOpts.Zeros = zeroPolicy
+	comment, err := parseCommentChar(*commentChar)
+	if err != nil {
+		return fmt.Errorf("Invalid -comment-char: %w", err)
+	}
+	loadOpts.Comment = comment
+	quoting, err := ParseNameQuoting(*nameQuoting)
+	if err != nil {
+		return fmt.Errorf("Invalid -name-quoting: %w", err)
+	}
+	saveOpts.Quoting = quoting
+	if *forceInt && *forceFloat {
+		return fmt.Errorf("-force-int cannot be combined with -force-float")
+	}
+	if *precision < 0 {
+		return fmt.Errorf("-precision must not be negative")
+	}
+	if *forceInt {
+		saveOpts.Format = FormatInt
+	} else if *forceFloat {
+		saveOpts.Format = FormatFloat
+	}
+	saveOpts.Precision = *precision
+	if *geneMapFile != "" {
+		if loadOpts.GeneMap, err = LoadGeneMap(*geneMapFile); err != nil {
+			return fmt.Errorf("Invalid -gene-map: %w", err)
+		}
+	}
+
+	// Flags given explicitly, recorded by -append-log
+	parameters := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) { parameters[f.Name] = f.Value.String() })
+
+	if *compare {
+		if flags.NArg() != 2 {
+			return fmt.Errorf("Compare mode requires two files: -compare a.scz b.scz")
+		}
+		err := compareFiles(flags.Arg(0), flags.Arg(1), uint32(*tolerance), loadOpts)
+		if err != nil {
+			return fmt.Errorf("Comparison failed: %w", err)
+		}
+		return nil
+	}
+
+	if *benchCodecs {
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Codec benchmark requires one matrix file: -benchmark-codecs input.csv")
+		}
+		matrix, geneNames, _, err := loadAnyMatrix(flags.Arg(0), loadOpts)
+		if err != nil {
+			return fmt.Errorf("Codec benchmark failed: failed to load %s: %w", flags.Arg(0), err)
+		}
+		if err := RunCodecBenchmark(os.Stdout, matrix, len(geneNames)); err != nil {
+			return fmt.Errorf("Codec benchmark failed: %w", err)
+		}
+		return nil
+	}
+
+	if *cellCache < 0 {
+		return fmt.Errorf("-cell-cache must not be negative")
+	}
+	if *benchCache {
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Cell cache benchmark requires one archive: -benchmark-cell-cache compressed.scz")
+		}
+		if *cellCache == 0 {
+			return fmt.Errorf("-benchmark-cell-cache needs a non-zero -cell-cache")
+		}
+		compressed, err := LoadCompressedData(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("Cell cache benchmark failed: failed to load %s: %w", flags.Arg(0), err)
+		}
+		if err := RunCellCacheBenchmark(os.Stdout, compressed, *selfTestN, *cellCache, *seed); err != nil {
+			return fmt.Errorf("Cell cache benchmark failed: %w", err)
+		}
+		return nil
+	}
+
+	if *explain {
+		if *inputFile == "" || *explainCell == "" {
+			return fmt.Errorf("-explain requires -input and -cell")
+		}
+		if err := explainFile(*inputFile, *explainCell, os.Stdout); err != nil {
+			return fmt.Errorf("Explain failed: %w", err)
+		}
+		return nil
+	}
+	if *explainCell != "" {
+		return fmt.Errorf("-cell requires -explain")
+	}
+
+	if *selfTest != "" {
+		if err := RunSelfTest(os.Stdout, *selfTest, *selfTestN, *seed); err != nil {
+			return fmt.Errorf("Self-test failed: %w", err)
+		}
+		return nil
+	}
+
+	strategy, fixedLowBits, err := parseLowBits(*efLowBits)
+	if err != nil {
+		return fmt.Errorf("Invalid -ef-lowbits: %w", err)
+	}
+	var referenceMode RefMode
+	switch *refMode {
+	case "chain":
+		referenceMode = RefChain
+	case "medoid":
+		referenceMode = RefMedoid
+	case "mean":
+		referenceMode = RefMean
+	case "gene-baseline":
+		referenceMode = RefGeneBaseline
+	default:
+		return fmt.Errorf("Unknown -ref-mode: %s. Use 'chain', 'medoid', 'mean' or 'gene-baseline'", *refMode)
+	}
+	refModeSet := false
+	flags.Visit(func(f *flag.Flag) { refModeSet = refModeSet || f.Name == "ref-mode" })
+	switch *valueMode {
+	case "":
+	case "cell-delta":
+		if referenceMode == RefGeneBaseline {
+			return fmt.Errorf("-value-mode cell-delta cannot be combined with -ref-mode gene-baseline")
+		}
+	case "gene-baseline":
+		if refModeSet && referenceMode != RefGeneBaseline {
+			return fmt.Errorf("-value-mode gene-baseline is -ref-mode gene-baseline and cannot be combined with -ref-mode %s", *refMode)
+		}
+		referenceMode = RefGeneBaseline
+	default:
+		return fmt.Errorf("Unknown -value-mode: %s. Use 'cell-delta' or 'gene-baseline'", *valueMode)
+	}
+	referenceIndex, err := ParseRefIndex(*refIndex)
+	if err != nil {
+		return fmt.Errorf("Invalid -ref-index: %w", err)
+	}
+	if referenceIndex == RefIndexLSH && referenceMode != RefChain {
+		return fmt.Errorf("-ref-index lsh only applies to -ref-mode chain")
+	}
+	if *lshBands <= 0 || *lshRows <= 0 {
+		return fmt.Errorf("-lsh-bands and -lsh-rows must be positive")
+	}
+	metric, err := ParseSimilarityMetric(*similarity)
+	if err != nil {
+		return fmt.Errorf("Invalid -similarity: %w", err)
+	}
+	codec, err := ParseValueCodec(*valueCodec)
+	if err != nil {
+		return fmt.Errorf("Invalid -value-codec: %w", err)
+	}
+	if *geneChunk < 0 {
+		return fmt.Errorf("-gene-chunk must not be negative")
+	}
+	window, autoWindow, err := parseRefWindow(*refWindow)
+	if err != nil {
+		return fmt.Errorf("Invalid -ref-window: %w", err)
+	}
+	if *maxMemory < 0 {
+		return fmt.Errorf("-max-memory must not be negative")
+	}
+	if *maxMemory > 0 && !autoWindow {
+		return fmt.Errorf("-max-memory requires -ref-window auto")
+	}
+	if *lossyMaxErr < 0 {
+		return fmt.Errorf("-lossy-maxerr must not be negative")
+	}
+	if *topGenes < 0 {
+		return fmt.Errorf("-top-genes-per-cell must not be negative")
+	}
+	if *deltaMin < 0 {
+		return fmt.Errorf("-delta-min-genes must not be negative")
+	}
+	if *lossyMaxErr > 0 && !*lossy {
+		return fmt.Errorf("-lossy-maxerr requires -lossy")
+	}
+	var exactGenes []string
+	if *quantGenes != "" {
+		if !*lossy {
+			return fmt.Errorf("-quant-genes requires -lossy")
+		}
+		if exactGenes, err = readNameColumn(*quantGenes, strings.HasSuffix(*quantGenes, ".gz")); err != nil {
+			return fmt.Errorf("failed to read -quant-genes: %w", err)
+		}
+	}
+	var modalities map[string]bool
+	if *modalityOpts != "" {
+		if modalities, err = ParseModalityOptions(*modalityOpts); err != nil {
+			return fmt.Errorf("Invalid -modality-opts: %w", err)
+		}
+	}
+	if *graphFile != "" {
+		if referenceMode != RefChain || window == 0 || *noDelta {
+			return fmt.Errorf("-similarity-graph needs the chain reference search (-ref-mode chain, a non-zero -ref-window and no -no-delta)")
+		}
+		if *graphK <= 0 {
+			return fmt.Errorf("-graph-k must be positive")
+		}
+	}
+	if *numShards < 0 {
+		return fmt.Errorf("-shards must not be negative")
+	}
+	if *numShards > 1 && *graphFile != "" {
+		return fmt.Errorf("-similarity-graph cannot be combined with -shards")
+	}
+	if *tuneTime < 0 || *tuneSize < 0 {
+		return fmt.Errorf("-tune-time and -tune-size must not be negative")
+	}
+	if *tuneSample <= 0 {
+		return fmt.Errorf("Invalid -tune-sample %d: must be positive", *tuneSample)
+	}
+	if !*autotuneFlag && (*tuneTime > 0 || *tuneSize > 0) {
+		return fmt.Errorf("-tune-time and -tune-size require -autotune")
+	}
+	var qcGenes, qcCells string
+	if *qcOut != "" {
+		if qcGenes, qcCells, err = parseQCOutputs(*qcOut); err != nil {
+			return fmt.Errorf("Invalid -qc-out: %w", err)
+		}
+	}
+	if *quantLevels < 2 {
+		return fmt.Errorf("Invalid -quant %d: at least 2 levels are needed", *quantLevels)
+	}
+	var dtype DType
+	if *dtypeFlag != "" {
+		if dtype, err = ParseDType(*dtypeFlag); err != nil {
+			return fmt.Errorf("Invalid -dtype: %w", err)
+		}
+	}
+	opts := compressOptions{
+		lossy:        *lossy,
+		threshold:    *threshold,
+		quantLevels:  uint32(*quantLevels),
+		lowBits:      strategy,
+		fixedLowBits: fixedLowBits,
+		refWindow:    window,
+		refMemory:    refMemory(autoWindow, *maxMemory),
+		refIndex:     referenceIndex,
+		lshBands:     *lshBands,
+		lshRows:      *lshRows,
+		refMode:      referenceMode,
+		numMedoids:   *numMedoids,
+		forwardRefs:  *forwardRefs,
+		noDelta:      *noDelta,
+		deltaMin:     *deltaMin,
+		similarity:   metric,
+		adaptive:     *quantAdapt,
+		lossyMaxErr:  *lossyMaxErr,
+		exactGenes:   exactGenes,
+		modalities:   modalities,
+		pickSmallest: *pickSmallest,
+		seed:         *seed,
+		hvg:          *hvg,
+		topGenes:     *topGenes,
+		dtype:        dtype,
+		binary:       *binaryFlag,
+		eliasFlate:   *efFlate,
+		geneChunk:    uint32(*geneChunk),
+		frontCode:    *frontCode,
+		valueCodec:   codec,
+		graphFile:    *graphFile,
+		graphK:       *graphK,
+		shards:       *numShards,
+		autotune:     *autotuneFlag,
+		tuneBudget:   TuneBudget{Time: *tuneTime, Size: int64(*tuneSize * (1 << 20))},
+		tuneSample:   *tuneSample,
+		sourceHash:   *sourceHash,
+		qcGenes:      qcGenes,
+		qcCells:      qcCells,
+		load:         loadOpts,
+		save:         saveOpts,
+		ctx:          ctx,
+	}
+
+	if *autotuneFlag && (*recompress != "" || *compact != "") {
+		return fmt.Errorf("-autotune is only supported when compressing a matrix")
+	}
+	if modalities != nil && (*recompress != "" || *compact != "" || *sweep) {
+		return fmt.Errorf("-modality-opts is only supported when compressing a matrix")
+	}
+
+	if *sweep {
+		if *inputFile == "" {
+			return fmt.Errorf("Sweep mode requires -input")
+		}
+		if *autotuneFlag || *numShards > 1 || *graphFile != "" || *qcOut != "" {
+			return fmt.Errorf("-sweep cannot be combined with -autotune, -shards, -similarity-graph or -qc-out")
+		}
+		thresholds := []float64{*threshold}
+		if *sweepThresh != "" {
+			if thresholds, err = parseFloatList(*sweepThresh); err != nil {
+				return fmt.Errorf("Invalid -sweep-threshold: %w", err)
+			}
+		}
+		levels := []uint32{uint32(*quantLevels)}
+		if *sweepQuant != "" {
+			if levels, err = parseQuantList(*sweepQuant); err != nil {
+				return fmt.Errorf("Invalid -sweep-quant: %w", err)
+			}
+		}
+		if *outputFile != "" {
+			if err := prepareOutput(*outputFile, *mkdir, *force); err != nil {
+				return err
+			}
+		}
+		if err := sweepFile(*inputFile, *outputFile, opts, thresholds, levels); err != nil {
+			return fmt.Errorf("Sweep failed: %w", err)
+		}
+		return nil
+	}
+	if *sweepThresh != "" || *sweepQuant != "" {
+		return fmt.Errorf("-sweep-threshold and -sweep-quant require -sweep")
+	}
+
+	if *recompress != "" {
+		if *outputFile == "" {
+			return fmt.Errorf("Recompress mode requires -output")
+		}
+		if *numShards > 1 {
+			return fmt.Errorf("-shards is only supported when compressing a matrix")
+		}
+		if err := prepareOutput(*outputFile, *mkdir, *force); err != nil {
+			return err
+		}
+		start := time.Now()
+		record := NewRunRecord("recompress", *recompress, *outputFile, parameters, start)
+		stats, err := recompressFile(*recompress, *outputFile, opts, *verbose)
+		if err != nil {
+			err = fmt.Errorf("Recompression failed: %w", err)
+		}
+		record.Compression = stats
+		if err := finishRun(*appendLog, record, start, err); err != nil {
+			return err
+		}
+		fmt.Printf("Successfully recompressed %s to %s\n", *recompress, *outputFile)
+		return nil
+	}
+
+	if *compact != "" {
+		if *outputFile == "" {
+			return fmt.Errorf("Compact mode requires -output")
+		}
+		if *recompress != "" || *numShards > 1 {
+			return fmt.Errorf("-compact cannot be combined with -recompress or -shards")
+		}
+		if err := prepareOutput(*outputFile, *mkdir, *force); err != nil {
+			return err
+		}
+		start := time.Now()
+		record := NewRunRecord("compact", *compact, *outputFile, parameters, start)
+		stats, err := compactFile(*compact, *outputFile, opts, *verbose)
+		if err != nil {
+			err = fmt.Errorf("Compaction failed: %w", err)
+		}
+		record.Compression = stats
+		if err := finishRun(*appendLog, record, start, err); err != nil {
+			return err
+		}
+		fmt.Printf("Successfully compacted %s to %s\n", *compact, *outputFile)
+		return nil
+	}
+
+	if *repair != "" {
+		if *outputFile == "" {
+			return fmt.Errorf("Repair mode requires -output")
+		}
+		policy, err := ParseLostCellPolicy(*repairLost)
+		if err != nil {
+			return fmt.Errorf("Invalid -repair-lost: %w", err)
+		}
+		if err := prepareOutput(*outputFile, *mkdir, *force); err != nil {
+			return err
+		}
+		if err := repairFile(*repair, *outputFile, policy, saveOpts); err != nil {
+			return fmt.Errorf("Repair failed: %w", err)
+		}
+		fmt.Printf("Successfully repaired %s to %s\n", *repair, *outputFile)
+		return nil
+	}
+
+	if *mode == "generate" {
+		if *outputFile == "" {
+			return fmt.Errorf("Generate mode requires -output")
+		}
+		if err := prepareOutput(*outputFile, *mkdir, *force); err != nil {
+			return err
+		}
+		matrix, geneNames, cellNames := GenerateSyntheticMatrix(*numCells, *numGenes, *sparsity, *seed)
+		if err := SaveSparseMatrix(matrix, geneNames, cellNames, defaultNameHeader, DTypeUnknown, *outputFile, saveOpts); err != nil {
+			return fmt.Errorf("Generation failed: %w", err)
+		}
+		fmt.Printf("Generated %d cells x %d genes into %s\n", *numCells, *numGenes, *outputFile)
+		return nil
+	}
 
 	if *inputFile == "" {
 		fmt.Println("Usage:")
 		fmt.Println("  Compress: go run . -input data.csv -output compressed.scz -mode compress")
 		fmt.Println("  Decompress: go run . -input compressed.scz -output decompressed.csv -mode decompress")
+		fmt.Println("  Gene panel: go run . -input compressed.scz -output markers.csv -mode decompress -gene-panel markers.txt")
 		fmt.Println("  Lossy: go run . -input data.csv -output compressed.scz -lossy -threshold 0.1")
-		os.Exit(1)
+		fmt.Println("  Compare: go run . -compare lossy.scz original.csv")
+		fmt.Println("  Explain: go run . -explain -input compressed.scz -cell AAACCTGAGAAACCAT-1")
+		fmt.Println("  Sweep: go run . -sweep -input data.csv -sweep-threshold 0.1,0.2,0.5 -sweep-quant 64,128,256 -output sweep.csv")
+		fmt.Println("  QC: go run . -mode qc -input data.csv -qc-out genes.csv,cells.csv")
+		fmt.Println("  Recompress: go run . -recompress in.scz -output out.scz -lossy -threshold 0.2")
+		fmt.Println("  Compact: go run . -compact grown.scz -output compact.scz")
+		fmt.Println("  Repair: go run . -repair damaged.scz -output fixed.scz -repair-lost drop")
+		fmt.Println("  Generate: go run . -mode generate -cells 1000 -genes 2000 -sparsity 0.9 -seed 1 -output synthetic.csv")
+		return fmt.Errorf("no -input given")
 	}
 
 	switch *mode {
 	case "compress":
+		if *outputFile == "" && isShardPattern(*inputFile) {
+			return fmt.Errorf("Compressing shards (-input %s) requires -output", *inputFile)
+		}
 		if *outputFile == "" {
 			*outputFile = strings.TrimSuffix(*inputFile, filepath.Ext(*inputFile)) + ".scz"
 		}
-		err := compressFile(*inputFile, *outputFile, *lossy, *threshold, *quantLevels, *verbose)
+		if *numShards > 1 {
+			files, indexFile := shardFileNames(*outputFile, *numShards)
+			for _, file := range append(files, indexFile) {
+				if err := prepareOutput(file, *mkdir, *force); err != nil {
+					return err
+				}
+			}
+		} else if err := prepareOutput(*outputFile, *mkdir, *force); err != nil {
+			return err
+		}
+		if *graphFile != "" {
+			if err := prepareOutput(*graphFile, *mkdir, *force); err != nil {
+				return err
+			}
+		}
+		if qcGenes != "" {
+			if err := prepareQCOutputs(qcGenes, qcCells, *mkdir, *force); err != nil {
+				return err
+			}
+		}
+		start := time.Now()
+		record := NewRunRecord("compress", *inputFile, *outputFile, parameters, start)
+		stats, err := compressFile(*inputFile, *outputFile, opts, *verbose)
 		if err != nil {
-			log.Fatalf("Compression failed: %v", err)
+			err = fmt.Errorf("Compression failed: %w", err)
+		}
+		record.Compression = stats
+		if err := finishRun(*appendLog, record, start, err); err != nil {
+			return err
+		}
+		if *numShards > 1 {
+			_, indexFile := shardFileNames(*outputFile, *numShards)
+			fmt.Printf("Successfully compressed %s to %d shards listed in %s\n", *inputFile, *numShards, indexFile)
+		} else {
+			fmt.Printf("Successfully compressed %s to %s\n", *inputFile, *outputFile)
 		}
-		fmt.Printf("Successfully compressed %s to %s\n", *inputFile, *outputFile)
 
 	case "decompress":
-		if *outputFile == "" {
+		if *head > 0 {
+			if err := headFile(*inputFile, *head, *cellCache, OutputDelimiter(*outputFile), saveOpts); err != nil {
+				return fmt.Errorf("Decompression failed: %w", err)
+			}
+			return nil
+		}
+		if *pipeCmd == "" && *outputFile == "" {
 			*outputFile = strings.TrimSuffix(*inputFile, filepath.Ext(*inputFile)) + "_decompressed.csv"
 		}
-		err := decompressFile(*inputFile, *outputFile, *verbose)
+		decompressOpts := decompressOptions{
+			streamOut:     *streamOut,
+			skipBadBlocks: *skipBad,
+			originalShape: *origShape,
+			dtype:         dtype,
+
+			splitByFeatureType: *splitTypes,
+			geneOrder:          *geneOrder,
+			genePanel:          *genePanel,
+			transpose:          *transposeOut,
+			save:               saveOpts,
+			ctx:                ctx,
+		}
+		if *genePanel != "" && (*pipeCmd != "" || *streamOut || *origShape) {
+			return fmt.Errorf("-gene-panel cannot be combined with -pipe, -stream-out or -original-shape")
+		}
+		if *pipeCmd != "" {
+			if *outputFile != "" || *splitTypes || *transposeOut {
+				return fmt.Errorf("-pipe cannot be combined with -output, -split-by-feature-type or -transpose-out")
+			}
+			if err := pipeDecompressFile(*inputFile, *pipeCmd, decompressOpts, *verbose); err != nil {
+				return fmt.Errorf("Decompression failed: %w", err)
+			}
+			return nil
+		}
+		if err := prepareOutput(*outputFile, *mkdir, *force); err != nil {
+			return err
+		}
+		if IsMTXOutput(*outputFile) {
+			featuresFile, barcodesFile := MTXSidecarFiles(*outputFile)
+			for _, file := range []string{featuresFile, barcodesFile} {
+				if err := prepareOutput(file, *mkdir, *force); err != nil {
+					return err
+				}
+			}
+		}
+		start := time.Now()
+		record := NewRunRecord("decompress", *inputFile, *outputFile, parameters, start)
+		stats, err := decompressFile(*inputFile, *outputFile, decompressOpts, *verbose)
 		if err != nil {
-			log.Fatalf("Decompression failed: %v", err)
+			err = fmt.Errorf("Decompression failed: %w", err)
+		}
+		record.Decompression = stats
+		if err := finishRun(*appendLog, record, start, err); err != nil {
+			return err
 		}
 		fmt.Printf("Successfully decompressed %s to %s\n", *inputFile, *outputFile)
 
+	case "inspect":
+		if err := inspectFile(*inputFile, *checkSource, *verbose); err != nil {
+			return fmt.Errorf("Inspection failed: %w", err)
+		}
+
+	case "qc":
+		if qcGenes == "" {
+			return fmt.Errorf("QC mode requires -qc-out genes.csv,cells.csv")
+		}
+		if err := prepareQCOutputs(qcGenes, qcCells, *mkdir, *force); err != nil {
+			return err
+		}
+		if err := qcFile(*inputFile, qcGenes, qcCells, loadOpts, saveOpts); err != nil {
+			return fmt.Errorf("QC failed: %w", err)
+		}
+
 	default:
-		log.Fatalf("Unknown mode: %s. Use 'compress' or 'decompress'", *mode)
+		return fmt.Errorf("Unknown mode: %s. Use 'compress', 'decompress', 'inspect' or 'qc'", *mode)
+	}
+	return nil
+}
+
+// finishRun appends the run's record to the -append-log file, if one was
+// given, and passes on the run's own error. Failed runs are logged too.
+func finishRun(logFile string, record *RunRecord, start time.Time, runErr error) error {
+	if logFile == "" {
+		return runErr
+	}
+	record.Finish(start, runErr)
+	if err := AppendRunLog(logFile, record); err != nil {
+		if runErr != nil {
+			log.Printf("WARNING: %v", err)
+			return runErr
+		}
+		return err
+	}
+	return runErr
+}
+
+// prepareOutput creates the output's parent directory when -mkdir is given,
+// and fails early (before any slow work) if the output exists without -force
+func prepareOutput(outputFile string, mkdir, force bool) error {
+	if !force {
+		if _, err := os.Stat(outputFile); err == nil {
+			return fmt.Errorf("output %s exists, use -force to overwrite", outputFile)
+		}
+	}
+	if !mkdir {
+		return nil
 	}
+	if err := EnsureOutputDir(outputFile); err != nil {
+		return fmt.Errorf("Failed to create output directory: %w", err)
+	}
+	return nil
+}
+
+// compressOptions collects the compression settings given on the command line
+type compressOptions struct {
+	lossy        bool
+	threshold    float64
+	quantLevels  uint32
+	lowBits      LowBitsStrategy
+	fixedLowBits uint32
+	refWindow    int
+	refMemory    int64 // Budget in bytes of an automatic reference window, 0 for refWindow
+	refIndex     RefIndex
+	lshBands     int
+	lshRows      int
+	refMode      RefMode
+	numMedoids   int
+	forwardRefs  bool
+	noDelta      bool
+	deltaMin     int // -delta-min-genes, 0 for none
+	similarity   SimilarityMetric
+	adaptive     bool
+	lossyMaxErr  float64
+	exactGenes   []string        // -quant-genes panel, stored unquantized
+	modalities   map[string]bool // -modality-opts lossy setting by feature type, nil for none
+	pickSmallest bool
+	seed         int64
+	hvg          int
+	topGenes     int // -top-genes-per-cell, 0 keeps every gene
+	dtype        DType
+	binary       bool
+	eliasFlate   bool
+	geneChunk    uint32
+	frontCode    bool
+	valueCodec   ValueCodec
+	graphFile    string // -similarity-graph output, if any
+	graphK       int
+	shards       int    // Number of shard files, 0 or 1 for a single archive
+	sourceHash   bool   // Record the input's SHA-256 in the archive
+	qcGenes      string // -qc-out gene statistics output, if any
+	qcCells      string // -qc-out cell statistics output
+	load         LoadOptions
+	save         SaveOptions     // Of the archive and the -qc-out tables
+	ctx          context.Context // Stops compression once done, nil for never
+
+	// -autotune picks the settings by trials on tuneSample cells
+	autotune   bool
+	tuneBudget TuneBudget
+	tuneSample int
+}
+
+// newCompressor creates a compressor configured with the given options
+func (opts compressOptions) newCompressor() *Compressor {
+	compressor := NewCompressor(opts.lossy, opts.threshold, opts.quantLevels)
+	compressor.SetLowBitsStrategy(opts.lowBits, opts.fixedLowBits)
+	compressor.SetRefWindow(opts.refWindow)
+	if opts.refMemory > 0 {
+		compressor.SetAutoRefWindow(opts.refMemory)
+	}
+	compressor.SetRefIndex(opts.refIndex, opts.lshBands, opts.lshRows)
+	compressor.SetRefMode(opts.refMode, opts.numMedoids)
+	compressor.SetForwardRefs(opts.forwardRefs)
+	compressor.SetNoDelta(opts.noDelta)
+	compressor.SetDeltaMinGenes(opts.deltaMin)
+	compressor.SetSimilarity(opts.similarity)
+	compressor.SetAdaptiveQuantization(opts.adaptive)
+	compressor.SetLossyMaxError(opts.lossyMaxErr)
+	compressor.SetLosslessGenes(opts.exactGenes)
+	compressor.SetPickSmallest(opts.pickSmallest)
+	compressor.SetSeed(opts.seed)
+	compressor.SetVariableGenes(opts.hvg)
+	compressor.SetTopGenesPerCell(opts.topGenes)
+	compressor.SetDType(opts.dtype)
+	compressor.SetBinary(opts.binary)
+	compressor.SetEliasFlate(opts.eliasFlate)
+	compressor.SetGeneChunk(opts.geneChunk)
+	compressor.SetFrontCodedNames(opts.frontCode)
+	compressor.SetValueCodec(opts.valueCodec)
+	if opts.graphFile != "" {
+		compressor.SetSimilarityGraph(opts.graphK)
+	}
+	if opts.ctx != nil {
+		compressor.SetContext(opts.ctx)
+	}
+	// Honour the reproducible-builds convention for a fixed creation time
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		compressor.SetTimestamp(epoch)
+	}
+	return compressor
+}
+
+// matrixSource is a matrix file loaded for compression: the matrix and the
+// sections an archive records about the file besides it
+type matrixSource struct {
+	matrix       []SparseRow
+	geneNames    []string
+	cellNames    []string
+	featureTypes []string
+	nameHeader   *string
+	sourceHash   []byte
 }
 
-func compressFile(inputFile, outputFile string, lossy bool, threshold float64, quantLevels int, verbose bool) error {
-	// Load the sparse matrix
-	matrix, geneNames, cellNames, err := LoadSparseMatrix(inputFile)
+// loadMatrixSource loads a matrix file for compression, applying -gene-map
+// and -limit, and records its SHA-256 if hash is set. The cells read are
+// reported to w.
+func loadMatrixSource(w io.Writer, inputFile string, opts LoadOptions, hash bool) (*matrixSource, error) {
+	matrix, geneNames, cellNames, err := LoadSparseMatrix(inputFile, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load input file: %w", err)
+	}
+	src := &matrixSource{cellNames: cellNames}
+
+	featureTypes, err := LoadFeatureTypes(inputFile)
 	if err != nil {
-		return fmt.Errorf("failed to load input file: %w", err)
+		return nil, fmt.Errorf("failed to load feature types: %w", err)
+	}
+	if src.nameHeader, err = LoadNameHeader(inputFile, opts); err != nil {
+		return nil, fmt.Errorf("failed to load input file: %w", err)
+	}
+	if hash {
+		if src.sourceHash, err = HashSource(inputFile); err != nil {
+			return nil, fmt.Errorf("failed to hash input file: %w", err)
+		}
+	}
+	matrix, geneNames, featureTypes, err = opts.applyGeneMap(matrix, geneNames, featureTypes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply -gene-map: %w", err)
+	}
+	if opts.CellOffset > 0 || opts.CellCount > 0 {
+		fmt.Fprintf(w, "Read cells %d to %d of the input\n", opts.CellOffset+1, opts.CellOffset+len(matrix))
+	}
+	if opts.CellLimit > 0 {
+		matrix, geneNames, featureTypes = opts.applyCellLimit(matrix, geneNames, featureTypes)
+		fmt.Fprintf(w, "Limited to the first %d cells and the %d genes they express\n", len(matrix), len(geneNames))
+	}
+	src.matrix, src.geneNames, src.featureTypes = matrix, geneNames, featureTypes
+	return src, nil
+}
+
+// record stores the sections describing the source file in an archive
+// compressed from its matrix
+func (src *matrixSource) record(compressed *CompressedData) {
+	compressed.FeatureTypes = src.featureTypes
+	compressed.NameHeader = src.nameHeader
+	compressed.SourceHash = src.sourceHash
+}
+
+func compressFile(inputFile, outputFile string, opts compressOptions, verbose bool) (*CompressionStats, error) {
+	src, err := loadMatrixSource(os.Stdout, inputFile, opts.load, opts.sourceHash)
+	if err != nil {
+		return nil, err
+	}
+	matrix, geneNames, cellNames, featureTypes := src.matrix, src.geneNames, src.cellNames, src.featureTypes
+	if opts.modalities != nil {
+		lossless, anyLossy, err := modalityLosslessGenes(geneNames, featureTypes, opts.modalities, opts.lossy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply -modality-opts: %w", err)
+		}
+		opts.lossy = anyLossy
+		if anyLossy {
+			opts.exactGenes = append(append([]string(nil), opts.exactGenes...), lossless...)
+		}
+		fmt.Printf("Modalities: %d of %d genes stored losslessly\n", len(lossless), len(geneNames))
 	}
 
 	if verbose {
 		fmt.Printf("Loaded matrix: %d cells x %d genes\n", len(matrix), len(geneNames))
 		fmt.Printf("Total non-zero entries: %d\n", countNonZeros(matrix))
+		fmt.Printf("Genes per cell: %s\n", genesPerCell(matrix))
+	}
+
+	if opts.qcGenes != "" {
+		genes, cells := ComputeQC(matrix, len(geneNames))
+		if err := SaveQC(genes, cells, geneNames, cellNames, opts.qcGenes, opts.qcCells, opts.save); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Wrote QC statistics to %s and %s\n", opts.qcGenes, opts.qcCells)
+	}
+
+	if opts.autotune {
+		tuned, trials, err := autotune(matrix, geneNames, cellNames, opts, opts.tuneBudget, opts.tuneSample)
+		if err != nil {
+			return nil, fmt.Errorf("autotune failed: %w", err)
+		}
+		if verbose {
+			printTuneTrials(os.Stdout, trials)
+		}
+		best := trials[0]
+		fmt.Printf("Autotune picked %s: estimated ratio %.2f, about %d bytes in %s\n",
+			best, best.Ratio, best.Size, best.Time.Round(time.Millisecond))
+		if !best.Fits {
+			log.Printf("WARNING: no setting tried fits the -autotune budget; using the closest")
+		}
+		opts = tuned
 	}
 
 	// Create compressor
-	compressor := NewCompressor(lossy, threshold, quantLevels)
+	compressor := opts.newCompressor()
 
-	// Compress the matrix
-	compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+	// Compress the matrix, or each shard of it
+	var compressed *CompressedData
+	var shards []*CompressedData
+	if opts.shards > 1 {
+		shards, err = compressor.CompressShards(matrix, geneNames, cellNames, opts.shards)
+	} else {
+		compressed, err = compressor.Compress(matrix, geneNames, cellNames)
+	}
 	if err != nil {
-		return fmt.Errorf("compression failed: %w", err)
+		return nil, fmt.Errorf("compression failed: %w", err)
+	}
+	stats := compressor.Stats()
+	fmt.Printf("Compression completed in %v\n", time.Duration(stats.CompressionTime))
+	if opts.refMemory > 0 {
+		fmt.Printf("Reference window: %d cells (auto, %d MiB budget)\n", compressor.RefWindow(), opts.refMemory>>20)
+	}
+	if opts.lossyMaxErr > 0 {
+		fmt.Printf("%d of %d cells exceeded -lossy-maxerr %g and were stored losslessly\n",
+			stats.LosslessCells, stats.NumCells, opts.lossyMaxErr)
+	}
+	if opts.topGenes > 0 {
+		retained := 1.0
+		if total := totalCounts(matrix); total > 0 {
+			retained = 1 - float64(stats.DroppedCounts)/float64(total)
+		}
+		fmt.Printf("Kept the top %d genes of each cell: %.2f%% of the total counts retained\n", opts.topGenes, 100*retained)
+	}
+	if len(opts.exactGenes) > 0 && opts.modalities == nil {
+		archive := compressed
+		if shards != nil {
+			archive = shards[0]
+		}
+		fmt.Printf("%d of %d -quant-genes genes are in the matrix and were stored losslessly\n",
+			len(archive.LosslessGenes), len(opts.exactGenes))
+	}
+	if opts.graphFile != "" {
+		edges := compressor.SimilarityGraph()
+		if err := SaveSimilarityGraph(edges, cellNames, opts.graphFile, opts.save); err != nil {
+			return nil, fmt.Errorf("failed to save similarity graph: %w", err)
+		}
+		if len(edges) == 0 {
+			log.Printf("WARNING: the similarity graph is empty (binary matrices skip the reference search)")
+		}
+		fmt.Printf("Wrote %d similarity edges to %s\n", len(edges), opts.graphFile)
 	}
 
 	// Save compressed data
-	err = compressed.SaveToFile(outputFile)
+	if shards != nil {
+		for _, shard := range shards {
+			src.record(shard)
+		}
+		err = SaveShardedArchive(shards, outputFile, opts.save)
+	} else {
+		src.record(compressed)
+		err = compressed.SaveToFile(outputFile, opts.save)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to save compressed file: %w", err)
+		return nil, fmt.Errorf("failed to save compressed file: %w", err)
 	}
 
 	if verbose {
-		originalSize := estimateOriginalSize(matrix, geneNames, cellNames)
-		compressedSize := compressed.EstimateSize()
-		ratio := float64(originalSize) / float64(compressedSize)
-		fmt.Printf("Original size: %d bytes\n", originalSize)
-		fmt.Printf("Compressed size: %d bytes\n", compressedSize)
-		fmt.Printf("Compression ratio: %.2fx\n", ratio)
+		fmt.Printf("Original size: %d bytes\n", stats.OriginalSize)
+		fmt.Printf("Compressed size: %d bytes\n", stats.CompressedSize)
+		fmt.Printf("Compression ratio: %.2fx\n", stats.CompressionRatio)
+		fmt.Printf("Exact duplicate cells: %d\n", stats.DuplicateCells)
+		if compressed != nil && compressed.Codebook != nil {
+			fmt.Printf("Quantization RMSE: %.4f (%d levels)\n",
+				compressed.Codebook.RMSE, len(compressed.Codebook.Representatives))
+		}
 	}
 
-	return nil
+	return &stats, nil
 }
 
-func decompressFile(inputFile, outputFile string, verbose bool) error {
-	// Load compressed data
+// recompressFile decompresses an archive in memory and compresses it again
+// with new settings, without a round trip through a CSV on disk
+func recompressFile(inputFile, outputFile string, opts compressOptions, verbose bool) (*CompressionStats, error) {
 	compressed, err := LoadCompressedData(inputFile)
 	if err != nil {
-		return fmt.Errorf("failed to load compressed file: %w", err)
+		return nil, fmt.Errorf("failed to load compressed file: %w", err)
 	}
 
-	// Create decompressor
+	if compressed.Header.IsLossy {
+		log.Printf("WARNING: %s is already lossy; the original values cannot be recovered", inputFile)
+		if opts.lossy {
+			log.Printf("WARNING: recompressing lossy data lossily compounds the quantization error")
+		}
+	}
+
+	matrix, _, cellNames, err := newDecompressor(opts.ctx).Decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+
+	// Recompress in the original gene space so -hvg selects from all genes
+	// and an existing gene filter is carried over
+	matrix = compressed.ExpandMatrix(matrix)
+	geneNames := compressed.OriginalGeneNames()
+
+	// Keep the original dtype; lossy values no longer reveal it
+	if opts.dtype == DTypeUnknown {
+		opts.dtype = compressed.DType
+	}
+	opts.topGenes = keptTopGenes(compressed, opts.topGenes)
+
+	compressor := opts.newCompressor()
+	recompressed, err := compressor.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		return nil, fmt.Errorf("compression failed: %w", err)
+	}
+	recompressed.FeatureTypes = compressed.FeatureTypes
+	recompressed.NameHeader = compressed.NameHeader
+	recompressed.SourceHash = compressed.SourceHash
+
+	if err := recompressed.SaveToFile(outputFile, opts.save); err != nil {
+		return nil, fmt.Errorf("failed to save compressed file: %w", err)
+	}
+
+	if verbose {
+		fmt.Printf("Size: %d -> %d bytes (estimated)\n", compressed.EstimateSize(), recompressed.EstimateSize())
+	}
+	stats := compressor.Stats()
+	return &stats, nil
+}
+
+// compactFile compresses an archive's cells again with a fresh reference
+// search over all of them, keeping the archive's genes, values and encoding
+// settings. Only the reference settings of opts are used. Lossy archives are
+// refused, since their decoded values would be quantized a second time.
+func compactFile(inputFile, outputFile string, opts compressOptions, verbose bool) (*CompressionStats, error) {
+	compressed, err := LoadCompressedData(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load compressed file: %w", err)
+	}
+	if compressed.Header.IsLossy {
+		return nil, fmt.Errorf("%s is lossy and compacting would quantize it again; use -recompress to choose new settings", inputFile)
+	}
+
+	matrix, geneNames, cellNames, err := newDecompressor(opts.ctx).Decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+
+	opts.lossy = false
+	opts.adaptive = false
+	opts.lossyMaxErr = 0
+	opts.hvg = 0
+	opts.graphFile = ""
+	opts.dtype = compressed.DType
+	opts.binary = compressed.Header.IsBinary
+	opts.eliasFlate = compressed.Header.EliasFlate
+	opts.geneChunk = compressed.Header.GeneChunk
+	opts.frontCode = compressed.Header.FrontCodedNames
+	opts.valueCodec = compressed.Header.ValueCodec
+	opts.topGenes = int(compressed.TopGenesPerCell)
+
+	compressor := opts.newCompressor()
+	compacted, err := compressor.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		return nil, fmt.Errorf("compression failed: %w", err)
+	}
+	// The genes are compressed as stored, so an -hvg filter carries over as is
+	compacted.KeptGenes = compressed.KeptGenes
+	compacted.DroppedGeneNames = compressed.DroppedGeneNames
+	compacted.FeatureTypes = compressed.FeatureTypes
+	compacted.NameHeader = compressed.NameHeader
+	compacted.SourceHash = compressed.SourceHash
+
+	if err := compacted.SaveToFile(outputFile, opts.save); err != nil {
+		return nil, fmt.Errorf("failed to save compressed file: %w", err)
+	}
+
+	before, err := archiveSize(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	after, err := archiveSize(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Size: %d -> %d bytes (%+.1f%%)\n", before, after, 100*float64(after-before)/float64(before))
+	if verbose {
+		fmt.Printf("Delta-encoded cells: %d -> %d\n", referencedCells(compressed), referencedCells(compacted))
+	}
+	stats := compressor.Stats()
+	return &stats, nil
+}
+
+// keptTopGenes returns the -top-genes-per-cell setting of an archive
+// recompressed with topGenes: the dropped genes are gone for good, so an
+// archive that kept fewer genes per cell keeps recording its own count
+func keptTopGenes(cd *CompressedData, topGenes int) int {
+	if archived := int(cd.TopGenesPerCell); archived > 0 && (topGenes == 0 || topGenes > archived) {
+		return archived
+	}
+	return topGenes
+}
+
+// referencedCells counts the rows stored against a reference
+func referencedCells(cd *CompressedData) int {
+	count := 0
+	for _, row := range cd.CompressedRows {
+		if row.RefCell != -1 {
+			count++
+		}
+	}
+	return count
+}
+
+// decompressOptions collects the decompression settings given on the command line
+type decompressOptions struct {
+	streamOut     bool
+	skipBadBlocks bool
+	originalShape bool
+	dtype         DType // Overrides the archive's recorded dtype when set
+
+	splitByFeatureType bool
+	geneOrder          string // -gene-order spec, see GeneOrder
+	genePanel          string // -gene-panel file, empty for every gene
+	transpose          bool   // Write genes as rows and cells as columns
+	save               SaveOptions
+	ctx                context.Context // Stops decoding once done, nil for never
+}
+
+// newDecompressor creates a decompressor that stops once ctx, if not nil, is
+// done
+func newDecompressor(ctx context.Context) *Decompressor {
 	decompressor := NewDecompressor()
+	if ctx != nil {
+		decompressor.SetContext(ctx)
+	}
+	return decompressor
+}
 
-	// Decompress the data
-	matrix, geneNames, cellNames, err := decompressor.Decompress(compressed)
+// outputDType returns the dtype to write an archive's values as: -dtype if
+// given, else the one recorded
+func (opts decompressOptions) outputDType(compressed *CompressedData) DType {
+	if opts.dtype != DTypeUnknown {
+		return opts.dtype
+	}
+	return compressed.DType
+}
+
+func decompressFile(inputFile, outputFile string, opts decompressOptions, verbose bool) (*DecompressionStats, error) {
+	// Load compressed data
+	compressed, err := loadCompressedFile(inputFile, opts.skipBadBlocks)
 	if err != nil {
-		return fmt.Errorf("decompression failed: %w", err)
+		return nil, fmt.Errorf("failed to load compressed file: %w", err)
+	}
+
+	if opts.streamOut {
+		if opts.splitByFeatureType {
+			return nil, fmt.Errorf("-split-by-feature-type cannot be combined with -stream-out")
+		}
+		if opts.transpose {
+			return nil, fmt.Errorf("-transpose-out cannot be combined with -stream-out, which writes one cell at a time")
+		}
+		return nil, streamDecompressFile(compressed, outputFile, opts, verbose)
+	}
+
+	// Create decompressor
+	decompressor := newDecompressor(opts.ctx)
+
+	// Decompress the data, or only the -gene-panel genes
+	var matrix []SparseRow
+	geneNames, cellNames := compressed.GeneNames, compressed.CellNames
+	featureTypes := compressed.GeneFeatureTypes()
+	if opts.genePanel != "" {
+		listed, err := readNameColumn(opts.genePanel, strings.HasSuffix(opts.genePanel, ".gz"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -gene-panel: %w", err)
+		}
+		panel, err := GenePanelIndices(geneNames, listed, opts.genePanel)
+		if err != nil {
+			return nil, err
+		}
+		if matrix, err = decompressor.DecompressGenes(compressed, panel); err != nil {
+			return nil, fmt.Errorf("decompression failed: %w", err)
+		}
+		order := make([]int, len(panel))
+		for i, gene := range panel {
+			order[i] = int(gene)
+		}
+		geneNames = reorderStrings(geneNames, order)
+		featureTypes = reorderStrings(featureTypes, order)
+	} else if matrix, geneNames, cellNames, err = decompressor.Decompress(compressed); err != nil {
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+	stats := decompressor.Stats()
+	fmt.Printf("Decompression completed in %v\n", time.Duration(stats.DecompressionTime))
+
+	if opts.originalShape {
+		matrix = compressed.ExpandMatrix(matrix)
+		geneNames = compressed.OriginalGeneNames()
+		featureTypes = compressed.FeatureTypes
+	}
+
+	if opts.geneOrder != "" {
+		order, err := GeneOrder(geneNames, opts.geneOrder)
+		if err != nil {
+			return nil, err
+		}
+		featureTypes = reorderStrings(featureTypes, order)
+		matrix, geneNames = ReorderGenes(matrix, geneNames, order)
 	}
 
 	if verbose {
 		fmt.Printf("Decompressed matrix: %d cells x %d genes\n", len(matrix), len(geneNames))
 		fmt.Printf("Total non-zero entries: %d\n", countNonZeros(matrix))
+		fmt.Printf("Genes per cell: %s\n", genesPerCell(matrix))
+	}
+
+	dtype := opts.outputDType(compressed)
+	if !opts.splitByFeatureType {
+		if err := saveDecompressed(matrix, geneNames, cellNames, featureTypes, compressed.NameColumnHeader(), dtype, outputFile, opts.transpose, opts.save); err != nil {
+			return nil, err
+		}
+		return &stats, nil
 	}
 
-	// Save decompressed matrix
-	err = SaveSparseMatrix(matrix, geneNames, cellNames, outputFile)
+	// Write one matrix per feature type (modality)
+	if IsMTXOutput(outputFile) {
+		return nil, fmt.Errorf("-split-by-feature-type cannot write Matrix Market, whose features.tsv and barcodes.tsv would collide")
+	}
+	if len(featureTypes) == 0 {
+		return nil, fmt.Errorf("-split-by-feature-type: %s records no feature types", inputFile)
+	}
+	for _, subset := range SplitByFeatureType(matrix, geneNames, featureTypes) {
+		types := make([]string, len(subset.GeneNames))
+		for i := range types {
+			types[i] = subset.FeatureType
+		}
+		filename := featureTypeFilename(outputFile, subset.FeatureType)
+		if err := saveDecompressed(subset.Matrix, subset.GeneNames, cellNames, types, compressed.NameColumnHeader(), dtype, filename, opts.transpose, opts.save); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Wrote %d %s features to %s\n", len(subset.GeneNames), subset.FeatureType, filename)
+	}
+	return &stats, nil
+}
+
+// saveDecompressed writes a decompressed matrix as CSV, with nameHeader above
+// the cell names, Arrow or Matrix Market, plus a features sidecar when the
+// feature types are known
+func saveDecompressed(matrix []SparseRow, geneNames, cellNames, featureTypes []string, nameHeader string, dtype DType, outputFile string, transpose bool, opts SaveOptions) error {
+	var err error
+	if IsMTXOutput(outputFile) {
+		// Matrix Market is already genes x cells, and carries the feature
+		// types in its own features.tsv
+		if transpose {
+			return fmt.Errorf("-transpose-out only supports CSV/TSV output")
+		}
+		if opts.Format != FormatByDType {
+			return fmt.Errorf("-force-int and -force-float only support CSV/TSV output")
+		}
+		if err := SaveMTXMatrix(matrix, geneNames, cellNames, featureTypes, outputFile, opts); err != nil {
+			return fmt.Errorf("failed to save decompressed file: %w", err)
+		}
+		return nil
+	} else if strings.ToLower(filepath.Ext(outputFile)) == ".arrow" {
+		if transpose {
+			return fmt.Errorf("-transpose-out only supports CSV/TSV output")
+		}
+		if opts.Format != FormatByDType {
+			return fmt.Errorf("-force-int and -force-float only support CSV/TSV output")
+		}
+		err = SaveArrowMatrix(matrix, geneNames, cellNames, dtype, outputFile, opts)
+	} else if transpose {
+		err = SaveTransposedMatrix(matrix, geneNames, cellNames, dtype, outputFile, opts)
+	} else {
+		err = SaveSparseMatrix(matrix, geneNames, cellNames, nameHeader, dtype, outputFile, opts)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to save decompressed file: %w", err)
 	}
 
+	if len(featureTypes) > 0 {
+		if _, err := SaveFeaturesSidecar(geneNames, featureTypes, outputFile, opts); err != nil {
+			return fmt.Errorf("failed to save features file: %w", err)
+		}
+	}
 	return nil
 }
 
-func countNonZeros(matrix []SparseRow) int {
-	count := 0
-	for _, row := range matrix {
-		count += len(row.Values)
+// headFile prints the first n cells of an archive to stdout, decoding them
+// with a cell cache of cacheSize cells. Only the genes expressed in at least
+// one of those cells become columns, keeping the table small.
+func headFile(inputFile string, n, cacheSize int, delimiter rune, opts SaveOptions) error {
+	compressed, err := LoadCompressedData(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to load compressed file: %w", err)
 	}
-	return count
+
+	if n > int(compressed.Header.NumCells) {
+		n = int(compressed.Header.NumCells)
+	}
+
+	decompressor := NewDecompressor()
+	decompressor.SetCellCache(cacheSize)
+	rows := make([]SparseRow, n)
+	expressed := make(map[uint32]bool)
+	for i := range rows {
+		rows[i], err = decompressor.DecompressCell(compressed, i)
+		if err != nil {
+			return err
+		}
+		for _, gene := range rows[i].Indices {
+			expressed[gene] = true
+		}
+	}
+
+	genes := make([]uint32, 0, len(expressed))
+	for gene := range expressed {
+		genes = append(genes, gene)
+	}
+	sort.Slice(genes, func(i, j int) bool { return genes[i] < genes[j] })
+
+	asFloat := opts.floatOutput(compressed.DType)
+	writer := csv.NewWriter(os.Stdout)
+	writer.Comma = delimiter
+
+	header := []string{"Cell"}
+	for _, gene := range genes {
+		name := fmt.Sprintf("Gene_%d", gene+1)
+		if int(gene) < len(compressed.GeneNames) {
+			name = compressed.GeneNames[gene]
+		}
+		header = append(header, name)
+	}
+	writer.Write(header)
+
+	for i, row := range rows {
+		values := make(map[uint32]uint32, len(row.Indices))
+		for j, gene := range row.Indices {
+			values[gene] = row.Values[j]
+		}
+
+		record := []string{fmt.Sprintf("Cell_%d", i+1)}
+		if i < len(compressed.CellNames) {
+			record[0] = compressed.CellNames[i]
+		}
+		for _, gene := range genes {
+			record = append(record, opts.formatValue(values[gene], asFloat))
+		}
+		writer.Write(record)
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// loadCompressedFile loads an archive, optionally skipping and reporting damaged blocks
+func loadCompressedFile(inputFile string, skipBadBlocks bool) (*CompressedData, error) {
+	if !skipBadBlocks {
+		return LoadCompressedData(inputFile)
+	}
+
+	compressed, damage, err := LoadCompressedDataSkippingBadBlocks(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range damage {
+		log.Printf("Warning: cells %d-%d lost (%v); emitting zeros", d.FirstCell, d.FirstCell+d.NumCells-1, d.Err)
+	}
+	if dependents := DependentCells(compressed, damage); len(dependents) > 0 {
+		log.Printf("Warning: %d more cells reference lost cells and may be inaccurate", len(dependents))
+	}
+	return compressed, nil
+}
+
+// repairFile salvages the intact blocks of an archive into a new one
+func repairFile(inputFile, outputFile string, policy LostCellPolicy, opts SaveOptions) error {
+	compressed, damage, err := LoadCompressedDataSkippingBadBlocks(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to load compressed file: %w", err)
+	}
+	for _, d := range damage {
+		log.Printf("Cells %d-%d lost (%v)", d.FirstCell, d.FirstCell+d.NumCells-1, d.Err)
+	}
+
+	numCells, damaged := compressed.Header.NumCells, 0
+	for _, d := range damage {
+		damaged += int(d.NumCells)
+	}
+	lost, err := RepairArchive(compressed, damage, policy)
+	if err != nil {
+		return err
+	}
+	if dependents := len(lost) - damaged; dependents > 0 {
+		log.Printf("%d more cells referenced lost cells and are lost as well", dependents)
+	}
+	switch {
+	case len(lost) == 0:
+		fmt.Printf("No damage found; all %d cells kept\n", numCells)
+	case policy == LostCellsDrop:
+		fmt.Printf("Dropped %d lost cells; %d of %d cells kept\n", len(lost), compressed.Header.NumCells, numCells)
+	default:
+		fmt.Printf("Wrote %d lost cells as empty cells; %d of %d cells intact\n", len(lost), int(numCells)-len(lost), numCells)
+	}
+	return compressed.SaveToFile(outputFile, opts)
+}
+
+func inspectFile(inputFile, sourceFile string, verbose bool) error {
+	compressed, err := LoadCompressedData(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to load compressed file: %w", err)
+	}
+	if sourceFile != "" {
+		if len(compressed.SourceHash) == 0 {
+			return fmt.Errorf("%s records no source hash to check %s against", inputFile, sourceFile)
+		}
+		matches, err := compressed.MatchesSource(sourceFile)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", sourceFile, err)
+		}
+		if !matches {
+			return fmt.Errorf("%s is not the source of %s: its SHA-256 differs from the recorded one", sourceFile, inputFile)
+		}
+		fmt.Printf("Source check: %s matches the recorded SHA-256\n", sourceFile)
+	}
+
+	info, err := compressed.Inspect()
+	if err != nil {
+		return err
+	}
+	info.Print(os.Stdout)
+	if verbose {
+		fmt.Println()
+		info.PrintCells(os.Stdout, compressed.CellNames)
+	}
+	return nil
+}
+
+// prepareQCOutputs checks the two -qc-out files like any other output
+func prepareQCOutputs(genesFile, cellsFile string, mkdir, force bool) error {
+	if err := prepareOutput(genesFile, mkdir, force); err != nil {
+		return err
+	}
+	return prepareOutput(cellsFile, mkdir, force)
+}
+
+// qcFile writes the QC statistics of a matrix file or .scz archive
+func qcFile(inputFile, genesFile, cellsFile string, loadOpts LoadOptions, saveOpts SaveOptions) error {
+	matrix, geneNames, cellNames, err := loadAnyMatrix(inputFile, loadOpts)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", inputFile, err)
+	}
+	genes, cells := ComputeQC(matrix, len(geneNames))
+	if err := SaveQC(genes, cells, geneNames, cellNames, genesFile, cellsFile, saveOpts); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote statistics of %d genes to %s and %d cells to %s\n", len(genes), genesFile, len(cells), cellsFile)
+	return nil
+}
+
+// parseLowBits parses the -ef-lowbits flag into a strategy and optional fixed width
+func parseLowBits(value string) (LowBitsStrategy, uint32, error) {
+	switch value {
+	case "heuristic":
+		return LowBitsHeuristic, 0, nil
+	case "floor":
+		return LowBitsFloorLog, 0, nil
+	case "search":
+		return LowBitsSearch, 0, nil
+	}
+
+	bits, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || bits > 31 {
+		return 0, 0, fmt.Errorf("expected heuristic, floor, search or 0-31, got %q", value)
+	}
+	return LowBitsFixed, uint32(bits), nil
+}
+
+// parseRefWindow parses the -ref-window flag into a window and whether it is
+// sized automatically
+func parseRefWindow(value string) (int, bool, error) {
+	if value == "auto" {
+		return -1, true, nil
+	}
+	window, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false, fmt.Errorf("expected a number of cells or auto, got %q", value)
+	}
+	return window, false, nil
+}
+
+// refMemory returns the reference window budget in bytes: -max-memory if
+// given, otherwise the default for the machine. It is 0 for a fixed window.
+func refMemory(autoWindow bool, maxMemoryMiB int64) int64 {
+	if !autoWindow {
+		return 0
+	}
+	if maxMemoryMiB > 0 {
+		return maxMemoryMiB << 20
+	}
+	return defaultRefWindowBudget()
+}
+
+// parseCommentChar parses the -comment-char flag; an empty value disables
+// comments
+func parseCommentChar(value string) (rune, error) {
+	if value == "" {
+		return 0, nil
+	}
+	comment, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || comment == utf8.RuneError {
+		return 0, fmt.Errorf("expected a single character, got %q", value)
+	}
+	if comment == '"' || comment == '\r' || comment == '\n' || comment == ',' {
+		return 0, fmt.Errorf("%q cannot mark comments", comment)
+	}
+	return comment, nil
+}
+
+func compareFiles(fileA, fileB string, tolerance uint32, opts LoadOptions) error {
+	matrixA, _, cellNames, err := loadAnyMatrix(fileA, opts)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", fileA, err)
+	}
+
+	matrixB, _, _, err := loadAnyMatrix(fileB, opts)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", fileB, err)
+	}
+
+	diff := CompareMatrices(matrixA, matrixB, tolerance)
+	diff.PrintSummary(os.Stdout, cellNames, 10)
+	return nil
+}
+
+// loadAnyMatrix loads a matrix from either a compressed .scz file or a plain matrix file
+func loadAnyMatrix(filename string, opts LoadOptions) ([]SparseRow, []string, []string, error) {
+	if strings.ToLower(filepath.Ext(filename)) != ".scz" && !isShardIndex(filename) {
+		matrix, geneNames, cellNames, err := LoadSparseMatrix(filename, opts)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		matrix, geneNames, _, err = opts.applyGeneMap(matrix, geneNames, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		matrix, geneNames, _ = opts.applyCellLimit(matrix, geneNames, nil)
+		return matrix, geneNames, cellNames, nil
+	}
+
+	compressed, err := LoadCompressedData(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	matrix, _, cellNames, err := NewDecompressor().Decompress(compressed)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Compare in the original gene space in case genes were filtered
+	return compressed.ExpandMatrix(matrix), compressed.OriginalGeneNames(), cellNames, nil
+}
+
+// streamDecompressFile writes each cell to the output CSV as soon as it is decoded
+func streamDecompressFile(compressed *CompressedData, outputFile string, opts decompressOptions, verbose bool) error {
+	if strings.ToLower(filepath.Ext(outputFile)) == ".arrow" || IsMTXOutput(outputFile) {
+		return fmt.Errorf("-stream-out only supports CSV output")
+	}
+
+	outputNames, featureTypes, err := streamDecompressTo(compressed, opts, verbose, func(geneNames []string) (*CSVMatrixWriter, error) {
+		return NewCSVMatrixWriter(outputFile, geneNames, compressed.CellNames, compressed.NameColumnHeader(), opts.save)
+	})
+	if err != nil {
+		return err
+	}
+	if len(featureTypes) > 0 {
+		if _, err := SaveFeaturesSidecar(outputNames, featureTypes, outputFile, opts.save); err != nil {
+			return fmt.Errorf("failed to save features file: %w", err)
+		}
+	}
+	return nil
 }
 
-func estimateOriginalSize(matrix []SparseRow, geneNames, cellNames []string) int {
-	size := 0
-	// Gene names
-	for _, name := range geneNames {
-		size += len(name)
+// streamDecompressTo decodes the archive one cell at a time into the CSV
+// writer newWriter creates for the output genes, and closes it. It returns
+// the output genes and their feature types, if known.
+func streamDecompressTo(compressed *CompressedData, opts decompressOptions, verbose bool, newWriter func(geneNames []string) (*CSVMatrixWriter, error)) ([]string, []string, error) {
+	geneNames := compressed.GeneNames
+	featureTypes := compressed.GeneFeatureTypes()
+	if opts.originalShape {
+		geneNames = compressed.OriginalGeneNames()
+		featureTypes = compressed.FeatureTypes
+	}
+
+	order, err := GeneOrder(geneNames, opts.geneOrder)
+	if err != nil {
+		return nil, nil, err
+	}
+	reorder := newGeneReorder(geneNames, order)
+	featureTypes = reorderStrings(featureTypes, order)
+
+	writer, err := newWriter(reorder.names)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create decompressed file: %w", err)
+	}
+	writer.SetDType(opts.outputDType(compressed))
+
+	nonZeros := 0
+	stats := newGenesPerCellStats()
+	err = newDecompressor(opts.ctx).DecompressTo(compressed, func(cellIdx int, row SparseRow) error {
+		nonZeros += len(row.Values)
+		stats.Add(float64(len(row.Values)))
+		if opts.originalShape {
+			row = compressed.ExpandRow(row)
+		}
+		return writer.WriteRow(reorder.row(row))
+	})
+	if err != nil {
+		writer.Close()
+		return nil, nil, fmt.Errorf("decompression failed: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to save decompressed file: %w", err)
 	}
-	// Cell names
-	for _, name := range cellNames {
-		size += len(name)
+
+	if verbose {
+		fmt.Printf("Decompressed matrix: %d cells x %d genes\n", compressed.Header.NumCells, len(geneNames))
+		fmt.Printf("Total non-zero entries: %d\n", nonZeros)
+		fmt.Printf("Genes per cell: %s\n", stats)
 	}
-	// Matrix data (assuming 4 bytes per int32)
+	return reorder.names, featureTypes, nil
+}
+
+// newGenesPerCellStats creates the streaming statistics reported for genes per cell
+func newGenesPerCellStats() *StreamStats {
+	return NewStreamStats(0.5, 0.9, 0.99)
+}
+
+// genesPerCell summarizes the number of expressed genes per cell
+func genesPerCell(matrix []SparseRow) *StreamStats {
+	stats := newGenesPerCellStats()
+	for _, row := range matrix {
+		stats.Add(float64(len(row.Indices)))
+	}
+	return stats
+}
+
+// totalCounts sums every value of the matrix
+func totalCounts(matrix []SparseRow) uint64 {
+	var total uint64
 	for _, row := range matrix {
-		size += len(row.Indices) * 4  // gene indices
-		size += len(row.Values) * 4   // expression values
+		for _, value := range row.Values {
+			total += uint64(value)
+		}
 	}
-	return size
+	return total
+}
+
+func countNonZeros(matrix []SparseRow) int {
+	count := 0
+	for _, row := range matrix {
+		count += len(row.Values)
+	}
+	return count
 }
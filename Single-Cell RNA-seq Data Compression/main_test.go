@@ -0,0 +1,1060 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestMatrix saves a synthetic matrix as CSV in a temporary directory
+// and returns its path and contents
+func writeTestMatrix(t *testing.T, cells, genes int) (string, []SparseRow) {
+	t.Helper()
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(cells, genes, 0.8, 1)
+	input := filepath.Join(t.TempDir(), "m.csv")
+	if err := SaveSparseMatrix(matrix, geneNames, cellNames, "", DTypeUnknown, input, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return input, matrix
+}
+
+// captureStdout runs f with os.Stdout redirected and returns what it printed
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	printed := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- data
+	}()
+	err = f()
+	w.Close()
+	os.Stdout = saved
+	return string(<-printed), err
+}
+
+// compressDecompress runs -mode compress and then -mode decompress on input
+// with the extra compress flags, and returns the decompressed CSV
+func compressDecompress(t *testing.T, input string, compressArgs ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	output := filepath.Join(dir, "out.csv")
+	if err := run(append([]string{"-mode", "compress", "-input", input, "-output", archive}, compressArgs...)); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err := run([]string{"-mode", "decompress", "-input", archive, "-output", output}); err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+	return output
+}
+
+func TestRunLosslessRoundTrip(t *testing.T) {
+	input, _ := writeTestMatrix(t, 150, 60)
+	want, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"default", nil},
+		{"medoid", []string{"-ref-mode", "medoid"}},
+		{"gene-baseline", []string{"-ref-mode", "gene-baseline"}},
+		{"no delta", []string{"-no-delta"}},
+		{"rice values", []string{"-value-codec", "rice"}},
+		{"rank similarity", []string{"-similarity", "rank"}},
+		{"rank similarity medoid", []string{"-similarity", "rank", "-ref-mode", "medoid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := os.ReadFile(compressDecompress(t, input, tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("the decompressed CSV differs from the input")
+			}
+		})
+	}
+}
+
+func TestRunLossyWithinTolerance(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 150, 60)
+	for _, levels := range []uint32{16, 256} {
+		output := compressDecompress(t, input, "-lossy", "-threshold", "0", "-quant", strconv.Itoa(int(levels)))
+		decoded, _, _, err := LoadSparseMatrix(output, DefaultLoadOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != len(matrix) {
+			t.Fatalf("-quant %d: %d cells, want %d", levels, len(decoded), len(matrix))
+		}
+		changed := false
+		for cell, row := range matrix {
+			got := referenceValues(decoded[cell], row.Indices)
+			for i, value := range row.Values {
+				diff := math.Abs(float64(got[i]) - float64(value))
+				if diff > quantizationBound(value, levels) {
+					t.Fatalf("-quant %d: cell %d gene %d: %d decoded as %d", levels, cell, row.Indices[i], value, got[i])
+				}
+				changed = changed || diff > 0
+			}
+		}
+		if levels == 16 && !changed {
+			t.Error("-quant 16 changed no value; the archive was not lossy")
+		}
+	}
+}
+
+func TestRunLossyMaxError(t *testing.T) {
+	input, _ := writeTestMatrix(t, 150, 60)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	printed, err := captureStdout(t, func() error {
+		return run([]string{"-mode", "compress", "-input", input, "-output", archive, "-lossy", "-threshold", "0", "-quant", "4", "-lossy-maxerr", "0.5"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := LoadCompressedData(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed.LosslessCells) == 0 {
+		t.Fatal("no cell fell back to lossless under -quant 4 -lossy-maxerr 0.5")
+	}
+	want := fmt.Sprintf("%d of 150 cells exceeded -lossy-maxerr 0.5 and were stored losslessly", len(compressed.LosslessCells))
+	if !strings.Contains(printed, want) {
+		t.Errorf("output lacks %q:\n%s", want, printed)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-lossy-maxerr", "2"}, "-lossy-maxerr requires -lossy"},
+		{[]string{"-lossy", "-lossy-maxerr", "-1"}, "-lossy-maxerr must not be negative"},
+	} {
+		err := run(append([]string{"-mode", "compress", "-input", input, "-output", filepath.Join(dir, "bad.scz")}, tt.args...))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestRunVerbose(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 150, 60)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"compress", []string{"-mode", "compress", "-input", input, "-output", archive, "-verbose"}, []string{
+			"Loaded matrix: 150 cells x 60 genes",
+			fmt.Sprintf("Total non-zero entries: %d", countNonZeros(matrix)),
+			"Compression ratio: ",
+			"Exact duplicate cells: ",
+		}},
+		{"decompress", []string{"-mode", "decompress", "-input", archive, "-output", filepath.Join(dir, "out.csv"), "-verbose"}, []string{
+			"Decompressed matrix: 150 cells x 60 genes",
+			fmt.Sprintf("Total non-zero entries: %d", countNonZeros(matrix)),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			printed, err := captureStdout(t, func() error { return run(tt.args) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range tt.want {
+				if !strings.Contains(printed, line) {
+					t.Errorf("output lacks %q:\n%s", line, printed)
+				}
+			}
+		})
+	}
+}
+
+func TestValueMode(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	input, _ := writeTestMatrix(t, 120, 40)
+	dir := t.TempDir()
+	baseline := filepath.Join(dir, "baseline.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", baseline, "-ref-mode", "gene-baseline"}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"alias", []string{"-value-mode", "gene-baseline"}, ""},
+		{"both", []string{"-value-mode", "gene-baseline", "-ref-mode", "gene-baseline"}, ""},
+		{"conflicting ref-mode", []string{"-value-mode", "gene-baseline", "-ref-mode", "medoid"}, "cannot be combined with -ref-mode medoid"},
+		{"cell-delta with baseline", []string{"-value-mode", "cell-delta", "-ref-mode", "gene-baseline"}, "cannot be combined"},
+		{"unknown", []string{"-value-mode", "median"}, "Unknown -value-mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "m.scz")
+			err := run(append([]string{"-mode", "compress", "-input", input, "-output", output}, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("the archive differs from the -ref-mode gene-baseline one")
+			}
+		})
+	}
+}
+
+// TestRunSeedReproducible runs randomized modes twice with the same -seed,
+// which must write byte-identical output
+func TestRunSeedReproducible(t *testing.T) {
+	// The archive header records the compression time
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	input, _ := writeTestMatrix(t, 150, 60)
+	tests := []struct {
+		name   string
+		output string
+		args   []string
+	}{
+		{"generate", "m.csv", []string{"-mode", "generate", "-cells", "50", "-genes", "40"}},
+		{"medoid", "m.scz", []string{"-mode", "compress", "-input", input, "-ref-mode", "medoid", "-medoids", "8"}},
+		{"medoid lossy", "m.scz", []string{"-mode", "compress", "-input", input, "-ref-mode", "medoid", "-lossy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputs := make([][]byte, 2)
+			for i := range outputs {
+				output := filepath.Join(t.TempDir(), tt.output)
+				if err := run(append([]string{"-output", output, "-seed", "7"}, tt.args...)); err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(output)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs[i] = data
+			}
+			if !bytes.Equal(outputs[0], outputs[1]) {
+				t.Errorf("two runs with -seed 7 wrote different output (%d and %d bytes)", len(outputs[0]), len(outputs[1]))
+			}
+		})
+	}
+}
+
+func TestRunForce(t *testing.T) {
+	input, _ := writeTestMatrix(t, 30, 20)
+	archive := filepath.Join(t.TempDir(), "m.scz")
+	args := []string{"-mode", "compress", "-input", input, "-output", archive}
+	if err := run(args); err != nil {
+		t.Fatal(err)
+	}
+	err := run(args)
+	if err == nil || !strings.Contains(err.Error(), "exists, use -force to overwrite") {
+		t.Fatalf("compressing again without -force: got %v", err)
+	}
+	if err := run(append(args, "-force")); err != nil {
+		t.Fatalf("compressing again with -force: %v", err)
+	}
+}
+
+func TestRunNoHeaderNoIndex(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "grid.csv")
+	if err := os.WriteFile(input, []byte("1,0,3\n0,2,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := compressDecompress(t, input, "-no-header", "-no-index")
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Cell,Gene_1,Gene_2,Gene_3\nCell_1,1,0,3\nCell_2,0,2,0\n"
+	if string(got) != want {
+		t.Errorf("decompressed\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestRunCompressArchiveInput points compress at an archive, under its own
+// name and renamed, which must fail clearly instead of parsing its bytes
+func TestRunCompressArchiveInput(t *testing.T) {
+	input, _ := writeTestMatrix(t, 30, 20)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"scz", "m.scz"},
+		{"renamed csv", "renamed.csv"},
+		{"renamed tsv", "renamed.tsv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := filepath.Join(dir, tt.input)
+			if err := os.WriteFile(input, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			output := filepath.Join(t.TempDir(), "again.scz")
+			err := run([]string{"-mode", "compress", "-input", input, "-output", output})
+			if err == nil || !strings.Contains(err.Error(), "appears to be an already-compressed .scz file") {
+				t.Fatalf("got %v, want an already-compressed input error", err)
+			}
+			if _, err := os.Stat(output); err == nil {
+				t.Error("compress wrote an output")
+			}
+		})
+	}
+}
+
+func TestParseCommentChar(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    rune
+		wantErr bool
+	}{
+		{"#", '#', false},
+		{"%", '%', false},
+		{"", 0, false},
+		{"##", 0, true},
+		{`"`, 0, true},
+		{",", 0, true},
+		{"\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Quote(tt.value), func(t *testing.T) {
+			got, err := parseCommentChar(tt.value)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseCommentChar(%q) = %q, %v", tt.value, got, err)
+			}
+		})
+	}
+}
+
+// TestRunTransposeOut decompresses genes x cells and reads the output back,
+// which transposed must be the input matrix with its names in place
+func TestRunTransposeOut(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 40, 25)
+	_, geneNames, cellNames, err := LoadSparseMatrix(input, DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		output  string
+		wantErr bool
+	}{
+		{"t.csv", false},
+		{"t.tsv", false},
+		{"t.mtx", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			output := filepath.Join(dir, tt.output)
+			err := run([]string{"-mode", "decompress", "-input", archive, "-output", output, "-transpose-out"})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "only supports CSV/TSV output") {
+					t.Errorf("got %v, want a CSV/TSV only error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			transposed, columns, rows, err := LoadSparseMatrix(output, DefaultLoadOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rows, geneNames) || !reflect.DeepEqual(columns, cellNames) {
+				t.Fatalf("rows %q and columns %q, want the genes and cells", rows, columns)
+			}
+			for cell, row := range TransposeMatrix(transposed, len(cellNames)) {
+				if !sameRow(row, matrix[cell]) {
+					t.Fatalf("cell %d read back as %v, want %v", cell, row, matrix[cell])
+				}
+			}
+		})
+	}
+}
+
+// TestRunFilteredRows compresses rows whose every value is zero or skipped,
+// which must come back as all-zero rows
+func TestRunFilteredRows(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "m.csv")
+	data := "Cell,A,B,C\nc1,0,0,0\nc2,1,0,2\nc3,NA,-1,\nc4,0,0,0\n"
+	if err := os.WriteFile(input, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := compressDecompress(t, input, "-lenient-values")
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Cell,A,B,C\nc1,0,0,0\nc2,1,0,2\nc3,0,0,0\nc4,0,0,0\n"
+	if string(got) != want {
+		t.Errorf("decompressed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRunQuantGenes(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 60, 30)
+	_, geneNames, _, err := LoadSparseMatrix(input, DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := filepath.Join(t.TempDir(), "panel.txt")
+	if err := os.WriteFile(panel, []byte(geneNames[2]+"\n"+geneNames[9]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "m.scz")
+	err = run([]string{"-mode", "compress", "-input", input, "-output", archive, "-quant-genes", panel})
+	if err == nil || !strings.Contains(err.Error(), "-quant-genes requires -lossy") {
+		t.Fatalf("-quant-genes without -lossy: got %v", err)
+	}
+
+	output := compressDecompress(t, input, "-lossy", "-threshold", "0", "-quant", "4", "-quant-genes", panel)
+	decoded, _, _, err := LoadSparseMatrix(output, DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cell, row := range matrix {
+		got := referenceValues(decoded[cell], []uint32{2, 9})
+		want := referenceValues(row, []uint32{2, 9})
+		if got[0] != want[0] || got[1] != want[1] {
+			t.Fatalf("cell %d panel genes decoded as %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestRunStripSuffix(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "m.csv")
+	if err := os.WriteFile(input, []byte("barcode,A,B\nAAAC-1,1,0\nGGTT-1,0,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := compressDecompress(t, input, "-strip-suffix")
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "barcode,A,B\nAAAC,1,0\nGGTT,0,2\n"
+	if string(got) != want {
+		t.Errorf("decompressed\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestRunKeepsHeader checks that the decompressed header line repeats the
+// input's byte for byte, name column header and gene order included
+func TestRunKeepsHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"barcode column", "barcode,Zeb2,Actb,Malat1"},
+		{"pandas empty column", ",Zeb2,Actb,Malat1"},
+		{"unsorted genes", "Cell,mt-Co1,Gapdh,Actb"},
+		{"quoted gene", `Cell,"HLA,A",Actb,B2m`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := filepath.Join(t.TempDir(), "m.csv")
+			content := tt.header + "\nc1,1,0,3\nc2,0,2,0\n"
+			if err := os.WriteFile(input, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(compressDecompress(t, input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line, _, _ := strings.Cut(string(got), "\n"); line != tt.header {
+				t.Errorf("decompressed header %q, want %q", line, tt.header)
+			}
+			if string(got) != content {
+				t.Errorf("decompressed\n%s\nwant\n%s", got, content)
+			}
+		})
+	}
+}
+
+// TestRunStreamOut checks that -stream-out writes the same CSV as the
+// in-memory decompressor, for lossless and lossy archives, and refuses
+// output formats other than CSV
+// TestRunKeepsGeneOrder writes a wide header whose genes are neither sorted
+// nor in any order derivable from their names, with each cell's counts
+// identifying their column. The archive must store the genes in header order,
+// and every compress and decompress path must give back the input file byte
+// for byte, so no column is reindexed on the way.
+func TestRunKeepsGeneOrder(t *testing.T) {
+	const genes = 120
+	rng := rand.New(rand.NewSource(7))
+	names := make([]string, genes)
+	for i, j := range rng.Perm(genes) {
+		names[i] = fmt.Sprintf("g%03d", j)
+		if j%3 == 0 {
+			names[i] = strings.ToUpper(names[i])
+		}
+	}
+	var content strings.Builder
+	content.WriteString("barcode," + strings.Join(names, ",") + "\n")
+	for cell := 0; cell < 40; cell++ {
+		record := []string{fmt.Sprintf("c%d", cell)}
+		for column := 0; column < genes; column++ {
+			value := 0
+			if (column+cell)%4 == 0 {
+				value = column + 1
+			}
+			record = append(record, strconv.Itoa(value))
+		}
+		content.WriteString(strings.Join(record, ",") + "\n")
+	}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "m.csv")
+	if err := os.WriteFile(input, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                     string
+		compressArgs, decompArgs []string
+	}{
+		{"default", nil, nil},
+		{"front-coded names", []string{"-front-code-names"}, nil},
+		{"gene chunks", []string{"-gene-chunk", "16"}, nil},
+		{"medoid references", []string{"-ref-mode", "medoid"}, nil},
+		{"stream out", nil, []string{"-stream-out"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "m.scz")
+			output := filepath.Join(t.TempDir(), "out.csv")
+			if err := run(append([]string{"-mode", "compress", "-input", input, "-output", archive}, tt.compressArgs...)); err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := LoadCompressedData(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(compressed.GeneNames, names) {
+				t.Fatalf("archive stores genes %v, want header order %v", compressed.GeneNames[:5], names[:5])
+			}
+			if err := run(append([]string{"-mode", "decompress", "-input", archive, "-output", output}, tt.decompArgs...)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotHeader, _, _ := strings.Cut(string(got), "\n")
+			wantHeader, _, _ := strings.Cut(content.String(), "\n")
+			if gotHeader != wantHeader {
+				t.Errorf("decompressed header\n%s\nwant\n%s", gotHeader, wantHeader)
+			}
+			if string(got) != content.String() {
+				t.Error("decompressed CSV differs from the input")
+			}
+		})
+	}
+}
+
+func TestRunStreamOut(t *testing.T) {
+	input, _ := writeTestMatrix(t, 150, 60)
+	dir := t.TempDir()
+	for _, args := range [][]string{nil, {"-lossy", "-threshold", "2"}, {"-ref-mode", "medoid"}} {
+		archive := filepath.Join(dir, "m.scz")
+		if err := run(append([]string{"-mode", "compress", "-input", input, "-output", archive, "-force"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		var outputs [2][]byte
+		for i, stream := range []bool{false, true} {
+			output := filepath.Join(dir, "out.csv")
+			decompressArgs := []string{"-mode", "decompress", "-input", archive, "-output", output, "-force"}
+			if stream {
+				decompressArgs = append(decompressArgs, "-stream-out")
+			}
+			if err := run(decompressArgs); err != nil {
+				t.Fatalf("%v, -stream-out %v: %v", args, stream, err)
+			}
+			var err error
+			if outputs[i], err = os.ReadFile(output); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("%v: -stream-out output differs from the in-memory one", args)
+		}
+	}
+
+	err := run([]string{"-mode", "decompress", "-input", filepath.Join(dir, "m.scz"), "-output", filepath.Join(dir, "out.mtx"), "-stream-out"})
+	if err == nil || !strings.Contains(err.Error(), "only supports CSV output") {
+		t.Errorf("-stream-out to .mtx: got %v, want a CSV-only error", err)
+	}
+}
+
+// headTable returns the table -head should print for the first n rows: a
+// "Cell" column plus one column per gene any of them expresses
+func headTable(matrix []SparseRow, geneNames, cellNames []string, n int, sep string) string {
+	expressed := make([]bool, len(geneNames))
+	for _, row := range matrix[:n] {
+		for _, gene := range row.Indices {
+			expressed[gene] = true
+		}
+	}
+	header := []string{"Cell"}
+	for gene, ok := range expressed {
+		if ok {
+			header = append(header, geneNames[gene])
+		}
+	}
+	lines := []string{strings.Join(header, sep)}
+	for i, row := range matrix[:n] {
+		values := make([]uint32, len(geneNames))
+		for j, gene := range row.Indices {
+			values[gene] = row.Values[j]
+		}
+		record := []string{cellNames[i]}
+		for gene, ok := range expressed {
+			if ok {
+				record = append(record, strconv.FormatUint(uint64(values[gene]), 10))
+			}
+		}
+		lines = append(lines, strings.Join(record, sep))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestRunHead(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 150, 60)
+	_, geneNames, cellNames := GenerateSyntheticMatrix(150, 60, 0.8, 1)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		n      int
+		sep    string
+		output string
+	}{
+		{"first cells", []string{"-head", "3"}, 3, ",", ""},
+		{"tsv output selects tabs", []string{"-head", "3", "-output", filepath.Join(dir, "out.tsv")}, 3, "\t", filepath.Join(dir, "out.tsv")},
+		{"more than the archive holds", []string{"-head", "1000"}, 150, ",", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			printed, err := captureStdout(t, func() error {
+				return run(append([]string{"-mode", "decompress", "-input", archive}, tt.args...))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := headTable(matrix, geneNames, cellNames, tt.n, tt.sep); printed != want {
+				t.Errorf("printed\n%s\nwant\n%s", printed, want)
+			}
+			if tt.output != "" {
+				if _, err := os.Stat(tt.output); !os.IsNotExist(err) {
+					t.Errorf("-head wrote %s; it should only print to stdout", tt.output)
+				}
+			}
+		})
+	}
+}
+
+// TestRunCompact compacts an archive whose references were limited to a
+// one-cell window: the compacted archive must reference more cells, keep the
+// value codec, decode to the same matrix and report both sizes
+func TestRunCompact(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 300, 60)
+	dir := t.TempDir()
+	windowed := filepath.Join(dir, "windowed.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", windowed, "-ref-window", "1", "-value-codec", "rice"}); err != nil {
+		t.Fatal(err)
+	}
+	compact := filepath.Join(dir, "compact.scz")
+	printed, err := captureStdout(t, func() error {
+		return run([]string{"-compact", windowed, "-output", compact})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := LoadCompressedData(windowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := LoadCompressedData(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if referencedCells(after) <= referencedCells(before) {
+		t.Errorf("compacting left %d delta-encoded cells, had %d", referencedCells(after), referencedCells(before))
+	}
+	if after.Header.ValueCodec != before.Header.ValueCodec {
+		t.Errorf("value codec changed from %v to %v", before.Header.ValueCodec, after.Header.ValueCodec)
+	}
+	decoded, _, _, err := NewDecompressor().Decompress(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, matrix) {
+		t.Error("the compacted archive decodes to a different matrix")
+	}
+
+	beforeSize, _ := archiveSize(windowed)
+	afterSize, _ := archiveSize(compact)
+	if want := fmt.Sprintf("Size: %d -> %d bytes", beforeSize, afterSize); !strings.Contains(printed, want) {
+		t.Errorf("output lacks %q:\n%s", want, printed)
+	}
+}
+
+func TestRunCompactShards(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 90, 30)
+	dir := t.TempDir()
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", filepath.Join(dir, "out.scz"), "-shards", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	_, index := shardFileNames(filepath.Join(dir, "out.scz"), 3)
+	compact := filepath.Join(dir, "compact.scz")
+	if err := run([]string{"-compact", index, "-output", compact}); err != nil {
+		t.Fatal(err)
+	}
+	if isShardIndex(compact) {
+		t.Fatal("compacting shards wrote another manifest")
+	}
+	compressed, err := LoadCompressedData(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, _, err := NewDecompressor().Decompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, matrix) {
+		t.Error("the compacted shards decode to a different matrix")
+	}
+}
+
+func TestRunCompactErrors(t *testing.T) {
+	input, _ := writeTestMatrix(t, 30, 20)
+	dir := t.TempDir()
+	lossy := filepath.Join(dir, "lossy.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", lossy, "-lossy"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-compact", lossy}, "Compact mode requires -output"},
+		{[]string{"-compact", lossy, "-output", filepath.Join(dir, "out.scz")}, "is lossy and compacting would quantize it again"},
+		{[]string{"-compact", lossy, "-output", filepath.Join(dir, "out.scz"), "-shards", "2"}, "cannot be combined"},
+	}
+	for _, tt := range tests {
+		err := run(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.scz")); !os.IsNotExist(err) {
+		t.Error("a refused compaction wrote its output")
+	}
+}
+
+// TestRunGenePanel decompresses a marker panel listed out of gene order: the
+// output must hold exactly the listed genes as columns, in list order
+func TestRunGenePanel(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 150, 60)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+	panel := filepath.Join(dir, "panel.txt")
+	if err := os.WriteFile(panel, []byte("Gene_42\nGene_7\nGene_13\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "panel.csv")
+	if err := run([]string{"-mode", "decompress", "-input", archive, "-output", output, "-gene-panel", panel}); err != nil {
+		t.Fatal(err)
+	}
+	rows, names, _, err := LoadSparseMatrix(output, DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Gene_42", "Gene_7", "Gene_13"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("columns %v, want %v", names, want)
+	}
+	if len(rows) != len(matrix) {
+		t.Fatalf("%d cells, want %d", len(rows), len(matrix))
+	}
+	for cell, row := range matrix {
+		for column, gene := range []uint32{41, 6, 12} {
+			if got, want := rowValue(rows[cell], uint32(column)), rowValue(row, gene); got != want {
+				t.Fatalf("cell %d %s = %d, want %d", cell, names[column], got, want)
+			}
+		}
+	}
+
+	if err := os.WriteFile(panel, []byte("Gene_1\nNOT_A_GENE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = run([]string{"-mode", "decompress", "-input", archive, "-output", filepath.Join(dir, "bad.csv"), "-gene-panel", panel})
+	if err == nil || !strings.Contains(err.Error(), `gene "NOT_A_GENE"`) {
+		t.Errorf("panel with an unknown gene: got %v, want an error naming it", err)
+	}
+}
+
+func TestHandleSignal(t *testing.T) {
+	tests := []struct {
+		sig  os.Signal
+		want int
+	}{
+		{os.Interrupt, 130},
+		{syscall.SIGTERM, 143},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sig.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			outputs := &OutputSet{}
+			opts := SaveOptions{Outputs: outputs}
+			matrix, geneNames, cellNames := GenerateSyntheticMatrix(10, 5, 0.5, 1)
+			finished := filepath.Join(dir, "finished.csv")
+			if err := SaveSparseMatrix(matrix, geneNames, cellNames, "", DTypeUnknown, finished, opts); err != nil {
+				t.Fatal(err)
+			}
+			outputs.Commit()
+			partial := filepath.Join(dir, "partial.scz")
+			file, err := createOutputFile(partial, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			file.WriteString("SCZB")
+
+			if got := handleSignal(tt.sig, outputs); got != tt.want {
+				t.Errorf("exit status %d, want %d", got, tt.want)
+			}
+			if _, err := os.Stat(partial); !os.IsNotExist(err) {
+				t.Errorf("partial output left behind: %v", err)
+			}
+			if _, err := os.Stat(finished); err != nil {
+				t.Errorf("finished output removed: %v", err)
+			}
+		})
+	}
+}
+
+// TestMain runs the CLI instead of the tests in child processes started by
+// startMain
+func TestMain(m *testing.M) {
+	if args := os.Getenv("SCZ_TEST_MAIN_ARGS"); args != "" {
+		os.Args = append([]string{"scz"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// mainProcess is the CLI running in a child process
+type mainProcess struct {
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	exited chan struct{} // Closed once the process has exited
+}
+
+// startMain runs main with args in a child process, killed at the end of
+// the test if still running
+func startMain(t *testing.T, args ...string) *mainProcess {
+	t.Helper()
+	p := &mainProcess{exited: make(chan struct{})}
+	p.cmd = exec.Command(os.Args[0])
+	p.cmd.Env = append(os.Environ(), "SCZ_TEST_MAIN_ARGS="+strings.Join(args, "\n"))
+	p.cmd.Stderr = &p.stderr
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		p.cmd.Wait()
+		close(p.exited)
+	}()
+	t.Cleanup(func() {
+		p.cmd.Process.Kill()
+		<-p.exited
+	})
+	return p
+}
+
+// exitCode waits up to 30 seconds for the process to exit and returns its
+// exit status
+func (p *mainProcess) exitCode(t *testing.T) int {
+	t.Helper()
+	select {
+	case <-p.exited:
+		return p.cmd.ProcessState.ExitCode()
+	case <-time.After(30 * time.Second):
+		t.Fatalf("the run did not exit\n%s", p.stderr.String())
+		return 0
+	}
+}
+
+// slowCompressArgs returns compress flags whose rank similarity, compared
+// with every earlier cell, makes the compression of a 1500-cell input take
+// seconds, and that first write QC tables, so a run can be stopped while it
+// has partial outputs
+func slowCompressArgs(input, dir string) (args, outputs []string) {
+	archive := filepath.Join(dir, "m.scz")
+	qcGenes, qcCells := filepath.Join(dir, "genes.csv"), filepath.Join(dir, "cells.csv")
+	args = []string{"-input", input, "-output", archive, "-similarity", "rank", "-qc-out", qcGenes + "," + qcCells}
+	return args, []string{archive, qcGenes, qcCells}
+}
+
+// TestInterruptMidRun signals the CLI once the QC tables are written and
+// compression is under way, and checks its exit status and that no output
+// is left behind
+func TestInterruptMidRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGINT on Windows")
+	}
+	input, _ := writeTestMatrix(t, 1500, 1000)
+	tests := []struct {
+		sig  os.Signal
+		want int
+	}{
+		{os.Interrupt, 130},
+		{syscall.SIGTERM, 143},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sig.String(), func(t *testing.T) {
+			args, outputs := slowCompressArgs(input, t.TempDir())
+			p := startMain(t, args...)
+			deadline := time.After(30 * time.Second)
+			for {
+				if _, err := os.Stat(outputs[2]); err == nil {
+					break
+				}
+				select {
+				case <-p.exited:
+					t.Fatalf("run ended before it was signalled\n%s", p.stderr.String())
+				case <-deadline:
+					t.Fatal("the QC tables never appeared")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			if err := p.cmd.Process.Signal(tt.sig); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.exitCode(t); got != tt.want {
+				t.Errorf("exit status %d, want %d\n%s", got, tt.want, p.stderr.String())
+			}
+			for _, file := range outputs {
+				if _, err := os.Stat(file); !os.IsNotExist(err) {
+					t.Errorf("%s left behind: %v", filepath.Base(file), err)
+				}
+			}
+			if !strings.Contains(p.stderr.String(), "Interrupted by") {
+				t.Errorf("no interruption message in\n%s", p.stderr.String())
+			}
+		})
+	}
+}
+
+// TestRunTimeout checks that -timeout stops the worker pool of a
+// deliberately slow compression, which would take about ten seconds, that
+// the run exits with status 124, and that the outputs written so far are
+// removed
+func TestRunTimeout(t *testing.T) {
+	input, _ := writeTestMatrix(t, 1500, 1000)
+	args, outputs := slowCompressArgs(input, t.TempDir())
+	start := time.Now()
+	p := startMain(t, append(args, "-timeout", "300ms")...)
+	if got := p.exitCode(t); got != 124 {
+		t.Errorf("exit status %d, want 124\n%s", got, p.stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the run took %v to stop after its -timeout", elapsed)
+	}
+	if !strings.Contains(p.stderr.String(), "Aborted: the run took longer than -timeout 300ms") {
+		t.Errorf("no timeout message in\n%s", p.stderr.String())
+	}
+	for _, file := range outputs {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(file), err)
+		}
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	input, _ := writeTestMatrix(t, 1500, 1000)
+	args, outputs := slowCompressArgs(input, t.TempDir())
+	set := &OutputSet{}
+	_, err := captureStdout(t, func() error {
+		return execute(context.Background(), append(args, "-timeout", "100ms"), set)
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+	if got := exitStatus(err); got != 124 {
+		t.Errorf("exit status %d, want 124", got)
+	}
+	if got := exitStatus(errors.New("other")); got != 1 {
+		t.Errorf("exit status %d for other errors, want 1", got)
+	}
+	set.RemovePartial()
+	for _, file := range outputs {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(file), err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "sort"
+
+// meanRefCell is the RefCell of rows delta-encoded against the archive's
+// synthetic mean cell (CompressedData.MeanCell) instead of a real cell
+const meanRefCell = -2
+
+// meanCell computes the synthetic reference of RefMean mode: for every gene,
+// the mean of its non-zero stored values, rounded to the nearest integer.
+// Deltas are only stored for the genes a cell expresses, so the mean over
+// the cells expressing a gene is the baseline those deltas see; averaging in
+// the zeros would pull all but the most common genes down to 0. The rounding
+// error simply ends up in the deltas.
+func meanCell(matrix []SparseRow) SparseRow {
+	numGenes := 0
+	for _, row := range matrix {
+		if n := len(row.Indices); n > 0 && int(row.Indices[n-1]) >= numGenes {
+			numGenes = int(row.Indices[n-1]) + 1
+		}
+	}
+
+	sums := make([]uint64, numGenes)
+	counts := make([]uint64, numGenes)
+	for _, row := range matrix {
+		for i, gene := range row.Indices {
+			sums[gene] += uint64(row.Values[i])
+			counts[gene]++
+		}
+	}
+
+	var mean SparseRow
+	for gene, count := range counts {
+		if count == 0 {
+			continue
+		}
+		if value := (sums[gene] + count/2) / count; value > 0 {
+			mean.Indices = append(mean.Indices, uint32(gene))
+			mean.Values = append(mean.Values, uint32(value))
+		}
+	}
+	return mean
+}
+
+// medianCell computes the synthetic reference of RefGeneBaseline mode: for
+// every gene, the median of its non-zero stored values (the upper one of an
+// even count). Like meanCell it leaves out the zeros, since deltas are only
+// stored for expressed genes.
+func medianCell(matrix []SparseRow) SparseRow {
+	var perGene [][]uint32
+	for _, row := range matrix {
+		for i, gene := range row.Indices {
+			for int(gene) >= len(perGene) {
+				perGene = append(perGene, nil)
+			}
+			perGene[gene] = append(perGene[gene], row.Values[i])
+		}
+	}
+
+	var median SparseRow
+	for gene, values := range perGene {
+		if len(values) == 0 {
+			continue
+		}
+		sort.Slice(values, func(a, b int) bool { return values[a] < values[b] })
+		if value := values[len(values)/2]; value > 0 {
+			median.Indices = append(median.Indices, uint32(gene))
+			median.Values = append(median.Values, value)
+		}
+	}
+	return median
+}
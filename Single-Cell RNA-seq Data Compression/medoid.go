@@ -0,0 +1,195 @@
+package main
+
+import "math/rand"
+
+const (
+	// medoidIterations bounds the assign/update rounds of the clustering
+	medoidIterations = 3
+	// medoidSampleSize bounds how many cluster members are considered when
+	// updating a medoid, keeping the update step linear in the cluster size
+	medoidSampleSize = 64
+)
+
+// selectMedoids picks up to k medoid cells with a cheap k-medoids clustering
+// over the delta encoder's similarity metric, and returns the medoid indices plus, for every cell,
+// the medoid it should reference (-1 for medoids themselves and for cells not
+// similar enough to any medoid). All randomness comes from rng, so a fixed
+// seed reproduces the same medoids.
+func selectMedoids(matrix []SparseRow, k int, deltaEncoder *DeltaEncoder, rng *rand.Rand) ([]int, []int) {
+	if k <= 0 || len(matrix) == 0 {
+		return nil, nil
+	}
+	if expressed := expressedCells(matrix); len(expressed) < len(matrix) {
+		return selectExpressedMedoids(matrix, expressed, k, deltaEncoder, rng)
+	}
+	if k > len(matrix) {
+		k = len(matrix)
+	}
+
+	metric := deltaEncoder.metric
+	medoids := initialMedoids(matrix, k, metric, rng)
+	assignment := make([]int, len(matrix))
+
+	for iter := 0; iter < medoidIterations; iter++ {
+		// Assign each cell to its nearest medoid
+		clusters := make([][]int, len(medoids))
+		for i, row := range matrix {
+			best := nearestMedoid(row, matrix, medoids, metric)
+			assignment[i] = best
+			clusters[best] = append(clusters[best], i)
+		}
+
+		// Move each medoid to the sampled member closest to the others
+		changed := false
+		for m, members := range clusters {
+			if len(members) == 0 {
+				continue
+			}
+			sample := members
+			if len(sample) > medoidSampleSize {
+				sample = make([]int, medoidSampleSize)
+				for i, j := range rng.Perm(len(members))[:medoidSampleSize] {
+					sample[i] = members[j]
+				}
+			}
+
+			bestCell := medoids[m]
+			bestCost := -1.0
+			for _, candidate := range sample {
+				cost := 0.0
+				for _, other := range sample {
+					cost += 1 - metric.Similarity(matrix[candidate], matrix[other])
+				}
+				if bestCost < 0 || cost < bestCost || (cost == bestCost && candidate < bestCell) {
+					bestCost = cost
+					bestCell = candidate
+				}
+			}
+			if bestCell != medoids[m] {
+				medoids[m] = bestCell
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	// Final references: medoids self-encode, everyone else uses the best medoid
+	medoidRows := make([]SparseRow, len(medoids))
+	for m, cell := range medoids {
+		medoidRows[m] = matrix[cell]
+	}
+	isMedoid := make(map[int]bool, len(medoids))
+	for _, cell := range medoids {
+		isMedoid[cell] = true
+	}
+
+	references := make([]int, len(matrix))
+	for i, row := range matrix {
+		if isMedoid[i] {
+			references[i] = -1
+			continue
+		}
+		references[i] = deltaEncoder.FindBestReference(row, medoidRows, medoids)
+	}
+
+	return medoids, references
+}
+
+// expressedCells returns the cells that express at least one gene
+func expressedCells(matrix []SparseRow) []int {
+	expressed := make([]int, 0, len(matrix))
+	for cell, row := range matrix {
+		if len(row.Indices) > 0 {
+			expressed = append(expressed, cell)
+		}
+	}
+	return expressed
+}
+
+// selectExpressedMedoids runs selectMedoids on the expressed cells only. Empty
+// cells store nothing and need no reference, but left in they would take a
+// medoid: they are as far as possible from every expressed cell, so k-means++
+// seeding is all but certain to pick one.
+func selectExpressedMedoids(matrix []SparseRow, expressed []int, k int, deltaEncoder *DeltaEncoder, rng *rand.Rand) ([]int, []int) {
+	subset := make([]SparseRow, len(expressed))
+	for i, cell := range expressed {
+		subset[i] = matrix[cell]
+	}
+	subsetMedoids, subsetReferences := selectMedoids(subset, k, deltaEncoder, rng)
+
+	medoids := make([]int, len(subsetMedoids))
+	for m, i := range subsetMedoids {
+		medoids[m] = expressed[i]
+	}
+	references := make([]int, len(matrix))
+	for cell := range references {
+		references[cell] = -1
+	}
+	for i, reference := range subsetReferences {
+		if reference >= 0 {
+			references[expressed[i]] = expressed[reference]
+		}
+	}
+	return medoids, references
+}
+
+// initialMedoids seeds the clustering with k-means++: the first medoid is a
+// random cell and each further medoid is drawn with probability proportional
+// to its squared distance (1 - similarity) from the closest medoid so far
+func initialMedoids(matrix []SparseRow, k int, metric SimilarityMetric, rng *rand.Rand) []int {
+	first := rng.Intn(len(matrix))
+	medoids := []int{first}
+
+	// distance[i] is the distance from cell i to its closest medoid
+	distance := make([]float64, len(matrix))
+	for i, row := range matrix {
+		distance[i] = 1 - metric.Similarity(row, matrix[first])
+	}
+
+	for len(medoids) < k {
+		total := 0.0
+		for _, d := range distance {
+			total += d * d
+		}
+		if total <= 0 {
+			break // Every remaining cell duplicates an existing medoid
+		}
+
+		target := rng.Float64() * total
+		next := len(matrix) - 1
+		for i, d := range distance {
+			target -= d * d
+			if target <= 0 && d > 0 {
+				next = i
+				break
+			}
+		}
+
+		medoids = append(medoids, next)
+		for i, row := range matrix {
+			d := 1 - metric.Similarity(row, matrix[next])
+			if d < distance[i] {
+				distance[i] = d
+			}
+		}
+	}
+
+	return medoids
+}
+
+// nearestMedoid returns the position in medoids of the medoid most similar to row
+func nearestMedoid(row SparseRow, matrix []SparseRow, medoids []int, metric SimilarityMetric) int {
+	best := 0
+	bestSimilarity := -1.0
+	for m, cell := range medoids {
+		similarity := metric.Similarity(row, matrix[cell])
+		if similarity > bestSimilarity {
+			bestSimilarity = similarity
+			best = m
+		}
+	}
+	return best
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// loadFromMTX loads a Matrix Market coordinate file in the CellRanger layout:
+// rows are features and columns are barcodes, with names in features.tsv (or
+// genes.tsv) and barcodes.tsv next to the matrix, each optionally gzipped.
+func loadFromMTX(filename string, isGzip bool, opts LoadOptions) ([]SparseRow, []string, []string, error) {
+	reader, err := openMaybeGzip(filename, isGzip, opts.bufferSize())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer reader.Close()
+
+	matrix, numGenes, err := parseMTXReader(reader, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	dir := filepath.Dir(filename)
+	geneNames, err := loadSidecarNames(dir, []string{"features.tsv", "genes.tsv"}, numGenes, "Gene")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cellNames, err := loadSidecarNames(dir, []string{"barcodes.tsv"}, len(matrix), "Cell")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return matrix, geneNames, cellNames, nil
+}
+
+// parseMTXReader parses a feature x barcode coordinate matrix into per-cell rows
+func parseMTXReader(reader io.Reader, opts LoadOptions) ([]SparseRow, int, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	// Header and comments
+	var sizeLine string
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if lineNum == 1 {
+			if !strings.HasPrefix(line, "%%MatrixMarket matrix coordinate") {
+				return nil, 0, fmt.Errorf("not a Matrix Market coordinate file")
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "%") {
+			continue
+		}
+		sizeLine = line
+		break
+	}
+	if sizeLine == "" {
+		return nil, 0, fmt.Errorf("missing Matrix Market size line")
+	}
+
+	var numGenes, numCells, numEntries int
+	if _, err := fmt.Sscan(sizeLine, &numGenes, &numCells, &numEntries); err != nil {
+		return nil, 0, fmt.Errorf("invalid Matrix Market size line %q: %w", sizeLine, err)
+	}
+	if numGenes <= 0 || numCells <= 0 || numEntries < 0 {
+		return nil, 0, fmt.Errorf("invalid Matrix Market size line %q: the row and column counts must be positive and the entry count not negative", sizeLine)
+	}
+
+	matrix := make([]SparseRow, numCells)
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, 0, fmt.Errorf("line %d: expected 'row col value'", lineNum)
+		}
+
+		gene, err := strconv.Atoi(fields[0])
+		if err != nil || gene < 1 || gene > numGenes {
+			return nil, 0, fmt.Errorf("line %d: invalid row index %q", lineNum, fields[0])
+		}
+		cell, err := strconv.Atoi(fields[1])
+		if err != nil || cell < 1 || cell > numCells {
+			return nil, 0, fmt.Errorf("line %d: invalid column index %q", lineNum, fields[1])
+		}
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: invalid value %q", lineNum, fields[2])
+		}
+		if isNonFinite(value) && opts.NonFinite == NonFiniteError {
+			return nil, 0, fmt.Errorf("line %d: non-finite value %q; use -nonfinite drop or zero to accept such values", lineNum, fields[2])
+		}
+		if isNonFinite(value) || value == 0 { // Both policies leave out zeros here
+			continue
+		}
+		if problem := countProblem(value); problem != "" {
+			if !opts.LenientValues {
+				return nil, 0, fmt.Errorf("line %d: %s %q; use -lenient-values to skip negative and out-of-range values and truncate fractions", lineNum, problem, fields[2])
+			}
+			if value < 0 || value > math.MaxUint32 {
+				continue
+			}
+		}
+
+		row := &matrix[cell-1]
+		row.Indices = append(row.Indices, uint32(gene-1))
+		row.Values = append(row.Values, uint32(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Entries may come in any order; rows must be sorted by gene index.
+	// Repeated coordinates are summed, as scipy.io.mmread does.
+	for i := range matrix {
+		row := &matrix[i]
+		sort.Sort(byGeneIndex{row})
+		if err := sumDuplicateGenes(row); err != nil {
+			return nil, 0, fmt.Errorf("column %d: %w", i+1, err)
+		}
+	}
+
+	return matrix, numGenes, nil
+}
+
+// sumDuplicateGenes merges the entries of a sorted row that share a gene
+// index into one holding their sum
+func sumDuplicateGenes(row *SparseRow) error {
+	n := 0
+	for i, gene := range row.Indices {
+		if n > 0 && row.Indices[n-1] == gene {
+			sum := uint64(row.Values[n-1]) + uint64(row.Values[i])
+			if sum > math.MaxUint32 {
+				return fmt.Errorf("the entries for row %d sum to %d, above the uint32 range", gene+1, sum)
+			}
+			row.Values[n-1] = uint32(sum)
+			continue
+		}
+		row.Indices[n], row.Values[n] = gene, row.Values[i]
+		n++
+	}
+	row.Indices, row.Values = row.Indices[:n], row.Values[:n]
+	return nil
+}
+
+// byGeneIndex sorts a row's entries by gene index
+type byGeneIndex struct{ row *SparseRow }
+
+func (b byGeneIndex) Len() int           { return len(b.row.Indices) }
+func (b byGeneIndex) Less(i, j int) bool { return b.row.Indices[i] < b.row.Indices[j] }
+func (b byGeneIndex) Swap(i, j int) {
+	b.row.Indices[i], b.row.Indices[j] = b.row.Indices[j], b.row.Indices[i]
+	b.row.Values[i], b.row.Values[j] = b.row.Values[j], b.row.Values[i]
+}
+
+// loadSidecarNames reads the first column of the first sidecar file found in
+// dir (plain or .gz), or synthesizes prefix_1..prefix_n if none exists
+func loadSidecarNames(dir string, candidates []string, count int, prefix string) ([]string, error) {
+	for _, name := range candidates {
+		for _, path := range []string{filepath.Join(dir, name+".gz"), filepath.Join(dir, name)} {
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+
+			names, err := readNameColumn(path, strings.HasSuffix(path, ".gz"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			if len(names) != count {
+				return nil, fmt.Errorf("%s lists %d names but the matrix has %d", path, len(names), count)
+			}
+			return names, nil
+		}
+	}
+
+	names := make([]string, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s_%d", prefix, i+1)
+	}
+	return names, nil
+}
+
+// LoadFeatureTypes returns the feature type of every gene of a Matrix Market
+// input, read from the third column of its features.tsv ("Gene Expression",
+// "Antibody Capture", ...). It returns nil when the input is not a Matrix
+// Market file or its features file has no type column.
+func LoadFeatureTypes(filename string) ([]string, error) {
+	lower := strings.ToLower(filename)
+	if !strings.HasSuffix(lower, ".mtx") && !strings.HasSuffix(lower, ".mtx.gz") {
+		return nil, nil
+	}
+
+	dir := filepath.Dir(filename)
+	for _, path := range []string{filepath.Join(dir, "features.tsv.gz"), filepath.Join(dir, "features.tsv")} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		types, err := readColumn(path, strings.HasSuffix(path, ".gz"), 2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		for _, featureType := range types {
+			if featureType == "" {
+				return nil, nil // Not every line has a type column
+			}
+		}
+		return types, nil
+	}
+	return nil, nil
+}
+
+// readNameColumn reads the first tab-separated column of every line
+func readNameColumn(path string, isGzip bool) ([]string, error) {
+	return readColumn(path, isGzip, 0)
+}
+
+// readColumn reads the given tab-separated column of every line, using an
+// empty string for lines with fewer columns
+func readColumn(path string, isGzip bool, column int) ([]string, error) {
+	reader, err := openMaybeGzip(path, isGzip, defaultIOBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", column+2)
+		if column < len(fields) {
+			names = append(names, fields[column])
+		} else {
+			names = append(names, "")
+		}
+	}
+	return names, scanner.Err()
+}
+
+// openMaybeGzip opens a file, transparently decompressing it with a buffer of
+// bufferSize bytes when isGzip is set
+func openMaybeGzip(path string, isGzip bool, bufferSize int) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isGzip {
+		return file, nil // Callers scan with bufio already
+	}
+
+	gzReader, err := gzip.NewReader(bufio.NewReaderSize(file, bufferSize))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gzReader, file: file}, nil
+}
+
+// gzipFile closes both the gzip stream and the underlying file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultFeatureType is written to features.tsv for genes of unknown type,
+// as CellRanger does for an RNA-only run
+const defaultFeatureType = "Gene Expression"
+
+// IsMTXOutput reports whether an output filename is a Matrix Market file,
+// plain or gzipped
+func IsMTXOutput(filename string) bool {
+	lower := strings.ToLower(filename)
+	return strings.HasSuffix(lower, ".mtx") || strings.HasSuffix(lower, ".mtx.gz")
+}
+
+// MTXSidecarFiles returns the features and barcodes files SaveMTXMatrix
+// writes next to a Matrix Market output, gzipped when the matrix is
+func MTXSidecarFiles(filename string) (string, string) {
+	suffix := ""
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		suffix = ".gz"
+	}
+	dir := filepath.Dir(filename)
+	return filepath.Join(dir, "features.tsv"+suffix), filepath.Join(dir, "barcodes.tsv"+suffix)
+}
+
+// SaveMTXMatrix writes a matrix in the CellRanger layout: a feature x barcode
+// coordinate matrix ordered by barcode, with features.tsv (id, name and type
+// columns) and barcodes.tsv in the same directory. A .gz filename gzips all
+// three files. Entries are written as they are formatted, so memory beyond
+// the matrix stays bounded.
+func SaveMTXMatrix(matrix []SparseRow, geneNames, cellNames, featureTypes []string, filename string, opts SaveOptions) error {
+	if len(featureTypes) > 0 && len(featureTypes) != len(geneNames) {
+		return fmt.Errorf("%d feature types for %d genes", len(featureTypes), len(geneNames))
+	}
+	geneNames, err := opts.outputNames(geneNames, "gene")
+	if err != nil {
+		return err
+	}
+	cellNames, err = opts.outputNames(cellNames, "cell")
+	if err != nil {
+		return err
+	}
+	if len(cellNames) < len(matrix) {
+		return fmt.Errorf("%d cell names for %d cells", len(cellNames), len(matrix))
+	}
+
+	out, err := createMaybeGzipFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "%%MatrixMarket matrix coordinate integer general")
+	fmt.Fprintf(out, "%d %d %d\n", len(geneNames), len(matrix), countNonZeros(matrix))
+	var line []byte
+	for cellIdx, row := range matrix {
+		for j, geneIdx := range row.Indices {
+			if int(geneIdx) >= len(geneNames) {
+				out.Close()
+				return fmt.Errorf("cell %d has gene index %d beyond %d genes", cellIdx, geneIdx, len(geneNames))
+			}
+			line = strconv.AppendUint(line[:0], uint64(geneIdx)+1, 10)
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, int64(cellIdx)+1, 10)
+			line = append(line, ' ')
+			line = strconv.AppendUint(line, uint64(row.Values[j]), 10)
+			line = append(line, '\n')
+			out.Write(line)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	featuresFile, barcodesFile := MTXSidecarFiles(filename)
+	if err := writeLines(featuresFile, len(geneNames), opts, func(w io.Writer, i int) {
+		featureType := defaultFeatureType
+		if len(featureTypes) > 0 {
+			featureType = featureTypes[i]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", geneNames[i], geneNames[i], featureType)
+	}); err != nil {
+		return err
+	}
+	return writeLines(barcodesFile, len(matrix), opts, func(w io.Writer, i int) {
+		fmt.Fprintln(w, cellNames[i])
+	})
+}
+
+// writeLines creates filename, gzipped for a .gz name, and writes n lines
+// with writeLine
+func writeLines(filename string, n int, opts SaveOptions, writeLine func(w io.Writer, i int)) error {
+	out, err := createMaybeGzipFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		writeLine(out, i)
+	}
+	return out.Close()
+}
+
+// gzipOutput buffers writes to an output file, compressing them first when
+// gz is set. Write errors surface from Close.
+type gzipOutput struct {
+	*bufio.Writer
+	gz   *gzip.Writer
+	file *os.File
+}
+
+// createMaybeGzipFile creates an output file with a buffer of
+// opts.BufferSize bytes, gzipped when its name ends in .gz
+func createMaybeGzipFile(filename string, opts SaveOptions) (*gzipOutput, error) {
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &gzipOutput{file: file}
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		out.gz = gzip.NewWriter(file)
+		out.Writer = bufio.NewWriterSize(out.gz, opts.bufferSize())
+	} else {
+		out.Writer = bufio.NewWriterSize(file, opts.bufferSize())
+	}
+	return out, nil
+}
+
+// Close flushes the buffer and the gzip stream and closes the file,
+// returning the first error
+func (o *gzipOutput) Close() error {
+	err := o.Flush()
+	if o.gz != nil {
+		if gzErr := o.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func TestSaveMTXMatrixRoundTrip(t *testing.T) {
+	matrix := []SparseRow{
+		{Indices: []uint32{0, 2}, Values: []uint32{5, 1}},
+		{},
+		{Indices: []uint32{1}, Values: []uint32{4294967295}},
+	}
+	geneNames := []string{"A", "B", "C"}
+	cellNames := []string{"AAAC-1", "AAAG-1", "AACT-1"}
+	tests := []struct {
+		name         string
+		filename     string
+		featureTypes []string
+		wantTypes    []string
+	}{
+		{"plain", "matrix.mtx", nil, []string{defaultFeatureType, defaultFeatureType, defaultFeatureType}},
+		{"gzipped", "matrix.mtx.gz", nil, []string{defaultFeatureType, defaultFeatureType, defaultFeatureType}},
+		{"gzipped with feature types", "matrix.mtx.gz",
+			[]string{"Gene Expression", "Antibody Capture", "Gene Expression"},
+			[]string{"Gene Expression", "Antibody Capture", "Gene Expression"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), tt.filename)
+			if err := SaveMTXMatrix(matrix, geneNames, cellNames, tt.featureTypes, filename, SaveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			featuresFile, barcodesFile := MTXSidecarFiles(filename)
+			for _, file := range []string{filename, featuresFile, barcodesFile} {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gzipped := bytes.HasPrefix(data, gzipMagic); gzipped != (filepath.Ext(file) == ".gz") {
+					t.Errorf("%s gzipped: %v", filepath.Base(file), gzipped)
+				}
+			}
+
+			loaded, loadedGenes, loadedCells, err := LoadSparseMatrix(filename, DefaultLoadOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded) != len(matrix) {
+				t.Fatalf("loaded %d cells, want %d", len(loaded), len(matrix))
+			}
+			for i := range matrix {
+				if !sameRow(loaded[i], matrix[i]) {
+					t.Errorf("cell %d loaded as %v, want %v", i, loaded[i], matrix[i])
+				}
+			}
+			if !reflect.DeepEqual(loadedGenes, geneNames) || !reflect.DeepEqual(loadedCells, cellNames) {
+				t.Errorf("loaded genes %v and cells %v", loadedGenes, loadedCells)
+			}
+			types, err := LoadFeatureTypes(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("feature types %v, want %v", types, tt.wantTypes)
+			}
+		})
+	}
+}
+
+// TestRunDecompressGzippedMTX checks that -output out.mtx.gz writes the
+// CellRanger layout the MTX loader reads back as the input
+func TestRunDecompressGzippedMTX(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 40, 15)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	output := filepath.Join(dir, "out", "matrix.mtx.gz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err := run([]string{"-mode", "decompress", "-input", archive, "-output", output, "-mkdir"}); err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+
+	loaded, gotGenes, gotCells, err := LoadSparseMatrix(output, DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(matrix) {
+		t.Fatalf("loaded %d cells, want %d", len(loaded), len(matrix))
+	}
+	for i := range matrix {
+		if !sameRow(loaded[i], matrix[i]) {
+			t.Errorf("cell %d loaded as %v, want %v", i, loaded[i], matrix[i])
+		}
+	}
+	_, wantGenes, wantCells, err := LoadSparseMatrix(input, DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotGenes, wantGenes) || !reflect.DeepEqual(gotCells, wantCells) {
+		t.Errorf("loaded genes %v and cells %v, want %v and %v", gotGenes, gotCells, wantGenes, wantCells)
+	}
+}
+
+// gunzipFile returns the decompressed contents of a gzip file
+func gunzipFile(t *testing.T, filename string) string {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("%s: %v", filepath.Base(filename), err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestSaveMTXMatrixCellRangerLayout checks the exact contents of the three
+// gzipped files against the CellRanger layout: a 1-based feature x barcode
+// coordinate matrix ordered by barcode, three-column features.tsv.gz and
+// barcodes.tsv.gz, side by side
+func TestSaveMTXMatrixCellRangerLayout(t *testing.T) {
+	matrix := []SparseRow{
+		{Indices: []uint32{0, 2}, Values: []uint32{5, 1}},
+		{},
+		{Indices: []uint32{1, 2}, Values: []uint32{7, 3}},
+	}
+	dir := filepath.Join(t.TempDir(), "filtered_feature_bc_matrix")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "matrix.mtx.gz")
+	err := SaveMTXMatrix(matrix, []string{"CD3E", "MS4A1", "CD4"}, []string{"AAAC-1", "AAAG-1", "AACT-1"},
+		[]string{"Gene Expression", "Gene Expression", "Antibody Capture"}, filename, SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"matrix.mtx.gz": "%%MatrixMarket matrix coordinate integer general\n" +
+			"3 3 4\n" +
+			"1 1 5\n" +
+			"3 1 1\n" +
+			"2 3 7\n" +
+			"3 3 3\n",
+		"features.tsv.gz": "CD3E\tCD3E\tGene Expression\n" +
+			"MS4A1\tMS4A1\tGene Expression\n" +
+			"CD4\tCD4\tAntibody Capture\n",
+		"barcodes.tsv.gz": "AAAC-1\nAAAG-1\nAACT-1\n",
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Errorf("wrote %d files, want %d", len(entries), len(want))
+	}
+	for name, contents := range want {
+		if got := gunzipFile(t, filepath.Join(dir, name)); got != contents {
+			t.Errorf("%s:\n%s\nwant\n%s", name, got, contents)
+		}
+	}
+}
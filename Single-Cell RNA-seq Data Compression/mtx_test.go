@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const mtxHeader = "%%MatrixMarket matrix coordinate integer general\n% comment\n"
+
+func TestParseMTXReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []SparseRow
+		wantErr string
+	}{
+		{
+			name: "entries in any order",
+			body: "3 2 4\n3 1 2\n1 1 5\n2 2 1\n1 2 7\n",
+			want: []SparseRow{
+				{Indices: []uint32{0, 2}, Values: []uint32{5, 2}},
+				{Indices: []uint32{0, 1}, Values: []uint32{7, 1}},
+			},
+		},
+		{
+			name: "zeros left out",
+			body: "2 1 2\n1 1 0\n2 1 4\n",
+			want: []SparseRow{{Indices: []uint32{1}, Values: []uint32{4}}},
+		},
+		{
+			name: "duplicates summed",
+			body: "2 1 3\n1 1 5\n2 1 1\n1 1 3\n",
+			want: []SparseRow{{Indices: []uint32{0, 1}, Values: []uint32{8, 1}}},
+		},
+		{
+			name: "largest count",
+			body: "1 1 1\n1 1 4294967295\n",
+			want: []SparseRow{{Indices: []uint32{0}, Values: []uint32{4294967295}}},
+		},
+		{name: "duplicates overflow", body: "1 1 2\n1 1 4294967295\n1 1 1\n", wantErr: "column 1: the entries for row 1 sum to 4294967296"},
+		{name: "negative size", body: "-2 1 1\n1 1 1\n", wantErr: "must be positive"},
+		{name: "no columns", body: "2 0 0\n", wantErr: "must be positive"},
+		{name: "negative entry count", body: "2 2 -1\n", wantErr: "must be positive"},
+		{name: "row out of range", body: "2 2 1\n3 1 1\n", wantErr: "line 4: invalid row index"},
+		{name: "value above uint32", body: "1 1 1\n1 1 4294967296\n", wantErr: "line 4: value above the uint32 range"},
+		{name: "scientific above uint32", body: "1 1 1\n1 1 1e10\n", wantErr: "line 4: value above the uint32 range"},
+		{name: "negative value", body: "1 1 1\n1 1 -3\n", wantErr: "line 4: negative value"},
+		{name: "fractional value", body: "1 1 1\n1 1 2.5\n", wantErr: "line 4: fractional value"},
+		{name: "missing size line", body: "% only comments\n", wantErr: "missing Matrix Market size line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matrix, _, err := parseMTXReader(strings.NewReader(mtxHeader+tt.body), DefaultLoadOptions())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(matrix, tt.want) {
+				t.Errorf("got %v, want %v", matrix, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMTXReaderNotMatrixMarket(t *testing.T) {
+	if _, _, err := parseMTXReader(strings.NewReader("1 1 1\n1 1 1\n"), DefaultLoadOptions()); err == nil {
+		t.Error("parsed a file without the Matrix Market banner")
+	}
+}
+
+func TestLoadGzippedMTX(t *testing.T) {
+	dir := t.TempDir()
+	writeGzip := func(name, content string) {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		writer := gzip.NewWriter(file)
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeGzip("matrix.mtx.gz", mtxHeader+"2 2 2\n1 1 3\n2 2 4\n")
+	writeGzip("features.tsv.gz", "ENSG1\tA\tGene Expression\nENSG2\tB\tGene Expression\n")
+	writeGzip("barcodes.tsv.gz", "AAAC-1\nAAAG-1\n")
+
+	matrix, geneNames, cellNames, err := LoadSparseMatrix(filepath.Join(dir, "matrix.mtx.gz"), DefaultLoadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SparseRow{{Indices: []uint32{0}, Values: []uint32{3}}, {Indices: []uint32{1}, Values: []uint32{4}}}
+	if !reflect.DeepEqual(matrix, want) {
+		t.Errorf("got %v, want %v", matrix, want)
+	}
+	if !reflect.DeepEqual(geneNames, []string{"ENSG1", "ENSG2"}) || !reflect.DeepEqual(cellNames, []string{"AAAC-1", "AAAG-1"}) {
+		t.Errorf("got genes %v and cells %v", geneNames, cellNames)
+	}
+}
+
+func TestParseMTXNonFinite(t *testing.T) {
+	tests := []struct {
+		token  string
+		policy string
+		want   []SparseRow
+	}{
+		{"nan", "error", nil},
+		{"inf", "error", nil},
+		{"-inf", "error", nil},
+		{"nan", "drop", []SparseRow{{Indices: []uint32{1}, Values: []uint32{4}}}},
+		{"inf", "drop", []SparseRow{{Indices: []uint32{1}, Values: []uint32{4}}}},
+		{"nan", "zero", []SparseRow{{Indices: []uint32{1}, Values: []uint32{4}}}},
+		{"+inf", "zero", []SparseRow{{Indices: []uint32{1}, Values: []uint32{4}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token+"/"+tt.policy, func(t *testing.T) {
+			policy, err := ParseNonFinitePolicy(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := DefaultLoadOptions()
+			opts.NonFinite = policy
+			header := "%%MatrixMarket matrix coordinate real general\n"
+			matrix, _, err := parseMTXReader(strings.NewReader(header+"2 1 2\n1 1 "+tt.token+"\n2 1 4\n"), opts)
+			if tt.want == nil {
+				if err == nil || !strings.Contains(err.Error(), "line 3: non-finite value") {
+					t.Fatalf("got error %v, want a non-finite value error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(matrix, tt.want) {
+				t.Errorf("parsed %v, want %v", matrix, tt.want)
+			}
+		})
+	}
+}
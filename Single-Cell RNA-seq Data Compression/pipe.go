@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// pipeDecompressFile streams the decompressed CSV into the standard input of
+// a shell command, which shares this process's standard output and error.
+// The command line is passed to sh -c unchanged: quoting, variables, pipes
+// and redirections follow the shell's rules, and nothing is escaped here.
+//
+// A command that stops reading early (say, head) ends the decompression
+// without an error, as in a shell pipeline; a command that fails is reported
+// with its exit status.
+func pipeDecompressFile(inputFile, command string, opts decompressOptions, verbose bool) error {
+	compressed, err := loadCompressedFile(inputFile, opts.skipBadBlocks)
+	if err != nil {
+		return fmt.Errorf("failed to load compressed file: %w", err)
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %q: %w", command, err)
+	}
+
+	_, _, streamErr := streamDecompressTo(compressed, opts, verbose, func(geneNames []string) (*CSVMatrixWriter, error) {
+		return NewCSVMatrixStreamWriter(stdin, geneNames, compressed.CellNames, compressed.NameColumnHeader(), opts.save)
+	})
+	closedEarly := errors.Is(streamErr, syscall.EPIPE)
+	if streamErr != nil {
+		stdin.Close()
+	}
+
+	waitErr := cmd.Wait()
+	switch {
+	case streamErr != nil && !closedEarly:
+		return streamErr
+	case waitErr != nil:
+		return fmt.Errorf("%q failed: %w", command, waitErr)
+	case closedEarly:
+		log.Printf("%q exited before reading all %d cells", command, compressed.Header.NumCells)
+	}
+	return nil
+}
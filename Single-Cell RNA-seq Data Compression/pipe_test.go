@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRunPipe streams the CSV into shell commands: the command line is
+// interpreted by sh, so quoting and variables work as in the shell, and what
+// the command reads must match the -output file byte for byte
+func TestRunPipe(t *testing.T) {
+	input, _ := writeTestMatrix(t, 150, 60)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(compressDecompress(t, input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	piped := filepath.Join(dir, "piped out.csv")
+	if err := run([]string{"-mode", "decompress", "-input", archive, "-pipe", "cat > '" + piped + "'"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(piped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("the piped CSV differs from the -output one")
+	}
+
+	lines := filepath.Join(dir, "lines.txt")
+	t.Setenv("SCZ_PIPE_OUT", lines)
+	if err := run([]string{"-mode", "decompress", "-input", archive, "-pipe", `wc -l > "$SCZ_PIPE_OUT"`}); err != nil {
+		t.Fatal(err)
+	}
+	count, err := os.ReadFile(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(count)); got != "151" {
+		t.Errorf("the command counted %s lines, want the header and 150 cells", got)
+	}
+}
+
+// TestRunPipeClosedEarly pipes more than a pipe buffer holds into a command
+// that reads two lines and exits, which must end decompression cleanly with
+// a note rather than an error
+func TestRunPipeClosedEarly(t *testing.T) {
+	input, _ := writeTestMatrix(t, 300, 300)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	head := filepath.Join(dir, "head.csv")
+	if err := run([]string{"-mode", "decompress", "-input", archive, "-pipe", "head -n 2 > '" + head + "'"}); err != nil {
+		t.Fatalf("a command that stopped reading failed the run: %v", err)
+	}
+	if !strings.Contains(logged.String(), "exited before reading all 300 cells") {
+		t.Errorf("no early-exit note logged: %q", logged.String())
+	}
+	got, err := os.ReadFile(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(got), "\n"); n != 2 {
+		t.Errorf("head read %d lines, want 2", n)
+	}
+}
+
+func TestRunPipeErrors(t *testing.T) {
+	input, _ := writeTestMatrix(t, 30, 20)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-pipe", "exit 3"}, `"exit 3" failed: exit status 3`},
+		{[]string{"-pipe", "cat", "-output", filepath.Join(dir, "out.csv")}, "-pipe cannot be combined with -output"},
+		{[]string{"-pipe", "cat", "-transpose-out"}, "-pipe cannot be combined"},
+	}
+	for _, tt := range tests {
+		err := run(append([]string{"-mode", "decompress", "-input", archive}, tt.args...))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// HashSource returns the SHA-256 of an input file's bytes as stored on disk,
+// compressed or not, so it matches sha256sum of the file. For a shard pattern
+// it hashes the shards' contents one after another in load order, as
+// cat shards | sha256sum would.
+func HashSource(filename string) ([]byte, error) {
+	files := []string{filename}
+	if isShardPattern(filename) {
+		shards, err := shardFiles(filename)
+		if err != nil {
+			return nil, err
+		}
+		files = shards
+	}
+
+	hash := sha256.New()
+	for _, name := range files {
+		if err := hashFile(hash, name); err != nil {
+			return nil, err
+		}
+	}
+	return hash.Sum(nil), nil
+}
+
+// hashFile adds a file's bytes to w
+func hashFile(w io.Writer, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyBuffer(w, file, make([]byte, defaultIOBufferSize))
+	return err
+}
+
+// MatchesSource reports whether the archive records a source hash and it is
+// the hash of the given input (see HashSource)
+func (cd *CompressedData) MatchesSource(filename string) (bool, error) {
+	if len(cd.SourceHash) == 0 {
+		return false, nil
+	}
+	hash, err := HashSource(filename)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hash, cd.SourceHash), nil
+}
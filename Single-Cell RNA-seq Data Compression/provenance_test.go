@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		pattern string
+		order   []string // Files whose concatenation the hash covers
+	}{
+		{"single file", map[string]string{"m.csv": "Cell,A\nc1,1\n"}, "m.csv", []string{"m.csv"}},
+		{"empty file", map[string]string{"m.csv": ""}, "m.csv", []string{"m.csv"}},
+		{"shards in natural order", map[string]string{
+			"counts.part2.csv":  "Cell,A\nc2,1\n",
+			"counts.part10.csv": "Cell,A\nc10,0\n",
+			"counts.part1.csv":  "Cell,A\nc1,2\n",
+		}, "counts.part*", []string{"counts.part1.csv", "counts.part2.csv", "counts.part10.csv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var concatenated []byte
+			for _, name := range tt.order {
+				concatenated = append(concatenated, tt.files[name]...)
+			}
+			want := sha256.Sum256(concatenated)
+			got, err := HashSource(filepath.Join(dir, tt.pattern))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want[:]) {
+				t.Errorf("HashSource = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+// TestRunSourceHash checks that compress records the SHA-256 of the input
+// and that inspect -check-source accepts only that input
+func TestRunSourceHash(t *testing.T) {
+	input, _ := writeTestMatrix(t, 20, 10)
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(data)
+	other := filepath.Join(t.TempDir(), "other.csv")
+	if err := os.WriteFile(other, append(data, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		want     []byte
+		check    string
+		checkErr string
+	}{
+		{"recorded", nil, want[:], input, ""},
+		{"other source", nil, want[:], other, "is not the source"},
+		{"skipped", []string{"-source-hash=false"}, nil, input, "records no source hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "m.scz")
+			if err := run(append([]string{"-mode", "compress", "-input", input, "-output", archive}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := LoadCompressedData(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(compressed.SourceHash, tt.want) {
+				t.Errorf("recorded hash %x, want %x", compressed.SourceHash, tt.want)
+			}
+
+			printed, err := captureStdout(t, func() error {
+				return run([]string{"-mode", "inspect", "-input", archive, "-check-source", tt.check})
+			})
+			if tt.checkErr == "" {
+				if err != nil {
+					t.Errorf("inspect -check-source: %v", err)
+				}
+				if line := fmt.Sprintf("Source SHA-256: %x\n", tt.want); !strings.Contains(printed, line) {
+					t.Errorf("inspect printed\n%s\nwithout %q", printed, line)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.checkErr) {
+				t.Errorf("inspect -check-source: got error %v, want one containing %q", err, tt.checkErr)
+			}
+		})
+	}
+}
+
+// TestRunSourceHashCoversInput checks that the recorded hash is the one
+// sha256sum gives for the input file as stored: of the gzip bytes for a
+// gzipped input, of the whole file when -limit or -row-offset load only part
+// of it, and unchanged by -recompress and -compact
+func TestRunSourceHashCoversInput(t *testing.T) {
+	input, _ := writeTestMatrix(t, 30, 20)
+	data, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	gzipped := filepath.Join(dir, "m.csv.gz")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gzipped, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plainHash := sha256.Sum256(data)
+	gzipHash := sha256.Sum256(buf.Bytes())
+
+	tests := []struct {
+		name  string
+		input string
+		args  []string
+		want  [sha256.Size]byte
+	}{
+		{"gzipped input", gzipped, nil, gzipHash},
+		{"limit", input, []string{"-limit", "5"}, plainHash},
+		{"row range", input, []string{"-row-offset", "10", "-row-count", "4"}, plainHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "m.scz")
+			if err := run(append([]string{"-mode", "compress", "-input", tt.input, "-output", archive}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := LoadCompressedData(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(compressed.SourceHash, tt.want[:]) {
+				t.Errorf("recorded hash %x, want %x", compressed.SourceHash, tt.want)
+			}
+			if ok, err := compressed.MatchesSource(tt.input); !ok || err != nil {
+				t.Errorf("MatchesSource(%s) = %v, %v", tt.input, ok, err)
+			}
+		})
+	}
+
+	archive := filepath.Join(dir, "m.scz")
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", archive}); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-recompress", archive, "-output", filepath.Join(dir, "recompressed.scz"), "-lossy"},
+		{"-compact", archive, "-output", filepath.Join(dir, "compacted.scz")},
+	} {
+		if err := run(args); err != nil {
+			t.Fatal(err)
+		}
+		derived, err := LoadCompressedData(args[3])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(derived.SourceHash, plainHash[:]) {
+			t.Errorf("%s: recorded hash %x, want the original's %x", args[0], derived.SourceHash, plainHash)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GeneQC holds the quality-control statistics of one gene. Mean and Variance
+// are taken over all cells, zeros included (population variance, as in
+// SelectVariableGenes).
+type GeneQC struct {
+	TotalCounts uint64
+	NumCells    int // Cells expressing the gene
+	Mean        float64
+	Variance    float64
+}
+
+// CellQC holds the quality-control statistics of one cell
+type CellQC struct {
+	LibrarySize uint64 // Sum of the cell's counts
+	NumGenes    int    // Genes the cell expresses
+}
+
+// ComputeQC computes per-gene and per-cell statistics in a single pass over
+// the matrix. Gene indices at or beyond numGenes are ignored.
+func ComputeQC(matrix []SparseRow, numGenes int) ([]GeneQC, []CellQC) {
+	genes := make([]GeneQC, numGenes)
+	cells := make([]CellQC, len(matrix))
+	sumSquares := make([]float64, numGenes)
+	for cell, row := range matrix {
+		for i, gene := range row.Indices {
+			if int(gene) >= numGenes {
+				continue
+			}
+			value := row.Values[i]
+			genes[gene].TotalCounts += uint64(value)
+			genes[gene].NumCells++
+			sumSquares[gene] += float64(value) * float64(value)
+			cells[cell].LibrarySize += uint64(value)
+			cells[cell].NumGenes++
+		}
+	}
+
+	if numCells := float64(len(matrix)); numCells > 0 {
+		for gene := range genes {
+			mean := float64(genes[gene].TotalCounts) / numCells
+			genes[gene].Mean = mean
+			// Clamp the rounding error of the one-pass formula
+			if variance := sumSquares[gene]/numCells - mean*mean; variance > 0 {
+				genes[gene].Variance = variance
+			}
+		}
+	}
+	return genes, cells
+}
+
+// parseQCOutputs splits the -qc-out flag into the gene and cell file names
+func parseQCOutputs(value string) (string, string, error) {
+	files := strings.Split(value, ",")
+	if len(files) != 2 || files[0] == "" || files[1] == "" {
+		return "", "", fmt.Errorf("expected genes.csv,cells.csv, got %q", value)
+	}
+	if files[0] == files[1] {
+		return "", "", fmt.Errorf("gene and cell statistics need different files")
+	}
+	return files[0], files[1], nil
+}
+
+// SaveQC writes the gene statistics to genesFile and the cell statistics to
+// cellsFile, as CSV or TSV depending on each file's extension, with names
+// quoted per the save options
+func SaveQC(genes []GeneQC, cells []CellQC, geneNames, cellNames []string, genesFile, cellsFile string, opts SaveOptions) error {
+	if len(geneNames) != len(genes) || len(cellNames) != len(cells) {
+		return fmt.Errorf("statistics for %d genes and %d cells, but %d gene and %d cell names",
+			len(genes), len(cells), len(geneNames), len(cellNames))
+	}
+
+	rows := make([][]string, len(genes))
+	for gene, qc := range genes {
+		rows[gene] = []string{
+			strconv.FormatUint(qc.TotalCounts, 10),
+			strconv.Itoa(qc.NumCells),
+			strconv.FormatFloat(qc.Mean, 'g', 8, 64),
+			strconv.FormatFloat(qc.Variance, 'g', 8, 64),
+		}
+	}
+	header := []string{"gene", "total_counts", "n_cells", "mean", "variance"}
+	if err := saveQCTable(genesFile, header, geneNames, "gene", rows, opts); err != nil {
+		return fmt.Errorf("failed to save gene statistics: %w", err)
+	}
+
+	rows = make([][]string, len(cells))
+	for cell, qc := range cells {
+		rows[cell] = []string{strconv.FormatUint(qc.LibrarySize, 10), strconv.Itoa(qc.NumGenes)}
+	}
+	header = []string{"cell", "library_size", "n_genes"}
+	if err := saveQCTable(cellsFile, header, cellNames, "cell", rows, opts); err != nil {
+		return fmt.Errorf("failed to save cell statistics: %w", err)
+	}
+	return nil
+}
+
+// saveQCTable writes a header and one row per name, the name first
+func saveQCTable(filename string, header, names []string, kind string, rows [][]string, opts SaveOptions) error {
+	names, err := opts.outputNames(names, kind)
+	if err != nil {
+		return err
+	}
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewWriterSize(file, defaultIOBufferSize)
+	writer := csv.NewWriter(buffered)
+	writer.Comma = OutputDelimiter(filename)
+	writer.Write(header)
+	record := make([]string, len(header))
+	for i, row := range rows {
+		record[0] = names[i]
+		copy(record[1:], row)
+		writer.Write(record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// naiveQC recomputes ComputeQC's statistics from the dense matrix, with the
+// two-pass variance
+func naiveQC(matrix []SparseRow, numGenes int) ([]GeneQC, []CellQC) {
+	dense := make([][]float64, len(matrix))
+	cells := make([]CellQC, len(matrix))
+	for cell, row := range matrix {
+		dense[cell] = make([]float64, numGenes)
+		for i, gene := range row.Indices {
+			dense[cell][gene] = float64(row.Values[i])
+			cells[cell].LibrarySize += uint64(row.Values[i])
+			cells[cell].NumGenes++
+		}
+	}
+	genes := make([]GeneQC, numGenes)
+	for gene := range genes {
+		var sum float64
+		for cell := range dense {
+			sum += dense[cell][gene]
+			if dense[cell][gene] != 0 {
+				genes[gene].NumCells++
+			}
+		}
+		genes[gene].TotalCounts = uint64(sum)
+		genes[gene].Mean = sum / float64(len(dense))
+		for cell := range dense {
+			diff := dense[cell][gene] - genes[gene].Mean
+			genes[gene].Variance += diff * diff / float64(len(dense))
+		}
+	}
+	return genes, cells
+}
+
+// closeQC reports whether two statistics agree up to rounding
+func closeQC(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+func TestComputeQC(t *testing.T) {
+	synthetic, _, _ := GenerateSyntheticMatrix(200, 50, 0.8, 1)
+	tests := []struct {
+		name     string
+		matrix   []SparseRow
+		numGenes int
+	}{
+		{"synthetic", synthetic, 50},
+		{"single cell", []SparseRow{{Indices: []uint32{0, 2}, Values: []uint32{3, 5}}}, 3},
+		{"empty cells", []SparseRow{{}, {Indices: []uint32{1}, Values: []uint32{4}}, {}}, 2},
+		{"large counts", []SparseRow{{Indices: []uint32{0}, Values: []uint32{math.MaxUint32}}, {Indices: []uint32{0}, Values: []uint32{1}}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			genes, cells := ComputeQC(tt.matrix, tt.numGenes)
+			wantGenes, wantCells := naiveQC(tt.matrix, tt.numGenes)
+			for gene, want := range wantGenes {
+				got := genes[gene]
+				if got.TotalCounts != want.TotalCounts || got.NumCells != want.NumCells ||
+					!closeQC(got.Mean, want.Mean) || !closeQC(got.Variance, want.Variance) {
+					t.Errorf("gene %d: %+v, want %+v", gene, got, want)
+				}
+			}
+			for cell, want := range wantCells {
+				if cells[cell] != want {
+					t.Errorf("cell %d: %+v, want %+v", cell, cells[cell], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseQCOutputs(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"genes.csv,cells.csv", false},
+		{"genes.tsv,cells.csv", false},
+		{"genes.csv", true},
+		{"genes.csv,", true},
+		{"a.csv,b.csv,c.csv", true},
+		{"qc.csv,qc.csv", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if _, _, err := parseQCOutputs(tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("parseQCOutputs(%q) error %v, want error %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestRunQCOut writes the statistics with compression and in qc mode, and
+// checks the gene totals and library sizes against the input
+func TestRunQCOut(t *testing.T) {
+	input, matrix := writeTestMatrix(t, 80, 30)
+	wantGenes, wantCells := naiveQC(matrix, 30)
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"compress", []string{"-mode", "compress", "-output", filepath.Join(t.TempDir(), "m.scz")}},
+		{"qc mode", []string{"-mode", "qc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			genesFile, cellsFile := filepath.Join(dir, "genes.csv"), filepath.Join(dir, "cells.csv")
+			if err := run(append([]string{"-input", input, "-qc-out", genesFile + "," + cellsFile}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			genes := readQCTable(t, genesFile, len(wantGenes))
+			for gene, want := range wantGenes {
+				if genes[gene][1] != strconv.FormatUint(want.TotalCounts, 10) || genes[gene][2] != strconv.Itoa(want.NumCells) {
+					t.Errorf("gene row %q, want total %d in %d cells", genes[gene], want.TotalCounts, want.NumCells)
+				}
+			}
+			cells := readQCTable(t, cellsFile, len(wantCells))
+			for cell, want := range wantCells {
+				if cells[cell][1] != strconv.FormatUint(want.LibrarySize, 10) || cells[cell][2] != strconv.Itoa(want.NumGenes) {
+					t.Errorf("cell row %q, want %+v", cells[cell], want)
+				}
+			}
+		})
+	}
+}
+
+// readQCTable reads a statistics table written by SaveQC, without its header
+func readQCTable(t *testing.T, filename string, rows int) [][]string {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != rows+1 {
+		t.Fatalf("%s has %d records, want %d", filename, len(records), rows+1)
+	}
+	return records[1:]
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// P2Quantile estimates a single quantile of a stream in constant memory using
+// the P-square algorithm (Jain & Chlamtac, 1985). It keeps five markers whose
+// heights are adjusted with piecewise-parabolic interpolation as values arrive.
+//
+// The estimate is exact for the first five values. After that the error
+// depends on the distribution rather than the stream length: for smooth
+// unimodal data such as genes per cell it is typically well under 1% of the
+// value range for the median and a few percent for extreme quantiles (p99),
+// where few observations fall between the outer markers.
+type P2Quantile struct {
+	p       float64
+	count   int
+	heights [5]float64 // Marker heights q
+	pos     [5]float64 // Actual marker positions n (1-based)
+	desired [5]float64 // Desired marker positions n'
+	incr    [5]float64 // Desired position increments dn'
+}
+
+// NewP2Quantile creates an estimator for the p-quantile, 0 < p < 1
+func NewP2Quantile(p float64) *P2Quantile {
+	return &P2Quantile{
+		p:       p,
+		desired: [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5},
+		incr:    [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+// Add adds an observation to the stream
+func (e *P2Quantile) Add(x float64) {
+	if e.count < 5 {
+		e.heights[e.count] = x
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.heights[:])
+			for i := range e.pos {
+				e.pos[i] = float64(i + 1)
+			}
+		}
+		return
+	}
+	e.count++
+
+	// Find the cell k with heights[k] <= x < heights[k+1], extending the extremes
+	var k int
+	switch {
+	case x < e.heights[0]:
+		e.heights[0] = x
+		k = 0
+	case x >= e.heights[4]:
+		e.heights[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3 && x >= e.heights[k+1]; k++ {
+		}
+	}
+
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.desired {
+		e.desired[i] += e.incr[i]
+	}
+
+	// Move the middle markers towards their desired positions
+	for i := 1; i <= 3; i++ {
+		d := e.desired[i] - e.pos[i]
+		if (d >= 1 && e.pos[i+1]-e.pos[i] > 1) || (d <= -1 && e.pos[i-1]-e.pos[i] < -1) {
+			step := 1.0
+			if d < 0 {
+				step = -1
+			}
+			height := e.parabolic(i, step)
+			if height <= e.heights[i-1] || height >= e.heights[i+1] {
+				height = e.linear(i, step)
+			}
+			e.heights[i] = height
+			e.pos[i] += step
+		}
+	}
+}
+
+// parabolic predicts marker i's height after moving it by step
+func (e *P2Quantile) parabolic(i int, step float64) float64 {
+	q, n := e.heights, e.pos
+	return q[i] + step/(n[i+1]-n[i-1])*
+		((n[i]-n[i-1]+step)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+			(n[i+1]-n[i]-step)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+// linear is the fallback when the parabolic prediction leaves the neighbours' range
+func (e *P2Quantile) linear(i int, step float64) float64 {
+	j := i + int(step)
+	return e.heights[i] + step*(e.heights[j]-e.heights[i])/(e.pos[j]-e.pos[i])
+}
+
+// Value returns the current quantile estimate, or 0 if nothing was added
+func (e *P2Quantile) Value() float64 {
+	if e.count == 0 {
+		return 0
+	}
+	if e.count < 5 {
+		sorted := append([]float64(nil), e.heights[:e.count]...)
+		sort.Float64s(sorted)
+		return sorted[int(e.p*float64(e.count-1)+0.5)]
+	}
+	return e.heights[2]
+}
+
+// StreamStats summarizes a stream of values (e.g. genes per cell) in constant
+// memory: exact count, mean and extremes, plus P-square percentile estimates
+type StreamStats struct {
+	Count     int
+	Min       float64
+	Max       float64
+	sum       float64
+	quantiles []*P2Quantile
+}
+
+// NewStreamStats creates stream statistics estimating the given quantiles
+func NewStreamStats(quantiles ...float64) *StreamStats {
+	stats := &StreamStats{}
+	for _, p := range quantiles {
+		stats.quantiles = append(stats.quantiles, NewP2Quantile(p))
+	}
+	return stats
+}
+
+// Add adds a value to the statistics
+func (s *StreamStats) Add(x float64) {
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if s.Count == 0 || x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+	s.sum += x
+	for _, q := range s.quantiles {
+		q.Add(x)
+	}
+}
+
+// Mean returns the mean of the values added so far
+func (s *StreamStats) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.Count)
+}
+
+// String formats the statistics for verbose output; percentiles are marked approximate
+func (s *StreamStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "min %.0f, max %.0f, mean %.1f", s.Min, s.Max, s.Mean())
+	for _, q := range s.quantiles {
+		fmt.Fprintf(&b, ", p%g ~%.0f", q.p*100, q.Value())
+	}
+	return b.String()
+}
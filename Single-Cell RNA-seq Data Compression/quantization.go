@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// lloydMaxIterations bounds the refinement rounds of the codebook
+	lloydMaxIterations = 50
+)
+
+// Codebook maps expression values to a small set of representative levels.
+// Values are stored as 1-based bin indices so that zero stays reserved for
+// absent entries.
+type Codebook struct {
+	Boundaries      []float64 // Upper boundary of each bin except the last
+	Representatives []uint32  // Reconstruction value of each bin
+	RMSE            float64   // Reconstruction error on the training values (not serialized)
+}
+
+// BuildCodebook designs a Lloyd-Max quantizer (1D k-means) with at most
+// levels bins that minimizes the squared error over all non-zero values
+func BuildCodebook(matrix []SparseRow, levels uint32) *Codebook {
+	// Work on the histogram of distinct values rather than every entry
+	histogram := make(map[uint32]uint64)
+	for _, row := range matrix {
+		for _, value := range row.Values {
+			histogram[value]++
+		}
+	}
+
+	values := make([]uint32, 0, len(histogram))
+	var total uint64
+	for value, count := range histogram {
+		values = append(values, value)
+		total += count
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	if levels == 0 {
+		levels = 1
+	}
+	if int(levels) > len(values) {
+		levels = uint32(len(values))
+	}
+	if levels == 0 {
+		return &Codebook{}
+	}
+
+	// Initialize representatives at evenly spaced quantiles
+	reps := make([]float64, levels)
+	var seen uint64
+	next := 0
+	for _, value := range values {
+		seen += histogram[value]
+		for next < len(reps) && float64(seen) >= float64(total)*(float64(next)+0.5)/float64(levels) {
+			reps[next] = float64(value)
+			next++
+		}
+	}
+	for ; next < len(reps); next++ {
+		reps[next] = float64(values[len(values)-1])
+	}
+
+	boundaries := make([]float64, levels-1)
+	for iter := 0; iter < lloydMaxIterations; iter++ {
+		// Boundaries are midpoints between neighbouring representatives
+		for i := range boundaries {
+			boundaries[i] = (reps[i] + reps[i+1]) / 2
+		}
+
+		// Representatives move to the centroid of their bin
+		sums := make([]float64, levels)
+		counts := make([]float64, levels)
+		for _, value := range values {
+			bin := findBin(boundaries, float64(value))
+			sums[bin] += float64(value) * float64(histogram[value])
+			counts[bin] += float64(histogram[value])
+		}
+
+		moved := false
+		for i := range reps {
+			if counts[i] == 0 {
+				continue
+			}
+			centroid := sums[i] / counts[i]
+			if math.Abs(centroid-reps[i]) > 1e-9 {
+				moved = true
+			}
+			reps[i] = centroid
+		}
+		sort.Float64s(reps)
+		if !moved {
+			break
+		}
+	}
+	for i := range boundaries {
+		boundaries[i] = (reps[i] + reps[i+1]) / 2
+	}
+
+	codebook := &Codebook{
+		Boundaries:      boundaries,
+		Representatives: make([]uint32, levels),
+	}
+	for i, rep := range reps {
+		codebook.Representatives[i] = uint32(math.Max(1, math.Round(rep)))
+	}
+
+	var squaredError float64
+	for _, value := range values {
+		diff := float64(value) - float64(codebook.Dequantize(codebook.Quantize(value)))
+		squaredError += diff * diff * float64(histogram[value])
+	}
+	if total > 0 {
+		codebook.RMSE = math.Sqrt(squaredError / float64(total))
+	}
+
+	return codebook
+}
+
+// Quantize maps a value to its 1-based bin index (0 stays 0)
+func (cb *Codebook) Quantize(value uint32) uint32 {
+	if value == 0 || len(cb.Representatives) == 0 {
+		return value
+	}
+	return uint32(findBin(cb.Boundaries, float64(value))) + 1
+}
+
+// Dequantize maps a 1-based bin index back to its representative value
+func (cb *Codebook) Dequantize(bin uint32) uint32 {
+	if bin == 0 || int(bin) > len(cb.Representatives) {
+		return 0
+	}
+	return cb.Representatives[bin-1]
+}
+
+// Validate checks that the codebook is usable for decoding
+func (cb *Codebook) Validate() error {
+	if len(cb.Representatives) > 0 && len(cb.Boundaries) != len(cb.Representatives)-1 {
+		return fmt.Errorf("codebook has %d boundaries for %d representatives",
+			len(cb.Boundaries), len(cb.Representatives))
+	}
+	return nil
+}
+
+// findBin returns the bin whose range contains value
+func findBin(boundaries []float64, value float64) int {
+	return sort.Search(len(boundaries), func(i int) bool { return value <= boundaries[i] })
+}
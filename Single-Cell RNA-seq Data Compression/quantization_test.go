@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// TestBuildCodebook checks the codebook's shape: zero stays zero, bins and
+// representatives increase, and with no more distinct values than levels
+// every value is its own representative
+func TestBuildCodebook(t *testing.T) {
+	few := []SparseRow{
+		{Indices: []uint32{0, 1, 2}, Values: []uint32{3, 50, 3}},
+		{Indices: []uint32{1, 4}, Values: []uint32{900, 7}},
+	}
+	codebook := BuildCodebook(few, 16)
+	if len(codebook.Representatives) != 4 || codebook.RMSE != 0 {
+		t.Fatalf("%d representatives with RMSE %g, want 4 and 0", len(codebook.Representatives), codebook.RMSE)
+	}
+	for _, value := range []uint32{3, 7, 50, 900} {
+		if got := codebook.Dequantize(codebook.Quantize(value)); got != value {
+			t.Errorf("%d decodes as %d", value, got)
+		}
+	}
+	if codebook.Quantize(0) != 0 || codebook.Dequantize(0) != 0 {
+		t.Error("zero does not stay zero")
+	}
+
+	matrix, _, _ := GenerateSyntheticMatrix(200, 300, 0.8, 1)
+	codebook = BuildCodebook(matrix, 8)
+	if err := codebook.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(codebook.Representatives); i++ {
+		if codebook.Representatives[i] < codebook.Representatives[i-1] {
+			t.Fatalf("representatives %v decrease", codebook.Representatives)
+		}
+	}
+	previous := uint32(0)
+	for value := uint32(1); value < 2000; value++ {
+		bin := codebook.Quantize(value)
+		if bin < previous || bin == 0 || bin > 8 {
+			t.Fatalf("%d quantized to bin %d after bin %d", value, bin, previous)
+		}
+		previous = bin
+	}
+
+	bad := &Codebook{Boundaries: []float64{1}, Representatives: []uint32{1, 2, 3}}
+	if bad.Validate() == nil {
+		t.Error("a codebook with too few boundaries validated")
+	}
+}
+
+// TestCodebookBeatsLogScale checks that on values concentrated in two high
+// modes, where the fixed logarithmic scale's bins are wide, a fitted codebook
+// with as many bins as the log scale ends up using has the lower RMSE. The
+// log scale continues past its levels, so it is compared by the bins it
+// uses, not by the levels it was given.
+func TestCodebookBeatsLogScale(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	row := SparseRow{}
+	for gene := uint32(0); gene < 20000; gene++ {
+		mode := 800.0
+		if gene%2 == 1 {
+			mode = 3000
+		}
+		row.Indices = append(row.Indices, gene)
+		row.Values = append(row.Values, uint32(mode+rng.NormFloat64()*40))
+	}
+
+	encoder := NewDeltaEncoder(true, 0, 16)
+	bins := make(map[uint32]bool)
+	var squaredError float64
+	for _, value := range row.Values {
+		bin := encoder.QuantizeValue(value)
+		bins[bin] = true
+		diff := float64(value) - float64(encoder.DequantizeValue(bin))
+		squaredError += diff * diff
+	}
+	logRMSE := math.Sqrt(squaredError / float64(len(row.Values)))
+
+	codebook := BuildCodebook([]SparseRow{row}, uint32(len(bins)))
+	t.Logf("%d bins: codebook RMSE %.3f, log scale %.3f", len(bins), codebook.RMSE, logRMSE)
+	if codebook.RMSE >= logRMSE {
+		t.Errorf("codebook RMSE %g, log scale %g with the same %d bins", codebook.RMSE, logRMSE, len(bins))
+	}
+}
+
+// TestAdaptiveQuantizationRoundTrip compresses lossily with a fitted
+// codebook and no deltas, so each decoded value, after a save and load,
+// must be exactly its codebook representative
+func TestAdaptiveQuantizationRoundTrip(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(100, 80, 0.7, 1)
+	c := NewCompressor(true, 0.1, 12)
+	c.SetAdaptiveQuantization(true)
+	c.SetNoDelta(true)
+	compressed, err := c.Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Codebook == nil || len(compressed.Codebook.Representatives) != 12 {
+		t.Fatalf("archive codebook %+v, want 12 levels", compressed.Codebook)
+	}
+	filename := filepath.Join(t.TempDir(), "m.scz")
+	if err := compressed.SaveToFile(filename, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCompressedData(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, _, err := NewDecompressor().Decompress(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codebook := compressed.Codebook
+	for cell, row := range matrix {
+		want := SparseRow{Indices: row.Indices, Values: make([]uint32, len(row.Values))}
+		for i, value := range row.Values {
+			want.Values[i] = codebook.Dequantize(codebook.Quantize(value))
+		}
+		if !sameRow(decoded[cell], want) {
+			t.Fatalf("cell %d decoded as %v, want %v", cell, decoded[cell], want)
+		}
+	}
+}
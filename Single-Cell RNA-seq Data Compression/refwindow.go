@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// minAutoRefWindow is the smallest window autoRefWindow picks, so tiny
+// budgets or huge cells still find references among the neighbouring cells
+const minAutoRefWindow = 16
+
+// defaultRefMemory is the reference search budget when the available memory
+// cannot be determined
+const defaultRefMemory = 1 << 30
+
+// autoRefWindow sizes the reference window to a memory budget in bytes. Each
+// of the workers holds a similarity and a candidate index per cell of its
+// window and streams through the window's rows, so a candidate costs 16 bytes
+// plus 8 bytes per expressed gene of the average cell.
+func autoRefWindow(matrix []SparseRow, budget int64, workers int) int {
+	nonZeros := 0
+	for _, row := range matrix {
+		nonZeros += len(row.Indices)
+	}
+	avgGenes := 0
+	if len(matrix) > 0 {
+		avgGenes = nonZeros / len(matrix)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	perCandidate := int64(16 + 8*avgGenes)
+	window := budget / int64(workers) / perCandidate
+	if window < minAutoRefWindow {
+		return minAutoRefWindow
+	}
+	if window > int64(len(matrix)) {
+		return len(matrix)
+	}
+	return int(window)
+}
+
+// defaultRefWindowBudget returns the memory budget of an automatic reference
+// window: a quarter of the available memory, or defaultRefMemory where that
+// is unknown
+func defaultRefWindowBudget() int64 {
+	if available := availableMemory(); available > 0 {
+		return available / 4
+	}
+	return defaultRefMemory
+}
+
+// availableMemory returns the memory available to new allocations in bytes,
+// from MemAvailable in /proc/meminfo, or 0 if it cannot be read
+func availableMemory() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kilobytes, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kilobytes * 1024
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+package main
+
+import "fmt"
+
+// LostCellPolicy selects what RepairArchive does with cells that cannot be
+// recovered: those in damaged blocks and those referencing them
+type LostCellPolicy int
+
+const (
+	// LostCellsZero keeps lost cells as empty, self-encoded rows, so the
+	// repaired archive has the original cells and names
+	LostCellsZero LostCellPolicy = iota
+	// LostCellsDrop removes lost cells and their names from the archive
+	LostCellsDrop
+)
+
+// ParseLostCellPolicy parses the -repair-lost flag: zero or drop
+func ParseLostCellPolicy(name string) (LostCellPolicy, error) {
+	switch name {
+	case "zero":
+		return LostCellsZero, nil
+	case "drop":
+		return LostCellsDrop, nil
+	}
+	return LostCellsZero, fmt.Errorf("unknown policy %q; use zero or drop", name)
+}
+
+// RepairArchive turns an archive loaded with LoadCompressedDataSkippingBadBlocks
+// into a consistent one. The rows of damaged cells were already replaced by
+// empty ones; cells referencing them (see DependentCells) would decode
+// against those empty rows, so they are lost as well and replaced or removed
+// according to policy. It returns the lost cells, damaged ones first.
+func RepairArchive(cd *CompressedData, damage []BlockDamage, policy LostCellPolicy) ([]uint32, error) {
+	if len(cd.CompressedRows) != int(cd.Header.NumCells) || len(cd.CellNames) != len(cd.CompressedRows) {
+		return nil, fmt.Errorf("archive has %d rows and %d cell names for %d cells",
+			len(cd.CompressedRows), len(cd.CellNames), cd.Header.NumCells)
+	}
+
+	var lost []uint32
+	for _, d := range damage {
+		for cell := d.FirstCell; cell < d.FirstCell+d.NumCells; cell++ {
+			lost = append(lost, cell)
+		}
+	}
+	dependents := DependentCells(cd, damage)
+	for _, cell := range dependents {
+		cd.CompressedRows[cell] = CompressedRow{RefCell: -1}
+	}
+	lost = append(lost, dependents...)
+
+	if policy == LostCellsDrop && len(lost) > 0 {
+		dropCells(cd, lost)
+	}
+	cd.Header.RefsOrdered = refsOrdered(cd.CompressedRows)
+	return lost, nil
+}
+
+// dropCells removes cells from the archive, renumbering the references,
+// medoids and lossless cells of the rest. No remaining row may reference a
+// dropped cell.
+func dropCells(cd *CompressedData, cells []uint32) {
+	dropped := make([]bool, len(cd.CompressedRows))
+	for _, cell := range cells {
+		dropped[cell] = true
+	}
+	newIndex := make([]int32, len(cd.CompressedRows))
+	kept := int32(0)
+	for cell := range cd.CompressedRows {
+		newIndex[cell] = -1
+		if !dropped[cell] {
+			newIndex[cell] = kept
+			kept++
+		}
+	}
+
+	rows := cd.CompressedRows[:0]
+	names := cd.CellNames[:0]
+	for cell, row := range cd.CompressedRows {
+		if dropped[cell] {
+			continue
+		}
+		if row.RefCell >= 0 {
+			row.RefCell = newIndex[row.RefCell]
+		}
+		rows = append(rows, row)
+		names = append(names, cd.CellNames[cell])
+	}
+	cd.CompressedRows = rows
+	cd.CellNames = names
+	cd.Header.NumCells = uint32(kept)
+	cd.Medoids = renumberCells(cd.Medoids, newIndex)
+	cd.LosslessCells = renumberCells(cd.LosslessCells, newIndex)
+}
+
+// renumberCells maps cell numbers through newIndex, leaving out
+// dropped cells
+func renumberCells(cells []uint32, newIndex []int32) []uint32 {
+	renumbered := cells[:0]
+	for _, cell := range cells {
+		if int(cell) < len(newIndex) && newIndex[cell] >= 0 {
+			renumbered = append(renumbered, uint32(newIndex[cell]))
+		}
+	}
+	return renumbered
+}
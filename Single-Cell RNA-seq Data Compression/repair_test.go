@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRunRepair damages the second of three blocks and repairs the archive
+// with each lost cell policy. The repaired archive must load without skipping
+// anything, and every cell it keeps must be intact or, with -repair-lost
+// zero, empty.
+func TestRunRepair(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(2*rowsPerBlock+100, 20, 0.8, 1)
+	compressed, err := NewCompressor(false, 0.1, 256).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := filepath.Join(t.TempDir(), "damaged.scz")
+	if err := compressed.SaveToFile(damaged, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[blockOffsets(t, data)[1]+16+10] ^= 0xff
+	if err := os.WriteFile(damaged, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	original := make(map[string]SparseRow, len(cellNames))
+	for cell, name := range cellNames {
+		original[name] = matrix[cell]
+	}
+
+	tests := []struct {
+		policy string
+		drop   bool
+	}{
+		{"zero", false},
+		{"drop", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			repaired := filepath.Join(t.TempDir(), "fixed.scz")
+			if err := run([]string{"-repair", damaged, "-output", repaired, "-repair-lost", tt.policy}); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := LoadCompressedData(repaired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, _, names, err := NewDecompressor().Decompress(loaded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.drop && len(names) != len(cellNames) {
+				t.Fatalf("%d cells kept, want all %d", len(names), len(cellNames))
+			}
+			if tt.drop && len(names) > len(cellNames)-rowsPerBlock {
+				t.Fatalf("%d cells kept, want at most %d", len(names), len(cellNames)-rowsPerBlock)
+			}
+			intact := 0
+			for cell, name := range names {
+				want, ok := original[name]
+				switch {
+				case !ok:
+					t.Fatalf("unknown cell %q", name)
+				case sameRow(decoded[cell], want):
+					intact++
+				case tt.drop || len(decoded[cell].Indices) > 0:
+					t.Fatalf("cell %q decoded as %v, want %v", name, decoded[cell], want)
+				}
+			}
+			// Chain references point back, so the first block cannot be lost
+			if intact < rowsPerBlock {
+				t.Errorf("%d intact cells, want at least %d", intact, rowsPerBlock)
+			}
+		})
+	}
+}
+
+// TestRunRepairCorruptLength gives the second of three blocks a length far
+// past the end of the file. Repair must treat that block, and the blocks it
+// hides, as lost rather than allocate the length, and keep the first block.
+func TestRunRepairCorruptLength(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(2*rowsPerBlock+100, 20, 0.8, 1)
+	compressed, err := NewCompressor(false, 0.1, 256).Compress(matrix, geneNames, cellNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	damaged := filepath.Join(dir, "damaged.scz")
+	if err := compressed.SaveToFile(damaged, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(data[blockOffsets(t, data)[1]+8:], 0xfffffff0)
+	if err := os.WriteFile(damaged, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired := filepath.Join(dir, "fixed.scz")
+	if err := run([]string{"-repair", damaged, "-output", repaired, "-repair-lost", "drop"}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCompressedData(repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, names, err := NewDecompressor().Decompress(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != rowsPerBlock {
+		t.Fatalf("%d cells kept, want the %d of the first block", len(names), rowsPerBlock)
+	}
+	for cell, name := range names {
+		if name != cellNames[cell] || !sameRow(decoded[cell], matrix[cell]) {
+			t.Fatalf("cell %d decoded as %q %v, want %q %v", cell, name, decoded[cell], cellNames[cell], matrix[cell])
+		}
+	}
+}
+
+func TestParseLostCellPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    LostCellPolicy
+		wantErr bool
+	}{
+		{"zero", LostCellsZero, false},
+		{"drop", LostCellsDrop, false},
+		{"keep", LostCellsZero, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLostCellPolicy(tt.name)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ParseLostCellPolicy(%q) = %v, %v", tt.name, got, err)
+			}
+		})
+	}
+}
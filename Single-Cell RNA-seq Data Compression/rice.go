@@ -0,0 +1,127 @@
+package main
+
+import "fmt"
+
+// ValueCodec selects how each row's deltas or self-encoded values are
+// entropy coded
+type ValueCodec uint8
+
+const (
+	// ValueCodecFlate deflates the row's zigzag varints
+	ValueCodecFlate ValueCodec = iota
+	// ValueCodecRice Golomb-Rice codes the row's zigzag values with a per-row
+	// parameter (see EncodeRice)
+	ValueCodecRice
+)
+
+var valueCodecNames = map[ValueCodec]string{
+	ValueCodecFlate: "flate",
+	ValueCodecRice:  "rice",
+}
+
+// String returns the codec's name as accepted by ParseValueCodec
+func (c ValueCodec) String() string {
+	if name, ok := valueCodecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", int(c))
+}
+
+// ParseValueCodec parses a value codec name
+func ParseValueCodec(name string) (ValueCodec, error) {
+	for codec, codecName := range valueCodecNames {
+		if codecName == name {
+			return codec, nil
+		}
+	}
+	return ValueCodecFlate, fmt.Errorf("unknown value codec %q; use flate or rice", name)
+}
+
+// riceEscape is the quotient from which a value is stored verbatim: the
+// escape is riceEscape zero bits and a one, followed by the 32-bit value. It
+// bounds the cost of outliers in a row coded with a small parameter.
+const riceEscape = 24
+
+// EncodeRice Golomb-Rice codes zigzagged values. The first byte holds the
+// parameter k, the smallest k with n*2^k >= sum of the values (the JPEG-LS
+// rule, near-optimal for geometrically distributed values). Each value v is
+// then written as v>>k zero bits, a one bit and the low k bits of v, packed
+// least significant bit first. The final byte is padded with zeros, which
+// the decoder tells apart from a value because a value always has a one bit.
+func EncodeRice(values []int32) []byte {
+	if len(values) == 0 {
+		return []byte{}
+	}
+
+	zigzagged := make([]uint32, len(values))
+	var sum uint64
+	for i, value := range values {
+		zigzagged[i] = zigzag(value)
+		sum += uint64(zigzagged[i])
+	}
+	k := uint32(0)
+	for uint64(len(values))<<k < sum {
+		k++
+	}
+
+	w := NewBitWriter(0)
+	for _, value := range zigzagged {
+		if quotient := value >> k; quotient < riceEscape {
+			w.WriteUnary(quotient)
+			w.WriteBits(uint64(value), uint32(k))
+		} else {
+			w.WriteUnary(riceEscape)
+			w.WriteBits(uint64(value), 32)
+		}
+	}
+	return append([]byte{byte(k)}, w.Bytes()...)
+}
+
+// DecodeRice decodes values written by EncodeRice
+func DecodeRice(data []byte) ([]int32, error) {
+	if len(data) == 0 {
+		return []int32{}, nil
+	}
+	k := uint32(data[0])
+	if k > 32 {
+		return nil, corruptf("invalid Rice parameter %d", k)
+	}
+
+	r := NewByteBitReader(data[1:])
+	var values []int32
+	for {
+		padding := r.Remaining()
+		zeros, ok := r.ReadUnary()
+		if !ok {
+			if padding >= 8 {
+				return nil, corruptf("Rice stream truncated after %d values", len(values))
+			}
+			break // Only the padding of the final byte is left
+		}
+		if zeros > riceEscape {
+			return nil, corruptf("invalid Rice code after %d values", len(values))
+		}
+		var value uint64
+		if zeros == riceEscape {
+			value, ok = r.ReadBits(32)
+		} else {
+			value, ok = r.ReadBits(k)
+			value |= uint64(zeros) << k
+		}
+		if !ok || value > 1<<32-1 {
+			return nil, corruptf("Rice stream truncated after %d values", len(values))
+		}
+		values = append(values, unzigzag(uint32(value)))
+	}
+	return values, nil
+}
+
+// zigzag maps signed values to unsigned ones, small magnitudes first
+func zigzag(value int32) uint32 {
+	return uint32((value << 1) ^ (value >> 31))
+}
+
+// unzigzag reverses zigzag
+func unzigzag(value uint32) int32 {
+	return int32(value>>1) ^ -int32(value&1)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeRice(t *testing.T) {
+	// Encodings written before the codec moved onto BitWriter, which
+	// archives still hold
+	tests := []struct {
+		name   string
+		values []int32
+		want   []byte
+	}{
+		{"empty", []int32{}, []byte{}},
+		{"zero", []int32{0}, []byte{0x0, 0x1}},
+		{"small", []int32{1, -1, 2, -2, 3}, []byte{0x2, 0x9d, 0x5c, 0x1}},
+		{"outlier", []int32{5, 100, -7, 0, 0, 1}, []byte{0x6, 0x15, 0x44, 0x36, 0x81, 0x40, 0x1}},
+		{"large", []int32{1 << 20, -3, 4}, []byte{0x14, 0x4, 0x0, 0x80, 0x5, 0x0, 0x10, 0x1, 0x0, 0x0}},
+		{"extremes", []int32{math.MaxInt32, math.MinInt32}, []byte{0x20, 0xfd, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EncodeRice(tt.values)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("EncodeRice(%v) = %#v, want %#v", tt.values, got, tt.want)
+			}
+			decoded, err := DecodeRice(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.values) {
+				t.Errorf("decoded %v, want %v", decoded, tt.values)
+			}
+		})
+	}
+}
+
+func TestRiceRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		values := make([]int32, 1+rng.Intn(300))
+		scale := int32(1) << uint(rng.Intn(31))
+		for j := range values {
+			values[j] = rng.Int31n(scale) - scale/2
+			if rng.Intn(50) == 0 {
+				values[j] = rng.Int31() // An outlier that needs the escape
+			}
+		}
+		decoded, err := DecodeRice(EncodeRice(values))
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(decoded, values) {
+			t.Fatalf("case %d: decoded %v, want %v", i, decoded, values)
+		}
+	}
+}
+
+func TestDecodeRiceCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"bad parameter", []byte{33, 0x1}},
+		{"truncated", []byte{0x2, 0x0, 0x0}},
+		{"truncated remainder", []byte{0x20, 0x1}},
+		{"overlong unary", []byte{0x0, 0x0, 0x0, 0x0, 0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeRice(tt.data); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("got %v, want a corrupt data error", err)
+			}
+		})
+	}
+}
+
+// BenchmarkValueCodec codes rows of geometrically distributed deltas of
+// several lengths with each value codec, reporting the coded bytes per row
+// next to the time to encode and decode it
+func BenchmarkValueCodec(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	for _, length := range []int{10, 100, 1000, 10000} {
+		row := make([]int32, length)
+		for i := range row {
+			row[i] = int32(rng.ExpFloat64() * 6)
+			if rng.Intn(2) == 0 {
+				row[i] = -row[i]
+			}
+		}
+		for _, codec := range []ValueCodec{ValueCodecFlate, ValueCodecRice} {
+			b.Run(fmt.Sprintf("%d/%v", length, codec), func(b *testing.B) {
+				encoder := NewDeltaEncoder(false, 0, 0)
+				encoder.SetValueCodec(codec)
+				var size int
+				for i := 0; i < b.N; i++ {
+					data, err := encoder.CompressDeltas(row)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := encoder.DecompressDeltas(data); err != nil {
+						b.Fatal(err)
+					}
+					size = len(data)
+				}
+				b.ReportMetric(float64(size), "bytes/row")
+			})
+		}
+	}
+}
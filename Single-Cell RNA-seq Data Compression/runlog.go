@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// RunRecord is one line of an -append-log provenance log, describing a single
+// compress, decompress or recompress invocation
+type RunRecord struct {
+	Timestamp       string              `json:"timestamp"` // Start time, RFC 3339 UTC
+	ToolVersion     string              `json:"tool_version"`
+	Mode            string              `json:"mode"`
+	Input           string              `json:"input"`
+	Output          string              `json:"output"`
+	InputSize       int64               `json:"input_size"`
+	OutputSize      int64               `json:"output_size"`
+	Parameters      map[string]string   `json:"parameters"` // Flags given on the command line
+	DurationSeconds float64             `json:"duration_seconds"`
+	Compression     *CompressionStats   `json:"compression,omitempty"`
+	Decompression   *DecompressionStats `json:"decompression,omitempty"`
+	Error           string              `json:"error,omitempty"`
+}
+
+// NewRunRecord starts a record for a run of mode beginning at start; sizes are
+// filled in by Finish once the output exists
+func NewRunRecord(mode, input, output string, parameters map[string]string, start time.Time) *RunRecord {
+	return &RunRecord{
+		Timestamp:   start.UTC().Format(time.RFC3339),
+		ToolVersion: ToolVersion(),
+		Mode:        mode,
+		Input:       input,
+		Output:      output,
+		Parameters:  parameters,
+	}
+}
+
+// Finish records the run's duration, file sizes and outcome
+func (r *RunRecord) Finish(start time.Time, runErr error) {
+	r.DurationSeconds = time.Since(start).Seconds()
+	if info, err := os.Stat(r.Input); err == nil {
+		r.InputSize = info.Size()
+	}
+	if info, err := os.Stat(r.Output); err == nil {
+		r.OutputSize = info.Size()
+	}
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+}
+
+// AppendRunLog appends the record to path as a single JSON line. The line is
+// written with one write on a file opened with O_APPEND, so concurrent runs
+// logging to the same file never interleave partial lines.
+func AppendRunLog(path string, record *RunRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode run record: %w", err)
+	}
+	line = append(line, '\n')
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open run log: %w", err)
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to append to run log: %w", err)
+	}
+	return file.Close()
+}
+
+// ToolVersion identifies the build: the module version, plus the VCS revision
+// when the binary was built from a checkout
+func ToolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version += "+" + setting.Value
+		}
+	}
+	return version
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// selfTestAccessSamples is the number of random positions checked with Access
+// per sequence; Access scans the high bits, so checking every element of the
+// large sequences would dominate the run
+const selfTestAccessSamples = 16
+
+// selfTestMaxReported caps the mismatches listed by the self-tests
+const selfTestMaxReported = 20
+
+// RunSelfTest runs the named built-in self-test (-selftest) with n random
+// cases, writing its report to w. It fails if any case mismatched.
+func RunSelfTest(w io.Writer, name string, n int, seed int64) error {
+	switch name {
+	case "elias":
+		return SelfTestElias(w, n, seed)
+	default:
+		return fmt.Errorf("unknown self-test %q; use elias", name)
+	}
+}
+
+// SelfTestElias encodes n random sorted sequences with Elias-Fano and checks
+// that Decode and Access give the sequence back and that the decoder reports
+// the encoder's parameters. Universes range from 1 to 2^32-1 and counts from
+// empty to the whole universe; the low-bit width cycles through the
+// heuristic, floor, search and fixed strategies, including width 0. A handful
+// of edge cases run before the random ones, among them widths too narrow for
+// the universe, whose high bits overflow a bit array and must be rejected.
+func SelfTestElias(w io.Writer, n int, seed int64) error {
+	if n <= 0 {
+		return fmt.Errorf("self-test needs a positive number of sequences")
+	}
+	rng := rand.New(rand.NewSource(seed))
+	test := &eliasSelfTest{rng: rng}
+
+	// Edge cases: empty, single values at both ends of the universe, a
+	// universe of one, full universes (low width 0) and the parallel decoder
+	test.check(1, []uint32{}, LowBitsHeuristic, 0)
+	test.check(1, []uint32{0}, LowBitsHeuristic, 0)
+	test.check(1000, []uint32{999}, LowBitsHeuristic, 0)
+	test.check(math.MaxUint32, []uint32{0, math.MaxUint32 - 1}, LowBitsHeuristic, 0)
+	test.check(math.MaxUint32, []uint32{math.MaxUint32 - 1}, LowBitsFloorLog, 0)
+	test.check(64, randomSortedSequence(rng, 64, 64), LowBitsHeuristic, 0)
+	test.check(1000, randomSortedSequence(rng, 1000, 10), LowBitsFixed, 0)
+	test.check(parallelDecodeThreshold*2, randomSortedSequence(rng, parallelDecodeThreshold*2, parallelDecodeThreshold), LowBitsHeuristic, 0)
+	test.checkRejected(math.MaxUint32, []uint32{0, math.MaxUint32 - 1}, 0)
+	test.checkRejected(math.MaxUint32, []uint32{math.MaxUint32 - 1}, 0)
+
+	strategies := []LowBitsStrategy{LowBitsHeuristic, LowBitsFloorLog, LowBitsSearch, LowBitsFixed}
+	for i := 0; i < n; i++ {
+		universe, count := randomShape(rng)
+		sequence := randomSortedSequence(rng, universe, count)
+		strategy := strategies[i%len(strategies)]
+		fixedLowBits := uint32(0)
+		if strategy == LowBitsFixed && i%(2*len(strategies)) != len(strategies)-1 {
+			// Every other fixed case uses width 0, the rest a random width
+			// around the textbook one
+			fixedLowBits = uint32(rng.Intn(int(floorLog2Ratio(universe, count)) + 4))
+		}
+		if strategy == LowBitsFixed && universe>>fixedLowBits > 1<<20 {
+			// Keep the unary high bits short; Access scans them bit by bit
+			fixedLowBits = floorLog2Ratio(universe, count)
+		}
+		test.check(universe, sequence, strategy, fixedLowBits)
+	}
+
+	fmt.Fprintf(w, "Elias-Fano self-test: %d sequences, %d elements (seed %d)\n", test.sequences, test.elements, seed)
+	fmt.Fprintf(w, "  Encode: %v\n", test.encodeTime)
+	fmt.Fprintf(w, "  Decode: %v\n", test.decodeTime)
+	fmt.Fprintf(w, "  Access: %v for %d lookups\n", test.accessTime, test.lookups)
+	for _, mismatch := range test.mismatches {
+		fmt.Fprintf(w, "  MISMATCH %s\n", mismatch)
+	}
+	if test.failed > 0 {
+		if test.failed > len(test.mismatches) {
+			fmt.Fprintf(w, "  ... %d more\n", test.failed-len(test.mismatches))
+		}
+		return fmt.Errorf("%d of %d sequences failed the Elias-Fano self-test", test.failed, test.sequences)
+	}
+	fmt.Fprintln(w, "  All sequences round-tripped")
+	return nil
+}
+
+// eliasSelfTest accumulates the results and timings of SelfTestElias
+type eliasSelfTest struct {
+	rng        *rand.Rand
+	sequences  int
+	elements   int
+	lookups    int
+	failed     int
+	mismatches []string // The first selfTestMaxReported failures
+	encodeTime time.Duration
+	decodeTime time.Duration
+	accessTime time.Duration
+}
+
+// check round-trips one sequence, recording a mismatch on the first check
+// that fails
+func (t *eliasSelfTest) check(universe uint32, sequence []uint32, strategy LowBitsStrategy, fixedLowBits uint32) {
+	t.sequences++
+	t.elements += len(sequence)
+	if err := t.roundTrip(universe, sequence, strategy, fixedLowBits); err != nil {
+		t.failed++
+		if len(t.mismatches) < selfTestMaxReported {
+			t.mismatches = append(t.mismatches, fmt.Sprintf("universe %d, count %d, strategy %d: %v",
+				universe, len(sequence), strategy, err))
+		}
+	}
+}
+
+// checkRejected checks that encoding a sequence whose bit arrays would not
+// fit with the given low-bit width fails instead of producing a corrupt
+// encoding
+func (t *eliasSelfTest) checkRejected(universe uint32, sequence []uint32, lowBits uint32) {
+	t.sequences++
+	t.elements += len(sequence)
+	encoder := NewEliasEncoderWithLowBits(universe, uint32(len(sequence)), lowBits)
+	if _, err := encoder.Encode(sequence); err == nil {
+		t.failed++
+		if len(t.mismatches) < selfTestMaxReported {
+			t.mismatches = append(t.mismatches, fmt.Sprintf("universe %d, count %d, low bits %d: encoded although the high bits overflow",
+				universe, len(sequence), lowBits))
+		}
+	}
+}
+
+// roundTrip encodes, decodes and accesses one sequence
+func (t *eliasSelfTest) roundTrip(universe uint32, sequence []uint32, strategy LowBitsStrategy, fixedLowBits uint32) error {
+	count := uint32(len(sequence))
+	var encoder *EliasEncoder
+	switch strategy {
+	case LowBitsSearch:
+		encoder = NewEliasEncoderWithLowBits(universe, count, BestLowBits(sequence, universe))
+	case LowBitsFixed:
+		encoder = NewEliasEncoderWithLowBits(universe, count, fixedLowBits)
+	default:
+		encoder = NewEliasEncoderWithStrategy(universe, count, strategy)
+	}
+
+	start := time.Now()
+	data, err := encoder.Encode(sequence)
+	t.encodeTime += time.Since(start)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if count == 0 {
+		if len(data) != 0 {
+			return fmt.Errorf("empty sequence encoded to %d bytes", len(data))
+		}
+		return nil
+	}
+	if len(data) != encoder.EncodedSize() {
+		return fmt.Errorf("encoded %d bytes, EncodedSize predicted %d", len(data), encoder.EncodedSize())
+	}
+
+	start = time.Now()
+	decoder, err := NewEliasDecoder(data)
+	if err != nil {
+		return fmt.Errorf("decoder: %w", err)
+	}
+	decoded, err := decoder.Decode()
+	t.decodeTime += time.Since(start)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	if decoder.Universe() != universe || decoder.Size() != count || decoder.LowBits() != encoder.LowBits() {
+		return fmt.Errorf("decoder reports universe %d, count %d, low bits %d; encoded with low bits %d",
+			decoder.Universe(), decoder.Size(), decoder.LowBits(), encoder.LowBits())
+	}
+	if len(decoded) != len(sequence) {
+		return fmt.Errorf("decoded %d values", len(decoded))
+	}
+	for i := range sequence {
+		if decoded[i] != sequence[i] {
+			return fmt.Errorf("decode: value %d is %d, want %d (low bits %d)", i, decoded[i], sequence[i], encoder.LowBits())
+		}
+	}
+
+	// Access the first and last elements plus random ones
+	positions := []uint32{0, count - 1}
+	for i := 0; i < selfTestAccessSamples && int(count) > 2; i++ {
+		positions = append(positions, uint32(t.rng.Intn(int(count))))
+	}
+	start = time.Now()
+	for _, pos := range positions {
+		value, err := decoder.Access(pos)
+		if err != nil {
+			return fmt.Errorf("access %d: %w", pos, err)
+		}
+		if value != sequence[pos] {
+			return fmt.Errorf("access: value %d is %d, want %d (low bits %d)", pos, value, sequence[pos], encoder.LowBits())
+		}
+	}
+	t.accessTime += time.Since(start)
+	t.lookups += len(positions)
+	if _, err := decoder.Access(count); err == nil {
+		return fmt.Errorf("access %d past the end succeeded", count)
+	}
+	return nil
+}
+
+// selfTestTypicalCount bounds the count of most random sequences, about the
+// number of genes a cell expresses; one in 64 may reach twice the parallel
+// decode threshold
+const selfTestTypicalCount = 1 << 12
+
+// randomShape picks a universe and count for a random sequence, both roughly
+// log-uniform so small, sparse and dense sequences all come up
+func randomShape(rng *rand.Rand) (universe, count uint32) {
+	universe = uint32(1) << uint(rng.Intn(32))
+	universe += uint32(rng.Int63n(int64(universe)))
+
+	maxCount := uint32(selfTestTypicalCount)
+	if rng.Intn(64) == 0 {
+		maxCount = parallelDecodeThreshold * 2
+	}
+	if maxCount > universe {
+		maxCount = universe
+	}
+	switch rng.Intn(8) {
+	case 0:
+		count = maxCount // Full or densest allowed
+	case 1:
+		count = uint32(rng.Intn(3)) // Empty and tiny
+	default:
+		count = uint32(1) << uint(rng.Intn(bits.Len32(maxCount)))
+		count = uint32(rng.Int63n(int64(count))) + 1
+	}
+	if count > universe {
+		count = universe
+	}
+	return universe, count
+}
+
+// randomSortedSequence draws count distinct values below universe, sorted
+func randomSortedSequence(rng *rand.Rand, universe, count uint32) []uint32 {
+	if count > universe {
+		count = universe
+	}
+	sequence := make([]uint32, 0, count)
+	if uint64(count)*2 >= uint64(universe) {
+		// Dense: take a random subset by a pass over the universe
+		remaining := universe
+		for value := uint32(0); value < universe && uint32(len(sequence)) < count; value++ {
+			if uint32(rng.Int63n(int64(remaining))) < count-uint32(len(sequence)) {
+				sequence = append(sequence, value)
+			}
+			remaining--
+		}
+		return sequence
+	}
+
+	// Sparse: Floyd's sampling
+	chosen := make(map[uint32]bool, count)
+	for j := universe - count; j < universe; j++ {
+		value := uint32(rng.Int63n(int64(j) + 1))
+		if chosen[value] {
+			value = j
+		}
+		chosen[value] = true
+		sequence = append(sequence, value)
+	}
+	sort.Slice(sequence, func(a, b int) bool { return sequence[a] < sequence[b] })
+	return sequence
+}
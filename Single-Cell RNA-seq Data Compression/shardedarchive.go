@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Sharded archive layout: out.000.scz, out.001.scz, ... each hold a
+// contiguous range of cells as a self-contained archive, and the text
+// manifest out.index lists them in order:
+//
+//	scz-shards 1
+//	out.000.scz<TAB>first cell<TAB>cell count
+//	...
+//
+// Shard file names are relative to the manifest's directory. Loading the
+// manifest with LoadCompressedData assembles the shards into one archive.
+
+// shardIndexMagic is the first line of a shard manifest
+const shardIndexMagic = "scz-shards 1"
+
+// ShardEntry describes one shard of a sharded archive
+type ShardEntry struct {
+	File      string // Relative to the manifest's directory
+	FirstCell uint32
+	NumCells  uint32
+}
+
+// isShardIndex reports whether the file is a shard manifest, by its extension
+func isShardIndex(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".index")
+}
+
+// shardFileNames returns the shard files and manifest written for an output
+// file: out.scz becomes out.000.scz, out.001.scz, ... and out.index
+func shardFileNames(outputFile string, numShards int) ([]string, string) {
+	base := strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+	files := make([]string, numShards)
+	for i := range files {
+		files[i] = fmt.Sprintf("%s.%03d.scz", base, i)
+	}
+	return files, base + ".index"
+}
+
+// shardRanges splits numCells cells into numShards contiguous ranges whose
+// sizes differ by at most one, returning each range's first cell and the end
+func shardRanges(numCells, numShards int) []int {
+	bounds := make([]int, numShards+1)
+	for i := range bounds {
+		bounds[i] = i * numCells / numShards
+	}
+	return bounds
+}
+
+// SaveShardedArchive writes each shard next to outputFile and the manifest
+// listing them (see shardFileNames)
+func SaveShardedArchive(shards []*CompressedData, outputFile string, opts SaveOptions) error {
+	files, indexFile := shardFileNames(outputFile, len(shards))
+	entries := make([]ShardEntry, len(shards))
+	firstCell := uint32(0)
+	for i, shard := range shards {
+		if err := shard.SaveToFile(files[i], opts); err != nil {
+			return fmt.Errorf("shard %s: %w", files[i], err)
+		}
+		entries[i] = ShardEntry{File: filepath.Base(files[i]), FirstCell: firstCell, NumCells: shard.Header.NumCells}
+		firstCell += shard.Header.NumCells
+	}
+	return writeShardIndex(indexFile, entries, opts)
+}
+
+// writeShardIndex writes a shard manifest
+func writeShardIndex(filename string, entries []ShardEntry, opts SaveOptions) error {
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, shardIndexMagic)
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s\t%d\t%d\n", entry.File, entry.FirstCell, entry.NumCells)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// readShardIndex reads a shard manifest, checking that the shards cover
+// consecutive cell ranges
+func readShardIndex(filename string) ([]ShardEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != shardIndexMagic {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, corruptf("%s is not a shard manifest (expected %q on the first line)", filename, shardIndexMagic)
+	}
+
+	var entries []ShardEntry
+	nextCell := uint64(0)
+	for line := 2; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			return nil, corruptf("%s line %d: expected file, first cell and cell count", filename, line)
+		}
+		firstCell, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, corruptf("%s line %d: invalid first cell: %w", filename, line, err)
+		}
+		numCells, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, corruptf("%s line %d: invalid cell count: %w", filename, line, err)
+		}
+		if firstCell != nextCell {
+			return nil, corruptf("%s line %d: shard starts at cell %d, expected %d", filename, line, firstCell, nextCell)
+		}
+		nextCell += numCells
+		if nextCell > 1<<32-1 {
+			return nil, corruptf("%s line %d: more than %d cells", filename, line, uint32(1<<32-1))
+		}
+		entries = append(entries, ShardEntry{File: fields[0], FirstCell: uint32(firstCell), NumCells: uint32(numCells)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, corruptf("%s lists no shards", filename)
+	}
+	return entries, nil
+}
+
+// loadShardedArchive loads every shard listed in a manifest with load and
+// assembles them into one archive. Damage reported by load is shifted to the
+// assembled archive's cell numbers.
+func loadShardedArchive(indexFile string, load func(string) (*CompressedData, []BlockDamage, error)) (*CompressedData, []BlockDamage, error) {
+	entries, err := readShardIndex(indexFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shards := make([]*CompressedData, len(entries))
+	var damage []BlockDamage
+	for i, entry := range entries {
+		path := filepath.Join(filepath.Dir(indexFile), entry.File)
+		shard, shardDamage, err := load(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("shard %s: %w", path, err)
+		}
+		if shard.Header.NumCells != entry.NumCells {
+			return nil, nil, corruptf("shard %s holds %d cells, the manifest lists %d", path, shard.Header.NumCells, entry.NumCells)
+		}
+		for _, d := range shardDamage {
+			d.FirstCell += entry.FirstCell
+			damage = append(damage, d)
+		}
+		shards[i] = shard
+	}
+
+	cd, err := mergeShards(shards)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cd, damage, nil
+}
+
+// mergeShards concatenates the cells of archives that share their genes and
+// encoding settings into one archive, renumbering references, medoids and
+// lossless cells. Shards with their own codebook, gene filter or mean cell
+// cannot be combined. Rows are left nil if the shards were loaded without
+// them (LoadCompressedHeader).
+func mergeShards(shards []*CompressedData) (*CompressedData, error) {
+	first := shards[0]
+	if first.Codebook != nil || len(first.KeptGenes) > 0 || first.MeanCell != nil {
+		return nil, unsupportedf("shards with a quantization codebook, gene filter or mean cell cannot be combined")
+	}
+
+	merged := &CompressedData{
+		Header:       first.Header,
+		GeneNames:    first.GeneNames,
+		DType:        first.DType,
+		FeatureTypes: first.FeatureTypes,
+
+		LosslessGenes:   first.LosslessGenes,
+		TopGenesPerCell: first.TopGenesPerCell,
+		NameHeader:      first.NameHeader,
+		SourceHash:      first.SourceHash,
+	}
+	merged.Header.NumCells = 0
+	offset := uint32(0)
+	for i, shard := range shards {
+		if err := compatibleShard(first, shard); err != nil {
+			return nil, corruptf("shard %d does not match shard 0: %w", i, err)
+		}
+		merged.Header.RefsOrdered = merged.Header.RefsOrdered && shard.Header.RefsOrdered
+
+		merged.CellNames = append(merged.CellNames, shard.CellNames...)
+		for _, row := range shard.CompressedRows {
+			if row.RefCell >= 0 {
+				row.RefCell += int32(offset)
+			}
+			merged.CompressedRows = append(merged.CompressedRows, row)
+		}
+		for _, cell := range shard.Medoids {
+			merged.Medoids = append(merged.Medoids, cell+offset)
+		}
+		for _, cell := range shard.LosslessCells {
+			merged.LosslessCells = append(merged.LosslessCells, cell+offset)
+		}
+		offset += shard.Header.NumCells
+	}
+	merged.Header.NumCells = offset
+	return merged, nil
+}
+
+// compatibleShard checks that a shard decodes with the same settings as the
+// first one
+func compatibleShard(first, shard *CompressedData) error {
+	a, b := first.Header, shard.Header
+	switch {
+	case a.NumGenes != b.NumGenes:
+		return fmt.Errorf("%d genes instead of %d", b.NumGenes, a.NumGenes)
+	case a.IsLossy != b.IsLossy || a.Threshold != b.Threshold || a.QuantLevels != b.QuantLevels:
+		return fmt.Errorf("different quantization")
+	case a.IsBinary != b.IsBinary:
+		return fmt.Errorf("binary and non-binary shards")
+	case a.EliasFlate != b.EliasFlate || a.GeneChunk != b.GeneChunk || a.ValueCodec != b.ValueCodec:
+		return fmt.Errorf("different row encoding")
+	case shard.Codebook != nil || len(shard.KeptGenes) > 0 || shard.MeanCell != nil:
+		return fmt.Errorf("shards with a quantization codebook, gene filter or mean cell cannot be combined")
+	case shard.DType != first.DType:
+		return fmt.Errorf("dtype %s instead of %s", shard.DType, first.DType)
+	case shard.TopGenesPerCell != first.TopGenesPerCell:
+		return fmt.Errorf("top %d genes per cell instead of %d", shard.TopGenesPerCell, first.TopGenesPerCell)
+	}
+	if err := sameGeneHeader(first.GeneNames, shard.GeneNames); err != nil {
+		return err
+	}
+	if err := sameGeneHeader(first.FeatureTypes, shard.FeatureTypes); err != nil {
+		return fmt.Errorf("feature types: %w", err)
+	}
+	if len(shard.LosslessGenes) != len(first.LosslessGenes) {
+		return fmt.Errorf("%d lossless genes instead of %d", len(shard.LosslessGenes), len(first.LosslessGenes))
+	}
+	for i, gene := range shard.LosslessGenes {
+		if gene != first.LosslessGenes[i] {
+			return fmt.Errorf("different lossless genes")
+		}
+	}
+	return nil
+}
+
+// archiveSize returns the bytes an archive occupies on disk: the file itself,
+// or a shard manifest plus every shard it lists
+func archiveSize(filename string) (int64, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if !isShardIndex(filename) {
+		return size, nil
+	}
+	entries, err := readShardIndex(filename)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		info, err := os.Stat(filepath.Join(filepath.Dir(filename), entry.File))
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
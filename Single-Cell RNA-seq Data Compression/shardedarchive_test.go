@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShardRanges(t *testing.T) {
+	tests := []struct {
+		numCells, numShards int
+		want                []int
+	}{
+		{9, 3, []int{0, 3, 6, 9}},
+		{10, 3, []int{0, 3, 6, 10}},
+		{2, 3, []int{0, 0, 1, 2}},
+		{5, 1, []int{0, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d cells in %d", tt.numCells, tt.numShards), func(t *testing.T) {
+			if got := shardRanges(tt.numCells, tt.numShards); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("shardRanges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRunShardedArchive compresses into shards and decompresses from the
+// manifest, which must restore the input
+func TestRunShardedArchive(t *testing.T) {
+	input, _ := writeTestMatrix(t, 100, 40)
+	want, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shards := range []int{2, 3, 7} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			dir := t.TempDir()
+			err := run([]string{"-mode", "compress", "-input", input, "-output", filepath.Join(dir, "out.scz"), "-shards", fmt.Sprint(shards)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, index := shardFileNames(filepath.Join(dir, "out.scz"), shards)
+			for _, file := range append(files, index) {
+				if _, err := os.Stat(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			loaded, err := LoadCompressedData(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Header.NumCells != 100 || len(loaded.CompressedRows) != 100 {
+				t.Errorf("manifest loads %d cells and %d rows, want 100", loaded.Header.NumCells, len(loaded.CompressedRows))
+			}
+
+			output := filepath.Join(dir, "out.csv")
+			if err := run([]string{"-mode", "decompress", "-input", index, "-output", output}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("decompressed shards differ from the input")
+			}
+		})
+	}
+}
+
+func TestLoadShardedArchiveMissingShard(t *testing.T) {
+	input, _ := writeTestMatrix(t, 30, 20)
+	dir := t.TempDir()
+	if err := run([]string{"-mode", "compress", "-input", input, "-output", filepath.Join(dir, "out.scz"), "-shards", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	files, index := shardFileNames(filepath.Join(dir, "out.scz"), 3)
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCompressedData(index); err == nil {
+		t.Error("loaded a manifest whose shard is missing")
+	}
+}
+
+// TestRunRowRangeShards compresses two slices of a matrix in separate runs,
+// as parallel jobs would, and decompresses them through a manifest listing
+// both, which must restore the input
+func TestRunRowRangeShards(t *testing.T) {
+	input, _ := writeTestMatrix(t, 90, 30)
+	want, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	slices := []struct {
+		file          string
+		offset, count string
+	}{
+		{"part0.scz", "0", "40"},
+		{"part1.scz", "40", "0"},
+	}
+	for _, slice := range slices {
+		err := run([]string{"-mode", "compress", "-input", input, "-output", filepath.Join(dir, slice.file),
+			"-row-offset", slice.offset, "-row-count", slice.count})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := filepath.Join(dir, "m.index")
+	manifest := shardIndexMagic + "\npart0.scz\t0\t40\npart1.scz\t40\t50\n"
+	if err := os.WriteFile(index, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "out.csv")
+	if err := run([]string{"-mode", "decompress", "-input", index, "-output", output}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("decompressed slices differ from the input")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isShardPattern reports whether an input path is a glob over several shards
+// (e.g. counts.part*.csv) rather than a single file. A file whose name
+// really contains glob characters is loaded as itself.
+func isShardPattern(filename string) bool {
+	if !strings.ContainsAny(filename, "*?[") {
+		return false
+	}
+	_, err := os.Stat(filename)
+	return err != nil
+}
+
+// loadShards loads every CSV/TSV file matching pattern and concatenates their
+// cells into one matrix. Shards are taken in natural order (part2 before
+// part10) and must all have the same gene header. Cells synthesized for
+// -no-index input are renumbered across the shards.
+func loadShards(pattern string, opts LoadOptions) ([]SparseRow, []string, []string, error) {
+	shards, err := shardFiles(pattern)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var matrix []SparseRow
+	var geneNames, cellNames []string
+	for i, shard := range shards {
+		lower := strings.ToLower(shard)
+		if !strings.HasSuffix(strings.TrimSuffix(lower, ".gz"), ".csv") && !strings.HasSuffix(strings.TrimSuffix(lower, ".gz"), ".tsv") {
+			return nil, nil, nil, fmt.Errorf("shard %s: sharded input must be CSV or TSV", shard)
+		}
+		shardMatrix, shardGenes, shardCells, err := loadSparseMatrix(shard, opts)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("shard %s: %w", shard, err)
+		}
+		if i == 0 {
+			geneNames = shardGenes
+		} else if err := sameGeneHeader(geneNames, shardGenes); err != nil {
+			return nil, nil, nil, fmt.Errorf("shard %s does not match %s: %w", shard, shards[0], err)
+		}
+		matrix = append(matrix, shardMatrix...)
+		cellNames = append(cellNames, shardCells...)
+	}
+
+	if !opts.HasIndex {
+		for i := range cellNames {
+			cellNames[i] = fmt.Sprintf("Cell_%d", i+1)
+		}
+	}
+	return matrix, geneNames, cellNames, nil
+}
+
+// shardFiles returns the files matching a shard pattern in natural order
+func shardFiles(pattern string) ([]string, error) {
+	shards, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input pattern %q: %w", pattern, err)
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no files match %s", pattern)
+	}
+	sort.Slice(shards, func(a, b int) bool { return naturalLess(shards[a], shards[b]) })
+	return shards, nil
+}
+
+// sameGeneHeader checks that a shard lists the same genes in the same order
+func sameGeneHeader(want, got []string) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("%d genes instead of %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			return fmt.Errorf("gene %d is %q instead of %q", i+1, got[i], want[i])
+		}
+	}
+	return nil
+}
+
+// naturalLess orders strings with embedded numbers by their numeric value,
+// so counts.part2.csv sorts before counts.part10.csv
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		digitsA, digitsB := leadingDigits(a), leadingDigits(b)
+		if digitsA > 0 && digitsB > 0 {
+			numberA := strings.TrimLeft(a[:digitsA], "0")
+			numberB := strings.TrimLeft(b[:digitsB], "0")
+			if len(numberA) != len(numberB) {
+				return len(numberA) < len(numberB)
+			}
+			if numberA != numberB {
+				return numberA < numberB
+			}
+			a, b = a[digitsA:], b[digitsB:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// leadingDigits returns the length of the run of ASCII digits starting s
+func leadingDigits(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// stripGemGroups removes the gem-group suffix (-1, -2, ...) that 10x
+// Genomics appends to barcodes, in place. The suffix tells apart the same
+// barcode sequenced in different runs, so names that become equal without it
+// are an error rather than silently merged cells.
+func stripGemGroups(cellNames []string) error {
+	first := make(map[string]int, len(cellNames))
+	for i, name := range cellNames {
+		if dash := strings.LastIndexByte(name, '-'); dash > 0 && isDigits(name[dash+1:]) {
+			cellNames[i] = name[:dash]
+		}
+		if j, ok := first[cellNames[i]]; ok {
+			return fmt.Errorf("cells %d and %d are both barcode %s once their suffix is stripped; keep the suffixes to tell them apart",
+				j+1, i+1, cellNames[i])
+		}
+		first[cellNames[i]] = i
+	}
+	return nil
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadShards(t *testing.T) {
+	tests := []struct {
+		name      string
+		shards    map[string]string
+		noIndex   bool
+		wantCells []string
+		wantErr   string
+	}{
+		{"two shards", map[string]string{
+			"counts.part0.csv": "Cell,A,B\nc1,1,0\nc2,0,2\n",
+			"counts.part1.csv": "Cell,A,B\nc3,3,3\n",
+		}, false, []string{"c1", "c2", "c3"}, ""},
+		{"natural order", map[string]string{
+			"counts.part2.csv":  "Cell,A,B\nc2,1,0\n",
+			"counts.part10.csv": "Cell,A,B\nc10,0,1\n",
+			"counts.part1.csv":  "Cell,A,B\nc1,2,2\n",
+		}, false, []string{"c1", "c2", "c10"}, ""},
+		{"renumbered cells", map[string]string{
+			"counts.part0.csv": "A,B\n1,0\n0,2\n",
+			"counts.part1.csv": "A,B\n3,3\n",
+		}, true, []string{"Cell_1", "Cell_2", "Cell_3"}, ""},
+		{"mismatched header", map[string]string{
+			"counts.part0.csv": "Cell,A,B\nc1,1,0\n",
+			"counts.part1.csv": "Cell,A,C\nc2,0,2\n",
+		}, false, nil, `does not match`},
+		{"mismatched gene count", map[string]string{
+			"counts.part0.csv": "Cell,A,B\nc1,1,0\n",
+			"counts.part1.csv": "Cell,A,B,C\nc2,0,2,1\n",
+		}, false, nil, "3 genes instead of 2"},
+		{"non-CSV shard", map[string]string{
+			"counts.part0.csv": "Cell,A,B\nc1,1,0\n",
+			"counts.part1.mtx": "",
+		}, false, nil, "sharded input must be CSV or TSV"},
+		{"no shards", map[string]string{}, false, nil, "no files match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.shards {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := DefaultLoadOptions()
+			opts.HasIndex = !tt.noIndex
+			matrix, geneNames, cellNames, err := LoadSparseMatrix(filepath.Join(dir, "counts.part*"), opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(geneNames, []string{"A", "B"}) {
+				t.Errorf("genes %q, want [A B]", geneNames)
+			}
+			if !reflect.DeepEqual(cellNames, tt.wantCells) || len(matrix) != len(tt.wantCells) {
+				t.Errorf("%d rows for cells %q, want cells %q", len(matrix), cellNames, tt.wantCells)
+			}
+		})
+	}
+}
+
+func TestStripGemGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		cells   []string
+		want    []string
+		wantErr string
+	}{
+		{"suffixes", []string{"AAAC-1", "GGTT-1", "CCAA-12"}, []string{"AAAC", "GGTT", "CCAA"}, ""},
+		{"no suffix", []string{"AAAC", "cell-x", "-3"}, []string{"AAAC", "cell-x", "-3"}, ""},
+		{"last dash only", []string{"sample-A-2"}, []string{"sample-A"}, ""},
+		{"same barcode from two runs", []string{"AAAC-1", "GGTT-1", "AAAC-2"}, nil, "cells 1 and 3 are both barcode AAAC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cells := append([]string(nil), tt.cells...)
+			err := stripGemGroups(cells)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cells, tt.want) {
+				t.Errorf("stripped %q, want %q", cells, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadShardsGemGroups merges two runs sharing barcode sequences, which
+// the gem-group suffixes keep apart
+func TestLoadShardsGemGroups(t *testing.T) {
+	dir := t.TempDir()
+	runs := map[string]string{
+		"run.part1.csv": "barcode,A,B\nAAAC-1,1,0\nGGTT-1,0,2\n",
+		"run.part2.csv": "barcode,A,B\nAAAC-2,3,3\nCCAA-2,1,1\n",
+	}
+	for name, data := range runs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		strip   bool
+		want    []string
+		wantErr string
+	}{
+		{"suffixed names", false, []string{"AAAC-1", "GGTT-1", "AAAC-2", "CCAA-2"}, ""},
+		{"stripped", true, nil, "both barcode AAAC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultLoadOptions()
+			opts.StripBarcodeSuffix = tt.strip
+			matrix, _, cellNames, err := LoadSparseMatrix(filepath.Join(dir, "run.part*.csv"), opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cellNames, tt.want) || len(matrix) != len(tt.want) {
+				t.Errorf("%d cells named %q, want %q", len(matrix), cellNames, tt.want)
+			}
+		})
+	}
+}
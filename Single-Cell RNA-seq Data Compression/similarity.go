@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// SimilarityMetric selects how similar two cells are judged to be when
+// choosing delta references and medoids
+type SimilarityMetric int
+
+const (
+	// SimilarityJaccard compares the sets of expressed genes, ignoring counts
+	SimilarityJaccard SimilarityMetric = iota
+	// SimilarityCosine is the cosine of the angle between the count vectors
+	SimilarityCosine
+	// SimilarityWeightedJaccard is the Ruzicka similarity: the sum of the
+	// element-wise minimum over the sum of the element-wise maximum of the
+	// counts. It equals SimilarityJaccard when every count is 1.
+	SimilarityWeightedJaccard
+	// SimilarityRank is the weighted Jaccard similarity of within-cell ranks
+	// (see RankTransform), so cells whose genes are ordered alike by
+	// expression are similar whatever their sequencing depth. Rows must be
+	// ranked by PrepareRows before they are compared.
+	SimilarityRank
+)
+
+// rankScale is the value RankTransform gives each cell's highest rank
+const rankScale = 1 << 20
+
+var similarityNames = map[SimilarityMetric]string{
+	SimilarityJaccard:         "jaccard",
+	SimilarityCosine:          "cosine",
+	SimilarityWeightedJaccard: "weighted-jaccard",
+	SimilarityRank:            "rank",
+}
+
+// String returns the metric's name as accepted by ParseSimilarityMetric
+func (m SimilarityMetric) String() string {
+	if name, ok := similarityNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("similarity(%d)", int(m))
+}
+
+// ParseSimilarityMetric parses a metric name; "ruzicka" is accepted as an
+// alias for "weighted-jaccard"
+func ParseSimilarityMetric(name string) (SimilarityMetric, error) {
+	if name == "ruzicka" {
+		return SimilarityWeightedJaccard, nil
+	}
+	for metric, metricName := range similarityNames {
+		if metricName == name {
+			return metric, nil
+		}
+	}
+	return SimilarityJaccard, fmt.Errorf("unknown similarity %q; use jaccard, cosine, weighted-jaccard or rank", name)
+}
+
+// Similarity returns the similarity of two cells under the metric, in [0,1]
+func (m SimilarityMetric) Similarity(a, b SparseRow) float64 {
+	switch m {
+	case SimilarityCosine:
+		return CosineSimilarity(a, b)
+	case SimilarityWeightedJaccard, SimilarityRank:
+		return WeightedJaccardSimilarity(a, b)
+	default:
+		return JaccardSimilarity(a.Indices, b.Indices)
+	}
+}
+
+// PrepareRows returns the rows the metric compares: the matrix itself, or for
+// SimilarityRank its rank-transformed copy, computed once per matrix
+func (m SimilarityMetric) PrepareRows(matrix []SparseRow) []SparseRow {
+	if m != SimilarityRank {
+		return matrix
+	}
+	ranked := make([]SparseRow, len(matrix))
+	for i, row := range matrix {
+		ranked[i] = RankTransform(row)
+	}
+	return ranked
+}
+
+// RankTransform replaces a cell's values by their dense rank among the cell's
+// distinct values, scaled so the highest is rankScale: equal values share a
+// rank and a larger value always gets a larger rank. Gene indices are kept.
+func RankTransform(row SparseRow) SparseRow {
+	distinct := append([]uint32(nil), row.Values...)
+	sort.Slice(distinct, func(a, b int) bool { return distinct[a] < distinct[b] })
+	n := 0
+	for i, value := range distinct {
+		if i == 0 || value != distinct[n-1] {
+			distinct[n] = value
+			n++
+		}
+	}
+	distinct = distinct[:n]
+
+	// Consecutive ranks stay at least one apart as long as scale >= n
+	scale := uint64(rankScale)
+	if uint64(n) > scale {
+		scale = uint64(n)
+	}
+	ranked := SparseRow{Indices: row.Indices, Values: make([]uint32, len(row.Values))}
+	for i, value := range row.Values {
+		rank := uint64(sort.Search(n, func(j int) bool { return distinct[j] >= value })) + 1
+		ranked.Values[i] = uint32((rank*scale + uint64(n) - 1) / uint64(n))
+	}
+	return ranked
+}
+
+// alignValues walks two rows with sorted gene indices in step, calling fn with
+// both values of every gene in their union (0 where a row lacks the gene)
+func alignValues(a, b SparseRow, fn func(valueA, valueB float64)) {
+	i, j := 0, 0
+	for i < len(a.Indices) || j < len(b.Indices) {
+		switch {
+		case j >= len(b.Indices) || (i < len(a.Indices) && a.Indices[i] < b.Indices[j]):
+			fn(float64(a.Values[i]), 0)
+			i++
+		case i >= len(a.Indices) || b.Indices[j] < a.Indices[i]:
+			fn(0, float64(b.Values[j]))
+			j++
+		default:
+			fn(float64(a.Values[i]), float64(b.Values[j]))
+			i++
+			j++
+		}
+	}
+}
+
+// WeightedJaccardSimilarity calculates the Ruzicka similarity of two cells'
+// counts: sum(min(a, b)) / sum(max(a, b)) over the aligned value vectors
+func WeightedJaccardSimilarity(a, b SparseRow) float64 {
+	var minSum, maxSum float64
+	alignValues(a, b, func(valueA, valueB float64) {
+		minSum += math.Min(valueA, valueB)
+		maxSum += math.Max(valueA, valueB)
+	})
+	if maxSum == 0 {
+		return 1.0 // Two empty cells are identical
+	}
+	return minSum / maxSum
+}
+
+// CosineSimilarity calculates the cosine similarity of two cells' counts
+func CosineSimilarity(a, b SparseRow) float64 {
+	var dot, normA, normB float64
+	alignValues(a, b, func(valueA, valueB float64) {
+		dot += valueA * valueB
+		normA += valueA * valueA
+		normB += valueB * valueB
+	})
+	if normA == 0 && normB == 0 {
+		return 1.0
+	}
+	if normA == 0 || normB == 0 {
+		return 0.0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
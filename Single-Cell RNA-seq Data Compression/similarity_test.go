@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestRankTransform(t *testing.T) {
+	synthetic, _, _ := GenerateSyntheticMatrix(50, 200, 0.5, 1)
+	tests := []struct {
+		name string
+		row  SparseRow
+	}{
+		{"empty", SparseRow{}},
+		{"single", SparseRow{Indices: []uint32{4}, Values: []uint32{9}}},
+		{"ties", SparseRow{Indices: []uint32{0, 1, 2, 3}, Values: []uint32{5, 1, 5, 1}}},
+		{"distinct", SparseRow{Indices: []uint32{0, 2, 4, 6}, Values: []uint32{3, 100, 1, 7}}},
+		{"extremes", SparseRow{Indices: []uint32{0, 1}, Values: []uint32{1, math.MaxUint32}}},
+		{"synthetic", synthetic[0]},
+		{"synthetic dense", synthetic[49]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranked := RankTransform(tt.row)
+			if fmt.Sprint(ranked.Indices) != fmt.Sprint(tt.row.Indices) {
+				t.Fatalf("indices %v, want %v", ranked.Indices, tt.row.Indices)
+			}
+			var highest uint32
+			for i, a := range tt.row.Values {
+				if ranked.Values[i] > highest {
+					highest = ranked.Values[i]
+				}
+				if ranked.Values[i] == 0 {
+					t.Errorf("value %d ranked 0", a)
+				}
+				for j, b := range tt.row.Values {
+					if (a < b) != (ranked.Values[i] < ranked.Values[j]) || (a == b) != (ranked.Values[i] == ranked.Values[j]) {
+						t.Fatalf("values %d and %d ranked %d and %d", a, b, ranked.Values[i], ranked.Values[j])
+					}
+				}
+			}
+			if len(tt.row.Values) > 0 && highest != rankScale {
+				t.Errorf("highest rank %d, want %d", highest, rankScale)
+			}
+		})
+	}
+}
+
+// TestRankSimilarityDepth checks that rank similarity ignores sequencing
+// depth: a cell with every count doubled is identical to the original
+func TestRankSimilarityDepth(t *testing.T) {
+	row := SparseRow{Indices: []uint32{1, 3, 8}, Values: []uint32{2, 9, 4}}
+	deeper := SparseRow{Indices: row.Indices, Values: []uint32{4, 18, 8}}
+	ranked := SimilarityRank.PrepareRows([]SparseRow{row, deeper})
+	if got := SimilarityRank.Similarity(ranked[0], ranked[1]); got != 1 {
+		t.Errorf("rank similarity %g, want 1", got)
+	}
+	if got := SimilarityWeightedJaccard.Similarity(row, deeper); got >= 1 {
+		t.Errorf("weighted Jaccard similarity %g, want below 1", got)
+	}
+}
+
+// TestWeightedJaccardEqualsJaccardOnBinary checks that with every value 1,
+// the sums of element-wise minima and maxima count the intersection and the
+// union, so weighted Jaccard is plain Jaccard
+func TestWeightedJaccardEqualsJaccardOnBinary(t *testing.T) {
+	ones := func(indices ...uint32) SparseRow {
+		row := SparseRow{Indices: indices, Values: make([]uint32, len(indices))}
+		for i := range row.Values {
+			row.Values[i] = 1
+		}
+		return row
+	}
+	synthetic, _, _ := GenerateSyntheticMatrix(2, 300, 0.7, 1)
+	tests := []struct {
+		name string
+		a, b SparseRow
+	}{
+		{"overlapping", ones(1, 3, 5, 7), ones(3, 4, 5, 6, 7)},
+		{"disjoint", ones(0, 2, 4), ones(1, 3, 5)},
+		{"identical", ones(2, 9, 40), ones(2, 9, 40)},
+		{"subset", ones(10, 20), ones(5, 10, 15, 20, 25)},
+		{"one empty", ones(1, 2), ones()},
+		{"synthetic", onesMatrix(synthetic)[0], onesMatrix(synthetic)[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weighted := SimilarityWeightedJaccard.Similarity(tt.a, tt.b)
+			plain := SimilarityJaccard.Similarity(tt.a, tt.b)
+			if math.Abs(weighted-plain) > 1e-12 {
+				t.Errorf("weighted Jaccard %g, plain Jaccard %g", weighted, plain)
+			}
+		})
+	}
+}
+
+// BenchmarkSimilarityRatio compresses the same synthetic matrix choosing
+// references with each metric, reporting the compression ratio alongside
+// the time
+func BenchmarkSimilarityRatio(b *testing.B) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(400, 1000, 0.9, 1)
+	for _, metric := range tuneSimilarities {
+		b.Run(metric.String(), func(b *testing.B) {
+			var ratio float64
+			for i := 0; i < b.N; i++ {
+				c := NewCompressor(false, 0.1, 256)
+				c.SetSimilarity(metric)
+				var err error
+				if ratio, err = c.EstimateRatio(matrix, geneNames, cellNames); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(ratio, "ratio")
+		})
+	}
+}
+
+func TestParseSimilarityMetric(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    SimilarityMetric
+		wantErr bool
+	}{
+		{"jaccard", SimilarityJaccard, false},
+		{"cosine", SimilarityCosine, false},
+		{"weighted-jaccard", SimilarityWeightedJaccard, false},
+		{"ruzicka", SimilarityWeightedJaccard, false},
+		{"rank", SimilarityRank, false},
+		{"spearman", SimilarityJaccard, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSimilarityMetric(tt.name)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("ParseSimilarityMetric(%q) = %v, %v", tt.name, got, err)
+			}
+			if err == nil && tt.name != "ruzicka" && got.String() != tt.name {
+				t.Errorf("%v.String() = %q", got, got.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SweepResult is the outcome of compressing with one lossy setting of a
+// -sweep: the archive size and ratio, the error of the decompressed matrix
+// against the input, and the time each direction took
+type SweepResult struct {
+	Threshold         float64
+	QuantLevels       uint32
+	CompressedSize    int64
+	Ratio             float64
+	RMSE              float64
+	MaxAbsDiff        uint32
+	MeanAbsDiff       float64
+	CompressionTime   time.Duration
+	DecompressionTime time.Duration
+}
+
+// RunSweep compresses the source's matrix lossily, with opts' other
+// settings, for every combination of threshold and quantization levels,
+// decompresses each archive and compares it with the matrix. Results are in
+// threshold-major order.
+func RunSweep(src *matrixSource, opts compressOptions, thresholds []float64, quantLevels []uint32) ([]SweepResult, error) {
+	opts.lossy = true
+	var results []SweepResult
+	for _, threshold := range thresholds {
+		for _, levels := range quantLevels {
+			opts.threshold, opts.quantLevels = threshold, levels
+			result, err := sweepSetting(src, opts)
+			if err != nil {
+				return nil, fmt.Errorf("-threshold %g -quant %d: %w", threshold, levels, err)
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// sweepSetting compresses, decompresses and compares the matrix with one setting
+func sweepSetting(src *matrixSource, opts compressOptions) (SweepResult, error) {
+	result := SweepResult{Threshold: opts.threshold, QuantLevels: opts.quantLevels}
+
+	compressor := opts.newCompressor()
+	compressed, err := compressor.Compress(src.matrix, src.geneNames, src.cellNames)
+	if err != nil {
+		return result, fmt.Errorf("compression failed: %w", err)
+	}
+	stats := compressor.Stats()
+	result.CompressionTime = time.Duration(stats.CompressionTime)
+
+	// Report the size of the file -mode compress would write, not the
+	// pre-zlib estimate
+	src.record(compressed)
+	result.CompressedSize, err = compressed.SerializedSize()
+	if err != nil {
+		return result, fmt.Errorf("serialization failed: %w", err)
+	}
+	if result.CompressedSize > 0 {
+		result.Ratio = float64(stats.OriginalSize) / float64(result.CompressedSize)
+	}
+
+	decompressor := NewDecompressor()
+	decompressed, _, _, err := decompressor.Decompress(compressed)
+	if err != nil {
+		return result, fmt.Errorf("decompression failed: %w", err)
+	}
+	result.DecompressionTime = time.Duration(decompressor.Stats().DecompressionTime)
+
+	// Compare in the input's gene space in case genes were filtered
+	diff := CompareMatrices(src.matrix, compressed.ExpandMatrix(decompressed), 0)
+	result.RMSE = diff.RMSE
+	result.MaxAbsDiff = diff.MaxAbsDiff
+	result.MeanAbsDiff = diff.MeanAbsDiff
+	return result, nil
+}
+
+// sweepHeader names the columns of a sweep table
+var sweepHeader = []string{"threshold", "quant", "compressed_size", "ratio", "rmse", "max_abs_diff", "mean_abs_diff", "compression_time_s", "decompression_time_s"}
+
+// WriteSweepResults writes the results as a CSV (or TSV, by delimiter) table
+func WriteSweepResults(w io.Writer, results []SweepResult, delimiter rune) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+	writer.Write(sweepHeader)
+	for _, result := range results {
+		writer.Write([]string{
+			strconv.FormatFloat(result.Threshold, 'g', -1, 64),
+			strconv.FormatUint(uint64(result.QuantLevels), 10),
+			strconv.FormatInt(result.CompressedSize, 10),
+			strconv.FormatFloat(result.Ratio, 'f', 4, 64),
+			strconv.FormatFloat(result.RMSE, 'g', 8, 64),
+			strconv.FormatUint(uint64(result.MaxAbsDiff), 10),
+			strconv.FormatFloat(result.MeanAbsDiff, 'g', 8, 64),
+			strconv.FormatFloat(result.CompressionTime.Seconds(), 'f', 6, 64),
+			strconv.FormatFloat(result.DecompressionTime.Seconds(), 'f', 6, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// SaveSweepResults writes the results to filename as CSV or TSV depending on
+// its extension
+func SaveSweepResults(results []SweepResult, filename string, opts SaveOptions) error {
+	file, err := createOutputFile(filename, opts)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewWriterSize(file, defaultIOBufferSize)
+	if err := WriteSweepResults(buffered, results, OutputDelimiter(filename)); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// loadSweepSource loads a matrix file as compressFile does, or an archive's
+// matrix without the sections recorded about its own source
+func loadSweepSource(inputFile string, opts LoadOptions, hash bool) (*matrixSource, error) {
+	if strings.ToLower(filepath.Ext(inputFile)) != ".scz" && !isShardIndex(inputFile) {
+		return loadMatrixSource(os.Stderr, inputFile, opts, hash)
+	}
+	matrix, geneNames, cellNames, err := loadAnyMatrix(inputFile, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &matrixSource{matrix: matrix, geneNames: geneNames, cellNames: cellNames}, nil
+}
+
+// sweepFile runs RunSweep on a matrix file (or the matrix of a .scz) and
+// writes the table to outputFile, or to stdout when it is empty
+func sweepFile(inputFile, outputFile string, opts compressOptions, thresholds []float64, quantLevels []uint32) error {
+	src, err := loadSweepSource(inputFile, opts.load, opts.sourceHash)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", inputFile, err)
+	}
+	fmt.Fprintf(os.Stderr, "Sweeping %d settings on %d cells x %d genes\n", len(thresholds)*len(quantLevels), len(src.matrix), len(src.geneNames))
+
+	results, err := RunSweep(src, opts, thresholds, quantLevels)
+	if err != nil {
+		return err
+	}
+	if outputFile == "" {
+		return WriteSweepResults(os.Stdout, results, ',')
+	}
+	if err := SaveSweepResults(results, outputFile, opts.save); err != nil {
+		return fmt.Errorf("failed to save sweep results: %w", err)
+	}
+	fmt.Printf("Wrote %d sweep results to %s\n", len(results), outputFile)
+	return nil
+}
+
+// parseFloatList parses a comma-separated list of numbers, e.g. 0.1,0.2,0.5
+func parseFloatList(value string) ([]float64, error) {
+	var list []float64
+	for _, field := range strings.Split(value, ",") {
+		number, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", field)
+		}
+		list = append(list, number)
+	}
+	return list, nil
+}
+
+// parseQuantList parses a comma-separated list of quantization levels, e.g.
+// 64,128,256; each must be at least 2
+func parseQuantList(value string) ([]uint32, error) {
+	var list []uint32
+	for _, field := range strings.Split(value, ",") {
+		levels, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil || levels < 2 {
+			return nil, fmt.Errorf("%q is not a number of levels of at least 2", field)
+		}
+		list = append(list, uint32(levels))
+	}
+	return list, nil
+}
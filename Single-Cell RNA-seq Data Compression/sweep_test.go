@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSweepReportsArchiveSize(t *testing.T) {
+	// The header's creation time is compressed with the preamble, so
+	// archives written at different times can differ in size by a byte
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	dir := t.TempDir()
+	input := filepath.Join(dir, "m.csv")
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(200, 60, 0.8, 1)
+	if err := SaveSparseMatrix(matrix, geneNames, cellNames, "", DTypeUnknown, input, SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	table := filepath.Join(dir, "sweep.csv")
+	if err := run([]string{"-sweep", "-input", input, "-output", table, "-sweep-quant", "16,256"}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d sweep rows, want 2 and a header", len(records)-1)
+	}
+
+	// Each reported size must be that of the archive -mode compress writes
+	for _, record := range records[1:] {
+		archive := filepath.Join(dir, "q"+record[1]+".scz")
+		if err := run([]string{"-mode", "compress", "-input", input, "-output", archive, "-lossy", "-threshold", record[0], "-quant", record[1]}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, _ := strconv.ParseInt(record[2], 10, 64); size != info.Size() {
+			t.Errorf("-quant %s: sweep reported %d bytes, the archive has %d", record[1], size, info.Size())
+		}
+	}
+}
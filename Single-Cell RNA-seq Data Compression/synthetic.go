@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+const (
+	// syntheticCellsPerType controls how many cell types a synthetic matrix has
+	syntheticCellsPerType = 200
+	// syntheticDispersion is the negative binomial size parameter (smaller = noisier)
+	syntheticDispersion = 2.0
+)
+
+// GenerateSyntheticMatrix produces a reproducible count matrix with clustered
+// cell types. Each type has its own set of active genes and mean profile, so
+// cells of the same type share most of their gene sets and delta encoding has
+// something to exploit. Counts are negative binomial (gamma-Poisson) and
+// sparsity is the target fraction of zero entries.
+func GenerateSyntheticMatrix(cells, genes int, sparsity float64, seed int64) ([]SparseRow, []string, []string) {
+	rng := rand.New(rand.NewSource(seed))
+
+	numTypes := cells/syntheticCellsPerType + 1
+	density := 1 - sparsity
+	if density < 0 {
+		density = 0
+	}
+	if density > 1 {
+		density = 1
+	}
+
+	// Active genes are expressed with probability 0.9, inactive ones with 0.01,
+	// so pick the active fraction that hits the requested density on average
+	activeFraction := (density - 0.01) / 0.89
+	activeFraction = math.Max(0, math.Min(1, activeFraction))
+
+	// Per-gene baseline means shared by all types (log-normal)
+	baseMeans := make([]float64, genes)
+	for g := range baseMeans {
+		baseMeans[g] = math.Exp(rng.NormFloat64()*1.2 + 0.5)
+	}
+
+	typeActive := make([][]bool, numTypes)
+	typeMeans := make([][]float64, numTypes)
+	for t := 0; t < numTypes; t++ {
+		typeActive[t] = make([]bool, genes)
+		typeMeans[t] = make([]float64, genes)
+		for g := 0; g < genes; g++ {
+			typeActive[t][g] = rng.Float64() < activeFraction
+			typeMeans[t][g] = baseMeans[g] * math.Exp(rng.NormFloat64()*0.5)
+		}
+	}
+
+	matrix := make([]SparseRow, cells)
+	cellNames := make([]string, cells)
+	for c := 0; c < cells; c++ {
+		cellType := rng.Intn(numTypes)
+		cellNames[c] = fmt.Sprintf("Cell_%d_type%d", c+1, cellType)
+
+		// Library size factor models sequencing depth variation between cells
+		depth := math.Exp(rng.NormFloat64() * 0.3)
+
+		var row SparseRow
+		for g := 0; g < genes; g++ {
+			p := 0.01
+			if typeActive[cellType][g] {
+				p = 0.9
+			}
+			if rng.Float64() >= p {
+				continue
+			}
+
+			count := negativeBinomial(rng, typeMeans[cellType][g]*depth, syntheticDispersion)
+			if count == 0 {
+				count = 1
+			}
+			row.Indices = append(row.Indices, uint32(g))
+			row.Values = append(row.Values, count)
+		}
+		matrix[c] = row
+	}
+
+	geneNames := make([]string, genes)
+	for g := range geneNames {
+		geneNames[g] = fmt.Sprintf("Gene_%d", g+1)
+	}
+
+	return matrix, geneNames, cellNames
+}
+
+// negativeBinomial draws a count with the given mean and size via a gamma-Poisson mixture
+func negativeBinomial(rng *rand.Rand, mean, size float64) uint32 {
+	lambda := gammaSample(rng, size) * mean / size
+	return poissonSample(rng, lambda)
+}
+
+// gammaSample draws from Gamma(shape, 1) using Marsaglia and Tsang's method
+func gammaSample(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return gammaSample(rng, shape+1) * math.Pow(rng.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// poissonSample draws from Poisson(lambda), using a normal approximation for large lambda
+func poissonSample(rng *rand.Rand, lambda float64) uint32 {
+	if lambda <= 0 {
+		return 0
+	}
+	if lambda > 30 {
+		value := math.Round(lambda + math.Sqrt(lambda)*rng.NormFloat64())
+		if value < 0 {
+			return 0
+		}
+		return uint32(value)
+	}
+
+	limit := math.Exp(-lambda)
+	count := uint32(0)
+	p := rng.Float64()
+	for p > limit {
+		count++
+		p *= rng.Float64()
+	}
+	return count
+}
@@ -0,0 +1,36 @@
+package main
+
+import "sort"
+
+// keepTopGenes keeps only the k highest values of every cell, breaking ties
+// by gene order, and returns the sum of the values it dropped. Rows that
+// already have at most k genes are shared, not copied.
+func keepTopGenes(matrix []SparseRow, k int) ([]SparseRow, uint64) {
+	kept := make([]SparseRow, len(matrix))
+	var dropped uint64
+	for cell, row := range matrix {
+		if len(row.Indices) <= k {
+			kept[cell] = row
+			continue
+		}
+
+		order := make([]int, len(row.Indices))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return row.Values[order[a]] > row.Values[order[b]] })
+		for _, i := range order[k:] {
+			dropped += uint64(row.Values[i])
+		}
+		top := order[:k]
+		sort.Ints(top)
+
+		kept[cell].Indices = make([]uint32, k)
+		kept[cell].Values = make([]uint32, k)
+		for j, i := range top {
+			kept[cell].Indices[j] = row.Indices[i]
+			kept[cell].Values[j] = row.Values[i]
+		}
+	}
+	return kept, dropped
+}
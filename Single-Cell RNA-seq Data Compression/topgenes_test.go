@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeepTopGenes(t *testing.T) {
+	tests := []struct {
+		name        string
+		row         SparseRow
+		k           int
+		want        SparseRow
+		wantDropped uint64
+	}{
+		{"fewer genes", SparseRow{Indices: []uint32{1, 4}, Values: []uint32{3, 9}}, 3,
+			SparseRow{Indices: []uint32{1, 4}, Values: []uint32{3, 9}}, 0},
+		{"gene order kept", SparseRow{Indices: []uint32{0, 2, 5, 7}, Values: []uint32{1, 8, 2, 6}}, 2,
+			SparseRow{Indices: []uint32{2, 7}, Values: []uint32{8, 6}}, 3},
+		{"ties broken by gene order", SparseRow{Indices: []uint32{0, 1, 2}, Values: []uint32{4, 4, 4}}, 2,
+			SparseRow{Indices: []uint32{0, 1}, Values: []uint32{4, 4}}, 4},
+		{"one gene", SparseRow{Indices: []uint32{3, 6, 9}, Values: []uint32{5, 7, 2}}, 1,
+			SparseRow{Indices: []uint32{6}, Values: []uint32{7}}, 7},
+		{"empty", SparseRow{}, 2, SparseRow{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, dropped := keepTopGenes([]SparseRow{tt.row}, tt.k)
+			if !sameRow(kept[0], tt.want) || dropped != tt.wantDropped {
+				t.Errorf("kept %v dropping %d, want %v dropping %d", kept[0], dropped, tt.want, tt.wantDropped)
+			}
+		})
+	}
+}
+
+// TestCompressTopGenes checks that every decoded cell keeps at most K genes,
+// that none it drops has a higher value than one it keeps, and that the
+// dropped counts are reported
+func TestCompressTopGenes(t *testing.T) {
+	matrix, geneNames, cellNames := GenerateSyntheticMatrix(150, 60, 0.5, 1)
+	for _, k := range []int{1, 5, 20} {
+		t.Run(fmt.Sprint(k), func(t *testing.T) {
+			compressor := NewCompressor(false, 0.1, 256)
+			compressor.SetTopGenesPerCell(k)
+			compressed, err := compressor.Compress(matrix, geneNames, cellNames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed.TopGenesPerCell != uint32(k) {
+				t.Errorf("archive records %d genes per cell, want %d", compressed.TopGenesPerCell, k)
+			}
+			decoded, _, _, err := NewDecompressor().Decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dropped uint64
+			for cell, row := range matrix {
+				got := decoded[cell]
+				want := k
+				if len(row.Indices) < k {
+					want = len(row.Indices)
+				}
+				if len(got.Indices) != want {
+					t.Fatalf("cell %d keeps %d of %d genes, want %d", cell, len(got.Indices), len(row.Indices), want)
+				}
+				kept := referenceValues(got, row.Indices)
+				var lowestKept, highestDropped uint32 = ^uint32(0), 0
+				for i, value := range row.Values {
+					switch kept[i] {
+					case value:
+						if value < lowestKept {
+							lowestKept = value
+						}
+					case 0:
+						dropped += uint64(value)
+						if value > highestDropped {
+							highestDropped = value
+						}
+					default:
+						t.Fatalf("cell %d gene %d: %d decoded as %d", cell, row.Indices[i], value, kept[i])
+					}
+				}
+				if highestDropped > lowestKept {
+					t.Fatalf("cell %d dropped a %d but kept a %d", cell, highestDropped, lowestKept)
+				}
+			}
+			if got := compressor.Stats().DroppedCounts; got != dropped {
+				t.Errorf("%d counts reported dropped, want %d", got, dropped)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/binary"
 	"io"
+	"sort"
 )
 
 // SparseRow represents a single cell's expression profile
@@ -11,41 +12,134 @@ type SparseRow struct {
 	Values  []uint32 // Expression counts
 }
 
-// CompressedData represents the complete compressed dataset
+// CompressedData represents the complete compressed dataset. Decoding never
+// modifies it: once loaded, an archive is safe for concurrent reads, e.g. a
+// server answering DecompressCell requests from many goroutines. Only code
+// that sets its fields (compression, recompress, repair) needs it exclusively.
 type CompressedData struct {
-	Header       Header
-	GeneNames    []string
-	CellNames    []string
-	CompressedRows []CompressedRow
+	Header           Header
+	GeneNames        []string
+	CellNames        []string
+	CompressedRows   []CompressedRow
+	Medoids          []uint32   // Self-encoded reference cells in medoid mode (version >= 2)
+	Codebook         *Codebook  // Adaptive quantization codebook, nil if unused (version >= 3)
+	KeptGenes        []uint32   // Original index of each stored gene when genes were filtered (version >= 4)
+	DroppedGeneNames []string   // Names of the filtered-out genes, in original order (version >= 4)
+	DType            DType      // Value type of the original matrix (version >= 5)
+	FeatureTypes     []string   // Feature type of every original gene, empty if unknown (version >= 6)
+	LosslessCells    []uint32   // Ascending cells stored unquantized in a lossy archive (version >= 14)
+	MeanCell         *SparseRow // Synthetic reference of RefMean rows, nil if unused (version >= 16)
+	LosslessGenes    []uint32   // Ascending stored genes kept unquantized in a lossy archive (version >= 17)
+	TopGenesPerCell  uint32     // Genes kept per cell when the rest were dropped, 0 if all were kept (version >= 18)
+	NameHeader       *string    // Header of the input's cell name column, nil if it had none (version >= 19)
+	SourceHash       []byte     // SHA-256 of the input file (see HashSource), empty if not recorded (version >= 20)
 }
 
+// FormatVersion is the archive format version written by Compress. Older
+// versions are read by leaving the sections they lack at their zero values:
+//
+//	1: header, names and rows only
+//	2: medoid cells (none: chain references)
+//	3: quantization codebook (none: fixed logarithmic quantizer)
+//	4: gene filter mapping (none: all genes kept)
+//	5: original value dtype (none: DTypeUnknown, exported as uint32)
+//	6: per-gene feature types (none: unknown)
+//	7: Header.IsBinary (none: false)
+//	8: Header.EliasFlate (none: false)
+//	9: Header.RefsOrdered (none: false)
+//	10: Header.GeneChunk (none: 0, one universe per row)
+//	11: Header.FrontCodedNames (none: false)
+//	12: Header.ValueCodec (none: ValueCodecFlate)
+//	13: duplicate rows, see CompressedRow.isDuplicate (none: not written)
+//	14: lossless cells of a lossy archive (none: every cell quantized)
+//	15: columnar rows within each block, see writeRowColumns (none: row by row)
+//	16: mean cell, see meanRefCell (none: no mean cell)
+//	17: lossless genes of a lossy archive (none: every gene quantized)
+//	18: top genes per cell (none: 0, every gene kept)
+//	19: header of the cell name column (none: nil, written as Cell)
+//	20: source file hash (none: empty, not recorded)
+//	21: fixed quantizer bins, see QuantizeValue (none: the binned counts)
+const FormatVersion = 21
+
 // Header contains metadata about the compressed data
 type Header struct {
-	Version      uint32
-	NumCells     uint32
-	NumGenes     uint32
-	IsLossy      bool
-	Threshold    float64
-	QuantLevels  uint32
-	Timestamp    int64
+	Version         uint32
+	NumCells        uint32
+	NumGenes        uint32
+	IsLossy         bool
+	Threshold       float64
+	QuantLevels     uint32
+	Timestamp       int64
+	IsBinary        bool       // Every value is 1 and no values are stored (version >= 7)
+	EliasFlate      bool       // Each row's Elias-Fano bytes are deflated (version >= 8)
+	RefsOrdered     bool       // Every RefCell precedes its referring cell (version >= 9)
+	GeneChunk       uint32     // Genes per Elias-Fano sub-universe, 0 if rows are not chunked (version >= 10)
+	FrontCodedNames bool       // Gene and cell names are stored front-coded (version >= 11)
+	ValueCodec      ValueCodec // Entropy coding of each row's values (version >= 12)
+}
+
+// headerV1 is the header layout before version 7, which appended IsBinary
+type headerV1 struct {
+	Version     uint32
+	NumCells    uint32
+	NumGenes    uint32
+	IsLossy     bool
+	Threshold   float64
+	QuantLevels uint32
+	Timestamp   int64
 }
 
 // CompressedRow represents a compressed cell's expression profile
 type CompressedRow struct {
 	EliasGenes   []byte  // Elias-Fano encoded gene indices
 	DeltaValues  []byte  // Delta-encoded and compressed expression values
-	RefCell      int32   // Reference cell index for delta encoding (-1 if none)
+	RefCell      int32   // Reference cell index for delta encoding (-1 if none, meanRefCell for the mean cell)
 	NumGenes     uint32  // Number of expressed genes
 	MaxGeneIndex uint32  // Maximum gene index for Elias-Fano
 }
 
-// EliasRange represents the range information for Elias-Fano encoding
+// isDuplicate reports whether the row is an exact copy of its reference cell:
+// it has genes and a reference but stores neither gene indices nor values
+// (version >= 13)
+func (row CompressedRow) isDuplicate() bool {
+	return row.RefCell >= 0 && row.NumGenes > 0 && len(row.EliasGenes) == 0
+}
+
+// NameColumnHeader returns the header to write above the cell names of a
+// decompressed matrix: the input's own, or Cell if it had none
+func (cd *CompressedData) NameColumnHeader() string {
+	if cd.NameHeader == nil {
+		return defaultNameHeader
+	}
+	return *cd.NameHeader
+}
+
+// isLosslessCell reports whether a cell of a lossy archive stores its
+// original values rather than quantized ones (see Compressor.SetLossyMaxError)
+func (cd *CompressedData) isLosslessCell(cell int) bool {
+	i := sort.Search(len(cd.LosslessCells), func(i int) bool { return int(cd.LosslessCells[i]) >= cell })
+	return i < len(cd.LosslessCells) && int(cd.LosslessCells[i]) == cell
+}
+
+// isLosslessGene reports whether a gene of a lossy archive keeps its original
+// values in every cell (see Compressor.SetLosslessGenes)
+func (cd *CompressedData) isLosslessGene(gene uint32) bool {
+	i := sort.Search(len(cd.LosslessGenes), func(i int) bool { return cd.LosslessGenes[i] >= gene })
+	return i < len(cd.LosslessGenes) && cd.LosslessGenes[i] == gene
+}
+
+// EliasRange represents the range information for Elias-Fano encoding. It is
+// the header of every encoded sequence, written by EliasEncoder.Encode and
+// read back by NewEliasDecoder (see EliasRange.bytes).
 type EliasRange struct {
 	Universe uint32 // Universe size (u)
 	Count    uint32 // Number of elements (k)
 	LowBits  uint32 // Number of low bits (l)
 }
 
+// eliasHeaderSize is the serialized size of an EliasRange
+const eliasHeaderSize = 12
+
 // BitArray provides efficient bit-level operations
 type BitArray struct {
 	Data []uint64
@@ -81,47 +175,87 @@ func (ba *BitArray) GetBit(pos uint32) bool {
 	return (ba.Data[wordIndex] & (1 << bitIndex)) != 0
 }
 
-// WriteBits writes the specified number of bits starting from the given position
+// WriteBits ORs the low numBits bits of value (at most 64) into the array
+// starting at pos. The bits are written a word at a time, spilling into the
+// next word when they straddle a word boundary; bits past Size are dropped.
 func (ba *BitArray) WriteBits(pos uint32, value uint64, numBits uint32) {
-	for i := uint32(0); i < numBits; i++ {
-		if (value & (1 << i)) != 0 {
-			ba.SetBit(pos + i)
-		}
+	numBits = ba.clampBits(pos, numBits)
+	if numBits == 0 {
+		return
+	}
+	if numBits < 64 {
+		value &= 1<<numBits - 1
+	}
+
+	wordIndex := pos / 64
+	bitIndex := pos % 64
+	ba.Data[wordIndex] |= value << bitIndex
+	if bitIndex+numBits > 64 {
+		ba.Data[wordIndex+1] |= value >> (64 - bitIndex)
 	}
 }
 
-// ReadBits reads the specified number of bits starting from the given position
+// ReadBits reads numBits bits (at most 64) starting from the given position,
+// a word at a time; bits past Size read as zero
 func (ba *BitArray) ReadBits(pos uint32, numBits uint32) uint64 {
-	var result uint64
-	for i := uint32(0); i < numBits; i++ {
-		if ba.GetBit(pos + i) {
-			result |= 1 << i
-		}
+	numBits = ba.clampBits(pos, numBits)
+	if numBits == 0 {
+		return 0
+	}
+
+	wordIndex := pos / 64
+	bitIndex := pos % 64
+	result := ba.Data[wordIndex] >> bitIndex
+	if bitIndex+numBits > 64 {
+		result |= ba.Data[wordIndex+1] << (64 - bitIndex)
+	}
+	if numBits < 64 {
+		result &= 1<<numBits - 1
 	}
 	return result
 }
 
+// clampBits limits a numBits-bit access at pos to 64 bits and to the array
+func (ba *BitArray) clampBits(pos uint32, numBits uint32) uint32 {
+	if pos >= ba.Size {
+		return 0
+	}
+	if numBits > 64 {
+		numBits = 64
+	}
+	if remaining := ba.Size - pos; numBits > remaining {
+		numBits = remaining
+	}
+	return numBits
+}
+
 // WriteTo writes the bit array to an io.Writer
-func (ba *BitArray) WriteTo(w io.Writer) error {
+func (ba *BitArray) WriteTo(w io.Writer) (int64, error) {
 	// Write size first
 	if err := binary.Write(w, binary.LittleEndian, ba.Size); err != nil {
-		return err
+		return 0, err
 	}
 	// Write data
-	return binary.Write(w, binary.LittleEndian, ba.Data)
+	if err := binary.Write(w, binary.LittleEndian, ba.Data); err != nil {
+		return 4, err
+	}
+	return 4 + int64(len(ba.Data))*8, nil
 }
 
 // ReadFrom reads the bit array from an io.Reader
-func (ba *BitArray) ReadFrom(r io.Reader) error {
+func (ba *BitArray) ReadFrom(r io.Reader) (int64, error) {
 	// Read size
 	if err := binary.Read(r, binary.LittleEndian, &ba.Size); err != nil {
-		return err
+		return 0, err
 	}
 	// Calculate number of words needed
 	numWords := (ba.Size + 63) / 64
 	ba.Data = make([]uint64, numWords)
 	// Read data
-	return binary.Read(r, binary.LittleEndian, ba.Data)
+	if err := binary.Read(r, binary.LittleEndian, ba.Data); err != nil {
+		return 4, err
+	}
+	return 4 + int64(numWords)*8, nil
 }
 
 // CellSimilarity represents similarity between two cells
@@ -133,21 +267,24 @@ type CellSimilarity struct {
 
 // CompressionStats holds statistics about compression performance
 type CompressionStats struct {
-	OriginalSize    int64
-	CompressedSize  int64
-	CompressionTime int64 // nanoseconds
-	CompressionRatio float64
-	NumCells        uint32
-	NumGenes        uint32
-	AvgGenesPerCell float64
-	Sparsity        float64
+	OriginalSize     int64   `json:"original_size"`
+	CompressedSize   int64   `json:"compressed_size"`
+	CompressionTime  int64   `json:"compression_time_ns"` // nanoseconds
+	CompressionRatio float64 `json:"compression_ratio"`
+	NumCells         uint32  `json:"num_cells"`
+	NumGenes         uint32  `json:"num_genes"`
+	AvgGenesPerCell  float64 `json:"avg_genes_per_cell"`
+	Sparsity         float64 `json:"sparsity"`
+	DuplicateCells   int     `json:"duplicate_cells"` // Cells stored as exact copies of an earlier cell
+	LosslessCells    int     `json:"lossless_cells"`  // Lossy cells re-encoded losslessly to meet -lossy-maxerr
+	DroppedCounts    uint64  `json:"dropped_counts"`  // Sum of the values left out by SetTopGenesPerCell
 }
 
 // DecompressionStats holds statistics about decompression performance
 type DecompressionStats struct {
-	DecompressedSize   int64
-	DecompressionTime  int64 // nanoseconds
-	NumCells           uint32
-	NumGenes           uint32
-	AvgGenesPerCell    float64
+	DecompressedSize  int64   `json:"decompressed_size"`
+	DecompressionTime int64   `json:"decompression_time_ns"` // nanoseconds
+	NumCells          uint32  `json:"num_cells"`
+	NumGenes          uint32  `json:"num_genes"`
+	AvgGenesPerCell   float64 `json:"avg_genes_per_cell"`
 }
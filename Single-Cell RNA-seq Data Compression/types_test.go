@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestBitArrayWordBoundaries writes values of every width from 1 to 64 at
+// offsets around a word boundary, alone and packed back to back, and checks
+// that ReadBits and GetBit see exactly the bits written and nothing else
+func TestBitArrayWordBoundaries(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for width := uint32(1); width <= 64; width++ {
+		mask := ^uint64(0)
+		if width < 64 {
+			mask = 1<<width - 1
+		}
+		t.Run(fmt.Sprintf("%d bits", width), func(t *testing.T) {
+			offsets := []uint32{0, 1, 63 - width/2, 64 - width, 63, 64, 65, 128 - width, 127}
+			for _, pos := range offsets {
+				value := rng.Uint64()
+				array := NewBitArray(256)
+				array.WriteBits(pos, value, width)
+				if got := array.ReadBits(pos, width); got != value&mask {
+					t.Fatalf("at %d: read %#x, want %#x", pos, got, value&mask)
+				}
+				for bit := uint32(0); bit < array.Size; bit++ {
+					want := bit >= pos && bit < pos+width && value>>(bit-pos)&1 == 1
+					if array.GetBit(bit) != want {
+						t.Fatalf("writing at %d: bit %d is %v, want %v", pos, bit, !want, want)
+					}
+				}
+			}
+
+			// Packed values start at every offset within a word in turn
+			values := make([]uint64, 200)
+			array := NewBitArray(uint32(len(values)) * width)
+			for i := range values {
+				values[i] = rng.Uint64() & mask
+				array.WriteBits(uint32(i)*width, values[i], width)
+			}
+			for i, want := range values {
+				if got := array.ReadBits(uint32(i)*width, width); got != want {
+					t.Fatalf("packed value %d: read %#x, want %#x", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestBitArrayClamp checks that bits past Size are neither written nor read
+func TestBitArrayClamp(t *testing.T) {
+	array := NewBitArray(70)
+	array.WriteBits(60, ^uint64(0), 20)
+	if got := array.ReadBits(60, 20); got != 0x3ff {
+		t.Errorf("read %#x, want the 10 bits before Size", got)
+	}
+	if array.Data[1] != 0x3f {
+		t.Errorf("second word %#x, want only bits 64 to 69 set", array.Data[1])
+	}
+	if got := array.ReadBits(70, 8); got != 0 {
+		t.Errorf("read %#x past Size", got)
+	}
+}